@@ -17,6 +17,7 @@ package conf
 import (
 	"rasp-cloud/tools"
 	"github.com/astaxie/beego"
+	"strings"
 )
 
 const (
@@ -24,6 +25,7 @@ const (
 	StartTypeAgent      = "agent"
 	StartTypeReset      = "reset"
 	StartTypeDefault    = "default"
+	StartTypeBackfill   = "backfill"
 )
 
 type RaspAppConfig struct {
@@ -40,7 +42,45 @@ type RaspAppConfig struct {
 	AlarmBufferSize    int
 	AlarmCheckInterval int64
 	CookieLifeTime     int
-	Flag               *Flag
+	ExportMaxSize      int64
+	ExportSyncMaxSize  int64
+	ExportExpireTime   int
+	// the alarms are spilled to the disk queue when the buffer is full or ES is unavailable, 0 size disables it
+	AlarmSpillQueuePath string
+	AlarmSpillQueueSize int
+	// the rotated alarm files are compressed by AlarmFileCompress, include: none, gzip,
+	// AlarmFileMaxTotalSize is the max total size of alarm files of each type in MB, 0 means no limit
+	AlarmFileCompress     string
+	AlarmFileMaxTotalSize int64
+	// the alarms of each app are written to the directory of its app id
+	AlarmFilePerApp bool
+	// the limits of log uploads from agents, the body size is in MB and the doc size is in KB
+	AgentLogMaxBodySize  int64
+	AgentLogMaxBatchSize int
+	AgentLogMaxDocSize   int
+	// the default masking of alarms for the apps without their own masking config,
+	// the key of keyed hashing is required by the hash mode
+	AlarmMaskingMode      string
+	AlarmMaskingDetectors []string
+	AlarmMaskingKey       string
+	// the stores of metadata and logs, include: external, embedded
+	StorageBackend string
+	// the directory of the embedded stores
+	EmbeddedDataPath string
+	// the period of rolling indices, include: day, month
+	EsIndexRolloverPeriod string
+	// the enrichers of attack alarms at ingest time, in order
+	AttackEnrichers []string
+	// the geoip databases are optional and reloaded when they are changed
+	GeoIpCityDbPath     string
+	GeoIpAsnDbPath      string
+	GeoIpReloadInterval int64
+	// the ip reputation feeds are plain text or csv files with cidr and category in each line
+	IpReputationFiles          []string
+	IpReputationReloadInterval int64
+	// the mappings from cidr to internal network zone, like "10.0.0.0/8=office,192.168.0.0/16=dmz"
+	NetworkZones string
+	Flag         *Flag
 }
 
 type Flag struct {
@@ -48,6 +88,10 @@ type Flag struct {
 	Password  *string
 	Daemon    *bool
 	Version   *bool
+	// the filters of backfill, the dates are like 2019-01-01
+	BackfillStart *string
+	BackfillEnd   *string
+	BackfillApp   *string
 }
 
 var (
@@ -56,9 +100,12 @@ var (
 
 func InitConfig(startFlag *Flag) {
 	AppConfig.Flag = startFlag
+	AppConfig.StorageBackend = beego.AppConfig.DefaultString("StorageBackend", "external")
+	AppConfig.EmbeddedDataPath = beego.AppConfig.DefaultString("EmbeddedDataPath", "data")
 	AppConfig.EsAddr = beego.AppConfig.String("EsAddr")
 	AppConfig.EsUser = beego.AppConfig.DefaultString("EsUser", "")
 	AppConfig.EsPwd = beego.AppConfig.DefaultString("EsPwd", "")
+	AppConfig.EsIndexRolloverPeriod = beego.AppConfig.DefaultString("EsIndexRolloverPeriod", "month")
 	AppConfig.MongoDBAddr = beego.AppConfig.DefaultString("MongoDBAddr", "")
 	AppConfig.MongoDBPoolLimit = beego.AppConfig.DefaultInt("MongoDBPoolLimit", 1024)
 	AppConfig.MongoDBName = beego.AppConfig.DefaultString("MongoDBName", "openrasp")
@@ -67,15 +114,45 @@ func InitConfig(startFlag *Flag) {
 	AppConfig.AlarmLogMode = beego.AppConfig.DefaultString("AlarmLogMode", "file")
 	AppConfig.AlarmBufferSize = beego.AppConfig.DefaultInt("AlarmBufferSize", 300)
 	AppConfig.AlarmCheckInterval = beego.AppConfig.DefaultInt64("AlarmCheckInterval", 120)
+	AppConfig.AlarmSpillQueuePath = beego.AppConfig.DefaultString("AlarmSpillQueuePath", "data/alarm-spill.db")
+	AppConfig.AlarmSpillQueueSize = beego.AppConfig.DefaultInt("AlarmSpillQueueSize", 1000000)
+	AppConfig.AlarmFileCompress = beego.AppConfig.DefaultString("AlarmFileCompress", "none")
+	AppConfig.AlarmFileMaxTotalSize = beego.AppConfig.DefaultInt64("AlarmFileMaxTotalSize", 0)
+	AppConfig.AlarmFilePerApp = beego.AppConfig.DefaultBool("AlarmFilePerApp", false)
+	AppConfig.AgentLogMaxBodySize = beego.AppConfig.DefaultInt64("AgentLogMaxBodySize", 10)
+	AppConfig.AgentLogMaxBatchSize = beego.AppConfig.DefaultInt("AgentLogMaxBatchSize", 1000)
+	AppConfig.AgentLogMaxDocSize = beego.AppConfig.DefaultInt("AgentLogMaxDocSize", 512)
+	AppConfig.AlarmMaskingMode = beego.AppConfig.DefaultString("AlarmMaskingMode", "redact")
+	AppConfig.AlarmMaskingDetectors = splitConfigList(beego.AppConfig.DefaultString("AlarmMaskingDetectors", ""))
+	AppConfig.AlarmMaskingKey = beego.AppConfig.DefaultString("AlarmMaskingKey", "")
 	AppConfig.CookieLifeTime = beego.AppConfig.DefaultInt("CookieLifeTime", 7*24)
+	AppConfig.ExportMaxSize = beego.AppConfig.DefaultInt64("ExportMaxSize", 1000000)
+	AppConfig.ExportSyncMaxSize = beego.AppConfig.DefaultInt64("ExportSyncMaxSize", 100000)
+	AppConfig.ExportExpireTime = beego.AppConfig.DefaultInt("ExportExpireTime", 24)
+	AppConfig.AttackEnrichers = splitConfigList(beego.AppConfig.DefaultString("AttackEnrichers", "geo,asn,reputation,zone"))
+	AppConfig.GeoIpCityDbPath = beego.AppConfig.DefaultString("GeoIpCityDbPath", "geoip/GeoLite2-City.mmdb")
+	AppConfig.GeoIpAsnDbPath = beego.AppConfig.DefaultString("GeoIpAsnDbPath", "geoip/GeoLite2-ASN.mmdb")
+	AppConfig.GeoIpReloadInterval = beego.AppConfig.DefaultInt64("GeoIpReloadInterval", 60)
+	AppConfig.IpReputationFiles = splitConfigList(beego.AppConfig.DefaultString("IpReputationFiles", ""))
+	AppConfig.IpReputationReloadInterval = beego.AppConfig.DefaultInt64("IpReputationReloadInterval", 60)
+	AppConfig.NetworkZones = beego.AppConfig.DefaultString("NetworkZones", "")
 	ValidRaspConf(AppConfig)
 }
 
 func ValidRaspConf(config *RaspAppConfig) {
-	if config.EsAddr == "" {
+	if config.StorageBackend != "external" && config.StorageBackend != "embedded" {
+		failLoadConfig("the 'StorageBackend' config must be external or embedded")
+	}
+	if config.StorageBackend == "embedded" && config.EmbeddedDataPath == "" {
+		failLoadConfig("the 'EmbeddedDataPath' config item in app.conf can not be empty")
+	}
+	if config.EsAddr == "" && config.StorageBackend == "external" {
 		failLoadConfig("the 'EsAddr' config item in app.conf can not be empty")
 	}
-	if config.MongoDBAddr == "" {
+	if config.EsIndexRolloverPeriod != "day" && config.EsIndexRolloverPeriod != "month" {
+		failLoadConfig("the 'EsIndexRolloverPeriod' config must be day or month")
+	}
+	if config.MongoDBAddr == "" && config.StorageBackend == "external" {
 		failLoadConfig("the 'MongoDBAddr' config item in app.conf can not be empty")
 	}
 	if config.MongoDBPoolLimit <= 0 {
@@ -98,6 +175,33 @@ func ValidRaspConf(config *RaspAppConfig) {
 		beego.Warning("the value of 'AlarmBufferSize' config is less than 100, it will be set to 100")
 		config.AlarmBufferSize = 100
 	}
+	if config.AlarmSpillQueueSize < 0 {
+		failLoadConfig("the 'AlarmSpillQueueSize' config can not be less than 0")
+	}
+	if config.AlarmSpillQueueSize > 0 && config.AlarmSpillQueuePath == "" {
+		failLoadConfig("the 'AlarmSpillQueuePath' config item in app.conf can not be empty")
+	}
+	if config.AlarmFileCompress != "none" && config.AlarmFileCompress != "gzip" {
+		failLoadConfig("the 'AlarmFileCompress' config must be none or gzip")
+	}
+	if config.AlarmFileMaxTotalSize < 0 {
+		failLoadConfig("the 'AlarmFileMaxTotalSize' config can not be less than 0")
+	}
+	if config.AgentLogMaxBodySize <= 0 {
+		failLoadConfig("the 'AgentLogMaxBodySize' config must be greater than 0")
+	}
+	if config.AgentLogMaxBatchSize <= 0 {
+		failLoadConfig("the 'AgentLogMaxBatchSize' config must be greater than 0")
+	}
+	if config.AgentLogMaxDocSize <= 0 {
+		failLoadConfig("the 'AgentLogMaxDocSize' config must be greater than 0")
+	}
+	if config.AlarmMaskingMode != "redact" && config.AlarmMaskingMode != "hash" {
+		failLoadConfig("the 'AlarmMaskingMode' config must be redact or hash")
+	}
+	if config.AlarmMaskingMode == "hash" && config.AlarmMaskingKey == "" {
+		failLoadConfig("the 'AlarmMaskingKey' config can not be empty in the hash mode")
+	}
 	if config.AlarmCheckInterval <= 0 {
 		failLoadConfig("the 'AlarmCheckInterval' config must be greater than 0")
 	} else if config.AlarmCheckInterval < 10 {
@@ -107,6 +211,35 @@ func ValidRaspConf(config *RaspAppConfig) {
 	if config.CookieLifeTime <= 0 {
 		failLoadConfig("the 'CookieLifeTime' config must be greater than 0")
 	}
+	if config.ExportMaxSize <= 0 {
+		failLoadConfig("the 'ExportMaxSize' config must be greater than 0")
+	}
+	if config.ExportSyncMaxSize <= 0 {
+		failLoadConfig("the 'ExportSyncMaxSize' config must be greater than 0")
+	} else if config.ExportSyncMaxSize > config.ExportMaxSize {
+		beego.Warning("the value of 'ExportSyncMaxSize' config is greater than 'ExportMaxSize', " +
+			"it will be set to 'ExportMaxSize'")
+		config.ExportSyncMaxSize = config.ExportMaxSize
+	}
+	if config.ExportExpireTime <= 0 {
+		failLoadConfig("the 'ExportExpireTime' config must be greater than 0")
+	}
+	if config.GeoIpReloadInterval <= 0 {
+		failLoadConfig("the 'GeoIpReloadInterval' config must be greater than 0")
+	}
+	if config.IpReputationReloadInterval <= 0 {
+		failLoadConfig("the 'IpReputationReloadInterval' config must be greater than 0")
+	}
+}
+
+func splitConfigList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
 }
 
 func failLoadConfig(msg string) {
@@ -17,7 +17,6 @@ package agent_logs
 import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models/logs"
-	"time"
 )
 
 // Operations about attack alarm message
@@ -27,16 +26,5 @@ type AttackAlarmController struct {
 
 // @router / [post]
 func (o *AttackAlarmController) Post() {
-	var alarms []map[string]interface{}
-	o.UnmarshalJson(&alarms)
-
-	count := 0
-	for _, alarm := range alarms {
-		alarm["@timestamp"] = time.Now().UnixNano() / 1000000
-		err := logs.AddAttackAlarm(alarm)
-		if err == nil {
-			count++
-		}
-	}
-	o.Serve(map[string]uint64{"count": uint64(count)})
+	ingestAlarms(&o.BaseController, logs.AttackAlarmInfo.EsType, logs.AddAttackAlarm)
 }
@@ -17,7 +17,6 @@ package agent_logs
 import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models/logs"
-	"time"
 )
 
 type ErrorController struct {
@@ -26,15 +25,5 @@ type ErrorController struct {
 
 // @router / [post]
 func (o *ErrorController) Post() {
-	var alarms []map[string]interface{}
-	o.UnmarshalJson(&alarms)
-	count := 0
-	for _, alarm := range alarms {
-		alarm["@timestamp"] = time.Now().UnixNano() / 1000000
-		err := logs.AddErrorAlarm(alarm)
-		if err == nil {
-			count++
-		}
-	}
-	o.Serve(map[string]uint64{"count": uint64(count)})
+	ingestAlarms(&o.BaseController, logs.ErrorAlarmInfo.EsType, logs.AddErrorAlarm)
 }
@@ -0,0 +1,178 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package agent_logs
+
+import (
+	"encoding/json"
+	"net/http"
+	"rasp-cloud/conf"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models/logs"
+	"strconv"
+	"time"
+	"bufio"
+	"bytes"
+	"io"
+)
+
+const (
+	ingestStatusAccepted = "accepted"
+	ingestStatusRejected = "rejected"
+)
+
+// IngestItem is the result of each alarm in the upload, the accepted alarm may have truncated fields
+type IngestItem struct {
+	Index     int      `json:"index"`
+	Status    string   `json:"status"`
+	Reason    string   `json:"reason,omitempty"`
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+// ingestAlarms validates the uploaded alarms by the schema of es type, the app_id of each alarm is always
+// the authenticated app of agent, the count in response is the number of accepted alarms
+func ingestAlarms(o *controllers.BaseController, esType string, addAlarm func(map[string]interface{}) error) {
+	if body := o.GetStreamBody(); body != nil {
+		ingestAlarmStream(o, body, esType, addAlarm)
+		return
+	}
+	maxBodySize := conf.AppConfig.AgentLogMaxBodySize * 1024 * 1024
+	if o.Ctx.Request.ContentLength > maxBodySize || int64(len(o.Ctx.Input.RequestBody)) > maxBodySize {
+		o.ServeError(http.StatusRequestEntityTooLarge,
+			"the request body can not be larger than "+strconv.FormatInt(conf.AppConfig.AgentLogMaxBodySize, 10)+"MB")
+	}
+	var docs []json.RawMessage
+	o.UnmarshalJson(&docs)
+	if len(docs) > conf.AppConfig.AgentLogMaxBatchSize {
+		o.ServeError(http.StatusBadRequest,
+			"the count of alarms can not be greater than "+strconv.Itoa(conf.AppConfig.AgentLogMaxBatchSize))
+	}
+
+	appId := o.Ctx.Input.Header("X-OpenRASP-AppID")
+	count := 0
+	items := make([]*IngestItem, 0, len(docs))
+	for i, doc := range docs {
+		item := ingestAlarm(i, doc, appId, esType, addAlarm)
+		if item.Status == ingestStatusAccepted {
+			count++
+		}
+		items = append(items, item)
+	}
+	o.Serve(map[string]interface{}{"count": count, "items": items, "complete": true})
+}
+
+// ingestAlarmStream reads the ndjson body line by line, each line is an alarm, so that only one alarm is
+// kept in memory at a time, the alarms before an error of body are still stored and complete is false
+func ingestAlarmStream(o *controllers.BaseController, body io.Reader, esType string,
+	addAlarm func(map[string]interface{}) error) {
+	maxBodySize := conf.AppConfig.AgentLogMaxBodySize * 1024 * 1024
+	maxDocSize := conf.AppConfig.AgentLogMaxDocSize * 1024
+	limitedBody := &io.LimitedReader{R: body, N: maxBodySize + 1}
+	reader := bufio.NewReader(limitedBody)
+	appId := o.Ctx.Input.Header("X-OpenRASP-AppID")
+	count := 0
+	items := make([]*IngestItem, 0)
+	reason := ""
+	for index := 0; ; {
+		line, tooLong, err := readAlarmLine(reader, maxDocSize)
+		// the body is cut by the limit, the last line may be incomplete
+		if err == io.EOF && limitedBody.N <= 0 {
+			reason = "the request body can not be larger than " +
+				strconv.FormatInt(conf.AppConfig.AgentLogMaxBodySize, 10) + "MB"
+			break
+		}
+		if err != nil && err != io.EOF {
+			reason = "failed to read the request body: " + err.Error()
+			break
+		}
+		if tooLong || len(bytes.TrimSpace(line)) > 0 {
+			if index >= conf.AppConfig.AgentLogMaxBatchSize {
+				reason = "the count of alarms can not be greater than " +
+					strconv.Itoa(conf.AppConfig.AgentLogMaxBatchSize)
+				break
+			}
+			var item *IngestItem
+			if tooLong {
+				item = &IngestItem{Index: index, Status: ingestStatusRejected,
+					Reason: "the alarm can not be larger than " + strconv.Itoa(conf.AppConfig.AgentLogMaxDocSize) + "KB"}
+			} else {
+				item = ingestAlarm(index, line, appId, esType, addAlarm)
+			}
+			if item.Status == ingestStatusAccepted {
+				count++
+			}
+			items = append(items, item)
+			index++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	result := map[string]interface{}{"count": count, "items": items, "complete": reason == ""}
+	if reason != "" {
+		result["reason"] = reason
+	}
+	o.Serve(result)
+}
+
+// readAlarmLine reads a line without the line break, the rest of a line longer than maxSize is discarded
+func readAlarmLine(reader *bufio.Reader, maxSize int) ([]byte, bool, error) {
+	line := make([]byte, 0)
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			// the line break is not counted in the size of alarm
+			if len(bytes.TrimRight(fragment, "\r\n"))+len(line) > maxSize {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return bytes.TrimRight(line, "\r\n"), tooLong, err
+	}
+}
+
+func ingestAlarm(index int, doc []byte, appId string, esType string,
+	addAlarm func(map[string]interface{}) error) *IngestItem {
+	item := &IngestItem{Index: index, Status: ingestStatusRejected}
+	if len(doc) > conf.AppConfig.AgentLogMaxDocSize*1024 {
+		item.Reason = "the alarm can not be larger than " + strconv.Itoa(conf.AppConfig.AgentLogMaxDocSize) + "KB"
+		return item
+	}
+	var alarm map[string]interface{}
+	if err := json.Unmarshal(doc, &alarm); err != nil || alarm == nil {
+		item.Reason = "the alarm must be a json object"
+		return item
+	}
+	alarm["app_id"] = appId
+	truncated, err := logs.ValidateAlarm(esType, alarm)
+	if err != nil {
+		item.Reason = err.Error()
+		return item
+	}
+	alarm["@timestamp"] = time.Now().UnixNano() / 1000000
+	if err := addAlarm(alarm); err != nil {
+		item.Reason = err.Error()
+		return item
+	}
+	item.Status = ingestStatusAccepted
+	item.Truncated = truncated
+	return item
+}
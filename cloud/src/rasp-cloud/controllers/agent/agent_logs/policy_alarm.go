@@ -17,7 +17,6 @@ package agent_logs
 import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models/logs"
-	"time"
 )
 
 // Operations about policy alarm message
@@ -27,15 +26,5 @@ type PolicyAlarmController struct {
 
 // @router / [post]
 func (o *PolicyAlarmController) Post() {
-	var alarms []map[string]interface{}
-	o.UnmarshalJson(&alarms)
-	count := 0
-	for _, alarm := range alarms {
-		alarm["@timestamp"] = time.Now().UnixNano() / 1000000
-		err := logs.AddPolicyAlarm(alarm)
-		if err == nil {
-			count++
-		}
-	}
-	o.Serve(map[string]uint64{"count": uint64(count)})
+	ingestAlarms(&o.BaseController, logs.PolicyAlarmInfo.EsType, logs.AddPolicyAlarm)
 }
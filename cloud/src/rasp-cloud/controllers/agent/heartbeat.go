@@ -15,7 +15,6 @@
 package agent
 
 import (
-	"gopkg.in/mgo.v2"
 	"net/http"
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
@@ -58,35 +57,24 @@ func (o *HeartbeatController) Post() {
 
 	result := make(map[string]interface{})
 	isUpdate := false
-	// handle plugin
-	selectedPlugin, err := models.GetSelectedPlugin(appId, true)
-	if err != nil && err != mgo.ErrNotFound {
-		o.ServeError(http.StatusBadRequest, "failed to get selected plugin", err)
+	// the config of app is merged with the host groups of rasp
+	config, err := models.GetRaspConfig(app, rasp)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the config of rasp", err)
 	}
-	if selectedPlugin != nil {
-		if pluginMd5 != selectedPlugin.Md5 {
+	// handle plugin
+	if config.Plugin != nil {
+		if pluginMd5 != config.Plugin.Md5 {
 			isUpdate = true
 		}
-		if app.ConfigTime > 0 && app.ConfigTime > int64(configTime) {
+		if config.ConfigTime > 0 && config.ConfigTime > int64(configTime) {
 			isUpdate = true
 		}
 	}
 	if isUpdate {
-		whitelistConfig := make(map[string]interface{})
-		for _, configItem := range app.WhitelistConfig {
-			whiteHookTypes := make([]string, 0, len(configItem.Hook))
-			for hookType, isWhite := range configItem.Hook {
-				if isWhite {
-					whiteHookTypes = append(whiteHookTypes, hookType)
-				}
-			}
-			whitelistConfig[configItem.Url] = whiteHookTypes
-		}
-		//app.GeneralConfig["algorithm.config"] = selectedPlugin.AlgorithmConfig
-		app.GeneralConfig["hook.white"] = whitelistConfig
-		result["plugin"] = selectedPlugin
-		result["config_time"] = app.ConfigTime
-		result["config"] = app.GeneralConfig
+		result["plugin"] = config.Plugin
+		result["config_time"] = config.ConfigTime
+		result["config"] = config.GeneralConfig
 	}
 	o.Serve(result)
 }
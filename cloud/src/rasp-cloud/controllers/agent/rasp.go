@@ -20,6 +20,7 @@ import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
 	"time"
+	"reflect"
 )
 
 type RaspController struct {
@@ -92,6 +93,27 @@ func (o *RaspController) Post() {
 		}
 	}
 
+	if err := models.ValidRaspLabels(rasp.Labels); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid rasp labels", err)
+	}
+	// the custom labels can only be set by admins, they are kept when the rasp registers again
+	rasp.CustomLabels = nil
+	if oldRasp, err := models.GetRaspById(rasp.Id); err == nil && oldRasp != nil {
+		rasp.CustomLabels = oldRasp.CustomLabels
+		rasp.ConfigTime = oldRasp.ConfigTime
+		if !reflect.DeepEqual(models.GetRaspLabels(rasp), models.GetRaspLabels(oldRasp)) {
+			rasp.ConfigTime = time.Now().UnixNano()
+		}
+	} else {
+		rasp.ConfigTime = 0
+	}
+	if rasp.Labels == nil {
+		rasp.Labels = map[string]string{}
+	}
+	if rasp.CustomLabels == nil {
+		rasp.CustomLabels = map[string]string{}
+	}
+
 	rasp.LastHeartbeatTime = time.Now().Unix()
 	rasp.RegisterTime = time.Now().Unix()
 	err := models.UpsertRaspById(rasp.Id, rasp)
@@ -15,6 +15,7 @@
 package api
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"github.com/astaxie/beego/validation"
 	"gopkg.in/mgo.v2"
@@ -24,8 +25,10 @@ import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"rasp-cloud/models/logs"
 )
 
 // Operations about app
@@ -140,6 +143,148 @@ func (o *AppController) RegenerateAppSecret() {
 	})
 }
 
+// @router /retention/get [post]
+func (o *AppController) GetRetention() {
+	var param struct {
+		AppId string `json:"app_id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	retention, err := models.GetRetentionByAppId(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get retention", err)
+	}
+	o.Serve(retention)
+}
+
+// @router /retention [post]
+func (o *AppController) UpdateRetention() {
+	var param struct {
+		AppId string         `json:"app_id"`
+		Days  map[string]int `json:"days"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if len(param.Days) == 0 {
+		o.ServeError(http.StatusBadRequest, "days can not be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	retention, err := models.UpdateRetention(param.AppId, param.Days)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update retention", err)
+	}
+	changes := make([]string, 0, len(param.Days))
+	for _, logType := range models.RetentionTypes {
+		if days, ok := param.Days[logType]; ok {
+			if days == 0 {
+				changes = append(changes, logType+"=default")
+			} else {
+				changes = append(changes, logType+"="+strconv.Itoa(days)+"d")
+			}
+		}
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdateRetention,
+		o.Ctx.Input.IP(), "Updated retention of "+param.AppId+": "+strings.Join(changes, ", "))
+	o.Serve(retention)
+}
+
+// @router /masking/get [post]
+func (o *AppController) GetMasking() {
+	var param struct {
+		AppId string `json:"app_id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	masking, err := models.GetMaskingByAppId(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get masking config", err)
+	}
+	o.Serve(masking)
+}
+
+// @router /masking [post]
+func (o *AppController) UpdateMasking() {
+	var param struct {
+		AppId  string              `json:"app_id"`
+		Config *logs.MaskingConfig `json:"config"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if param.Config == nil {
+		o.ServeError(http.StatusBadRequest, "config can not be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	masking, err := models.UpdateMasking(param.AppId, param.Config)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update masking config", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdateMasking, o.Ctx.Input.IP(),
+		"Updated masking config of "+param.AppId+", enable: "+strconv.FormatBool(masking.Enable)+
+			", mode: "+masking.Mode+", rules: "+strconv.Itoa(len(masking.Rules)))
+	o.Serve(masking)
+}
+
+// @router /masking/preview [post]
+func (o *AppController) PreviewMasking() {
+	var param struct {
+		Config *logs.MaskingConfig    `json:"config"`
+		Alarm  map[string]interface{} `json:"alarm"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Config == nil {
+		o.ServeError(http.StatusBadRequest, "config can not be empty")
+	}
+	if param.Alarm == nil {
+		o.ServeError(http.StatusBadRequest, "alarm can not be empty")
+	}
+	alarm, err := logs.PreviewMasking(param.Config, param.Alarm)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to preview masking", err)
+	}
+	o.Serve(alarm)
+}
+
+// @router /storage/get [post]
+func (o *AppController) GetStorage() {
+	var param struct {
+		AppId string `json:"app_id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId != "" {
+		_, err := models.GetAppById(param.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get app", err)
+		}
+	}
+	storages, err := models.GetAppStorage(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get storage", err)
+	}
+	o.Serve(storages)
+}
+
 // @router /general/config [post]
 func (o *AppController) UpdateAppGeneralConfig() {
 	var param struct {
@@ -188,6 +333,60 @@ func (o *AppController) UpdateAppWhiteListConfig() {
 	o.Serve(app)
 }
 
+// @router /whitelist/suggest [post]
+func (o *AppController) SuggestAlarmWhitelist() {
+	var param struct {
+		AppId   string                      `json:"app_id"`
+		AlarmId string                      `json:"alarm_id"`
+		Item    *models.WhitelistConfigItem `json:"item"`
+	}
+	o.UnmarshalJson(&param)
+	o.validAlarmWhitelistParam(param.AppId, param.AlarmId)
+	suggestion, err := models.GetAlarmWhitelistSuggestion(param.AppId, param.AlarmId, param.Item)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to suggest whitelist for the alarm", err)
+	}
+	o.Serve(suggestion)
+}
+
+// @router /whitelist/apply [post]
+func (o *AppController) ApplyAlarmWhitelist() {
+	var param struct {
+		AppId   string                      `json:"app_id"`
+		AlarmId string                      `json:"alarm_id"`
+		Item    *models.WhitelistConfigItem `json:"item"`
+	}
+	o.UnmarshalJson(&param)
+	o.validAlarmWhitelistParam(param.AppId, param.AlarmId)
+	app, suggestion, err := models.ApplyAlarmWhitelist(param.AppId, param.AlarmId, param.Item,
+		getRequestUser(&o.BaseController))
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to apply whitelist for the alarm", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdateWhitelistConfig, o.Ctx.Input.IP(),
+		"Added whitelist url "+suggestion.Item.Url+" from the attack alarm "+param.AlarmId+
+			", suppressed alarms: "+strconv.FormatInt(suggestion.SuppressedCount, 10))
+	o.Serve(map[string]interface{}{
+		"app":        app,
+		"suggestion": suggestion,
+	})
+}
+
+func (o *AppController) validAlarmWhitelistParam(appId string, alarmId string) {
+	if appId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if _, err := models.GetAppById(appId); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	if alarmId == "" {
+		o.ServeError(http.StatusBadRequest, "alarm_id can not be empty")
+	}
+	if len(alarmId) > 128 {
+		o.ServeError(http.StatusBadRequest, "the length of alarm_id can not be greater than 128")
+	}
+}
+
 // @router / [post]
 func (o *AppController) Post() {
 	var app = &models.App{}
@@ -328,6 +527,70 @@ func (o *AppController) validEmailConf(conf *models.EmailAlarmConf) {
 		o.ServeError(http.StatusBadRequest, "the count of email recv_addr cannot be greater than 128")
 	}
 	conf.RecvAddr = o.validAppArrayParam(conf.RecvAddr, "email recv_addr", valid.Email)
+	if conf.Locale == "" {
+		conf.Locale = models.DefaultEmailLocale
+	}
+	if !models.IsValidEmailLocale(conf.Locale) {
+		o.ServeError(http.StatusBadRequest, "unsupported email locale: "+conf.Locale)
+	}
+	if len(conf.RecvLocale) > len(conf.RecvAddr) {
+		o.ServeError(http.StatusBadRequest, "the count of email recv_locale cannot be greater than recv_addr")
+	}
+	for _, recvLocale := range conf.RecvLocale {
+		if len(recvLocale.Addr) > 256 {
+			o.ServeError(http.StatusBadRequest, "the length of email recv_locale addr cannot be greater than 256")
+		}
+		if !models.IsValidEmailLocale(recvLocale.Locale) {
+			o.ServeError(http.StatusBadRequest, "unsupported email locale of "+recvLocale.Addr+": "+recvLocale.Locale)
+		}
+	}
+	if conf.RecvLocale == nil {
+		conf.RecvLocale = make([]models.EmailRecvLocale, 0)
+	}
+	if conf.TlsEnable && conf.StartTlsEnable {
+		o.ServeError(http.StatusBadRequest, "tls_enable and starttls_enable cannot be enabled at the same time")
+	}
+	if len(conf.TlsCaCert) > 64*1024 {
+		o.ServeError(http.StatusBadRequest, "the length of email tls_ca_cert cannot be greater than 65536")
+	}
+	if conf.TlsCaCert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(conf.TlsCaCert)) {
+		o.ServeError(http.StatusBadRequest, "the email tls_ca_cert must be a valid PEM certificate")
+	}
+	if conf.AuthType == "" {
+		conf.AuthType = models.EmailAuthTypePlain
+	}
+	validAuthType := false
+	for _, authType := range models.EmailAuthTypes {
+		if conf.AuthType == authType {
+			validAuthType = true
+			break
+		}
+	}
+	if !validAuthType {
+		o.ServeError(http.StatusBadRequest, "unsupported email auth_type: "+conf.AuthType)
+	}
+	if conf.AuthType == models.EmailAuthTypeXOAuth2 {
+		if !conf.TlsEnable && !conf.StartTlsEnable {
+			o.ServeError(http.StatusBadRequest, "xoauth2 requires tls_enable or starttls_enable")
+		}
+		oauthConf := conf.OAuthConf
+		if oauthConf.TokenUrl == "" && conf.Password == "" {
+			o.ServeError(http.StatusBadRequest,
+				"the email password is used as the access token when oauth token_url is empty, it cannot be empty")
+		}
+		if oauthConf.TokenUrl != "" {
+			if !strings.HasPrefix(oauthConf.TokenUrl, "http://") && !strings.HasPrefix(oauthConf.TokenUrl, "https://") {
+				o.ServeError(http.StatusBadRequest, "the oauth token_url must start with http:// or https://")
+			}
+			if oauthConf.RefreshToken == "" {
+				o.ServeError(http.StatusBadRequest, "the oauth refresh_token cannot be empty")
+			}
+		}
+		if len(oauthConf.TokenUrl) > 1024 || len(oauthConf.ClientId) > 1024 ||
+			len(oauthConf.ClientSecret) > 1024 || len(oauthConf.RefreshToken) > 4096 {
+			o.ServeError(http.StatusBadRequest, "the length of email oauth_conf is too long")
+		}
+	}
 }
 
 func (o *AppController) validDingConf(conf *models.DingAlarmConf) {
@@ -401,6 +664,38 @@ func (o *AppController) Delete() {
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to remove plugin by app_id", err)
 	}
+	err = models.RemoveEmailTemplateByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove email template by app_id", err)
+	}
+	err = models.RemoveDigestByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove digest by app_id", err)
+	}
+	err = models.RemoveSavedSearchByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove saved search by app_id", err)
+	}
+	err = models.RemoveTriageByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove triage by app_id", err)
+	}
+	err = models.RemoveIncidentByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove incident by app_id", err)
+	}
+	err = models.RemoveRetentionByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove retention by app_id", err)
+	}
+	err = models.RemoveMaskingByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove masking config by app_id", err)
+	}
+	err = models.RemoveHostGroupByAppId(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove host group by app_id", err)
+	}
 	models.AddOperation(app.Id, models.OperationTypeDeleteApp, o.Ctx.Input.IP(), "Deleted app with name "+app.Name)
 	o.ServeWithEmptyData()
 }
@@ -486,9 +781,7 @@ func (o *AppController) ConfigAlarm() {
 	}
 	var updateData bson.M
 	if param.EmailAlarmConf != nil {
-		if param.EmailAlarmConf.Password == models.SecreteMask {
-			param.EmailAlarmConf.Password = app.EmailAlarmConf.Password
-		}
+		models.UnmaskEmailConf(param.EmailAlarmConf, &app.EmailAlarmConf)
 		o.validEmailConf(param.EmailAlarmConf)
 	}
 	if param.HttpAlarmConf != nil {
@@ -608,6 +901,108 @@ func (o *AppController) TestEmail() {
 	o.ServeWithEmptyData()
 }
 
+// @router /email/template/get [post]
+func (o *AppController) GetEmailTemplate() {
+	var param struct {
+		AppId  string `json:"app_id"`
+		Locale string `json:"locale"`
+	}
+	o.UnmarshalJson(&param)
+	o.validEmailTemplateParam(param.AppId, param.Locale)
+	emailTemplate, err := models.GetEmailTemplate(param.AppId, param.Locale)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get email template", err)
+	}
+	o.Serve(emailTemplate)
+}
+
+// @router /email/template [post]
+func (o *AppController) UpdateEmailTemplate() {
+	var param = &models.EmailTemplate{}
+	o.UnmarshalJson(param)
+	o.validEmailTemplateParam(param.AppId, param.Locale)
+	if len(param.Subject) > 256 {
+		o.ServeError(http.StatusBadRequest, "the length of email template subject cannot be greater than 256")
+	}
+	if len(param.Content) > 1024*1024 {
+		o.ServeError(http.StatusBadRequest, "the length of email template content cannot be greater than 1MB")
+	}
+	emailTemplate, err := models.UpsertEmailTemplate(param)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update email template", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdateEmailTemplate, o.Ctx.Input.IP(),
+		"Updated "+param.Locale+" email template of "+param.AppId)
+	o.Serve(emailTemplate)
+}
+
+// @router /email/template/restore [post]
+func (o *AppController) RestoreEmailTemplate() {
+	var param struct {
+		AppId  string `json:"app_id"`
+		Locale string `json:"locale"`
+	}
+	o.UnmarshalJson(&param)
+	o.validEmailTemplateParam(param.AppId, param.Locale)
+	err := models.RemoveEmailTemplate(param.AppId, param.Locale)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to restore email template", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdateEmailTemplate, o.Ctx.Input.IP(),
+		"Restored "+param.Locale+" email template of "+param.AppId+" to default")
+	emailTemplate, err := models.GetEmailTemplate(param.AppId, param.Locale)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get email template", err)
+	}
+	o.Serve(emailTemplate)
+}
+
+// @router /email/template/preview [post]
+func (o *AppController) PreviewEmailTemplate() {
+	var param = &models.EmailTemplate{}
+	o.UnmarshalJson(param)
+	app := o.validEmailTemplateParam(param.AppId, param.Locale)
+	if param.Content == "" {
+		emailTemplate, err := models.GetEmailTemplate(param.AppId, param.Locale)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get email template", err)
+		}
+		param = emailTemplate
+	} else if err := models.ValidEmailTemplate(param.Subject, param.Content); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to preview email template", err)
+	}
+	subject, content, err := models.PreviewEmailTemplate(app, param)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to preview email template", err)
+	}
+	o.Serve(map[string]string{
+		"subject": subject,
+		"content": content,
+	})
+}
+
+// @router /email/template/variables [get,post]
+func (o *AppController) GetEmailTemplateVariables() {
+	o.Serve(map[string]interface{}{
+		"locales":   models.GetEmailLocales(),
+		"variables": models.EmailTemplateVariables,
+	})
+}
+
+func (o *AppController) validEmailTemplateParam(appId string, locale string) *models.App {
+	if appId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id cannot be empty")
+	}
+	if !models.IsValidEmailLocale(locale) {
+		o.ServeError(http.StatusBadRequest, "unsupported email locale: "+locale)
+	}
+	app, err := models.GetAppById(appId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "can not find the app", err)
+	}
+	return app
+}
+
 // @router /ding/test [post]
 func (o *AppController) TestDing(config map[string]interface{}) {
 	var param map[string]string
@@ -0,0 +1,213 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+	"time"
+)
+
+type DigestController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *DigestController) Get() {
+	var param struct {
+		AppId   string `json:"app_id"`
+		Page    int    `json:"page"`
+		Perpage int    `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	o.ValidPage(param.Page, param.Perpage)
+	total, digests, err := models.GetDigests(param.AppId, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get digests", err)
+	}
+	var result = make(map[string]interface{})
+	result["total"] = total
+	result["total_page"] = math.Ceil(float64(total) / float64(param.Perpage))
+	result["page"] = param.Page
+	result["perpage"] = param.Perpage
+	result["data"] = digests
+	o.Serve(result)
+}
+
+// @router / [post]
+func (o *DigestController) Post() {
+	var digest = &models.Digest{}
+	o.UnmarshalJson(digest)
+	o.validDigest(digest)
+	digest, err := models.AddDigest(digest)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to create digest", err)
+	}
+	models.AddOperation(digest.AppId, models.OperationTypeAddDigest,
+		o.Ctx.Input.IP(), "Created the security digest: "+digest.Name)
+	o.Serve(digest)
+}
+
+// @router /update [post]
+func (o *DigestController) Update() {
+	var digest = &models.Digest{}
+	o.UnmarshalJson(digest)
+	oldDigest := o.getDigest(digest.Id, false)
+	models.UnmaskEmailConf(&digest.EmailConf, &oldDigest.EmailConf)
+	o.validDigest(digest)
+	digest, err := models.UpdateDigest(digest)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update digest", err)
+	}
+	models.AddOperation(digest.AppId, models.OperationTypeEditDigest,
+		o.Ctx.Input.IP(), "Updated the security digest: "+digest.Name)
+	o.Serve(digest)
+}
+
+// @router /delete [post]
+func (o *DigestController) Delete() {
+	var digest = &models.Digest{}
+	o.UnmarshalJson(digest)
+	if digest.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	digest, err := models.RemoveDigestById(digest.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove digest", err)
+	}
+	models.AddOperation(digest.AppId, models.OperationTypeDeleteDigest,
+		o.Ctx.Input.IP(), "Deleted the security digest: "+digest.Name)
+	o.Serve(digest)
+}
+
+// @router /send [post]
+func (o *DigestController) Send() {
+	var param = &models.Digest{}
+	o.UnmarshalJson(param)
+	digest := o.getDigest(param.Id, false)
+	startTime, endTime, err := models.GetDigestPeriod(digest, time.Now())
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get digest period", err)
+	}
+	err = models.SendDigest(digest, startTime, endTime)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to send digest", err)
+	}
+	o.ServeWithEmptyData()
+}
+
+// @router /preview [post]
+func (o *DigestController) Preview() {
+	var param struct {
+		Id     string `json:"id"`
+		Locale string `json:"locale"`
+	}
+	o.UnmarshalJson(&param)
+	digest := o.getDigest(param.Id, true)
+	if param.Locale == "" {
+		param.Locale = digest.EmailConf.Locale
+	}
+	if !models.IsValidEmailLocale(param.Locale) {
+		o.ServeError(http.StatusBadRequest, "unsupported email locale: "+param.Locale)
+	}
+	startTime, endTime, err := models.GetDigestPeriod(digest, time.Now())
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get digest period", err)
+	}
+	report, err := models.BuildDigestReport(digest, startTime, endTime, param.Locale)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to build digest report", err)
+	}
+	content, err := models.RenderDigestHtml(report)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to render digest report", err)
+	}
+	o.Serve(map[string]interface{}{
+		"start_time": startTime,
+		"end_time":   endTime,
+		"content":    content,
+	})
+}
+
+func (o *DigestController) getDigest(id string, mask bool) *models.Digest {
+	if id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	digest, err := models.GetDigestById(id, mask)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get digest", err)
+	}
+	return digest
+}
+
+func (o *DigestController) validDigest(digest *models.Digest) {
+	if digest.Name == "" {
+		o.ServeError(http.StatusBadRequest, "the digest name cannot be empty")
+	}
+	if len(digest.Name) > 64 {
+		o.ServeError(http.StatusBadRequest, "the length of digest name cannot be greater than 64")
+	}
+	if digest.SavedSearchId != "" {
+		searchController := &SavedSearchController{BaseController: o.BaseController}
+		search := searchController.getSavedSearch(digest.SavedSearchId, false)
+		if search.LogType != models.SavedSearchLogTypeAttack {
+			o.ServeError(http.StatusBadRequest, "only the attack searches can be used by digest")
+		}
+		if digest.AppId == "" {
+			digest.AppId = search.AppId
+		} else if search.AppId != "" && search.AppId != digest.AppId {
+			o.ServeError(http.StatusBadRequest, "the app_id of digest is different from the saved search")
+		}
+	}
+	if digest.AppId != "" {
+		_, err := models.GetAppById(digest.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get app", err)
+		}
+	}
+	validPeriod := false
+	for _, period := range models.DigestPeriods {
+		if digest.Period == period {
+			validPeriod = true
+			break
+		}
+	}
+	if !validPeriod {
+		o.ServeError(http.StatusBadRequest, "unsupported digest period: "+digest.Period)
+	}
+	if digest.Hour < 0 || digest.Hour > 23 {
+		o.ServeError(http.StatusBadRequest, "the digest hour must be between 0 and 23")
+	}
+	if digest.Weekday < 0 || digest.Weekday > 6 {
+		o.ServeError(http.StatusBadRequest, "the digest weekday must be between 0 and 6")
+	}
+	if digest.TimeZone == "" {
+		digest.TimeZone = "Local"
+	}
+	if _, err := time.LoadLocation(digest.TimeZone); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid digest time_zone", err)
+	}
+	if digest.TopSize == 0 {
+		digest.TopSize = 10
+	}
+	if digest.TopSize < 0 || digest.TopSize > 100 {
+		o.ServeError(http.StatusBadRequest, "the digest top_size must be between 1 and 100")
+	}
+	appController := &AppController{BaseController: o.BaseController}
+	appController.validEmailConf(&digest.EmailConf)
+}
@@ -0,0 +1,83 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+)
+
+// Operations about the background export jobs of logs
+type ExportController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *ExportController) Get() {
+	var param struct {
+		AppId   string `json:"app_id"`
+		Page    int    `json:"page"`
+		Perpage int    `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	o.ValidPage(param.Page, param.Perpage)
+	total, jobs, err := models.GetExportJobs(param.AppId, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get export jobs", err)
+	}
+	var result = make(map[string]interface{})
+	result["total"] = total
+	result["total_page"] = math.Ceil(float64(total) / float64(param.Perpage))
+	result["page"] = param.Page
+	result["perpage"] = param.Perpage
+	result["data"] = jobs
+	o.Serve(result)
+}
+
+// @router /download [get]
+func (o *ExportController) Download() {
+	jobId := o.GetString("id")
+	if jobId == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	job, err := models.GetExportJobById(jobId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get export job", err)
+	}
+	fileName, err := models.GetExportFile(job)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get export file", err)
+	}
+	o.Ctx.Output.Download(fileName, "openrasp-"+job.LogType+"-"+job.Id+"."+job.Format)
+}
+
+// @router /delete [post]
+func (o *ExportController) Delete() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	job, err := models.RemoveExportJob(param.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove export job", err)
+	}
+	o.Serve(job)
+}
@@ -0,0 +1,102 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package fore_logs
+
+import (
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
+	"time"
+)
+
+const (
+	maxAggrFieldSize = 1000
+	// the count of top values which are grouped in each time interval
+	timeAggrGroupSize = 20
+)
+
+func validTimeAggrParam(o *controllers.BaseController, param *logs.AggrTimeParam) {
+	if param.AppId != "" {
+		_, err := models.GetAppById(param.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get the app: "+param.AppId)
+		}
+	} else {
+		param.AppId = "*"
+	}
+	validAggrTime(o, param.StartTime, param.EndTime)
+	if param.Interval == "" {
+		o.ServeError(http.StatusBadRequest, "interval cannot be empty")
+	}
+	if param.TimeZone == "" {
+		o.ServeError(http.StatusBadRequest, "time_zone cannot be empty")
+	}
+	if len(param.Interval) > 32 {
+		o.ServeError(http.StatusBadRequest, "the length of interval cannot be greater than 32")
+	}
+	if len(param.TimeZone) > 32 {
+		o.ServeError(http.StatusBadRequest, "the length of time_zone cannot be greater than 32")
+	}
+}
+
+func validFieldAggrParam(o *controllers.BaseController, param *logs.AggrFieldParam) {
+	if param.AppId != "" {
+		_, err := models.GetAppById(param.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.AppId, err)
+		}
+	} else {
+		param.AppId = "*"
+	}
+	validAggrTime(o, param.StartTime, param.EndTime)
+	if param.Size <= 0 {
+		o.ServeError(http.StatusBadRequest, "size must be greater than 0")
+	}
+}
+
+// validAggrField checks that the field of param is one of the fields and the size is not too large
+func validAggrField(o *controllers.BaseController, param *logs.AggrFieldParam, fields []string) {
+	validField := false
+	for _, field := range fields {
+		if param.Field == field {
+			validField = true
+			break
+		}
+	}
+	if !validField {
+		o.ServeError(http.StatusBadRequest, "unsupported aggregation field: "+param.Field)
+	}
+	if param.Size > maxAggrFieldSize {
+		o.ServeError(http.StatusBadRequest, "size cannot be greater than 1000")
+	}
+}
+
+func validAggrTime(o *controllers.BaseController, startTime int64, endTime int64) {
+	if startTime <= 0 {
+		o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
+	}
+	if endTime <= 0 {
+		o.ServeError(http.StatusBadRequest, "end_time must be greater than 0")
+	}
+	if startTime > endTime {
+		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
+	}
+	duration := time.Duration(endTime-startTime) * time.Millisecond
+	if duration > 366*24*time.Hour {
+		o.ServeError(http.StatusBadRequest, "time duration can not be greater than 366 days")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"rasp-cloud/models"
 	"rasp-cloud/models/logs"
 	"math"
-	"time"
 )
 
 // Operations about attack alarm message
@@ -33,39 +32,7 @@ type AttackAlarmController struct {
 func (o *AttackAlarmController) AggregationWithTime() {
 	var param = &logs.AggrTimeParam{}
 	o.UnmarshalJson(&param)
-	if param.AppId != "" {
-		_, err := models.GetAppById(param.AppId)
-		if err != nil {
-			o.ServeError(http.StatusBadRequest, "failed to get the app: "+param.AppId)
-		}
-	} else {
-		param.AppId = "*"
-	}
-	if param.StartTime <= 0 {
-		o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
-	}
-	if param.EndTime <= 0 {
-		o.ServeError(http.StatusBadRequest, "end_time must be greater than 0")
-	}
-	if param.StartTime > param.EndTime {
-		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
-	}
-	duration := time.Duration(param.EndTime-param.StartTime) * time.Millisecond
-	if duration > 366*24*time.Hour {
-		o.ServeError(http.StatusBadRequest, "time duration can not be greater than 366 days")
-	}
-	if param.Interval == "" {
-		o.ServeError(http.StatusBadRequest, "interval cannot be empty")
-	}
-	if param.TimeZone == "" {
-		o.ServeError(http.StatusBadRequest, "time_zone cannot be empty")
-	}
-	if len(param.Interval) > 32 {
-		o.ServeError(http.StatusBadRequest, "the length of interval cannot be greater than 32")
-	}
-	if len(param.TimeZone) > 32 {
-		o.ServeError(http.StatusBadRequest, "the length of time_zone cannot be greater than 32")
-	}
+	validTimeAggrParam(&o.BaseController, param)
 	result, err :=
 		logs.AggregationAttackWithTime(param.StartTime, param.EndTime, param.Interval, param.TimeZone, param.AppId)
 	if err != nil {
@@ -78,7 +45,7 @@ func (o *AttackAlarmController) AggregationWithTime() {
 func (o *AttackAlarmController) AggregationWithType() {
 	var param = &logs.AggrFieldParam{}
 	o.UnmarshalJson(&param)
-	o.validFieldAggrParam(param)
+	validFieldAggrParam(&o.BaseController, param)
 	result, err :=
 		logs.AggregationAttackWithType(param.StartTime, param.EndTime, param.Size, param.AppId)
 	if err != nil {
@@ -91,7 +58,7 @@ func (o *AttackAlarmController) AggregationWithType() {
 func (o *AttackAlarmController) AggregationWithUserAgent() {
 	var param = &logs.AggrFieldParam{}
 	o.UnmarshalJson(&param)
-	o.validFieldAggrParam(param)
+	validFieldAggrParam(&o.BaseController, param)
 	result, err :=
 		logs.AggregationAttackWithUserAgent(param.StartTime, param.EndTime, param.Size, param.AppId)
 	if err != nil {
@@ -100,15 +67,70 @@ func (o *AttackAlarmController) AggregationWithUserAgent() {
 	o.Serve(result)
 }
 
+// @router /aggr/field [post]
+func (o *AttackAlarmController) AggregationWithField() {
+	var param = &logs.AggrTopFieldParam{}
+	o.UnmarshalJson(&param)
+	fieldParam := &logs.AggrFieldParam{
+		AppId:     param.AppId,
+		StartTime: param.StartTime,
+		EndTime:   param.EndTime,
+		Size:      param.Size,
+		Field:     param.Field,
+	}
+	validFieldAggrParam(&o.BaseController, fieldParam)
+	validAggrField(&o.BaseController, fieldParam, logs.AttackAggrFields)
+	param.AppSize = o.validAppSize(param.AppSize)
+	result, err := logs.AggregationAttackWithTopField(param.StartTime, param.EndTime, param.Field, param.Size,
+		param.AppSize, fieldParam.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
+// @router /aggr/geo [post]
+func (o *AttackAlarmController) AggregationWithGeo() {
+	var param = &logs.AggrGeoParam{}
+	o.UnmarshalJson(&param)
+	validFieldAggrParam(&o.BaseController, &logs.AggrFieldParam{
+		AppId:     param.AppId,
+		StartTime: param.StartTime,
+		EndTime:   param.EndTime,
+		Size:      1,
+	})
+	if param.AppId == "" {
+		param.AppId = "*"
+	}
+	if param.GridSize == 0 {
+		param.GridSize = 5
+	}
+	// the cells of the smallest grid, 180/3 * 360/3 = 7200, are within the 10000 max buckets of ElasticSearch 7
+	if param.GridSize < 3 || param.GridSize > 90 {
+		o.ServeError(http.StatusBadRequest, "grid_size must be between 3 and 90")
+	}
+	param.AppSize = o.validAppSize(param.AppSize)
+	result, err := logs.AggregationAttackWithGeo(param.StartTime, param.EndTime, param.GridSize,
+		param.AppSize, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
 // @router /search [post]
 func (o *AttackAlarmController) Search() {
-	param, searchData := o.handleAttackSearchParam()
+	param, searchData := o.handleAttackSearchParam(true, models.TriageTargetEvent, "_id")
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime,
 		false, searchData, "event_time", param.Page,
 		param.Perpage, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
+	err = models.JoinTriages(models.TriageTargetEvent, "id", result)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get triage", err)
+	}
 	o.Serve(map[string]interface{}{
 		"total":      total,
 		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
@@ -120,13 +142,17 @@ func (o *AttackAlarmController) Search() {
 
 // @router /aggr/vuln [post]
 func (o *AttackAlarmController) AggregationVuln() {
-	param, searchData := o.handleAttackSearchParam()
+	param, searchData := o.handleAttackSearchParam(true, models.TriageTargetVuln, "stack_md5")
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime,
 		true, searchData, "event_time", param.Page,
 		param.Perpage, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
+	err = models.JoinTriages(models.TriageTargetVuln, "stack_md5", result)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get triage", err)
+	}
 	o.Serve(map[string]interface{}{
 		"total":      total,
 		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
@@ -136,8 +162,28 @@ func (o *AttackAlarmController) AggregationVuln() {
 	})
 }
 
-func (o *AttackAlarmController) handleAttackSearchParam() (param *logs.SearchAttackParam,
-	searchData map[string]interface{}) {
+// @router /export [post]
+func (o *AttackAlarmController) Export() {
+	param, searchData := o.handleAttackSearchParam(false, models.TriageTargetEvent, "_id")
+	exportLogs(&o.BaseController, &logs.AttackAlarmInfo, "attack", param.Data.AppId,
+		param.Data.StartTime, param.Data.EndTime, searchData)
+}
+
+// validAppSize returns the count of top apps in each bucket of aggregation, it is 10 by default
+func (o *AttackAlarmController) validAppSize(appSize int) int {
+	if appSize == 0 {
+		return 10
+	}
+	if appSize < 0 || appSize > 100 {
+		o.ServeError(http.StatusBadRequest, "app_size must be between 1 and 100")
+	}
+	return appSize
+}
+
+// handleAttackSearchParam validates the search param, the triage filter is matched with the targetType
+// and the esField of attack logs
+func (o *AttackAlarmController) handleAttackSearchParam(isPaged bool, targetType string,
+	esField string) (param *logs.SearchAttackParam, searchData map[string]interface{}) {
 	param = &logs.SearchAttackParam{}
 	o.UnmarshalJson(&param)
 	if param.Data == nil {
@@ -160,7 +206,9 @@ func (o *AttackAlarmController) handleAttackSearchParam() (param *logs.SearchAtt
 	if param.Data.StartTime > param.Data.EndTime {
 		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
 	}
-	o.ValidPage(param.Page, param.Perpage)
+	if isPaged {
+		o.ValidPage(param.Page, param.Perpage)
+	}
 	content, err := json.Marshal(param.Data)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
@@ -172,32 +220,13 @@ func (o *AttackAlarmController) handleAttackSearchParam() (param *logs.SearchAtt
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
-	return
-}
-
-func (o *AttackAlarmController) validFieldAggrParam(param *logs.AggrFieldParam) {
-	if param.AppId != "" {
-		_, err := models.GetAppById(param.AppId)
-		if err != nil {
-			o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.AppId, err)
-		}
-	} else {
-		param.AppId = "*"
-	}
-	if param.StartTime <= 0 {
-		o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
-	}
-	if param.EndTime <= 0 {
-		o.ServeError(http.StatusBadRequest, "end_time must be greater than 0")
-	}
-	if param.StartTime > param.EndTime {
-		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
-	}
-	duration := time.Duration(param.EndTime-param.StartTime) * time.Millisecond
-	if duration > 366*24*time.Hour {
-		o.ServeError(http.StatusBadRequest, "time duration can not be greater than 366 days")
+	err = logs.HandleSearchQuery(logs.AttackAlarmInfo.EsType, searchData)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid search query", err)
 	}
-	if param.Size <= 0 {
-		o.ServeError(http.StatusBadRequest, "size must be greater than 0")
+	err = models.HandleTriageSearchData(param.Data.AppId, targetType, esField, searchData)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid triage filter", err)
 	}
+	return
 }
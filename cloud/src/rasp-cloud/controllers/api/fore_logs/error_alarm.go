@@ -27,9 +27,75 @@ type ErrorController struct {
 	controllers.BaseController
 }
 
+// @router /aggr/time [post]
+func (o *ErrorController) AggregationWithTime() {
+	var param = &logs.AggrTimeParam{}
+	o.UnmarshalJson(&param)
+	validTimeAggrParam(&o.BaseController, param)
+	result, err := logs.AggregationErrorWithTime(param.StartTime, param.EndTime, param.Interval, param.TimeZone,
+		timeAggrGroupSize, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
+// @router /aggr/field [post]
+func (o *ErrorController) AggregationWithField() {
+	var param = &logs.AggrFieldParam{}
+	o.UnmarshalJson(&param)
+	validFieldAggrParam(&o.BaseController, param)
+	validAggrField(&o.BaseController, param, logs.ErrorAggrFields)
+	result, err :=
+		logs.AggregationErrorWithField(param.StartTime, param.EndTime, param.Field, param.Size, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
+// @router /aggr/version [post]
+func (o *ErrorController) AggregationWithVersion() {
+	var param = &logs.AggrFieldParam{}
+	o.UnmarshalJson(&param)
+	validFieldAggrParam(&o.BaseController, param)
+	if param.Size > maxAggrFieldSize {
+		o.ServeError(http.StatusBadRequest, "size cannot be greater than 1000")
+	}
+	result, err := models.AggregationErrorWithVersion(param.StartTime, param.EndTime, param.Size, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
 // @router /search [post]
 func (o *ErrorController) Search() {
-	var param = &logs.SearchErrorParam{}
+	param, searchData := o.handleErrorSearchParam(true)
+	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
+		param.Page, param.Perpage, false, logs.ErrorAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
+	}
+	o.Serve(map[string]interface{}{
+		"total":      total,
+		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
+		"page":       param.Page,
+		"perpage":    param.Perpage,
+		"data":       result,
+	})
+}
+
+// @router /export [post]
+func (o *ErrorController) Export() {
+	param, searchData := o.handleErrorSearchParam(false)
+	exportLogs(&o.BaseController, &logs.ErrorAlarmInfo, "error", param.Data.AppId,
+		param.Data.StartTime, param.Data.EndTime, searchData)
+}
+
+func (o *ErrorController) handleErrorSearchParam(isPaged bool) (param *logs.SearchErrorParam,
+	searchData map[string]interface{}) {
+	param = &logs.SearchErrorParam{}
 	o.UnmarshalJson(&param)
 	if param.Data == nil {
 		o.ServeError(http.StatusBadRequest, "search data can not be empty")
@@ -42,7 +108,9 @@ func (o *ErrorController) Search() {
 	} else {
 		param.Data.AppId = "*"
 	}
-	o.ValidPage(param.Page, param.Perpage)
+	if isPaged {
+		o.ValidPage(param.Page, param.Perpage)
+	}
 	if param.Data.StartTime <= 0 {
 		o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
 	}
@@ -56,7 +124,6 @@ func (o *ErrorController) Search() {
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
 	}
-	var searchData map[string]interface{}
 	err = json.Unmarshal(content, &searchData)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to decode search data", err)
@@ -64,16 +131,9 @@ func (o *ErrorController) Search() {
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
-	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
-		param.Page, param.Perpage, false, logs.ErrorAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+	err = logs.HandleSearchQuery(logs.ErrorAlarmInfo.EsType, searchData)
 	if err != nil {
-		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
+		o.ServeError(http.StatusBadRequest, "invalid search query", err)
 	}
-	o.Serve(map[string]interface{}{
-		"total":      total,
-		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
-		"page":       param.Page,
-		"perpage":    param.Perpage,
-		"data":       result,
-	})
+	return
 }
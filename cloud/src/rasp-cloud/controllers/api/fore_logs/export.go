@@ -0,0 +1,106 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package fore_logs
+
+import (
+	"github.com/astaxie/beego"
+	"io"
+	"net/http"
+	"rasp-cloud/conf"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
+	"strconv"
+	"time"
+)
+
+// exportLogs streams the logs to the response, or starts a background job when param.Async is true
+func exportLogs(o *controllers.BaseController, info *logs.AlarmLogInfo, logType string, appId string,
+	startTime int64, endTime int64, searchData map[string]interface{}) {
+	var param = &logs.ExportParam{}
+	o.UnmarshalJson(param)
+	if param.Format == "" {
+		param.Format = logs.ExportFormatCsv
+	}
+	contentType, ok := logs.ExportFormats[param.Format]
+	if !ok {
+		o.ServeError(http.StatusBadRequest, "unsupported export format: "+param.Format)
+	}
+	if len(param.Columns) > 128 {
+		o.ServeError(http.StatusBadRequest, "the count of export columns cannot be greater than 128")
+	}
+	columns, err := logs.ValidExportColumns(info.EsType, param.Columns)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid export columns", err)
+	}
+	if param.Format == logs.ExportFormatNdjson && len(param.Columns) == 0 {
+		// the whole log is exported by default
+		columns = nil
+	}
+	if param.MaxSize < 0 {
+		o.ServeError(http.StatusBadRequest, "max_size cannot be less than 0")
+	}
+	if param.MaxSize == 0 || param.MaxSize > conf.AppConfig.ExportMaxSize {
+		param.MaxSize = conf.AppConfig.ExportMaxSize
+	}
+	index := info.EsAliasIndex + "-" + appId
+	total, err := logs.CountLogs(startTime, endTime, searchData, index)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to count logs from es", err)
+	}
+	exportSize := total
+	if exportSize > param.MaxSize {
+		exportSize = param.MaxSize
+	}
+	export := func(writer io.Writer) (int64, error) {
+		return logs.ExportLogs(writer, param.Format, columns, param.MaxSize, startTime, endTime, searchData, index)
+	}
+	operationAppId := appId
+	if operationAppId == "*" {
+		operationAppId = ""
+	}
+	if param.Async {
+		job, err := models.AddExportJob(&models.ExportJob{
+			AppId:   operationAppId,
+			LogType: logType,
+			Format:  param.Format,
+			Columns: columns,
+			Total:   exportSize,
+		}, export)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to create export job", err)
+		}
+		models.AddOperation(operationAppId, models.OperationTypeExportLogs, o.Ctx.Input.IP(),
+			"Started the background export of "+logType+" logs, count: "+strconv.FormatInt(exportSize, 10))
+		o.Serve(job)
+		return
+	}
+	if exportSize > conf.AppConfig.ExportSyncMaxSize {
+		o.ServeError(http.StatusBadRequest, "the count of logs to export is greater than "+
+			strconv.FormatInt(conf.AppConfig.ExportSyncMaxSize, 10)+", please export with async")
+	}
+	models.AddOperation(operationAppId, models.OperationTypeExportLogs, o.Ctx.Input.IP(),
+		"Exported "+logType+" logs, count: "+strconv.FormatInt(exportSize, 10))
+	o.Ctx.Output.Header("Content-Type", contentType)
+	o.Ctx.Output.Header("Content-Disposition", "attachment;filename=openrasp-"+logType+"-"+
+		time.Now().Format("20060102150405")+"."+param.Format)
+	o.Ctx.Output.Header("X-Export-Total", strconv.FormatInt(total, 10))
+	count, err := export(o.Ctx.ResponseWriter)
+	if err != nil {
+		// the response has been started, so the error can only be logged
+		beego.Error("failed to export "+logType+" logs after "+strconv.FormatInt(count, 10)+" logs: ", err)
+	}
+}
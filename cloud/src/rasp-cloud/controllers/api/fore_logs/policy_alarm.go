@@ -28,9 +28,60 @@ type PolicyAlarmController struct {
 	controllers.BaseController
 }
 
+// @router /aggr/time [post]
+func (o *PolicyAlarmController) AggregationWithTime() {
+	var param = &logs.AggrTimeParam{}
+	o.UnmarshalJson(&param)
+	validTimeAggrParam(&o.BaseController, param)
+	result, err := logs.AggregationPolicyWithTime(param.StartTime, param.EndTime, param.Interval, param.TimeZone,
+		timeAggrGroupSize, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
+// @router /aggr/field [post]
+func (o *PolicyAlarmController) AggregationWithField() {
+	var param = &logs.AggrFieldParam{}
+	o.UnmarshalJson(&param)
+	validFieldAggrParam(&o.BaseController, param)
+	validAggrField(&o.BaseController, param, logs.PolicyAggrFields)
+	result, err :=
+		logs.AggregationPolicyWithField(param.StartTime, param.EndTime, param.Field, param.Size, param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
 // @router /search [post]
 func (o *PolicyAlarmController) Search() {
-	var param = &logs.SearchPolicyParam{}
+	param, searchData := o.handlePolicySearchParam(true)
+	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
+		param.Page, param.Perpage, false, logs.PolicyAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
+	}
+	o.Serve(map[string]interface{}{
+		"total":      total,
+		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
+		"page":       param.Page,
+		"perpage":    param.Perpage,
+		"data":       result,
+	})
+}
+
+// @router /export [post]
+func (o *PolicyAlarmController) Export() {
+	param, searchData := o.handlePolicySearchParam(false)
+	exportLogs(&o.BaseController, &logs.PolicyAlarmInfo, "policy", param.Data.AppId,
+		param.Data.StartTime, param.Data.EndTime, searchData)
+}
+
+func (o *PolicyAlarmController) handlePolicySearchParam(isPaged bool) (param *logs.SearchPolicyParam,
+	searchData map[string]interface{}) {
+	param = &logs.SearchPolicyParam{}
 	o.UnmarshalJson(&param)
 	if param.Data == nil {
 		o.ServeError(http.StatusBadRequest, "search data can not be empty")
@@ -52,12 +103,13 @@ func (o *PolicyAlarmController) Search() {
 	if param.Data.StartTime > param.Data.EndTime {
 		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
 	}
-	o.ValidPage(param.Page, param.Perpage)
+	if isPaged {
+		o.ValidPage(param.Page, param.Perpage)
+	}
 	content, err := json.Marshal(param.Data)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
 	}
-	var searchData map[string]interface{}
 	err = json.Unmarshal(content, &searchData)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to decode search data", err)
@@ -65,16 +117,9 @@ func (o *PolicyAlarmController) Search() {
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
-	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
-		param.Page, param.Perpage, false, logs.PolicyAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+	err = logs.HandleSearchQuery(logs.PolicyAlarmInfo.EsType, searchData)
 	if err != nil {
-		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
+		o.ServeError(http.StatusBadRequest, "invalid search query", err)
 	}
-	o.Serve(map[string]interface{}{
-		"total":      total,
-		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
-		"page":       param.Page,
-		"perpage":    param.Perpage,
-		"data":       result,
-	})
+	return
 }
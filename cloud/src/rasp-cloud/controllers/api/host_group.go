@@ -0,0 +1,142 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+)
+
+type HostGroupController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *HostGroupController) Get() {
+	var param struct {
+		AppId   string `json:"app_id"`
+		Page    int    `json:"page"`
+		Perpage int    `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	o.ValidPage(param.Page, param.Perpage)
+	total, groups, err := models.GetHostGroups(param.AppId, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get host groups", err)
+	}
+	var result = make(map[string]interface{})
+	result["total"] = total
+	result["total_page"] = math.Ceil(float64(total) / float64(param.Perpage))
+	result["page"] = param.Page
+	result["perpage"] = param.Perpage
+	result["data"] = groups
+	o.Serve(result)
+}
+
+// @router /rasps [post]
+func (o *HostGroupController) GetRasps() {
+	var param struct {
+		Id      string `json:"id"`
+		Page    int    `json:"page"`
+		Perpage int    `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	o.ValidPage(param.Page, param.Perpage)
+	group := o.getHostGroup(param.Id)
+	total, rasps, err := models.GetHostGroupRasps(group, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the rasps of host group", err)
+	}
+	var result = make(map[string]interface{})
+	result["total"] = total
+	result["total_page"] = math.Ceil(float64(total) / float64(param.Perpage))
+	result["page"] = param.Page
+	result["perpage"] = param.Perpage
+	result["data"] = rasps
+	o.Serve(result)
+}
+
+// @router / [post]
+func (o *HostGroupController) Post() {
+	var group = &models.HostGroup{}
+	o.UnmarshalJson(group)
+	if group.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if _, err := models.GetAppById(group.AppId); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	if err := models.ValidateHostGroup(group); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid host group", err)
+	}
+	group, err := models.AddHostGroup(group)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to create host group", err)
+	}
+	models.AddOperation(group.AppId, models.OperationTypeAddHostGroup,
+		o.Ctx.Input.IP(), "Created the host group: "+group.Name)
+	o.Serve(group)
+}
+
+// @router /update [post]
+func (o *HostGroupController) Update() {
+	var group = &models.HostGroup{}
+	o.UnmarshalJson(group)
+	oldGroup := o.getHostGroup(group.Id)
+	group.AppId = oldGroup.AppId
+	if err := models.ValidateHostGroup(group); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid host group", err)
+	}
+	group, err := models.UpdateHostGroup(group)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update host group", err)
+	}
+	models.AddOperation(group.AppId, models.OperationTypeEditHostGroup,
+		o.Ctx.Input.IP(), "Updated the host group: "+group.Name)
+	o.Serve(group)
+}
+
+// @router /delete [post]
+func (o *HostGroupController) Delete() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	o.getHostGroup(param.Id)
+	group, err := models.RemoveHostGroupById(param.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove host group", err)
+	}
+	models.AddOperation(group.AppId, models.OperationTypeDeleteHostGroup,
+		o.Ctx.Input.IP(), "Deleted the host group: "+group.Name)
+	o.Serve(group)
+}
+
+func (o *HostGroupController) getHostGroup(id string) *models.HostGroup {
+	if id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	group, err := models.GetHostGroupById(id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get host group", err)
+	}
+	return group
+}
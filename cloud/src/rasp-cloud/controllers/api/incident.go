@@ -0,0 +1,84 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"gopkg.in/mgo.v2"
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+)
+
+// Operations about the attack incidents correlated from attack events
+type IncidentController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *IncidentController) Get() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	incident, err := models.GetIncidentById(param.Id)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			o.ServeError(http.StatusBadRequest, "the incident does not exist")
+		}
+		o.ServeError(http.StatusBadRequest, "failed to get incident", err)
+	}
+	o.Serve(incident)
+}
+
+// @router /search [post]
+func (o *IncidentController) Search() {
+	var param struct {
+		Data    *models.IncidentSearchParam `json:"data"`
+		Page    int                         `json:"page"`
+		Perpage int                         `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Data == nil {
+		o.ServeError(http.StatusBadRequest, "search data can not be empty")
+	}
+	o.ValidPage(param.Page, param.Perpage)
+	if param.Data.AppId != "" {
+		if _, err := models.GetAppById(param.Data.AppId); err != nil {
+			o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.Data.AppId, err)
+		}
+	}
+	if param.Data.StartTime < 0 || param.Data.EndTime < 0 {
+		o.ServeError(http.StatusBadRequest, "start_time and end_time cannot be less than 0")
+	}
+	if param.Data.EndTime > 0 && param.Data.StartTime > param.Data.EndTime {
+		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
+	}
+	total, result, err := models.FindIncidents(param.Data, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to search incidents", err)
+	}
+	o.Serve(map[string]interface{}{
+		"total":      total,
+		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
+		"page":       param.Page,
+		"perpage":    param.Perpage,
+		"data":       result,
+	})
+}
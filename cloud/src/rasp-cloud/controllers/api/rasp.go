@@ -107,3 +107,58 @@ func (o *RaspController) Delete() {
 		})
 	}
 }
+
+// @router /labels [post]
+func (o *RaspController) UpdateLabels() {
+	var param struct {
+		Id     string            `json:"id"`
+		Labels map[string]string `json:"labels"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id can not be empty")
+	}
+	if param.Labels == nil {
+		param.Labels = map[string]string{}
+	}
+	if err := models.ValidRaspLabels(param.Labels); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid rasp labels", err)
+	}
+	if _, err := models.GetRaspById(param.Id); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get rasp", err)
+	}
+	rasp, err := models.UpdateRaspCustomLabels(param.Id, param.Labels)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update rasp labels", err)
+	}
+	models.AddOperation(rasp.AppId, models.OperationTypeUpdateRaspLabels, o.Ctx.Input.IP(),
+		"Updated the labels of RASP agent: "+rasp.Id)
+	o.Serve(rasp)
+}
+
+// @router /config [post]
+func (o *RaspController) GetConfig() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id can not be empty")
+	}
+	rasp, err := models.GetRaspById(param.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get rasp", err)
+	}
+	app, err := models.GetAppById(rasp.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	config, err := models.GetRaspConfig(app, rasp)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the config of rasp", err)
+	}
+	if config.Plugin != nil {
+		config.Plugin.Content = ""
+	}
+	o.Serve(config)
+}
@@ -0,0 +1,236 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
+	"time"
+)
+
+// Operations about the saved searches of logs
+type SavedSearchController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *SavedSearchController) Get() {
+	var param struct {
+		LogType string `json:"log_type"`
+		AppId   string `json:"app_id"`
+		Page    int    `json:"page"`
+		Perpage int    `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	o.ValidPage(param.Page, param.Perpage)
+	total, searches, err := models.GetSavedSearches(getRequestUser(&o.BaseController),
+		param.LogType, param.AppId, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get saved searches", err)
+	}
+	var result = make(map[string]interface{})
+	result["total"] = total
+	result["total_page"] = math.Ceil(float64(total) / float64(param.Perpage))
+	result["page"] = param.Page
+	result["perpage"] = param.Perpage
+	result["data"] = searches
+	o.Serve(result)
+}
+
+// @router /detail [post]
+func (o *SavedSearchController) Detail() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	search := o.getSavedSearch(param.Id, false)
+	startTime, endTime, err := models.GetSavedSearchTime(search, time.Now())
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the time range of saved search", err)
+	}
+	// the search data can be posted to the search api of the log type directly
+	data := make(map[string]interface{}, len(search.Data)+3)
+	for key, value := range search.Data {
+		data[key] = value
+	}
+	data["start_time"] = startTime
+	data["end_time"] = endTime
+	if search.AppId != "" {
+		data["app_id"] = search.AppId
+	}
+	o.Serve(map[string]interface{}{
+		"search": search,
+		"data":   data,
+	})
+}
+
+// @router / [post]
+func (o *SavedSearchController) Post() {
+	var search = &models.SavedSearch{}
+	o.UnmarshalJson(search)
+	o.validSavedSearch(search)
+	search.Owner = getRequestUser(&o.BaseController)
+	search, err := models.AddSavedSearch(search)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to create saved search", err)
+	}
+	models.AddOperation(search.AppId, models.OperationTypeAddSavedSearch,
+		o.Ctx.Input.IP(), "Created the saved search: "+search.Name)
+	o.Serve(search)
+}
+
+// @router /update [post]
+func (o *SavedSearchController) Update() {
+	var search = &models.SavedSearch{}
+	o.UnmarshalJson(search)
+	oldSearch := o.getSavedSearch(search.Id, true)
+	o.validSavedSearch(search)
+	search, err := models.UpdateSavedSearch(search, oldSearch)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update saved search", err)
+	}
+	models.AddOperation(search.AppId, models.OperationTypeEditSavedSearch,
+		o.Ctx.Input.IP(), "Updated the saved search: "+search.Name)
+	o.Serve(search)
+}
+
+// @router /delete [post]
+func (o *SavedSearchController) Delete() {
+	var param struct {
+		Id string `json:"id"`
+	}
+	o.UnmarshalJson(&param)
+	o.getSavedSearch(param.Id, true)
+	search, err := models.RemoveSavedSearchById(param.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove saved search", err)
+	}
+	models.AddOperation(search.AppId, models.OperationTypeDeleteSavedSearch,
+		o.Ctx.Input.IP(), "Deleted the saved search: "+search.Name)
+	o.Serve(search)
+}
+
+// getSavedSearch returns the saved search that can be read by the user,
+// only the owner can modify the saved search
+func (o *SavedSearchController) getSavedSearch(id string, isModify bool) *models.SavedSearch {
+	if id == "" {
+		o.ServeError(http.StatusBadRequest, "the id cannot be empty")
+	}
+	search, err := models.GetSavedSearchById(id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get saved search", err)
+	}
+	user := getRequestUser(&o.BaseController)
+	if search.Owner != user && (isModify || !search.Shared) {
+		o.ServeError(http.StatusForbidden, "the saved search belongs to other user")
+	}
+	return search
+}
+
+func (o *SavedSearchController) validSavedSearch(search *models.SavedSearch) {
+	if search.Name == "" {
+		o.ServeError(http.StatusBadRequest, "the saved search name cannot be empty")
+	}
+	if len(search.Name) > 64 {
+		o.ServeError(http.StatusBadRequest, "the length of saved search name cannot be greater than 64")
+	}
+	if _, ok := models.SavedSearchLogTypes[search.LogType]; !ok {
+		o.ServeError(http.StatusBadRequest, "unsupported log type: "+search.LogType)
+	}
+	if search.AppId != "" {
+		_, err := models.GetAppById(search.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get app", err)
+		}
+	}
+	if search.TimeRange != "" {
+		if _, err := models.ParseTimeRange(search.TimeRange); err != nil {
+			o.ServeError(http.StatusBadRequest, "invalid time_range", err)
+		}
+		search.StartTime = 0
+		search.EndTime = 0
+	} else {
+		if search.StartTime <= 0 {
+			o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
+		}
+		if search.EndTime <= 0 {
+			o.ServeError(http.StatusBadRequest, "end_time must be greater than 0")
+		}
+		if search.StartTime > search.EndTime {
+			o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
+		}
+	}
+	search.Data = o.normalizeSearchData(search.LogType, search.Data)
+	if _, err := models.GetSavedSearchQuery(search); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid search query", err)
+	}
+	if search.Alarm.Enable {
+		if search.LogType != models.SavedSearchLogTypeAttack {
+			o.ServeError(http.StatusBadRequest, "only the attack searches support alarm")
+		}
+		if search.AppId == "" {
+			o.ServeError(http.StatusBadRequest, "the app_id of the search with alarm cannot be empty")
+		}
+		if search.Alarm.Threshold == 0 {
+			search.Alarm.Threshold = 1
+		}
+		if search.Alarm.Threshold < 0 {
+			o.ServeError(http.StatusBadRequest, "the alarm threshold must be greater than 0")
+		}
+	}
+}
+
+// normalizeSearchData checks the search data with the search param of the log type,
+// the unknown fields are dropped
+func (o *SavedSearchController) normalizeSearchData(logType string,
+	data map[string]interface{}) map[string]interface{} {
+	var param interface{}
+	switch logType {
+	case models.SavedSearchLogTypeAttack:
+		param = &logs.SearchAttackParam{}
+	case models.SavedSearchLogTypePolicy:
+		param = &logs.SearchPolicyParam{}
+	default:
+		param = &logs.SearchErrorParam{}
+	}
+	content, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
+	}
+	if err = json.Unmarshal(content, param); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid search data", err)
+	}
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if content, err = json.Marshal(param); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
+	}
+	if err = json.Unmarshal(content, &result); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to decode search data", err)
+	}
+	if result.Data == nil {
+		result.Data = make(map[string]interface{})
+	}
+	delete(result.Data, "start_time")
+	delete(result.Data, "end_time")
+	delete(result.Data, "app_id")
+	return result.Data
+}
@@ -17,9 +17,11 @@ package api
 import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
 	"net/http"
 	"gopkg.in/mgo.v2"
 	"strings"
+	"rasp-cloud/es"
 )
 
 type ServerController struct {
@@ -75,6 +77,27 @@ func (o *ServerController) PutUrl() {
 	o.Serve(serverUrl)
 }
 
+// @router /geoip/get [post]
+func (o *ServerController) GetGeoIp() {
+	o.Serve(logs.GetGeoIpDbStatus())
+}
+
+// @router /geoip/reload [post]
+func (o *ServerController) ReloadGeoIp() {
+	// the databases of the current server are reloaded, the others reload them when the files are changed
+	o.Serve(logs.ReloadGeoIpDbs(true))
+}
+
+// @router /queue/get [post]
+func (o *ServerController) GetSpillQueue() {
+	o.Serve(logs.GetSpillQueueStatus())
+}
+
+// @router /deadletter/get [post]
+func (o *ServerController) GetDeadLetter() {
+	o.Serve(es.GetDeadLetterStatus())
+}
+
 func validHttpUrl(url string) bool {
 	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
 }
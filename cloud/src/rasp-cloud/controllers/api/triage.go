@@ -0,0 +1,151 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package api
+
+import (
+	"math"
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+	"strings"
+)
+
+// Operations about the triage of attack events and vulnerabilities
+type TriageController struct {
+	controllers.BaseController
+}
+
+// @router /get [post]
+func (o *TriageController) Get() {
+	var param = &models.Triage{}
+	o.UnmarshalJson(param)
+	o.validTriageTarget(param)
+	triage, err := models.GetTriage(param.AppId, param.TargetType, param.TargetId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get triage", err)
+	}
+	o.Serve(triage)
+}
+
+// @router /search [post]
+func (o *TriageController) Search() {
+	var param struct {
+		Data    *models.Triage `json:"data"`
+		Page    int            `json:"page"`
+		Perpage int            `json:"perpage"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Data == nil {
+		o.ServeError(http.StatusBadRequest, "search data can not be empty")
+	}
+	o.ValidPage(param.Page, param.Perpage)
+	if param.Data.TargetType != "" && !models.IsValidTriageTarget(param.Data.TargetType) {
+		o.ServeError(http.StatusBadRequest, "unsupported target_type: "+param.Data.TargetType)
+	}
+	if param.Data.State != "" && !models.IsValidTriageState(param.Data.State) {
+		o.ServeError(http.StatusBadRequest, "unsupported triage state: "+param.Data.State)
+	}
+	total, result, err := models.FindTriages(param.Data, param.Page, param.Perpage)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to search triage", err)
+	}
+	o.Serve(map[string]interface{}{
+		"total":      total,
+		"total_page": math.Ceil(float64(total) / float64(param.Perpage)),
+		"page":       param.Page,
+		"perpage":    param.Perpage,
+		"data":       result,
+	})
+}
+
+// @router /update [post]
+func (o *TriageController) Update() {
+	var param = &models.Triage{}
+	o.UnmarshalJson(param)
+	o.validTriageTarget(param)
+	if !models.IsValidTriageState(param.State) {
+		o.ServeError(http.StatusBadRequest, "unsupported triage state: "+param.State)
+	}
+	if len(param.Assignee) > 64 {
+		o.ServeError(http.StatusBadRequest, "the length of assignee cannot be greater than 64")
+	}
+	if len(param.Tags) > 16 {
+		o.ServeError(http.StatusBadRequest, "the count of tags cannot be greater than 16")
+	}
+	tags := make([]string, 0, len(param.Tags))
+	for _, tag := range param.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if len(tag) > 32 {
+			o.ServeError(http.StatusBadRequest, "the length of tag cannot be greater than 32")
+		}
+		tags = append(tags, tag)
+	}
+	param.Tags = tags
+	triage, err := models.UpdateTriage(param)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update triage", err)
+	}
+	models.AddOperation(triage.AppId, models.OperationTypeUpdateTriage, o.Ctx.Input.IP(),
+		"Updated the triage of attack "+triage.TargetType+" "+triage.TargetId+": state is "+triage.State+
+			", assignee is "+triage.Assignee+", tags are ["+strings.Join(triage.Tags, ",")+"]")
+	o.Serve(triage)
+}
+
+// @router /comment [post]
+func (o *TriageController) Comment() {
+	var param struct {
+		models.Triage
+		Content string `json:"content"`
+	}
+	o.UnmarshalJson(&param)
+	o.validTriageTarget(&param.Triage)
+	if strings.TrimSpace(param.Content) == "" {
+		o.ServeError(http.StatusBadRequest, "the comment content cannot be empty")
+	}
+	if len(param.Content) > 1024 {
+		o.ServeError(http.StatusBadRequest, "the length of comment content cannot be greater than 1024")
+	}
+	user := getRequestUser(&o.BaseController)
+	triage, err := models.AddTriageComment(param.AppId, param.TargetType, param.TargetId,
+		&models.TriageComment{User: user, Content: param.Content})
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to add triage comment", err)
+	}
+	models.AddOperation(triage.AppId, models.OperationTypeCommentTriage, o.Ctx.Input.IP(),
+		"Commented on the attack "+triage.TargetType+" "+triage.TargetId)
+	o.Serve(triage)
+}
+
+func (o *TriageController) validTriageTarget(param *models.Triage) {
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id cannot be empty")
+	}
+	if _, err := models.GetAppById(param.AppId); err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	if !models.IsValidTriageTarget(param.TargetType) {
+		o.ServeError(http.StatusBadRequest, "unsupported target_type: "+param.TargetType)
+	}
+	if param.TargetId == "" {
+		o.ServeError(http.StatusBadRequest, "the target_id cannot be empty")
+	}
+	if len(param.TargetId) > 128 {
+		o.ServeError(http.StatusBadRequest, "the length of target_id cannot be greater than 128")
+	}
+}
@@ -87,3 +87,13 @@ func (o *UserController) Logout() {
 	models.RemoveCookie(cookie)
 	o.ServeWithEmptyData()
 }
+
+// getRequestUser returns the user who sends the request
+func getRequestUser(o *controllers.BaseController) string {
+	user, err := models.GetRequestUser(o.Ctx.GetCookie(models.AuthCookieName),
+		o.Ctx.Input.Header(models.AuthTokenName))
+	if err != nil {
+		o.ServeError(http.StatusUnauthorized, "failed to get the user of request", err)
+	}
+	return user
+}
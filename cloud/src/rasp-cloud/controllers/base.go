@@ -18,6 +18,12 @@ import (
 	"github.com/astaxie/beego"
 	"net/http"
 	"encoding/json"
+	"io"
+)
+
+const (
+	// StreamBodyKey is the key of input data for the request body that is read as a stream by the controller
+	StreamBodyKey = "stream_body"
 )
 
 // base controller
@@ -61,6 +67,14 @@ func (o *BaseController) UnmarshalJson(v interface{}) {
 	}
 }
 
+// GetStreamBody returns the request body that is not copied into memory, it is nil for the other requests
+func (o *BaseController) GetStreamBody() io.Reader {
+	if body, ok := o.Ctx.Input.GetData(StreamBodyKey).(io.Reader); ok {
+		return body
+	}
+	return nil
+}
+
 func (o *BaseController) ValidPage(page int, perpage int) {
 	if page <= 0 {
 		o.ServeError(http.StatusBadRequest, "page must be greater than 0")
@@ -0,0 +1,75 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package controllers
+
+import (
+	"compress/gzip"
+	"github.com/astaxie/beego/context"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// the request bodies of agents are decoded before beego copies them, so that the size of decoded body is
+// limited by the MaxMemory of beego, and the ndjson bodies of log uploads are read as streams by the controllers
+// instead of being copied into memory
+
+const (
+	agentLogPathPrefix = "/v1/agent/log/"
+)
+
+var (
+	ndjsonContentTypes = map[string]bool{
+		"application/x-ndjson": true,
+		"application/ndjson":   true,
+	}
+)
+
+// DecodeAgentBody is the filter of agent requests, which decodes the gzip body and passes the ndjson body of
+// log uploads as a stream
+func DecodeAgentBody(ctx *context.Context) {
+	if ctx.Request.Body == nil || ctx.Request.Body == http.NoBody {
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(ctx.Input.Header("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			ctx.Output.JSON(map[string]interface{}{
+				"status": http.StatusBadRequest, "description": "invalid gzip request body: " + err.Error()},
+				false, false)
+			return
+		}
+		// the body is decoded here, beego must not decode it again
+		ctx.Request.Header.Del("Content-Encoding")
+		ctx.Request.ContentLength = -1
+		ctx.Request.Body = reader
+	default:
+		ctx.Output.JSON(map[string]interface{}{
+			"status":      http.StatusUnsupportedMediaType,
+			"description": "unsupported content encoding: " + encoding + ", only gzip is supported"},
+			false, false)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(ctx.Input.Header("Content-Type"))
+	if err == nil && ndjsonContentTypes[mediaType] && strings.HasPrefix(ctx.Request.URL.Path, agentLogPathPrefix) {
+		ctx.Input.SetData(StreamBodyKey, ctx.Request.Body)
+		ctx.Request.Body = http.NoBody
+	}
+}
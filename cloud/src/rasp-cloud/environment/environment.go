@@ -38,6 +38,9 @@ func init() {
 	StartFlag.StartType = flag.String("type", "", "use to provide different routers")
 	StartFlag.Daemon = flag.Bool("d", false, "use to run as daemon process")
 	StartFlag.Version = flag.Bool("version", false, "use to get version")
+	StartFlag.BackfillStart = flag.String("start", "", "use to provide the start date of backfill, like 2019-01-01")
+	StartFlag.BackfillEnd = flag.String("end", "", "use to provide the end date of backfill, like 2019-01-31")
+	StartFlag.BackfillApp = flag.String("app", "", "use to provide the app id of backfill")
 	flag.Parse()
 
 	if *StartFlag.Version {
@@ -0,0 +1,318 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/olivere/elastic"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the client is built for ElasticSearch 6, the differences of the newer ElasticSearch and OpenSearch
+// are handled here, so that the same rasp-cloud works with ElasticSearch 5.6 ~ 8.x and OpenSearch
+
+const (
+	DistributionElasticSearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+	typelessDocType           = "_doc"
+)
+
+type ClusterInfo struct {
+	Distribution string `json:"distribution"`
+	Version      string `json:"version"`
+	Major        int    `json:"major"`
+	Minor        int    `json:"minor"`
+}
+
+var (
+	Cluster = &ClusterInfo{Distribution: DistributionElasticSearch}
+	// the calendar units of date histogram, the other intervals are fixed intervals
+	calendarIntervals = map[string]bool{
+		"minute": true, "1m": true, "hour": true, "1h": true, "day": true, "1d": true, "week": true, "1w": true,
+		"month": true, "1M": true, "quarter": true, "1q": true, "year": true, "1y": true,
+	}
+)
+
+// compatVersion returns the ElasticSearch version that the cluster is compatible with,
+// OpenSearch is forked from ElasticSearch 7.10
+func (c *ClusterInfo) compatVersion() (int, int) {
+	if c.Distribution == DistributionOpenSearch {
+		return 7, 10
+	}
+	return c.Major, c.Minor
+}
+
+func (c *ClusterInfo) atLeast(major int, minor int) bool {
+	clusterMajor, clusterMinor := c.compatVersion()
+	return clusterMajor > major || clusterMajor == major && clusterMinor >= minor
+}
+
+// IsTypeless returns whether the mapping types are removed, since ElasticSearch 7
+func (c *ClusterInfo) IsTypeless() bool {
+	return c.atLeast(7, 0)
+}
+
+// SupportComposableTemplate returns whether the composable index template is supported, since ElasticSearch 7.8
+func (c *ClusterInfo) SupportComposableTemplate() bool {
+	return c.atLeast(7, 8)
+}
+
+// SupportCalendarInterval returns whether the calendar_interval of date histogram is supported,
+// since ElasticSearch 7.2, the interval param is removed in ElasticSearch 8
+func (c *ClusterInfo) SupportCalendarInterval() bool {
+	return c.atLeast(7, 2)
+}
+
+// SupportComposite returns whether the composite aggregation which pages through all buckets is supported,
+// since ElasticSearch 6.1
+func (c *ClusterInfo) SupportComposite() bool {
+	return c.atLeast(6, 1)
+}
+
+// SupportLifecycle returns whether the index lifecycle policy with the origination date is supported,
+// since ElasticSearch 7.5, OpenSearch has its own index state management instead
+func (c *ClusterInfo) SupportLifecycle() bool {
+	return c.Distribution == DistributionElasticSearch && c.atLeast(7, 5)
+}
+
+func (c *ClusterInfo) checkMinVersion() error {
+	if c.Distribution == DistributionOpenSearch {
+		return nil
+	}
+	if !c.atLeast(5, 6) {
+		return errors.New("unable to support the ElasticSearch with a version lower than " +
+			minEsVersion + ", the current version is " + c.Version)
+	}
+	return nil
+}
+
+// detectCluster gets the distribution and version of the cluster
+func detectCluster(client *elastic.Client) (*ClusterInfo, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	response, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var root struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	err = json.Unmarshal(response.Body, &root)
+	if err != nil {
+		return nil, err
+	}
+	info := &ClusterInfo{
+		Distribution: DistributionElasticSearch,
+		Version:      root.Version.Number,
+	}
+	if root.Version.Distribution == DistributionOpenSearch {
+		info.Distribution = DistributionOpenSearch
+	}
+	info.Major, info.Minor, err = parseVersion(info.Version)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func parseVersion(version string) (major int, minor int, err error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, errors.New("invalid version: " + version)
+	}
+	major, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.New("invalid version: " + version)
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, errors.New("invalid version: " + version)
+	}
+	return
+}
+
+// DocType returns the type used in the path of documents, it is always _doc without mapping types
+func DocType(esType string) string {
+	if Cluster.IsTypeless() {
+		return typelessDocType
+	}
+	return esType
+}
+
+// BulkDocType returns the _type of bulk requests, it must be omitted since ElasticSearch 8
+func BulkDocType(esType string) string {
+	if Cluster.IsTypeless() {
+		return ""
+	}
+	return esType
+}
+
+// NewIdsQuery returns the ids query with the type only if the mapping types are supported
+func NewIdsQuery(esType string) *elastic.IdsQuery {
+	if Cluster.IsTypeless() {
+		return elastic.NewIdsQuery()
+	}
+	return elastic.NewIdsQuery(esType)
+}
+
+type dateHistogramAggregation struct {
+	*elastic.DateHistogramAggregation
+}
+
+// DateHistogram returns the date histogram aggregation which replaces the removed interval param
+// with calendar_interval or fixed_interval according to the version of cluster
+func DateHistogram(aggr *elastic.DateHistogramAggregation) elastic.Aggregation {
+	return dateHistogramAggregation{aggr}
+}
+
+func (a dateHistogramAggregation) Source() (interface{}, error) {
+	source, err := a.DateHistogramAggregation.Source()
+	if err != nil || !Cluster.SupportCalendarInterval() {
+		return source, err
+	}
+	if sourceMap, ok := source.(map[string]interface{}); ok {
+		if opts, ok := sourceMap["date_histogram"].(map[string]interface{}); ok {
+			if interval, ok := opts["interval"].(string); ok {
+				delete(opts, "interval")
+				if calendarIntervals[interval] {
+					opts["calendar_interval"] = interval
+				} else {
+					opts["fixed_interval"] = interval
+				}
+			}
+		}
+	}
+	return source, nil
+}
+
+// compatTransport adds the params for the newer cluster to the requests of client,
+// the total hits of search response is an object since ElasticSearch 7, which can not be parsed by the client
+type compatTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *compatTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if Cluster.IsTypeless() && request.Method != http.MethodDelete {
+		path := request.URL.Path
+		isSearch := strings.HasSuffix(path, "/_search")
+		isScroll := strings.HasSuffix(path, "/_search/scroll") || strings.Contains(path, "/_search/scroll/")
+		if isSearch || isScroll {
+			compatRequest := new(http.Request)
+			*compatRequest = *request
+			compatUrl := *request.URL
+			query := compatUrl.Query()
+			query.Set("rest_total_hits_as_int", "true")
+			if isSearch && query.Get("scroll") == "" {
+				query.Set("track_total_hits", "true")
+			}
+			compatUrl.RawQuery = query.Encode()
+			compatRequest.URL = &compatUrl
+			request = compatRequest
+		}
+	}
+	return t.transport.RoundTrip(request)
+}
+
+// putTemplate puts the template of the es type, the typed legacy template is converted to
+// the typeless template or the composable index template for the newer cluster
+func putTemplate(client *elastic.Client, name string, esType string, body string) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	if !Cluster.IsTypeless() {
+		_, err := elastic.NewIndicesPutTemplateService(client).Name(name).BodyString(body).Do(ctx)
+		return err
+	}
+	patterns, settings, mappings, err := parseLegacyTemplate(esType, body)
+	if err != nil {
+		return err
+	}
+	if !Cluster.SupportComposableTemplate() {
+		_, err = elastic.NewIndicesPutTemplateService(client).Name(name).BodyJson(map[string]interface{}{
+			"index_patterns": patterns,
+			"settings":       settings,
+			"mappings":       mappings,
+		}).Do(ctx)
+		return err
+	}
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/_index_template/" + name,
+		Body: map[string]interface{}{
+			"index_patterns": patterns,
+			"priority":       200,
+			"template": map[string]interface{}{
+				"settings": settings,
+				"mappings": mappings,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// the legacy template put by the old version is useless now
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       "DELETE",
+		Path:         "/_template/" + name,
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	return err
+}
+
+// parseLegacyTemplate returns the index patterns, settings and typeless mappings of the legacy template
+func parseLegacyTemplate(esType string, body string) (patterns []string, settings map[string]interface{},
+	mappings map[string]interface{}, err error) {
+	var template struct {
+		Template      string                            `json:"template"`
+		IndexPatterns []string                          `json:"index_patterns"`
+		Settings      map[string]interface{}            `json:"settings"`
+		Mappings      map[string]map[string]interface{} `json:"mappings"`
+	}
+	err = json.Unmarshal([]byte(body), &template)
+	if err != nil {
+		return
+	}
+	patterns = template.IndexPatterns
+	if template.Template != "" {
+		patterns = append(patterns, template.Template)
+	}
+	if len(patterns) == 0 {
+		err = errors.New("can not find the index patterns of template for type: " + esType)
+		return
+	}
+	settings = template.Settings
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	mappings, ok := template.Mappings[esType]
+	if !ok {
+		err = errors.New("can not find the mappings of template for type: " + esType)
+		return
+	}
+	// the _all field is removed since ElasticSearch 7
+	delete(mappings, "_all")
+	return
+}
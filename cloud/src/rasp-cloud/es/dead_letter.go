@@ -0,0 +1,170 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package es
+
+import (
+	"encoding/json"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"os"
+	"path"
+	"rasp-cloud/tools"
+	"sync"
+	"time"
+	"strconv"
+	"sync/atomic"
+)
+
+// the docs rejected by ES permanently, like the mapping conflicts, are written to the dead-letter file
+// with the error reason instead of being lost, the counts and the recent dead letters are kept in memory
+
+const (
+	deadLetterDirName     = "/openrasp-logs/dead-letter"
+	deadLetterFileName    = "dead-letter.log"
+	deadLetterRecentCount = 100
+	deadLetterLogInterval = time.Minute
+)
+
+type DeadLetter struct {
+	Time      int64                  `json:"@timestamp"`
+	DocType   string                 `json:"doc_type"`
+	Index     string                 `json:"index,omitempty"`
+	Status    int                    `json:"status"`
+	ErrorType string                 `json:"error_type"`
+	Reason    string                 `json:"reason"`
+	Doc       map[string]interface{} `json:"doc"`
+}
+
+type DeadLetterStatus struct {
+	Total int64 `json:"total"`
+	// the counts of each doc type and error type, like {"attack-alarm": {"mapper_parsing_exception": 1}}
+	Counts   map[string]map[string]int64 `json:"counts"`
+	FilePath string                      `json:"file_path"`
+	Recent   []*DeadLetter               `json:"recent"`
+}
+
+var (
+	deadLetterLogger     *logs.BeeLogger
+	deadLetterFilePath   string
+	deadLetterLoggerOnce sync.Once
+	deadLetterLock       sync.Mutex
+	deadLetterTotal      int64
+	deadLetterCounts     = make(map[string]map[string]int64)
+	deadLetterRecent     = make([]*DeadLetter, 0, deadLetterRecentCount)
+	// the error log of dead letters is limited to once a minute, the suppressed ones are counted in it
+	lastDeadLetterLogTime int64
+	suppressedDeadLetters int64
+)
+
+func initDeadLetterLogger() {
+	currentPath, err := tools.GetCurrentPath()
+	if err != nil {
+		beego.Error("failed to init the dead-letter logger: " + err.Error())
+		return
+	}
+	dirName := currentPath + deadLetterDirName
+	if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
+		beego.Error("failed to init the dead-letter logger: " + err.Error())
+		return
+	}
+	logger := logs.NewLogger()
+	logPath := path.Join(dirName, deadLetterFileName)
+	err = logger.SetLogger(tools.AdapterAlarmFile,
+		`{"filename":"`+logPath+`", "daily":true, "maxdays":30, "perm":"0777"}`)
+	if err != nil {
+		beego.Error("failed to init the dead-letter logger: " + err.Error())
+		return
+	}
+	deadLetterLock.Lock()
+	deadLetterLogger = logger
+	deadLetterFilePath = logPath
+	deadLetterLock.Unlock()
+}
+
+// addDeadLetter writes the rejected doc to the dead-letter file and counts it
+func addDeadLetter(docType string, index string, doc map[string]interface{}, status int, errorType string,
+	reason string) {
+	letter := &DeadLetter{
+		Time:      time.Now().UnixNano() / 1000000,
+		DocType:   docType,
+		Index:     index,
+		Status:    status,
+		ErrorType: errorType,
+		Reason:    reason,
+		Doc:       doc,
+	}
+	logDeadLetter(docType, errorType, reason)
+	deadLetterLoggerOnce.Do(initDeadLetterLogger)
+	if deadLetterLogger != nil {
+		content, err := json.Marshal(letter)
+		if err == nil {
+			_, err = deadLetterLogger.Write(content)
+		}
+		if err != nil {
+			beego.Error("failed to write the dead letter: " + err.Error())
+		}
+	}
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	deadLetterTotal++
+	if _, ok := deadLetterCounts[docType]; !ok {
+		deadLetterCounts[docType] = make(map[string]int64)
+	}
+	deadLetterCounts[docType][errorType]++
+	if len(deadLetterRecent) >= deadLetterRecentCount {
+		deadLetterRecent = deadLetterRecent[1:]
+	}
+	deadLetterRecent = append(deadLetterRecent, letter)
+}
+
+func logDeadLetter(docType string, errorType string, reason string) {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&lastDeadLetterLogTime)
+	if now-last < int64(deadLetterLogInterval/time.Second) ||
+		!atomic.CompareAndSwapInt64(&lastDeadLetterLogTime, last, now) {
+		atomic.AddInt64(&suppressedDeadLetters, 1)
+		return
+	}
+	message := "the " + docType + " doc is rejected by ES and sent to the dead letters, " + errorType + ": " + reason
+	if suppressed := atomic.SwapInt64(&suppressedDeadLetters, 0); suppressed > 0 {
+		message += ", " + strconv.FormatInt(suppressed, 10) + " dead letters are not logged since the last one"
+	}
+	beego.Error(message)
+}
+
+// GetDeadLetterStatus returns the counts of dead letters since rasp-cloud starts and the recent ones,
+// the latest dead letter is the first
+func GetDeadLetterStatus() *DeadLetterStatus {
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	status := &DeadLetterStatus{
+		Total:    deadLetterTotal,
+		Counts:   make(map[string]map[string]int64),
+		FilePath: deadLetterFilePath,
+		Recent:   make([]*DeadLetter, 0, len(deadLetterRecent)),
+	}
+	for docType, counts := range deadLetterCounts {
+		status.Counts[docType] = make(map[string]int64)
+		for errorType, count := range counts {
+			status.Counts[docType][errorType] = count
+		}
+	}
+	for i := len(deadLetterRecent) - 1; i >= 0; i-- {
+		status.Recent = append(status.Recent, deadLetterRecent[i])
+	}
+	return status
+}
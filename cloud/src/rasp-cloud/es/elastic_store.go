@@ -0,0 +1,232 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package es
+
+import (
+	"context"
+	"github.com/olivere/elastic"
+	"io"
+	"rasp-cloud/storage"
+	"time"
+	"github.com/astaxie/beego"
+	"net/http"
+	"rasp-cloud/conf"
+	"rasp-cloud/tools"
+	"strconv"
+)
+
+// elasticStore is the log store of ElasticSearch or OpenSearch
+type elasticStore struct {
+	client *elastic.Client
+}
+
+// openElasticStore connects to the cluster and detects its version
+func openElasticStore() *elasticStore {
+	client, err := elastic.NewSimpleClient(elastic.SetURL(conf.AppConfig.EsAddr),
+		elastic.SetBasicAuth(conf.AppConfig.EsUser, conf.AppConfig.EsPwd),
+		elastic.SetHttpClient(&http.Client{Transport: &compatTransport{http.DefaultTransport}}))
+	if err != nil {
+		tools.Panic(tools.ErrCodeESInitFailed, "init ES failed", err)
+	}
+	Cluster, err = detectCluster(client)
+	if err != nil {
+		tools.Panic(tools.ErrCodeESInitFailed, "failed to get es version", err)
+	}
+	beego.Info("ES distribution: " + Cluster.Distribution + ", version: " + Cluster.Version)
+	if err = Cluster.checkMinVersion(); err != nil {
+		tools.Panic(tools.ErrCodeESInitFailed, err.Error(), nil)
+	}
+	return &elasticStore{client: client}
+}
+
+func (store *elasticStore) PutTemplate(name string, esType string, body string) error {
+	return putTemplate(store.client, name, esType, body)
+}
+
+func (store *elasticStore) CreateIndex(name string, alias string) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	exists, err := store.client.IndexExists(name).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		body := map[string]interface{}{
+			"aliases": map[string]interface{}{
+				alias: map[string]interface{}{},
+			},
+		}
+		_, err = store.client.CreateIndex(name).BodyJson(body).Do(ctx)
+		if err == nil {
+			return nil
+		}
+		// the index may be created by another rasp-cloud at the same time
+		if e, ok := err.(*elastic.Error); !ok || e.Details == nil ||
+			e.Details.Type != "resource_already_exists_exception" && e.Details.Type != "index_already_exists_exception" {
+			return err
+		}
+	}
+	_, err = store.client.Alias().Add(name, alias).Do(ctx)
+	return err
+}
+
+func (store *elasticStore) DeleteIndex(name string) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	_, err := store.client.DeleteIndex(name).Do(ctx)
+	return err
+}
+
+func (store *elasticStore) GetAliasIndices(aliasPattern string) (map[string][]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	result, err := store.client.Aliases().Alias(aliasPattern).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return make(map[string][]string), nil
+		}
+		return nil, err
+	}
+	aliasIndices := make(map[string][]string)
+	for index, indexInfo := range result.Indices {
+		for _, aliasInfo := range indexInfo.Aliases {
+			aliasIndices[aliasInfo.AliasName] = append(aliasIndices[aliasInfo.AliasName], index)
+		}
+	}
+	return aliasIndices, nil
+}
+
+func (store *elasticStore) IndexStats(indices ...string) (map[string]*elastic.IndexStats, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	result, err := store.client.IndexStats(indices...).Metric("docs", "store").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result.Indices, nil
+}
+
+func (store *elasticStore) Bulk(ctx context.Context,
+	requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	return store.client.Bulk().Add(requests...).Do(ctx)
+}
+
+func (store *elasticStore) Search(ctx context.Context, search *storage.LogSearch) (*elastic.SearchResult, error) {
+	searchService := store.client.Search(search.Indices...).
+		From(search.From).
+		Size(search.Size).
+		SortBy(search.Sorters...)
+	if search.Query != nil {
+		searchService.Query(search.Query)
+	}
+	if search.Source != nil {
+		searchService.FetchSourceContext(search.Source)
+	}
+	for name, aggr := range search.Aggregations {
+		searchService.Aggregation(name, aggr)
+	}
+	return searchService.Do(ctx)
+}
+
+func (store *elasticStore) Count(ctx context.Context, query elastic.Query, indices ...string) (int64, error) {
+	countService := store.client.Count(indices...)
+	if query != nil {
+		countService.Query(query)
+	}
+	return countService.Do(ctx)
+}
+
+func (store *elasticStore) Scan(ctx context.Context, search *storage.LogSearch,
+	handler func(hit *elastic.SearchHit) error) error {
+	scrollService := store.client.Scroll(search.Indices...).
+		Size(search.Size).
+		SortBy(search.Sorters...).
+		KeepAlive("5m")
+	defer scrollService.Clear(context.Background())
+	if search.Query != nil {
+		scrollService.Query(search.Query)
+	}
+	if search.Source != nil {
+		scrollService.FetchSourceContext(search.Source)
+	}
+	for {
+		result, err := scrollService.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if result == nil || result.Hits == nil || len(result.Hits.Hits) == 0 {
+			return nil
+		}
+		for _, hit := range result.Hits.Hits {
+			if err = handler(hit); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (store *elasticStore) DeleteByQuery(ctx context.Context, query elastic.Query,
+	indices ...string) (int64, error) {
+	result, err := store.client.DeleteByQuery(indices...).Query(query).ProceedOnVersionConflict().Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
+
+func (store *elasticStore) Close() {
+	store.client.Stop()
+}
+
+func (store *elasticStore) PutLifecyclePolicy(name string, deleteAfter time.Duration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	_, err := store.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/_ilm/policy/" + name,
+		Body: map[string]interface{}{
+			"policy": map[string]interface{}{
+				"phases": map[string]interface{}{
+					"delete": map[string]interface{}{
+						"min_age": strconv.FormatInt(int64(deleteAfter/time.Hour), 10) + "h",
+						"actions": map[string]interface{}{
+							"delete": map[string]interface{}{},
+						},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// SetIndexLifecycle sets the policy of the index, the ages of phases are counted from the origination time
+func (store *elasticStore) SetIndexLifecycle(index string, policy string, origination time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	_, err := store.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + index + "/_settings",
+		Body: map[string]interface{}{
+			"index.lifecycle.name":             policy,
+			"index.lifecycle.origination_date": origination.UnixNano() / int64(time.Millisecond),
+		},
+	})
+	return err
+}
@@ -18,47 +18,60 @@ import (
 	"github.com/olivere/elastic"
 	"time"
 	"context"
-	"github.com/astaxie/beego/logs"
 	"strconv"
 	"github.com/astaxie/beego"
-	"rasp-cloud/tools"
 	"fmt"
 	"strings"
 	"rasp-cloud/conf"
+	"net/http"
+	"rasp-cloud/storage"
+	"errors"
 )
 
 var (
-	ElasticClient *elastic.Client
+	// store is the ElasticSearch or the embedded log store
+	store         storage.LogStore
 	Version       string
 	ttlIndexes    = make(chan map[string]time.Duration, 1)
-	minEsVersion  = "5.6.0"
+	// AppTTLLoader returns the retention of apps for each index registered by RegisterTTL,
+	// like {"openrasp-attack-alarm": {"<app_id>": duration}}
+	AppTTLLoader func() (map[string]map[string]time.Duration, error)
+	minEsVersion = "5.6.0"
+)
+
+const (
+	bulkMaxRetries    = 3
+	bulkRetryInterval = time.Second
+	// BulkIdField is the internal field of doc with its deterministic id, it is removed before the doc is inserted
+	BulkIdField = "_bulk_id"
+	// IndexTimeField is the time when the attack alarm is written to ES, unlike @timestamp, it is also the latest time
+	// for the alarms which are replayed from the spill queue or backfilled from the log files
+	IndexTimeField = "index_time"
+	ttlStartDelay  = time.Minute
 )
 
 func init() {
 	ttlIndexes <- make(map[string]time.Duration)
 	if *conf.AppConfig.Flag.StartType != conf.StartTypeReset {
-		esAddr := conf.AppConfig.EsAddr
-		client, err := elastic.NewSimpleClient(elastic.SetURL(esAddr),
-			elastic.SetBasicAuth(conf.AppConfig.EsUser, conf.AppConfig.EsPwd))
-		if err != nil {
-			tools.Panic(tools.ErrCodeESInitFailed, "init ES failed", err)
+		if storage.IsEmbedded() {
+			store = storage.OpenEmbeddedLogStore()
+			// the embedded log store behaves like ElasticSearch 6 with the mapping types
+			Cluster = &ClusterInfo{Distribution: DistributionElasticSearch, Version: storage.EmbeddedEsVersion}
+			Cluster.Major, Cluster.Minor, _ = parseVersion(Cluster.Version)
+			beego.Info("use the embedded log store")
+		} else {
+			store = openElasticStore()
 		}
+		Version = Cluster.Version
 		go startTTL(24 * time.Hour)
-
-		Version, err = client.ElasticsearchVersion(esAddr)
-		if err != nil {
-			tools.Panic(tools.ErrCodeESInitFailed, "failed to get es version", err)
-		}
-		beego.Info("ES version: " + Version)
-		if strings.Compare(Version, minEsVersion) < 0 {
-			tools.Panic(tools.ErrCodeESInitFailed, "unable to support the ElasticSearch with a version lower than "+
-				minEsVersion+ ","+ " the current version is "+ Version, nil)
-		}
-		ElasticClient = client
 	}
 }
 
+// startTTL deletes the expired data periodically, the first time is after the templates and the retention
+// of indices are registered at startup, so that the legacy indices are moved to the rolling indices soon
 func startTTL(duration time.Duration) {
+	time.Sleep(ttlStartDelay)
+	DeleteExpiredData()
 	ticker := time.NewTicker(duration)
 	for {
 		select {
@@ -68,6 +81,8 @@ func startTTL(duration time.Duration) {
 	}
 }
 
+// DeleteExpiredData deletes the expired rolling indices and documents of each app,
+// the retention of app is loaded by AppTTLLoader, the default retention of the index is used if the app has no retention
 func DeleteExpiredData() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -78,27 +93,48 @@ func DeleteExpiredData() {
 	defer func() {
 		ttlIndexes <- ttls
 	}()
+	appTtls := make(map[string]map[string]time.Duration)
+	if AppTTLLoader != nil {
+		var err error
+		appTtls, err = AppTTLLoader()
+		if err != nil {
+			// never delete the data with the wrong retention
+			beego.Error("failed to load the retention of apps: " + err.Error())
+			return
+		}
+	}
 	for index, duration := range ttls {
-		expiredTime := strconv.FormatInt((time.Now().UnixNano()-int64(duration))/1000000, 10)
-		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
-		r, err := ElasticClient.DeleteByQuery(index).QueryString("@timestamp:<" + expiredTime).Do(ctx)
+		prefix := GetAliasName(index, "")
+		aliasIndices, err := GetAliasIndices(prefix + "*")
 		if err != nil {
-			if r != nil && r.Failures != nil {
-				beego.Error(r.Failures)
-			}
-			beego.Error("failed to delete expired data for index " + index + ": " + err.Error())
-		} else {
-			var deleteNum int64
-			if r != nil {
-				deleteNum = r.Deleted
+			beego.Error("failed to get the indices of " + prefix + "*: " + err.Error())
+			continue
+		}
+		for alias, indices := range aliasIndices {
+			appId := strings.TrimPrefix(alias, prefix)
+			appDuration := duration
+			if appTtl, ok := appTtls[index][appId]; ok && appTtl > 0 {
+				appDuration = appTtl
 			}
-			beego.Info("delete expired data successfully for index " + index + ", total: " +
-				strconv.FormatInt(deleteNum, 10))
+			deleteExpiredIndices(index, appId, indices, appDuration)
 		}
-		cancel()
 	}
 }
 
+// GetAliasIndices returns the indices of each alias which matches the pattern
+func GetAliasIndices(aliasPattern string) (map[string][]string, error) {
+	return store.GetAliasIndices(aliasPattern)
+}
+
+// GetIndexStats returns the stats of docs and store of the indices
+func GetIndexStats(indices ...string) (map[string]*elastic.IndexStats, error) {
+	if len(indices) == 0 {
+		return make(map[string]*elastic.IndexStats), nil
+	}
+	return store.IndexStats(indices...)
+}
+
+// RegisterTTL registers the default retention of the rolling indices, like openrasp-attack-alarm
 func RegisterTTL(duration time.Duration, index string) {
 	ttls := <-ttlIndexes
 	defer func() {
@@ -107,75 +143,199 @@ func RegisterTTL(duration time.Duration, index string) {
 	ttls[index] = duration
 }
 
-func CreateTemplate(name string, body string) error {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
-	defer cancel()
-	_, err := elastic.NewIndicesPutTemplateService(ElasticClient).Name(name).BodyString(body).Do(ctx)
+func CreateTemplate(name string, esType string, body string) error {
+	err := store.PutTemplate(name, esType, body)
 	if err != nil {
+		beego.Error("failed to put es template " + name + ": " + err.Error())
 		return err
 	}
 	beego.Info("put es template: " + name)
 	return nil
 }
 
-func CreateEsIndex(index string) error {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+func Insert(index string, docType string, doc interface{}) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
 	defer cancel()
-	exists, err := ElasticClient.IndexExists(index).Do(ctx)
+	response, err := store.Bulk(ctx, elastic.NewBulkIndexRequest().Index(index).Type(BulkDocType(docType)).Doc(doc))
 	if err != nil {
 		return err
 	}
-	if !exists {
-		createResult, err := ElasticClient.CreateIndex(index).Do(ctx)
-		if err != nil {
-			return err
-		}
-		logs.Info("create es index: " + createResult.Index)
-		if err != nil {
-			beego.Error("failed to create index with name " + index + ": " + err.Error())
-			return err
+	for _, item := range response.Indexed() {
+		if item.Error != nil {
+			return errors.New(item.Error.Type + ": " + item.Error.Reason)
 		}
 	}
 	return nil
 }
 
-func Insert(index string, docType string, doc interface{}) (err error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
-	defer cancel()
-	_, err = ElasticClient.Index().Index(index).Type(docType).BodyJson(doc).Do(ctx)
-	return
+// BulkError is returned by BulkInsert with the docs which are not inserted, they can be retried later,
+// the other docs are inserted or sent to the dead letters
+type BulkError struct {
+	Docs []map[string]interface{}
+	Err  error
+}
+
+func (e *BulkError) Error() string {
+	return strconv.Itoa(len(e.Docs)) + " docs are not inserted: " + e.Err.Error()
 }
 
-func BulkInsert(docType string, docs []map[string]interface{}) (err error) {
-	bulkService := ElasticClient.Bulk()
+// BulkInsert inserts the docs to the write indices of their apps, the items rejected by the retryable errors,
+// like the full queue of ES, are retried, the items rejected permanently, like the mapping conflicts,
+// are sent to the dead letters, the docs not inserted finally are returned in the BulkError
+func BulkInsert(docType string, docs []map[string]interface{}) error {
+	pending := make([]map[string]interface{}, 0, len(docs))
 	for _, doc := range docs {
-		if doc["app_id"] == nil {
-			beego.Error("failed to get app_id param from alarm: " + fmt.Sprintf("%+v", doc))
-		}
-		if appId, ok := doc["app_id"].(string); ok {
-			if docType == "policy-alarm" {
-
-				bulkService.Add(elastic.NewBulkUpdateRequest().
-					Index("real-openrasp-" + docType + "-" + appId).
-					Type(docType).
-					Id(fmt.Sprint(doc["upsert_id"])).
-					DocAsUpsert(true).
-					Doc(doc))
-			} else {
-				if appId, ok := doc["app_id"].(string); ok {
-					bulkService.Add(elastic.NewBulkIndexRequest().
-						Index("real-openrasp-" + docType + "-" + appId).
-						Type(docType).
-						OpType("index").
-						Doc(doc))
-				}
+		if _, ok := doc["app_id"].(string); !ok {
+			addDeadLetter(docType, "", doc, http.StatusBadRequest, "invalid_app_id",
+				"the app_id of doc is missing or not string: "+fmt.Sprint(doc["app_id"]))
+			continue
+		}
+		pending = append(pending, doc)
+	}
+	var err error
+	for retry := 0; len(pending) > 0; retry++ {
+		if retry > 0 {
+			if retry > bulkMaxRetries {
+				return &BulkError{Docs: pending, Err: err}
 			}
+			time.Sleep(time.Duration(retry) * bulkRetryInterval)
+		}
+		var failed bool
+		pending, failed, err = bulkInsertOnce(docType, pending)
+		if failed {
+			// the whole request fails, like ES is unavailable, it is not retried here
+			return &BulkError{Docs: pending, Err: err}
+		}
+	}
+	return nil
+}
+
+// bulkInsertOnce sends a bulk request of the docs, the docs to be retried are returned,
+// the failed is true if the whole request fails
+func bulkInsertOnce(docType string, docs []map[string]interface{}) (retryDocs []map[string]interface{},
+	failed bool, err error) {
+	requests := make([]elastic.BulkableRequest, 0, len(docs))
+	// the docs of each bulk request in order
+	requestDocs := make([]map[string]interface{}, 0, len(docs))
+	retryDocs = make([]map[string]interface{}, 0)
+	// the alias of each request, the copies of upserted docs in the other indices of alias are removed
+	requestAliases := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		appId := doc["app_id"].(string)
+		// the doc is written to the rolling index of its own time, so that the same doc always has the same index
+		docTime, ok := parseTimestamp(doc["@timestamp"])
+		if !ok {
+			docTime = time.Now()
+		}
+		index, indexErr := GetRollingIndex("openrasp-"+docType, appId, docTime)
+		if indexErr != nil {
+			beego.Error("failed to get the write index of app " + appId + ": " + indexErr.Error())
+			err = indexErr
+			retryDocs = append(retryDocs, doc)
+			continue
+		}
+		// the policy alarm is upserted in the rolling index of its time,
+		// its copies of the other periods are removed after the upsert, so it is unique behind the alias
+		if docType == "policy-alarm" {
+			requests = append(requests, elastic.NewBulkUpdateRequest().
+				Index(index).
+				Type(BulkDocType(docType)).
+				Id(fmt.Sprint(doc["upsert_id"])).
+				DocAsUpsert(true).
+				Doc(doc))
 		} else {
-			beego.Error("the type of alarm's app_id param is not string: " + fmt.Sprintf("%+v", doc))
+			if docType == "attack-alarm" {
+				doc[IndexTimeField] = time.Now().UnixNano() / 1000000
+			}
+			id, source := splitBulkId(doc)
+			requests = append(requests, elastic.NewBulkIndexRequest().
+				Index(index).
+				Type(BulkDocType(docType)).
+				Id(id).
+				OpType("index").
+				Doc(source))
 		}
+		requestDocs = append(requestDocs, doc)
+		requestAliases = append(requestAliases, GetAliasName("openrasp-"+docType, appId))
+	}
+	if len(requestDocs) == 0 {
+		return retryDocs, len(retryDocs) > 0, err
 	}
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
 	defer cancel()
-	_, err = bulkService.Do(ctx)
-	return err
+	response, doErr := store.Bulk(ctx, requests...)
+	if doErr != nil {
+		return docs, true, doErr
+	}
+	upserted := make(map[string]map[string][]string)
+	for i, items := range response.Items {
+		if i >= len(requestDocs) {
+			break
+		}
+		for _, item := range items {
+			if item.Status >= 200 && item.Status < 300 && item.Error == nil {
+				if docType == "policy-alarm" {
+					if upserted[requestAliases[i]] == nil {
+						upserted[requestAliases[i]] = make(map[string][]string)
+					}
+					upserted[requestAliases[i]][item.Index] = append(upserted[requestAliases[i]][item.Index], item.Id)
+				}
+				continue
+			}
+			errorType, reason := "unknown", "unknown error of bulk item"
+			if item.Error != nil {
+				errorType, reason = item.Error.Type, item.Error.Reason
+			}
+			if isRetryableBulkItem(item.Status, errorType) {
+				if errorType == "index_not_found_exception" {
+					forgetRollingIndex(item.Index)
+				}
+				err = errors.New(errorType + ": " + reason)
+				retryDocs = append(retryDocs, requestDocs[i])
+				continue
+			}
+			addDeadLetter(docType, item.Index, requestDocs[i], item.Status, errorType, reason)
+		}
+	}
+	removeUpsertedCopies(upserted)
+	return retryDocs, false, err
+}
+
+// removeUpsertedCopies deletes the docs with the same ids as the upserted docs in the other indices of alias,
+// the upserted docs are keyed by alias and index
+func removeUpsertedCopies(upserted map[string]map[string][]string) {
+	for alias, indexIds := range upserted {
+		for index, ids := range indexIds {
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+			_, err := store.DeleteByQuery(ctx, elastic.NewBoolQuery().
+				Must(elastic.NewIdsQuery().Ids(ids...)).
+				MustNot(elastic.NewTermQuery("_index", index)), alias)
+			cancel()
+			if err != nil {
+				beego.Warn("failed to remove the copies of upserted docs in " + alias + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// splitBulkId returns the id in BulkIdField of doc and the source without it, the id is empty if not exists
+func splitBulkId(doc map[string]interface{}) (string, map[string]interface{}) {
+	id, ok := doc[BulkIdField].(string)
+	if !ok {
+		return "", doc
+	}
+	source := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		if key != BulkIdField {
+			source[key] = value
+		}
+	}
+	return id, source
+}
+
+// isRetryableBulkItem returns whether the rejected item may succeed later, like the full queue of ES,
+// the deleted write index is created again in the retry
+func isRetryableBulkItem(status int, errorType string) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError ||
+		errorType == "es_rejected_execution_exception" || errorType == "index_not_found_exception"
 }
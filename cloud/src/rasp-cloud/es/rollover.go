@@ -0,0 +1,340 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package es
+
+import (
+	"context"
+	"github.com/astaxie/beego"
+	"rasp-cloud/conf"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"encoding/json"
+	"errors"
+	"github.com/olivere/elastic"
+)
+
+// the indices of each app roll over by date, like openrasp-attack-alarm-<app_id>-2019.01,
+// all of them are behind the alias real-openrasp-attack-alarm-<app_id> for searching,
+// the documents of the legacy index openrasp-attack-alarm-<app_id> are moved to the rolling indices,
+// the expired rolling indices are deleted by the index lifecycle policy of ElasticSearch if it is supported
+
+const (
+	RolloverPeriodDay   = "day"
+	RolloverPeriodMonth = "month"
+	AliasIndexPrefix    = "real-"
+	migrateBatchSize    = 1000
+	lifecyclePolicyName = "openrasp-delete-after-"
+)
+
+// lifecycleStore is the log store which deletes the indices by the index lifecycle policies
+type lifecycleStore interface {
+	// PutLifecyclePolicy puts the policy which deletes the index after the duration since its origination date
+	PutLifecyclePolicy(name string, deleteAfter time.Duration) error
+	SetIndexLifecycle(index string, policy string, origination time.Time) error
+}
+
+type rolloverPeriod struct {
+	format string
+	start  func(t time.Time) time.Time
+	next   func(start time.Time) time.Time
+}
+
+var (
+	rolloverPeriods = map[string]*rolloverPeriod{
+		RolloverPeriodDay: {
+			format: "2006.01.02",
+			start: func(t time.Time) time.Time {
+				return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			},
+			next: func(start time.Time) time.Time {
+				return start.AddDate(0, 0, 1)
+			},
+		},
+		RolloverPeriodMonth: {
+			format: "2006.01",
+			start: func(t time.Time) time.Time {
+				return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+			},
+			next: func(start time.Time) time.Time {
+				return start.AddDate(0, 1, 0)
+			},
+		},
+	}
+	// the rolling indices which have been created with alias
+	rollingIndices     = make(map[string]bool)
+	rollingIndicesLock sync.Mutex
+	// the lifecycle policies which have been put
+	lifecyclePolicies     = make(map[string]bool)
+	lifecyclePoliciesLock sync.Mutex
+)
+
+// GetAliasName returns the alias of the rolling indices of the app
+func GetAliasName(index string, appId string) string {
+	return AliasIndexPrefix + index + "-" + appId
+}
+
+// GetRollingIndexName returns the name of the rolling index that the time belongs to
+func GetRollingIndexName(index string, appId string, t time.Time) string {
+	period := getRolloverPeriod()
+	return index + "-" + appId + "-" + period.start(t.UTC()).Format(period.format)
+}
+
+// GetWriteIndex returns the rolling index of current period, the index is created with the alias if not exists,
+// the documents must be written to it instead of the alias which has more than one index
+func GetWriteIndex(index string, appId string) (string, error) {
+	return GetRollingIndex(index, appId, time.Now())
+}
+
+// GetRollingIndex returns the rolling index that the time belongs to, the index is created with the alias
+// if not exists, so that the documents are written to the index of their own time
+func GetRollingIndex(index string, appId string, t time.Time) (string, error) {
+	name := GetRollingIndexName(index, appId, t)
+	rollingIndicesLock.Lock()
+	defer rollingIndicesLock.Unlock()
+	if rollingIndices[name] {
+		return name, nil
+	}
+	err := createRollingIndex(name, GetAliasName(index, appId))
+	if err != nil {
+		return "", err
+	}
+	rollingIndices[name] = true
+	return name, nil
+}
+
+// forgetRollingIndex removes the deleted index from the created rolling indices, it is created again when it is used
+func forgetRollingIndex(name string) {
+	rollingIndicesLock.Lock()
+	defer rollingIndicesLock.Unlock()
+	delete(rollingIndices, name)
+}
+
+// CreateRollingIndex creates the rolling index of current period for the app
+func CreateRollingIndex(index string, appId string) error {
+	_, err := GetWriteIndex(index, appId)
+	return err
+}
+
+func createRollingIndex(name string, alias string) error {
+	err := store.CreateIndex(name, alias)
+	if err != nil {
+		beego.Error("failed to create index with name " + name + ": " + err.Error())
+		return err
+	}
+	beego.Info("create es index: " + name)
+	return nil
+}
+
+// getRollingIndexPeriod returns the start and end time of the rolling index,
+// ok is false if the index is not a rolling index
+func getRollingIndexPeriod(name string, prefix string) (start time.Time, end time.Time, ok bool) {
+	suffix := strings.TrimPrefix(name, prefix)
+	if suffix == name {
+		return
+	}
+	for _, period := range rolloverPeriods {
+		start, err := time.ParseInLocation(period.format, suffix, time.UTC)
+		if err == nil {
+			return start, period.next(start), true
+		}
+	}
+	return
+}
+
+// deleteExpiredIndices deletes the rolling indices of the app which all documents are expired,
+// the indices are deleted by the lifecycle policy of the retention if it is supported,
+// the expired documents of the index which is partly expired are deleted by query,
+// so that no document is kept longer than the retention whatever the rollover period is,
+// the legacy index is deleted after its documents are moved to the rolling indices
+func deleteExpiredIndices(index string, appId string, indices []string, duration time.Duration) {
+	now := time.Now()
+	expiredTime := now.Add(-duration)
+	writeIndex := GetRollingIndexName(index, appId, now)
+	legacyIndex := index + "-" + appId
+	for _, name := range indices {
+		if name == legacyIndex {
+			migrateLegacyIndex(index, appId, name, duration)
+			continue
+		}
+		start, end, ok := getRollingIndexPeriod(name, legacyIndex+"-")
+		if !ok {
+			continue
+		}
+		// the policy is applied every time because the retention of app may change
+		lifecycle := applyLifecycle(name, end, duration)
+		if end.After(expiredTime) {
+			if start.Before(expiredTime) {
+				deleteExpiredDocs(name, expiredTime)
+			}
+			continue
+		}
+		if lifecycle || name == writeIndex {
+			continue
+		}
+		deleteIndex(name)
+	}
+}
+
+// deleteExpiredDocs deletes the documents of the index which @timestamp is before the expired time
+func deleteExpiredDocs(name string, expiredTime time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Minute))
+	defer cancel()
+	count, err := store.DeleteByQuery(ctx,
+		elastic.NewRangeQuery("@timestamp").Lt(expiredTime.UnixNano()/int64(time.Millisecond)), name)
+	if err != nil {
+		beego.Error("failed to delete the expired docs of index " + name + ": " + err.Error())
+		return
+	}
+	if count > 0 {
+		beego.Info("delete " + strconv.FormatInt(count, 10) + " expired docs of index " + name)
+	}
+}
+
+// applyLifecycle sets the lifecycle policy which deletes the index after the retention since the end of its period,
+// false is returned if the lifecycle is not supported or failed to be set
+func applyLifecycle(name string, end time.Time, duration time.Duration) bool {
+	lifecycle, ok := store.(lifecycleStore)
+	if !ok || !Cluster.SupportLifecycle() {
+		return false
+	}
+	policy := lifecyclePolicyName + strconv.FormatInt(int64(duration/time.Hour), 10) + "h"
+	lifecyclePoliciesLock.Lock()
+	defer lifecyclePoliciesLock.Unlock()
+	if !lifecyclePolicies[policy] {
+		if err := lifecycle.PutLifecyclePolicy(policy, duration); err != nil {
+			beego.Error("failed to put the lifecycle policy " + policy + ": " + err.Error())
+			return false
+		}
+		lifecyclePolicies[policy] = true
+	}
+	if err := lifecycle.SetIndexLifecycle(name, policy, end); err != nil {
+		beego.Error("failed to set the lifecycle policy of index " + name + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// migrateLegacyIndex moves the unexpired documents of the legacy index to the rolling indices of their @timestamp
+// with the same ids, the legacy index is deleted after all of them are moved, the interrupted migration
+// is done again in the next time
+func migrateLegacyIndex(index string, appId string, name string, duration time.Duration) {
+	docType := strings.TrimPrefix(index, "openrasp-")
+	expiredTime := time.Now().Add(-duration).UnixNano() / int64(time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := make([]elastic.BulkableRequest, 0, migrateBatchSize)
+	flush := func() error {
+		if len(requests) == 0 {
+			return nil
+		}
+		response, err := store.Bulk(ctx, requests...)
+		if err != nil {
+			return err
+		}
+		for _, item := range response.Failed() {
+			reason := "unknown error of bulk item"
+			if item.Error != nil {
+				reason = item.Error.Type + ": " + item.Error.Reason
+			}
+			return errors.New("failed to move the doc " + item.Id + ": " + reason)
+		}
+		requests = requests[:0]
+		return nil
+	}
+	count := 0
+	err := Scan(name).
+		Query(elastic.NewRangeQuery("@timestamp").Gte(expiredTime)).
+		Size(migrateBatchSize).
+		Do(ctx, func(hit *elastic.SearchHit) error {
+			if hit.Source == nil {
+				return nil
+			}
+			var doc struct {
+				Timestamp interface{} `json:"@timestamp"`
+			}
+			if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+				return err
+			}
+			t, ok := parseTimestamp(doc.Timestamp)
+			if !ok {
+				t = time.Now()
+			}
+			target, err := GetRollingIndex(index, appId, t)
+			if err != nil {
+				return err
+			}
+			requests = append(requests, elastic.NewBulkIndexRequest().
+				Index(target).
+				Type(BulkDocType(docType)).
+				Id(hit.Id).
+				Doc(hit.Source))
+			count++
+			if len(requests) >= migrateBatchSize {
+				return flush()
+			}
+			return nil
+		})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		beego.Error("failed to move the docs of legacy index " + name + ": " + err.Error())
+		return
+	}
+	beego.Info("move " + strconv.Itoa(count) + " docs of legacy index " + name + " to the rolling indices")
+	deleteIndex(name)
+}
+
+// parseTimestamp parses the @timestamp in milliseconds or the date string
+func parseTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case int64:
+		return time.Unix(0, v*int64(time.Millisecond)), true
+	case float64:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)), true
+	case json.Number:
+		return parseTimestamp(v.String())
+	case string:
+		if millis, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(0, millis*int64(time.Millisecond)), true
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func deleteIndex(name string) {
+	err := store.DeleteIndex(name)
+	if err != nil {
+		beego.Error("failed to delete expired index " + name + ": " + err.Error())
+		return
+	}
+	rollingIndicesLock.Lock()
+	delete(rollingIndices, name)
+	rollingIndicesLock.Unlock()
+	beego.Info("delete index successfully: " + name)
+}
+
+func getRolloverPeriod() *rolloverPeriod {
+	if period, ok := rolloverPeriods[conf.AppConfig.EsIndexRolloverPeriod]; ok {
+		return period
+	}
+	return rolloverPeriods[RolloverPeriodMonth]
+}
@@ -0,0 +1,131 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package es
+
+import (
+	"context"
+	"github.com/olivere/elastic"
+	"rasp-cloud/storage"
+)
+
+// the searches of logs are built like the services of elastic client and executed by the log store
+
+const defaultSearchSize = 10
+
+// SearchService searches the logs of the indices or aliases
+type SearchService struct {
+	search *storage.LogSearch
+}
+
+// CountService counts the logs of the indices or aliases
+type CountService struct {
+	indices []string
+	query   elastic.Query
+}
+
+// ScanService iterates all logs of the search in batches
+type ScanService struct {
+	search *storage.LogSearch
+}
+
+func Search(indices ...string) *SearchService {
+	return &SearchService{search: &storage.LogSearch{Indices: indices, Size: defaultSearchSize}}
+}
+
+func (s *SearchService) Query(query elastic.Query) *SearchService {
+	s.search.Query = query
+	return s
+}
+
+func (s *SearchService) Aggregation(name string, aggr elastic.Aggregation) *SearchService {
+	if s.search.Aggregations == nil {
+		s.search.Aggregations = make(map[string]elastic.Aggregation)
+	}
+	s.search.Aggregations[name] = aggr
+	return s
+}
+
+func (s *SearchService) FetchSourceContext(source *elastic.FetchSourceContext) *SearchService {
+	s.search.Source = source
+	return s
+}
+
+func (s *SearchService) Sort(field string, ascending bool) *SearchService {
+	s.search.Sorters = append(s.search.Sorters, elastic.SortInfo{Field: field, Ascending: ascending})
+	return s
+}
+
+func (s *SearchService) SortBy(sorters ...elastic.Sorter) *SearchService {
+	s.search.Sorters = append(s.search.Sorters, sorters...)
+	return s
+}
+
+func (s *SearchService) From(from int) *SearchService {
+	s.search.From = from
+	return s
+}
+
+func (s *SearchService) Size(size int) *SearchService {
+	s.search.Size = size
+	return s
+}
+
+func (s *SearchService) Do(ctx context.Context) (*elastic.SearchResult, error) {
+	return store.Search(ctx, s.search)
+}
+
+func Count(indices ...string) *CountService {
+	return &CountService{indices: indices}
+}
+
+func (s *CountService) Query(query elastic.Query) *CountService {
+	s.query = query
+	return s
+}
+
+func (s *CountService) Do(ctx context.Context) (int64, error) {
+	return store.Count(ctx, s.query, s.indices...)
+}
+
+func Scan(indices ...string) *ScanService {
+	return &ScanService{search: &storage.LogSearch{Indices: indices, Size: defaultSearchSize}}
+}
+
+func (s *ScanService) Query(query elastic.Query) *ScanService {
+	s.search.Query = query
+	return s
+}
+
+func (s *ScanService) Sort(field string, ascending bool) *ScanService {
+	s.search.Sorters = append(s.search.Sorters, elastic.SortInfo{Field: field, Ascending: ascending})
+	return s
+}
+
+func (s *ScanService) FetchSourceContext(source *elastic.FetchSourceContext) *ScanService {
+	s.search.Source = source
+	return s
+}
+
+// Size sets the count of logs in each batch
+func (s *ScanService) Size(size int) *ScanService {
+	s.search.Size = size
+	return s
+}
+
+// Do calls the handler with each log in order until all logs are handled or the handler returns an error
+func (s *ScanService) Do(ctx context.Context, handler func(hit *elastic.SearchHit) error) error {
+	return store.Scan(ctx, s.search, handler)
+}
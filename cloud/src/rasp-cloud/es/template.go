@@ -14,14 +14,27 @@
 
 package es
 
-import "rasp-cloud/conf"
+import (
+	"encoding/json"
+	"errors"
+	"rasp-cloud/conf"
+	"sync"
+)
+
+// TemplateField describes a searchable field in the mapping of es template
+type TemplateField struct {
+	Name string
+	Type string
+	// the path of the nested object that the field belongs to
+	NestedPath string
+	Lowercase  bool
+	// the max length of keyword value which is indexed, 0 means no limit
+	IgnoreAbove int
+}
 
 var attackAlarmTemplate = `
 		{
 			"template":"openrasp-attack-alarm-*",
-			"aliases" : {
-        		"real-{index}" : {} 
-    		},
 			"settings": {
 				"analysis": {
 					"normalizer": {
@@ -41,6 +54,9 @@ var attackAlarmTemplate = `
 						"@timestamp":{
 							"type":"date"
 						},
+						"index_time":{
+							"type":"date"
+						},
 						"request_method": {
 							"type": "keyword",
 							"ignore_above": 50
@@ -147,6 +163,26 @@ var attackAlarmTemplate = `
 								}
 							}
 						},
+						"attack_intel": {
+							"type": "object",
+							"properties": {
+								"asn":{
+									"type": "long"
+								},
+								"as_org":{
+									"type": "keyword",
+									"ignore_above": 256
+								},
+								"reputation":{
+									"type": "keyword",
+									"ignore_above": 256
+								},
+								"zone":{
+									"type": "keyword",
+									"ignore_above": 256
+								}
+							}
+						},
 						"plugin_algorithm":{
 							"type": "keyword",
 							"ignore_above": 256
@@ -186,9 +222,6 @@ var attackAlarmTemplate = `
 var policyAlarmTemplate = `
 		{
 			"template":"openrasp-policy-alarm-*",
-			"aliases" : {
-        		"real-{index}" : {} 
-    		},
 			"settings": {
 				"analysis": {
 					"normalizer": {
@@ -269,9 +302,6 @@ var policyAlarmTemplate = `
 		`
 var errorAlarmTemplate = `{
 			"template":"openrasp-error-alarm-*",
-			"aliases" : {
-        		"real-{index}" : {} 
-    		},
 			"settings": {
 				"analysis": {
 					"normalizer": {
@@ -344,9 +374,6 @@ var errorAlarmTemplate = `{
 var reportDataTemplate = `
 		{
 			"template":"openrasp-report-data-*",
-			"aliases" : {
-        		"real-{index}" : {} 
-    		},
 			"mappings": {
 				"report-data": {
 					"_all": {
@@ -372,11 +399,84 @@ var reportDataTemplate = `
 		}
 	`
 
+var (
+	templates = map[string]string{
+		"report-data":  reportDataTemplate,
+		"error-alarm":  errorAlarmTemplate,
+		"attack-alarm": attackAlarmTemplate,
+		"policy-alarm": policyAlarmTemplate,
+	}
+	templateFields     = make(map[string]map[string]*TemplateField)
+	templateFieldsLock sync.Mutex
+)
+
 func init() {
 	if *conf.AppConfig.Flag.StartType != conf.StartTypeReset {
-		CreateTemplate("report-data-template", reportDataTemplate)
-		CreateTemplate("error-alarm-template", errorAlarmTemplate)
-		CreateTemplate("attack-alarm-template", attackAlarmTemplate)
-		CreateTemplate("policy-alarm-template", policyAlarmTemplate)
+		CreateTemplate("report-data-template", "report-data", reportDataTemplate)
+		CreateTemplate("error-alarm-template", "error-alarm", errorAlarmTemplate)
+		CreateTemplate("attack-alarm-template", "attack-alarm", attackAlarmTemplate)
+		CreateTemplate("policy-alarm-template", "policy-alarm", policyAlarmTemplate)
+	}
+}
+
+// GetTemplateFields returns the searchable fields of the es type, the key is the full path of field
+func GetTemplateFields(esType string) (map[string]*TemplateField, error) {
+	templateFieldsLock.Lock()
+	defer templateFieldsLock.Unlock()
+	if fields, ok := templateFields[esType]; ok {
+		return fields, nil
+	}
+	template, ok := templates[esType]
+	if !ok {
+		return nil, errors.New("can not find the es template of type: " + esType)
+	}
+	var content struct {
+		Mappings map[string]struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	err := json.Unmarshal([]byte(template), &content)
+	if err != nil {
+		return nil, errors.New("failed to parse the es template of type " + esType + ": " + err.Error())
+	}
+	fields := make(map[string]*TemplateField)
+	if mapping, ok := content.Mappings[esType]; ok {
+		parseTemplateFields(mapping.Properties, "", "", fields)
+	}
+	templateFields[esType] = fields
+	return fields, nil
+}
+
+func parseTemplateFields(properties map[string]interface{}, prefix string, nestedPath string,
+	fields map[string]*TemplateField) {
+	for name, value := range properties {
+		property, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if enabled, ok := property["enabled"]; ok && (enabled == false || enabled == "false") {
+			continue
+		}
+		fieldType, _ := property["type"].(string)
+		if subProperties, ok := property["properties"].(map[string]interface{}); ok {
+			subNestedPath := nestedPath
+			if fieldType == "nested" {
+				subNestedPath = prefix + name
+			}
+			parseTemplateFields(subProperties, prefix+name+".", subNestedPath, fields)
+			continue
+		}
+		if fieldType == "" || name[0] == '@' {
+			continue
+		}
+		_, lowercase := property["normalizer"]
+		ignoreAbove, _ := property["ignore_above"].(float64)
+		fields[prefix+name] = &TemplateField{
+			Name:        prefix + name,
+			Type:        fieldType,
+			NestedPath:  nestedPath,
+			Lowercase:   lowercase,
+			IgnoreAbove: int(ignoreAbove),
+		}
 	}
 }
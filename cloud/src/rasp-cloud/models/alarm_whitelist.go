@@ -0,0 +1,211 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"rasp-cloud/models/logs"
+	"strings"
+)
+
+type AlarmWhitelistSuggestion struct {
+	Alarm           map[string]interface{} `json:"alarm"`
+	Item            *WhitelistConfigItem   `json:"item"`
+	SuppressedCount int64                  `json:"suppressed_count"`
+	Exists          bool                   `json:"exists"`
+}
+
+const (
+	whitelistHookAll      = "all"
+	maxWhitelistItems     = 200
+	maxWhitelistUrlLength = 200
+)
+
+// GetAlarmWhitelistUrl returns the whitelist url of the attack alarm, which is the url without scheme and query,
+// the agent matches the whitelist url with the prefix of request url in the same form
+func GetAlarmWhitelistUrl(alarm map[string]interface{}) (string, error) {
+	rawUrl, _ := alarm["url"].(string)
+	if rawUrl == "" {
+		return "", errors.New("the alarm has no url")
+	}
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", errors.New("failed to parse the url of alarm: " + err.Error())
+	}
+	if parsedUrl.Host == "" {
+		return "", errors.New("the url of alarm has no host: " + rawUrl)
+	}
+	whitelistUrl := parsedUrl.Host + parsedUrl.EscapedPath()
+	if len(whitelistUrl) > maxWhitelistUrlLength {
+		whitelistUrl = whitelistUrl[:maxWhitelistUrlLength]
+	}
+	return whitelistUrl, nil
+}
+
+// GetAlarmWhitelistSuggestion derives the whitelist item from the attack alarm, the item can be replaced by
+// the given item, and the count of historical alarms suppressed by the item is returned
+func GetAlarmWhitelistSuggestion(appId string, alarmId string,
+	item *WhitelistConfigItem) (*AlarmWhitelistSuggestion, error) {
+	alarm, err := logs.GetAlarmById(&logs.AttackAlarmInfo, appId, alarmId)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		whitelistUrl, err := GetAlarmWhitelistUrl(alarm)
+		if err != nil {
+			return nil, err
+		}
+		attackType := fmt.Sprint(alarm["attack_type"])
+		item = &WhitelistConfigItem{Url: whitelistUrl, Hook: map[string]bool{attackType: true}}
+	}
+	item.AlarmId = alarmId
+	err = validAlarmWhitelistItem(alarm, item)
+	if err != nil {
+		return nil, err
+	}
+	attackTypes := make([]string, 0, len(item.Hook))
+	if !item.Hook[whitelistHookAll] {
+		for hookType, isWhite := range item.Hook {
+			if isWhite {
+				attackTypes = append(attackTypes, hookType)
+			}
+		}
+	}
+	count, err := logs.CountAttackWithUrlPrefix(appId, item.Url, attackTypes)
+	if err != nil {
+		return nil, errors.New("failed to count the suppressed alarms: " + err.Error())
+	}
+	app, err := GetAppById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return &AlarmWhitelistSuggestion{
+		Alarm:           alarm,
+		Item:            item,
+		SuppressedCount: count,
+		Exists:          isWhitelistCovered(app.WhitelistConfig, item),
+	}, nil
+}
+
+// ApplyAlarmWhitelist adds the whitelist item of the alarm to the app, the hooks are merged into the item
+// with the same url, and the alarm is triaged as false positive
+func ApplyAlarmWhitelist(appId string, alarmId string, item *WhitelistConfigItem,
+	user string) (*App, *AlarmWhitelistSuggestion, error) {
+	suggestion, err := GetAlarmWhitelistSuggestion(appId, alarmId, item)
+	if err != nil {
+		return nil, nil, err
+	}
+	app, err := GetAppById(appId)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := make([]WhitelistConfigItem, 0, len(app.WhitelistConfig)+1)
+	isMerged := false
+	for _, configItem := range app.WhitelistConfig {
+		if configItem.Url == suggestion.Item.Url {
+			if configItem.Hook == nil {
+				configItem.Hook = make(map[string]bool)
+			}
+			for hookType, isWhite := range suggestion.Item.Hook {
+				if isWhite {
+					configItem.Hook[hookType] = true
+				}
+			}
+			if configItem.AlarmId == "" {
+				configItem.AlarmId = alarmId
+			}
+			isMerged = true
+		}
+		config = append(config, configItem)
+	}
+	if !isMerged {
+		config = append(config, *suggestion.Item)
+	}
+	if len(config) > maxWhitelistItems {
+		return nil, nil, errors.New("the count of whitelist config items can not be greater than 200")
+	}
+	app, err = UpdateWhiteListConfig(appId, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	triage, err := GetTriage(appId, TriageTargetEvent, alarmId)
+	if err != nil {
+		return nil, nil, err
+	}
+	triage.State = TriageStateFalsePositive
+	if _, err = UpdateTriage(triage); err != nil {
+		return nil, nil, err
+	}
+	_, err = AddTriageComment(appId, TriageTargetEvent, alarmId, &TriageComment{
+		User:    user,
+		Content: "Added to the whitelist: " + suggestion.Item.Url,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return app, suggestion, nil
+}
+
+func validAlarmWhitelistItem(alarm map[string]interface{}, item *WhitelistConfigItem) error {
+	if item.Url == "" || len(item.Url) > maxWhitelistUrlLength {
+		return errors.New("the length of whitelist url must be between [1,200]")
+	}
+	if strings.HasPrefix(item.Url, "http://") || strings.HasPrefix(item.Url, "https://") {
+		return errors.New("the whitelist url can not start with http:// or https://")
+	}
+	whitelistUrl, err := GetAlarmWhitelistUrl(alarm)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.ToLower(whitelistUrl), strings.ToLower(item.Url)) {
+		return errors.New("the whitelist url " + item.Url + " does not cover the url of alarm: " + whitelistUrl)
+	}
+	attackType := fmt.Sprint(alarm["attack_type"])
+	if !item.Hook[whitelistHookAll] && !item.Hook[attackType] {
+		return errors.New("the whitelist hooks do not contain the attack type of alarm: " + attackType)
+	}
+	for hookType := range item.Hook {
+		if len(hookType) > 128 {
+			return errors.New("the length of hook's type can not be greater 128")
+		}
+	}
+	return nil
+}
+
+// isWhitelistCovered checks whether the whitelist has covered the url and hooks of the item
+func isWhitelistCovered(config []WhitelistConfigItem, item *WhitelistConfigItem) bool {
+	for _, configItem := range config {
+		if !strings.HasPrefix(item.Url, configItem.Url) {
+			continue
+		}
+		if configItem.Hook[whitelistHookAll] {
+			return true
+		}
+		isCovered := true
+		for hookType, isWhite := range item.Hook {
+			if isWhite && !configItem.Hook[hookType] {
+				isCovered = false
+				break
+			}
+		}
+		if isCovered {
+			return true
+		}
+	}
+	return false
+}
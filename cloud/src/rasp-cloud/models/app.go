@@ -26,19 +26,12 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"rasp-cloud/models/logs"
 	"github.com/astaxie/beego"
-	"net/smtp"
-	"os"
-	"net/mail"
 	"strings"
-	"html/template"
-	"bytes"
 	"github.com/astaxie/beego/httplib"
 	"errors"
 	"crypto/sha256"
 	"encoding/base64"
 	"io/ioutil"
-	"crypto/tls"
-	"net"
 	"rasp-cloud/conf"
 	"net/url"
 	"crypto/md5"
@@ -62,18 +55,42 @@ type App struct {
 }
 
 type WhitelistConfigItem struct {
-	Url  string          `json:"url" bson:"url"`
-	Hook map[string]bool `json:"hook" bson:"hook"`
+	Url     string          `json:"url" bson:"url"`
+	Hook    map[string]bool `json:"hook" bson:"hook"`
+	AlarmId string          `json:"alarm_id,omitempty" bson:"alarm_id,omitempty"`
 }
 
 type EmailAlarmConf struct {
-	Enable     bool     `json:"enable" bson:"enable"`
-	ServerAddr string   `json:"server_addr" bson:"server_addr"`
-	UserName   string   `json:"username" bson:"username"`
-	Password   string   `json:"password" bson:"password"`
-	Subject    string   `json:"subject" bson:"subject"`
-	RecvAddr   []string `json:"recv_addr" bson:"recv_addr"`
-	TlsEnable  bool     `json:"tls_enable" bson:"tls_enable"`
+	Enable     bool              `json:"enable" bson:"enable"`
+	ServerAddr string            `json:"server_addr" bson:"server_addr"`
+	UserName   string            `json:"username" bson:"username"`
+	Password   string            `json:"password" bson:"password"`
+	Subject    string            `json:"subject" bson:"subject"`
+	RecvAddr   []string          `json:"recv_addr" bson:"recv_addr"`
+	TlsEnable  bool              `json:"tls_enable" bson:"tls_enable"`
+	Locale     string            `json:"locale" bson:"locale"`
+	RecvLocale []EmailRecvLocale `json:"recv_locale" bson:"recv_locale"`
+	// explicit tls with the STARTTLS command, the default port is 587
+	StartTlsEnable bool           `json:"starttls_enable" bson:"starttls_enable"`
+	TlsCaCert      string         `json:"tls_ca_cert" bson:"tls_ca_cert"`
+	TlsSkipVerify  bool           `json:"tls_skip_verify" bson:"tls_skip_verify"`
+	AuthType       string         `json:"auth_type" bson:"auth_type"`
+	OAuthConf      EmailOAuthConf `json:"oauth_conf" bson:"oauth_conf"`
+}
+
+// EmailOAuthConf is used to refresh the access token of XOAUTH2,
+// the email password is used as the access token when the token_url is empty
+type EmailOAuthConf struct {
+	TokenUrl     string `json:"token_url" bson:"token_url"`
+	ClientId     string `json:"client_id" bson:"client_id"`
+	ClientSecret string `json:"client_secret" bson:"client_secret"`
+	RefreshToken string `json:"refresh_token" bson:"refresh_token"`
+}
+
+// EmailRecvLocale overrides the email locale of the app for a single receiving address
+type EmailRecvLocale struct {
+	Addr   string `json:"addr" bson:"addr"`
+	Locale string `json:"locale" bson:"locale"`
 }
 
 type DingAlarmConf struct {
@@ -95,6 +112,7 @@ type emailTemplateParam struct {
 	Alarms       []map[string]interface{}
 	DetailedLink string
 	AppName      string
+	Locale       string
 	HttpPort     int
 }
 
@@ -177,7 +195,8 @@ func initApp() error {
 		if err != nil {
 			tools.Panic(tools.ErrCodeESInitFailed, "failed to init es index for app "+app.Name, err)
 		}
-		if *conf.AppConfig.Flag.StartType != conf.StartTypeAgent {
+		if *conf.AppConfig.Flag.StartType != conf.StartTypeAgent &&
+			*conf.AppConfig.Flag.StartType != conf.StartTypeBackfill {
 			initPlugin(app)
 		}
 	}
@@ -364,10 +383,8 @@ func GetAppById(id string) (app *App, err error) {
 }
 
 func GetSecretByAppId(appId string) (secret string, err error) {
-	newSession := mongo.NewSession()
-	defer newSession.Close()
 	var result *App
-	err = newSession.DB(mongo.DbName).C(appCollectionName).FindId(appId).Select(bson.M{"secret": 1}).One(&result)
+	err = mongo.FindIdWithSelect(appCollectionName, appId, &result, bson.M{"secret": 1})
 	if err != nil {
 		return
 	}
@@ -392,6 +409,12 @@ func HandleApp(app *App, isCreate bool) error {
 	if app.EmailAlarmConf.RecvAddr == nil {
 		app.EmailAlarmConf.RecvAddr = make([]string, 0)
 	}
+	if app.EmailAlarmConf.RecvLocale == nil {
+		app.EmailAlarmConf.RecvLocale = make([]EmailRecvLocale, 0)
+	}
+	if app.EmailAlarmConf.Locale == "" {
+		app.EmailAlarmConf.Locale = DefaultEmailLocale
+	}
 	if app.DingAlarmConf.RecvParty == nil {
 		app.DingAlarmConf.RecvParty = make([]string, 0)
 	}
@@ -402,9 +425,7 @@ func HandleApp(app *App, isCreate bool) error {
 		app.HttpAlarmConf.RecvAddr = make([]string, 0)
 	}
 	if !isCreate {
-		if app.EmailAlarmConf.Password != "" {
-			app.EmailAlarmConf.Password = SecreteMask
-		}
+		maskEmailConf(&app.EmailAlarmConf)
 		if app.DingAlarmConf.CorpSecret != "" {
 			app.DingAlarmConf.CorpSecret = SecreteMask
 		}
@@ -498,80 +519,28 @@ func getTestAlarmData() []map[string]interface{} {
 func PushEmailAttackAlarm(app *App, total int64, alarms []map[string]interface{}, isTest bool) error {
 	var emailConf = app.EmailAlarmConf
 	if len(emailConf.RecvAddr) > 0 && emailConf.ServerAddr != "" {
-		var (
-			subject   string
-			msg       string
-			emailAddr = &mail.Address{Address: emailConf.UserName}
-		)
-		hostName, err := os.Hostname()
-		if err == nil {
-			emailAddr.Name = hostName
-		} else {
-			emailAddr.Name = "OpenRASP"
-		}
-		if emailConf.Subject == "" {
-			subject = "OpenRASP alarm"
-		} else {
-			subject = emailConf.Subject
-		}
 		if isTest {
-			subject = "【测试邮件】" + subject
 			alarms = getTestAlarmData()
 			total = int64(len(alarms))
 		}
-		head := map[string]string{
-			"from":              emailAddr.String(),
-			"To":                strings.Join(emailConf.RecvAddr, ","),
-			"Subject":           subject,
-			"Content-Type":      "text/html; charset=UTF-8",
-			"X-Priority":        "3",
-			"X-MSMail-Priority": "Normal",
-			"X-Mailer":          "Microsoft Outlook Express 6.00.2900.2869",
-			"X-MimeOLE":         "Produced By Microsoft MimeOLE V6.00.2900.2869",
-			"ReturnReceipt":     "1",
-		}
-		t, err := template.ParseFiles("views/email.tpl")
-		if err != nil {
-			beego.Error("failed to render email template: " + err.Error())
-			return err
-		}
-		alarmData := new(bytes.Buffer)
-		panelUrl, port := getPanelServerUrl()
-		handleAlarms(alarms)
-		err = t.Execute(alarmData, &emailTemplateParam{
-			Total:        total - int64(len(alarms)),
-			Alarms:       alarms,
-			AppName:      app.Name,
-			DetailedLink: panelUrl + "/#/events/" + app.Id,
-			HttpPort:     port,
-		})
-		if err != nil {
-			beego.Error("failed to execute email template: " + err.Error())
-			return err
-		}
-		for k, v := range head {
-			msg += fmt.Sprintf("%s: %s\r\n", k, v)
-		}
-		msg += "\r\n" + alarmData.String()
-		if !strings.Contains(emailConf.ServerAddr, ":") {
-			if emailConf.TlsEnable {
-				emailConf.ServerAddr += ":465"
-			} else {
-				emailConf.ServerAddr += ":25"
+		var lastErr error
+		for _, locale := range GetEmailLocales() {
+			recvAddr := getEmailRecvAddrByLocale(emailConf, locale)
+			if len(recvAddr) == 0 {
+				continue
+			}
+			msg, err := buildEmailMessage(app, locale, recvAddr, total, alarms, isTest)
+			if err != nil {
+				beego.Error("failed to build " + locale + " email alarm: " + err.Error())
+				lastErr = err
+				continue
+			}
+			err = sendEmail(emailConf, recvAddr, msg)
+			if err != nil {
+				lastErr = err
 			}
 		}
-		host, _, err := net.SplitHostPort(emailConf.ServerAddr)
-		if err != nil {
-			return handleError("failed to get email serve host: " + err.Error())
-		}
-		auth := smtp.PlainAuth("", emailConf.UserName, emailConf.Password, host)
-		if emailConf.Password == "" {
-			auth = nil
-		}
-		if emailConf.TlsEnable {
-			return sendEmailWithTls(emailConf, auth, msg)
-		}
-		return sendNormalEmail(emailConf, auth, msg)
+		return lastErr
 	} else {
 		beego.Error(
 			"failed to send email alarm: the email receiving address and email server address can not be empty", emailConf)
@@ -579,17 +548,99 @@ func PushEmailAttackAlarm(app *App, total int64, alarms []map[string]interface{}
 	}
 }
 
-func handleAlarms(alarms []map[string]interface{}) {
-	for index, alarm := range alarms {
+// getEmailRecvAddrByLocale returns the receiving addresses that read the email in the given locale
+func getEmailRecvAddrByLocale(emailConf EmailAlarmConf, locale string) []string {
+	defaultLocale := emailConf.Locale
+	if !IsValidEmailLocale(defaultLocale) {
+		defaultLocale = DefaultEmailLocale
+	}
+	recvLocales := make(map[string]string, len(emailConf.RecvLocale))
+	for _, item := range emailConf.RecvLocale {
+		if IsValidEmailLocale(item.Locale) {
+			recvLocales[item.Addr] = item.Locale
+		}
+	}
+	result := make([]string, 0, len(emailConf.RecvAddr))
+	for _, addr := range emailConf.RecvAddr {
+		addrLocale, ok := recvLocales[addr]
+		if !ok {
+			addrLocale = defaultLocale
+		}
+		if addrLocale == locale {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+func getEmailSubject(emailConf EmailAlarmConf, locale string, isTest bool) string {
+	subject := emailConf.Subject
+	if subject == "" {
+		subject = getEmailLocale(locale).DefaultSubject
+	}
+	if isTest {
+		subject = getEmailLocale(locale).TestPrefix + subject
+	}
+	return subject
+}
+
+func buildEmailMessage(app *App, locale string, recvAddr []string, total int64,
+	alarms []map[string]interface{}, isTest bool) (string, error) {
+	var (
+		emailConf = app.EmailAlarmConf
+		emailAddr = getEmailSender(emailConf)
+	)
+	emailTemplate, err := GetEmailTemplate(app.Id, locale)
+	if err != nil {
+		return "", errors.New("failed to get email template: " + err.Error())
+	}
+	panelUrl, port := getPanelServerUrl()
+	localeAlarms := handleAlarms(alarms, locale)
+	subject, content, err := renderEmailTemplate(emailTemplate, &emailTemplateParam{
+		Total:        total - int64(len(localeAlarms)),
+		Alarms:       localeAlarms,
+		AppName:      app.Name,
+		Locale:       locale,
+		DetailedLink: getDetailedLink(panelUrl, app.Id),
+		HttpPort:     port,
+	})
+	if err != nil {
+		return "", err
+	}
+	if subject == "" {
+		subject = getEmailSubject(emailConf, locale, isTest)
+	} else if isTest {
+		subject = getEmailLocale(locale).TestPrefix + subject
+	}
+	csvContent, err := buildAlarmCsv(localeAlarms)
+	if err != nil {
+		return "", errors.New("failed to build alarm csv: " + err.Error())
+	}
+	return buildMimeEmail(emailAddr, recvAddr, subject, content, []emailAttachment{{
+		Name:        "openrasp-alarms-" + time.Now().Format("20060102150405") + ".csv",
+		ContentType: "text/csv; charset=UTF-8",
+		Content:     csvContent,
+	}})
+}
+
+// handleAlarms returns copies of the alarms with the display fields localized, the origin alarms are not changed
+func handleAlarms(alarms []map[string]interface{}, locale string) []map[string]interface{} {
+	emailLocale := getEmailLocale(locale)
+	result := make([]map[string]interface{}, len(alarms))
+	for index, origin := range alarms {
+		alarm := make(map[string]interface{}, len(origin)+2)
+		for k, v := range origin {
+			alarm[k] = v
+		}
 		alarm["index"] = index + 1
-		if intercept, ok := logs.AttackInterceptMap[alarm["intercept_state"]]; ok {
+		if intercept, ok := emailLocale.InterceptTypes[alarm["intercept_state"]]; ok {
 			alarm["intercept_state"] = intercept
 		}
 
-		if attackType, ok := logs.AttackTypeMap[alarm["attack_type"]]; ok {
+		if attackType, ok := emailLocale.AttackTypes[alarm["attack_type"]]; ok {
 			alarm["attack_type"] = attackType
 		} else {
-			alarm["attack_type"] = "其他类型"
+			alarm["attack_type"] = emailLocale.OtherType
 		}
 
 		if alarm["url"] != nil {
@@ -600,7 +651,9 @@ func handleAlarms(alarms []map[string]interface{}) {
 				}
 			}
 		}
+		result[index] = alarm
 	}
+	return result
 }
 
 func getPanelServerUrl() (string, int) {
@@ -618,56 +671,12 @@ func getPanelServerUrl() (string, int) {
 	return serverUrl.PanelUrl, port
 }
 
-func sendNormalEmail(emailConf EmailAlarmConf, auth smtp.Auth, msg string) (err error) {
-	err = smtp.SendMail(emailConf.ServerAddr, auth, emailConf.UserName, emailConf.RecvAddr, []byte(msg))
-	if err != nil {
-		beego.Error("failed to push email alarms: " + err.Error())
-		return
+// getDetailedLink returns the link of the alarms of app in the panel, it is empty if the panel url is not set
+func getDetailedLink(panelUrl string, appId string) string {
+	if panelUrl == "" {
+		return ""
 	}
-	return
-}
-
-func sendEmailWithTls(emailConf EmailAlarmConf, auth smtp.Auth, msg string) error {
-	client, err := smtpTlsDial(emailConf.ServerAddr)
-	if err != nil {
-		return handleError("failed to start tls: " + err.Error())
-	}
-	if client.Text != nil {
-		defer client.Close()
-	}
-	if auth != nil {
-		if ok, _ := client.Extension("AUTH"); ok {
-			if err = client.Auth(auth); err != nil {
-				return handleError("failed to auth with tls: " + err.Error())
-			}
-		}
-	}
-	if err = client.Mail(emailConf.UserName); err != nil {
-		return handleError("failed to mail from 'emailConf.UserName': " + err.Error())
-	}
-
-	for _, addr := range emailConf.RecvAddr {
-		if err = client.Rcpt(addr); err != nil {
-			return handleError("failed to push email to " + addr + " with tls: " + err.Error())
-		}
-	}
-
-	writer, err := client.Data()
-	if err != nil {
-		return handleError("failed to get writer for email with tls: " + err.Error())
-	}
-	defer writer.Close()
-
-	_, err = writer.Write([]byte(msg))
-	if err != nil {
-		return handleError("failed to write msg with tls: " + err.Error())
-	}
-
-	if client.Text != nil {
-		client.Quit()
-	}
-
-	return nil
+	return panelUrl + "/#/events/" + appId
 }
 
 func handleError(msg string) error {
@@ -675,18 +684,6 @@ func handleError(msg string) error {
 	return errors.New(msg)
 }
 
-func smtpTlsDial(addr string) (*smtp.Client, error) {
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return nil, handleError("failed to get email serve host: " + err.Error())
-	}
-	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 5}, "tcp", addr, nil)
-	if err != nil {
-		return nil, handleError("smtp dialing error: " + err.Error())
-	}
-	return smtp.NewClient(conn, host)
-}
-
 func PushHttpAttackAlarm(app *App, total int64, alarms []map[string]interface{}, isTest bool) error {
 	var httpConf = app.HttpAlarmConf
 	if len(httpConf.RecvAddr) != 0 {
@@ -0,0 +1,72 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"os"
+	"rasp-cloud/conf"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/tools"
+	"time"
+)
+
+func init() {
+	if *conf.AppConfig.Flag.StartType != conf.StartTypeBackfill {
+		return
+	}
+	filter, err := getBackfillFilter(conf.AppConfig.Flag)
+	if err != nil {
+		tools.Panic(tools.ErrCodeBackfillFailed, "invalid backfill params", err)
+	}
+	if filter.AppId != "" {
+		if _, err := GetAppById(filter.AppId); err != nil {
+			tools.Panic(tools.ErrCodeBackfillFailed, "failed to get the app "+filter.AppId, err)
+		}
+	}
+	result, err := logs.Backfill(filter)
+	logs.PrintBackfillResult(result)
+	if err != nil {
+		tools.Panic(tools.ErrCodeBackfillFailed, "failed to backfill the alarm files, it can run again", err)
+	}
+	os.Exit(0)
+}
+
+// getBackfillFilter parses the dates of backfill in local time zone, the end date is included
+func getBackfillFilter(flag *conf.Flag) (*logs.BackfillFilter, error) {
+	filter := &logs.BackfillFilter{}
+	if flag.BackfillApp != nil {
+		filter.AppId = *flag.BackfillApp
+	}
+	if flag.BackfillStart != nil && *flag.BackfillStart != "" {
+		start, err := time.ParseInLocation("2006-01-02", *flag.BackfillStart, time.Local)
+		if err != nil {
+			return nil, errors.New("the start date must be like 2019-01-01: " + err.Error())
+		}
+		filter.StartTime = start.UnixNano() / 1000000
+	}
+	if flag.BackfillEnd != nil && *flag.BackfillEnd != "" {
+		end, err := time.ParseInLocation("2006-01-02", *flag.BackfillEnd, time.Local)
+		if err != nil {
+			return nil, errors.New("the end date must be like 2019-01-31: " + err.Error())
+		}
+		filter.EndTime = end.AddDate(0, 0, 1).UnixNano()/1000000 - 1
+	}
+	if filter.StartTime > 0 && filter.EndTime > 0 && filter.StartTime > filter.EndTime {
+		return nil, errors.New("the start date can not be after the end date")
+	}
+	return filter, nil
+}
@@ -0,0 +1,616 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"html/template"
+	"rasp-cloud/conf"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"strconv"
+	"time"
+)
+
+type Digest struct {
+	Id            string         `json:"id" bson:"_id"`
+	Name          string         `json:"name" bson:"name"`
+	AppId         string         `json:"app_id" bson:"app_id"`
+	Enable        bool           `json:"enable" bson:"enable"`
+	Period        string         `json:"period" bson:"period"`
+	Hour          int            `json:"hour" bson:"hour"`
+	Weekday       int            `json:"weekday" bson:"weekday"`
+	TimeZone      string         `json:"time_zone" bson:"time_zone"`
+	TopSize       int            `json:"top_size" bson:"top_size"`
+	SavedSearchId string         `json:"saved_search_id" bson:"saved_search_id"`
+	EmailConf     EmailAlarmConf `json:"email_conf" bson:"email_conf"`
+	CreateTime    int64          `json:"create_time" bson:"create_time"`
+	LastSendTime  int64          `json:"last_send_time" bson:"last_send_time"`
+	// the error of the last failed sending, it is cleared after the digest is sent
+	LastError string `json:"last_error" bson:"last_error"`
+	// the time when a server starts to send the digest, the other servers skip it until the lock expires
+	LockTime int64 `json:"-" bson:"lock_time"`
+	// the locales which have been sent in the period ending at SentPeriod,
+	// only the failed locales are sent again in the same period
+	SentLocales []string `json:"-" bson:"sent_locales,omitempty"`
+	SentPeriod  int64    `json:"-" bson:"sent_period,omitempty"`
+}
+
+type DigestReport struct {
+	Name      string
+	Period    string
+	StartTime string
+	EndTime   string
+	Labels    map[string]string
+	Apps      []*DigestAppReport
+}
+
+type DigestAppReport struct {
+	AppId           string
+	AppName         string
+	AttackTotal     int64
+	AttackTypes     [][]interface{}
+	InterceptStates [][]interface{}
+	TopSources      [][]interface{}
+	TopUrls         [][]interface{}
+	TopUserAgents   [][]interface{}
+	NewVulns        []map[string]interface{}
+	RaspTotal       int
+	RaspOnline      int
+	OnlineRatio     string
+	RequestSum      int64
+}
+
+const (
+	digestCollectionName = "digest"
+	DigestPeriodDaily    = "daily"
+	DigestPeriodWeekly   = "weekly"
+	digestTemplateFile   = "views/digest.tpl"
+	// the failed digest is sent again after the lock expires
+	digestLockTime = 10 * time.Minute
+)
+
+var (
+	DigestPeriods = []string{DigestPeriodDaily, DigestPeriodWeekly}
+	digestLabels  = map[string]map[string]string{
+		EmailLocaleZhCn: {
+			"title":        "OpenRASP 安全报告",
+			"daily":        "日报",
+			"weekly":       "周报",
+			"period":       "统计周期",
+			"app":          "应用",
+			"attack_total": "攻击总数",
+			"attack_type":  "攻击类型",
+			"intercept":    "拦截状态",
+			"source":       "攻击来源",
+			"url":          "攻击目标",
+			"user_agent":   "User-Agent",
+			"new_vuln":     "新增漏洞",
+			"first_time":   "首次发现",
+			"count":        "次数",
+			"rasp_online":  "主机在线率",
+			"request_sum":  "请求总数",
+			"none":         "无",
+		},
+		EmailLocaleEnUs: {
+			"title":        "OpenRASP Security Digest",
+			"daily":        "Daily",
+			"weekly":       "Weekly",
+			"period":       "Period",
+			"app":          "App",
+			"attack_total": "Total attacks",
+			"attack_type":  "Attack type",
+			"intercept":    "Intercept state",
+			"source":       "Attack source",
+			"url":          "Target URL",
+			"user_agent":   "User-Agent",
+			"new_vuln":     "New vulnerabilities",
+			"first_time":   "First seen",
+			"count":        "Count",
+			"rasp_online":  "Agent online ratio",
+			"request_sum":  "Total requests",
+			"none":         "None",
+		},
+	}
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"app_id"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id",
+	}
+	err := mongo.CreateIndex(digestCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id index for digest collection", err)
+	}
+	if *conf.AppConfig.Flag.StartType == conf.StartTypeDefault ||
+		*conf.AppConfig.Flag.StartType == conf.StartTypeForeground {
+		go startDigestTicker(time.Minute)
+	}
+}
+
+func startDigestTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			HandleDigests()
+		}
+	}
+}
+
+// HandleDigests sends the digests whose latest scheduled time has not been sent yet
+func HandleDigests() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to handle digest: ", r)
+		}
+	}()
+	var digests []*Digest
+	_, err := mongo.FindAllWithoutLimit(digestCollectionName, bson.M{"enable": true}, &digests)
+	if err != nil {
+		beego.Error("failed to get digests: " + err.Error())
+		return
+	}
+	now := time.Now()
+	for _, digest := range digests {
+		startTime, endTime, err := GetDigestPeriod(digest, now)
+		if err != nil {
+			beego.Error("failed to get the period of digest " + digest.Name + ": " + err.Error())
+			continue
+		}
+		if digest.LastSendTime >= endTime {
+			continue
+		}
+		// lock the digest first so that only one server sends it, the send time is updated after it is sent
+		locked, err := lockDigest(digest.Id, endTime, now)
+		if err != nil {
+			beego.Error("failed to lock digest " + digest.Name + ": " + err.Error())
+			continue
+		}
+		if !locked {
+			continue
+		}
+		// the sent locales may be updated by another server before the lock
+		digest, err = GetDigestById(digest.Id, false)
+		if err != nil {
+			beego.Error("failed to get the locked digest: " + err.Error())
+			continue
+		}
+		sentLocales := make([]string, 0)
+		if digest.SentPeriod == endTime {
+			sentLocales = append(sentLocales, digest.SentLocales...)
+		}
+		sent, err := sendDigestLocales(digest, startTime, endTime, sentLocales)
+		if err != nil {
+			beego.Error("failed to send digest " + digest.Name + ", the failed locales will be sent again after " +
+				digestLockTime.String() + ": " + err.Error())
+			err = mongo.UpdateId(digestCollectionName, digest.Id, bson.M{
+				"last_error":   err.Error(),
+				"sent_locales": append(sentLocales, sent...),
+				"sent_period":  endTime,
+			})
+		} else {
+			err = mongo.Update(digestCollectionName, bson.M{"_id": digest.Id},
+				bson.M{"$set": bson.M{"last_send_time": endTime, "last_error": ""},
+					"$unset": bson.M{"lock_time": 1, "sent_locales": 1, "sent_period": 1}})
+		}
+		if err != nil {
+			beego.Error("failed to update the send result of digest " + digest.Name + ": " + err.Error())
+		}
+	}
+}
+
+// lockDigest locks the digest which is not sent until the send time, the lock of a failed or crashed
+// server expires after digestLockTime
+func lockDigest(id string, sendTime int64, now time.Time) (bool, error) {
+	err := mongo.Update(digestCollectionName,
+		bson.M{
+			"_id":            id,
+			"last_send_time": bson.M{"$lt": sendTime},
+			"$or": []bson.M{
+				{"lock_time": bson.M{"$exists": false}},
+				{"lock_time": bson.M{"$lt": now.Add(-digestLockTime).UnixNano() / 1000000}},
+			},
+		},
+		bson.M{"$set": bson.M{"lock_time": now.UnixNano() / 1000000}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetDigestPeriod returns the latest finished period of the digest before the given time, in milliseconds
+func GetDigestPeriod(digest *Digest, now time.Time) (startTime int64, endTime int64, err error) {
+	location, err := time.LoadLocation(digest.TimeZone)
+	if err != nil {
+		return 0, 0, err
+	}
+	localNow := now.In(location)
+	scheduled := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), digest.Hour, 0, 0, 0, location)
+	// the periods are calendar days of the time zone, which are not 24 hours across the daylight saving time
+	var days int
+	switch digest.Period {
+	case DigestPeriodDaily:
+		days = 1
+		if scheduled.After(localNow) {
+			scheduled = scheduled.AddDate(0, 0, -1)
+		}
+	case DigestPeriodWeekly:
+		days = 7
+		scheduled = scheduled.AddDate(0, 0, -((int(localNow.Weekday()) - digest.Weekday + 7) % 7))
+		if scheduled.After(localNow) {
+			scheduled = scheduled.AddDate(0, 0, -7)
+		}
+	default:
+		return 0, 0, errors.New("unsupported digest period: " + digest.Period)
+	}
+	endTime = scheduled.UnixNano() / 1000000
+	startTime = scheduled.AddDate(0, 0, -days).UnixNano() / 1000000
+	return
+}
+
+func AddDigest(digest *Digest) (*Digest, error) {
+	digest.Id = mongo.GenerateObjectId()
+	digest.CreateTime = time.Now().Unix()
+	// the first digest is sent at the next scheduled time
+	_, endTime, err := GetDigestPeriod(digest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	digest.LastSendTime = endTime
+	err = mongo.Insert(digestCollectionName, digest)
+	if err != nil {
+		return nil, err
+	}
+	HandleDigest(digest)
+	return digest, nil
+}
+
+func UpdateDigest(digest *Digest) (*Digest, error) {
+	_, endTime, err := GetDigestPeriod(digest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	err = mongo.UpdateId(digestCollectionName, digest.Id, bson.M{
+		"name":            digest.Name,
+		"app_id":          digest.AppId,
+		"enable":          digest.Enable,
+		"period":          digest.Period,
+		"hour":            digest.Hour,
+		"weekday":         digest.Weekday,
+		"time_zone":       digest.TimeZone,
+		"top_size":        digest.TopSize,
+		"saved_search_id": digest.SavedSearchId,
+		"email_conf":      digest.EmailConf,
+		"last_send_time":  endTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetDigestById(digest.Id, true)
+}
+
+func GetDigestById(id string, mask bool) (digest *Digest, err error) {
+	err = mongo.FindId(digestCollectionName, id, &digest)
+	if err == nil && mask {
+		HandleDigest(digest)
+	}
+	return
+}
+
+func GetDigests(appId string, page int, perpage int) (count int, result []*Digest, err error) {
+	query := bson.M{}
+	if appId != "" {
+		query["app_id"] = appId
+	}
+	count, err = mongo.FindAll(digestCollectionName, query, &result, perpage*(page-1), perpage, "-create_time")
+	if err == nil {
+		for _, digest := range result {
+			HandleDigest(digest)
+		}
+	}
+	if result == nil {
+		result = make([]*Digest, 0)
+	}
+	return
+}
+
+func RemoveDigestById(id string) (digest *Digest, err error) {
+	digest, err = GetDigestById(id, true)
+	if err != nil {
+		return
+	}
+	return digest, mongo.RemoveId(digestCollectionName, id)
+}
+
+func RemoveDigestByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(digestCollectionName, bson.M{"app_id": appId})
+	return
+}
+
+func HandleDigest(digest *Digest) {
+	maskEmailConf(&digest.EmailConf)
+	if digest.EmailConf.RecvAddr == nil {
+		digest.EmailConf.RecvAddr = make([]string, 0)
+	}
+	if digest.EmailConf.RecvLocale == nil {
+		digest.EmailConf.RecvLocale = make([]EmailRecvLocale, 0)
+	}
+	if digest.EmailConf.Locale == "" {
+		digest.EmailConf.Locale = DefaultEmailLocale
+	}
+}
+
+// BuildDigestReport collects the statistics of the digest apps in [startTime, endTime)
+func BuildDigestReport(digest *Digest, startTime int64, endTime int64, locale string) (*DigestReport, error) {
+	var apps []*App
+	if digest.AppId != "" {
+		app, err := GetAppById(digest.AppId)
+		if err != nil {
+			return nil, errors.New("failed to get the app of digest: " + err.Error())
+		}
+		apps = []*App{app}
+	} else {
+		_, err := mongo.FindAllWithSelect(appCollectionName, nil, &apps, bson.M{"name": 1}, 0, 0)
+		if err != nil {
+			return nil, errors.New("failed to get apps: " + err.Error())
+		}
+	}
+	var query map[string]interface{}
+	if digest.SavedSearchId != "" {
+		search, err := GetSavedSearchById(digest.SavedSearchId)
+		if err != nil {
+			return nil, errors.New("failed to get the saved search of digest: " + err.Error())
+		}
+		if query, err = GetSavedSearchQuery(search); err != nil {
+			return nil, errors.New("invalid saved search of digest: " + err.Error())
+		}
+	}
+	location, err := time.LoadLocation(digest.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	labels, ok := digestLabels[locale]
+	if !ok {
+		labels = digestLabels[DefaultEmailLocale]
+	}
+	report := &DigestReport{
+		Name:      digest.Name,
+		Period:    labels[digest.Period],
+		StartTime: time.Unix(0, startTime*1000000).In(location).Format("2006-01-02 15:04"),
+		EndTime:   time.Unix(0, endTime*1000000).In(location).Format("2006-01-02 15:04"),
+		Labels:    labels,
+		Apps:      make([]*DigestAppReport, 0, len(apps)),
+	}
+	topSize := digest.TopSize
+	if topSize <= 0 {
+		topSize = 10
+	}
+	// the range of es aggregations is inclusive
+	endTime = endTime - 1
+	// es only accepts the offset or the iana name of the time zone
+	timeZone := time.Unix(0, startTime*1000000).In(location).Format("-07:00")
+	for _, app := range apps {
+		appReport, err := buildDigestAppReport(app, startTime, endTime, topSize, query, location, timeZone, locale)
+		if err != nil {
+			return nil, err
+		}
+		report.Apps = append(report.Apps, appReport)
+	}
+	return report, nil
+}
+
+func buildDigestAppReport(app *App, startTime int64, endTime int64, topSize int, query map[string]interface{},
+	location *time.Location, timeZone string, locale string) (appReport *DigestAppReport, err error) {
+	appReport = &DigestAppReport{AppId: app.Id, AppName: app.Name}
+	emailLocale := getEmailLocale(locale)
+	if appReport.AttackTypes, err =
+		logs.AggregationAttackWithQuery(startTime, endTime, "attack_type", topSize, query, app.Id); err != nil {
+		return nil, errors.New("failed to aggregate attack type: " + err.Error())
+	}
+	for _, item := range appReport.AttackTypes {
+		if count, ok := item[1].(int64); ok {
+			appReport.AttackTotal += count
+		}
+		if attackType, ok := emailLocale.AttackTypes[item[0]]; ok {
+			item[0] = attackType
+		}
+	}
+	if appReport.InterceptStates, err =
+		logs.AggregationAttackWithQuery(startTime, endTime, "intercept_state", topSize, query, app.Id); err != nil {
+		return nil, errors.New("failed to aggregate intercept state: " + err.Error())
+	}
+	for _, item := range appReport.InterceptStates {
+		if intercept, ok := emailLocale.InterceptTypes[item[0]]; ok {
+			item[0] = intercept
+		}
+	}
+	if appReport.TopSources, err =
+		logs.AggregationAttackWithQuery(startTime, endTime, "attack_source", topSize, query, app.Id); err != nil {
+		return nil, errors.New("failed to aggregate attack source: " + err.Error())
+	}
+	if appReport.TopUrls, err =
+		logs.AggregationAttackWithQuery(startTime, endTime, "url", topSize, query, app.Id); err != nil {
+		return nil, errors.New("failed to aggregate url: " + err.Error())
+	}
+	if appReport.TopUserAgents, err =
+		logs.AggregationAttackWithQuery(startTime, endTime, "user_agent", topSize, query, app.Id); err != nil {
+		return nil, errors.New("failed to aggregate user agent: " + err.Error())
+	}
+	if appReport.NewVulns, err = logs.GetNewVulns(startTime, endTime, query, app.Id); err != nil {
+		return nil, errors.New("failed to get new vulnerabilities: " + err.Error())
+	}
+	for _, vuln := range appReport.NewVulns {
+		if attackType, ok := emailLocale.AttackTypes[vuln["attack_type"]]; ok {
+			vuln["attack_type"] = attackType
+		}
+		if firstTime, ok := vuln["first_time"].(int64); ok {
+			vuln["first_time"] = time.Unix(0, firstTime*1000000).In(location).Format("2006-01-02 15:04:05")
+		}
+	}
+	if appReport.RaspTotal, appReport.RaspOnline, err = GetRaspOnlineCount(app.Id); err != nil {
+		return nil, errors.New("failed to get rasp count: " + err.Error())
+	}
+	if appReport.RaspTotal > 0 {
+		appReport.OnlineRatio = fmt.Sprintf("%.1f%%", float64(appReport.RaspOnline)*100/float64(appReport.RaspTotal))
+	} else {
+		appReport.OnlineRatio = "-"
+	}
+	err, requestSums := GetHistoryRequestSum(startTime, endTime, "day", timeZone, app.Id)
+	if err != nil {
+		return nil, errors.New("failed to get request sum: " + err.Error())
+	}
+	for _, item := range requestSums {
+		if sum, ok := item["request_sum"].(*float64); ok && sum != nil {
+			appReport.RequestSum += int64(*sum)
+		}
+	}
+	return appReport, nil
+}
+
+func RenderDigestHtml(report *DigestReport) (string, error) {
+	t, err := template.ParseFiles(digestTemplateFile)
+	if err != nil {
+		return "", errors.New("failed to parse digest template: " + err.Error())
+	}
+	content := new(bytes.Buffer)
+	err = t.Execute(content, report)
+	if err != nil {
+		return "", errors.New("failed to execute digest template: " + err.Error())
+	}
+	return content.String(), nil
+}
+
+func RenderDigestCsv(report *DigestReport) ([]byte, error) {
+	content := new(bytes.Buffer)
+	// BOM makes the utf-8 content readable for excel
+	content.WriteString("\xEF\xBB\xBF")
+	writer := csv.NewWriter(content)
+	writer.Write([]string{"app_id", "app_name", "section", "key", "value"})
+	for _, app := range report.Apps {
+		// the keys like url and user_agent are controlled by the attacker
+		writeRow := func(section string, key interface{}, value interface{}) {
+			writer.Write([]string{app.AppId, logs.EscapeCsvCell(app.AppName), section,
+				logs.EscapeCsvCell(fmt.Sprint(key)), logs.EscapeCsvCell(fmt.Sprint(value))})
+		}
+		writeRow("summary", "attack_total", app.AttackTotal)
+		writeRow("summary", "request_sum", app.RequestSum)
+		writeRow("summary", "rasp_total", app.RaspTotal)
+		writeRow("summary", "rasp_online", app.RaspOnline)
+		// the sections are written in the order of the html report
+		sections := []struct {
+			name  string
+			items [][]interface{}
+		}{
+			{"attack_type", app.AttackTypes},
+			{"intercept_state", app.InterceptStates},
+			{"attack_source", app.TopSources},
+			{"url", app.TopUrls},
+			{"user_agent", app.TopUserAgents},
+		}
+		for _, section := range sections {
+			for _, item := range section.items {
+				writeRow(section.name, item[0], item[1])
+			}
+		}
+		for _, vuln := range app.NewVulns {
+			writeRow("new_vuln", vuln["stack_md5"], fmt.Sprintf("%v %v %v",
+				vuln["attack_type"], vuln["url"], vuln["attack_count"]))
+		}
+	}
+	writer.Flush()
+	return content.Bytes(), writer.Error()
+}
+
+// SendDigest renders the digest of [startTime, endTime) and sends it to the receiving addresses
+func SendDigest(digest *Digest, startTime int64, endTime int64) error {
+	_, err := sendDigestLocales(digest, startTime, endTime, nil)
+	return err
+}
+
+// sendDigestLocales sends the digest to the receiving addresses of each locale except the skipped locales,
+// the locales which are sent successfully are returned with the last error
+func sendDigestLocales(digest *Digest, startTime int64, endTime int64,
+	skipLocales []string) (sent []string, lastErr error) {
+	emailConf := digest.EmailConf
+	if len(emailConf.RecvAddr) == 0 || emailConf.ServerAddr == "" {
+		return nil, errors.New("the email receiving address and email server address can not be empty")
+	}
+	skipped := make(map[string]bool, len(skipLocales))
+	for _, locale := range skipLocales {
+		skipped[locale] = true
+	}
+	sent = make([]string, 0)
+	for _, locale := range GetEmailLocales() {
+		recvAddr := getEmailRecvAddrByLocale(emailConf, locale)
+		if len(recvAddr) == 0 || skipped[locale] {
+			continue
+		}
+		err := sendDigestLocale(digest, startTime, endTime, locale, recvAddr)
+		if err != nil {
+			beego.Error("failed to send digest " + digest.Name + " to the locale " + locale + ": " + err.Error())
+			lastErr = err
+			continue
+		}
+		sent = append(sent, locale)
+	}
+	if lastErr == nil {
+		beego.Info("succeed in sending digest: " + digest.Name)
+	}
+	return sent, lastErr
+}
+
+func sendDigestLocale(digest *Digest, startTime int64, endTime int64, locale string, recvAddr []string) error {
+	emailConf := digest.EmailConf
+	report, err := BuildDigestReport(digest, startTime, endTime, locale)
+	if err != nil {
+		return err
+	}
+	html, err := RenderDigestHtml(report)
+	if err != nil {
+		return err
+	}
+	csvContent, err := RenderDigestCsv(report)
+	if err != nil {
+		return err
+	}
+	subject := emailConf.Subject
+	if subject == "" {
+		subject = report.Labels["title"] + " - " + digest.Name
+	}
+	msg, err := buildMimeEmail(getEmailSender(emailConf), recvAddr,
+		subject+" ("+report.StartTime+" ~ "+report.EndTime+")", html,
+		[]emailAttachment{{
+			Name:        "openrasp-digest-" + strconv.FormatInt(endTime, 10) + ".csv",
+			ContentType: "text/csv; charset=UTF-8",
+			Content:     csvContent,
+		}})
+	if err != nil {
+		return err
+	}
+	return sendEmail(emailConf, recvAddr, msg)
+}
@@ -0,0 +1,431 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/httplib"
+	"html"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	EmailAuthTypePlain   = "plain"
+	EmailAuthTypeXOAuth2 = "xoauth2"
+)
+
+var (
+	EmailAuthTypes = []string{EmailAuthTypePlain, EmailAuthTypeXOAuth2}
+	// the columns of the alarm csv attachment
+	emailAlarmCsvFields = []string{"event_time", "attack_type", "intercept_state", "attack_source",
+		"target", "server_hostname", "url", "plugin_message", "stack_md5"}
+	htmlInvisibleRegex = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+	htmlLineBreakRegex = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|h[1-6]|li|table)>`)
+	htmlCellRegex      = regexp.MustCompile(`(?i)</t[dh]>`)
+	htmlTagRegex       = regexp.MustCompile(`<[^>]*>`)
+	blankLineRegex     = regexp.MustCompile(`\n\s*\n+`)
+	headerBreakRegex   = regexp.MustCompile(`[\r\n]+`)
+)
+
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+func getEmailSender(emailConf EmailAlarmConf) *mail.Address {
+	sender := &mail.Address{Address: emailConf.UserName}
+	hostName, err := os.Hostname()
+	if err == nil {
+		sender.Name = hostName
+	} else {
+		sender.Name = "OpenRASP"
+	}
+	return sender
+}
+
+// buildMimeEmail builds a multipart/mixed message, whose first part is a multipart/alternative
+// with the text fallback and the html content, followed by the attachments
+func buildMimeEmail(sender *mail.Address, recvAddr []string, subject string, htmlContent string,
+	attachments []emailAttachment) (string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	alternative := new(bytes.Buffer)
+	alternativeWriter := multipart.NewWriter(alternative)
+	err := writeQuotedPrintablePart(alternativeWriter, "text/plain; charset=UTF-8", htmlToText(htmlContent))
+	if err != nil {
+		return "", err
+	}
+	err = writeQuotedPrintablePart(alternativeWriter, "text/html; charset=UTF-8", htmlContent)
+	if err != nil {
+		return "", err
+	}
+	if err = alternativeWriter.Close(); err != nil {
+		return "", err
+	}
+	alternativeHeader := textproto.MIMEHeader{}
+	alternativeHeader.Set("Content-Type",
+		"multipart/alternative; boundary=\""+alternativeWriter.Boundary()+"\"")
+	part, err := writer.CreatePart(alternativeHeader)
+	if err != nil {
+		return "", err
+	}
+	if _, err = part.Write(alternative.Bytes()); err != nil {
+		return "", err
+	}
+
+	for _, attachment := range attachments {
+		attachmentHeader := textproto.MIMEHeader{}
+		attachmentHeader.Set("Content-Type", attachment.ContentType)
+		attachmentHeader.Set("Content-Transfer-Encoding", "base64")
+		attachmentHeader.Set("Content-Disposition",
+			mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		part, err := writer.CreatePart(attachmentHeader)
+		if err != nil {
+			return "", err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			if _, err = part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+				return "", err
+			}
+			encoded = encoded[76:]
+		}
+		if _, err = part.Write([]byte(encoded + "\r\n")); err != nil {
+			return "", err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+
+	msg := new(bytes.Buffer)
+	msg.WriteString("From: " + sender.String() + "\r\n")
+	msg.WriteString("To: " + strings.Join(recvAddr, ",") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("UTF-8", cleanEmailHeader(subject)) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: " + buildMessageId(sender.Address) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/mixed; boundary=\"" + writer.Boundary() + "\"\r\n")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.String(), nil
+}
+
+// cleanEmailHeader replaces the line breaks of the header value with spaces
+func cleanEmailHeader(value string) string {
+	return strings.TrimSpace(headerBreakRegex.ReplaceAllString(value, " "))
+}
+
+func writeQuotedPrintablePart(writer *multipart.Writer, contentType string, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qpWriter := quotedprintable.NewWriter(part)
+	if _, err = qpWriter.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qpWriter.Close()
+}
+
+func buildMessageId(senderAddr string) string {
+	domain := "openrasp"
+	if index := strings.LastIndex(senderAddr, "@"); index >= 0 && index < len(senderAddr)-1 {
+		domain = senderAddr[index+1:]
+	}
+	return fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), rand.Intn(10000), domain)
+}
+
+// htmlToText generates the text fallback of the html email content
+func htmlToText(content string) string {
+	content = htmlInvisibleRegex.ReplaceAllString(content, "")
+	content = htmlLineBreakRegex.ReplaceAllString(content, "\n")
+	content = htmlCellRegex.ReplaceAllString(content, "\t")
+	content = htmlTagRegex.ReplaceAllString(content, "")
+	content = html.UnescapeString(content)
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	content = blankLineRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(content) + "\n"
+}
+
+// buildAlarmCsv builds the csv attachment of the alarm batch
+func buildAlarmCsv(alarms []map[string]interface{}) ([]byte, error) {
+	content := new(bytes.Buffer)
+	// BOM makes the utf-8 content readable for excel
+	content.WriteString("\xEF\xBB\xBF")
+	writer := csv.NewWriter(content)
+	writer.Write(emailAlarmCsvFields)
+	for _, alarm := range alarms {
+		row := make([]string, len(emailAlarmCsvFields))
+		for i, field := range emailAlarmCsvFields {
+			if value, ok := alarm[field]; ok && value != nil {
+				row[i] = fmt.Sprint(value)
+			}
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return content.Bytes(), writer.Error()
+}
+
+// sendEmail delivers the message to the receiving addresses with the smtp server of the email conf
+func sendEmail(emailConf EmailAlarmConf, recvAddr []string, msg string) error {
+	if !strings.Contains(emailConf.ServerAddr, ":") {
+		if emailConf.TlsEnable {
+			emailConf.ServerAddr += ":465"
+		} else if emailConf.StartTlsEnable {
+			emailConf.ServerAddr += ":587"
+		} else {
+			emailConf.ServerAddr += ":25"
+		}
+	}
+	host, _, err := net.SplitHostPort(emailConf.ServerAddr)
+	if err != nil {
+		return handleError("failed to get email serve host: " + err.Error())
+	}
+	auth, err := getEmailAuth(emailConf, host)
+	if err != nil {
+		return handleError("failed to get email auth: " + err.Error())
+	}
+	emailConf.RecvAddr = recvAddr
+	return deliverEmail(emailConf, host, auth, msg)
+}
+
+func getEmailAuth(emailConf EmailAlarmConf, host string) (smtp.Auth, error) {
+	if emailConf.AuthType == EmailAuthTypeXOAuth2 {
+		token, err := getEmailOAuthToken(emailConf)
+		if err != nil {
+			return nil, err
+		}
+		return &xoauth2Auth{username: emailConf.UserName, token: token}, nil
+	}
+	if emailConf.Password == "" {
+		return nil, nil
+	}
+	return smtp.PlainAuth("", emailConf.UserName, emailConf.Password, host), nil
+}
+
+// getEmailOAuthToken gets the access token with the refresh token grant
+func getEmailOAuthToken(emailConf EmailAlarmConf) (string, error) {
+	oauthConf := emailConf.OAuthConf
+	if oauthConf.TokenUrl == "" {
+		if emailConf.Password == "" {
+			return "", errors.New("the access token of xoauth2 can not be empty")
+		}
+		return emailConf.Password, nil
+	}
+	request := httplib.Post(oauthConf.TokenUrl)
+	request.Param("grant_type", "refresh_token")
+	request.Param("client_id", oauthConf.ClientId)
+	request.Param("client_secret", oauthConf.ClientSecret)
+	request.Param("refresh_token", oauthConf.RefreshToken)
+	request.SetTimeout(10*time.Second, 10*time.Second)
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err := request.ToJSON(&result)
+	if err != nil {
+		return "", errors.New("failed to refresh the oauth token: " + err.Error())
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("failed to refresh the oauth token: " + result.Error + " " + result.ErrorDescription)
+	}
+	return result.AccessToken, nil
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism of gmail and outlook
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("xoauth2 requires a tls connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends the error detail, an empty response is required to get the final error
+		beego.Error("xoauth2 authentication failed: " + string(fromServer))
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func getEmailTlsConfig(emailConf EmailAlarmConf, host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: emailConf.TlsSkipVerify,
+	}
+	if emailConf.TlsCaCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(emailConf.TlsCaCert)) {
+			return nil, errors.New("failed to parse the tls ca cert")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// deliverEmail sends the message with the tls config of the email conf, the plain connection is
+// upgraded with STARTTLS if the server supports it, so that the ca cert and skip verify options
+// take effect for all modes
+func deliverEmail(emailConf EmailAlarmConf, host string, auth smtp.Auth, msg string) error {
+	tlsConfig, err := getEmailTlsConfig(emailConf, host)
+	if err != nil {
+		return handleError("failed to get tls config: " + err.Error())
+	}
+	var client *smtp.Client
+	if emailConf.TlsEnable {
+		client, err = smtpTlsDial(emailConf.ServerAddr, host, tlsConfig)
+	} else {
+		client, err = smtpStartTlsDial(emailConf.ServerAddr, host, tlsConfig, emailConf.StartTlsEnable)
+	}
+	if err != nil {
+		return handleError("failed to connect to smtp server: " + err.Error())
+	}
+	if client.Text != nil {
+		defer client.Close()
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err = client.Auth(auth); err != nil {
+				return handleError("failed to auth with smtp server: " + err.Error())
+			}
+		}
+	}
+	if err = client.Mail(emailConf.UserName); err != nil {
+		return handleError("failed to mail from " + emailConf.UserName + ": " + err.Error())
+	}
+
+	for _, addr := range emailConf.RecvAddr {
+		if err = client.Rcpt(addr); err != nil {
+			return handleError("failed to push email to " + addr + ": " + err.Error())
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return handleError("failed to get writer for email: " + err.Error())
+	}
+	_, err = writer.Write([]byte(msg))
+	if err != nil {
+		writer.Close()
+		return handleError("failed to write email msg: " + err.Error())
+	}
+	// the message is accepted by the server only when the data writer is closed
+	if err = writer.Close(); err != nil {
+		return handleError("failed to finish email msg: " + err.Error())
+	}
+	if client.Text != nil {
+		if err = client.Quit(); err != nil {
+			beego.Warn("failed to quit smtp session: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// smtpTlsDial dials the smtp server with implicit tls
+func smtpTlsDial(addr string, host string, tlsConfig *tls.Config) (*smtp.Client, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 5}, "tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, handleError("smtp dialing error: " + err.Error())
+	}
+	return smtp.NewClient(conn, host)
+}
+
+// smtpStartTlsDial dials the smtp server in plain text and upgrades the connection with STARTTLS,
+// the upgrade is opportunistic if STARTTLS is not required like smtp.SendMail
+func smtpStartTlsDial(addr string, host string, tlsConfig *tls.Config, required bool) (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		return nil, handleError("smtp dialing error: " + err.Error())
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if !required {
+			return client, nil
+		}
+		client.Close()
+		return nil, errors.New("the smtp server does not support STARTTLS")
+	}
+	if err = client.StartTLS(tlsConfig); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// maskEmailConf hides the secrets of the email conf
+func maskEmailConf(emailConf *EmailAlarmConf) {
+	if emailConf.Password != "" {
+		emailConf.Password = SecreteMask
+	}
+	if emailConf.OAuthConf.ClientSecret != "" {
+		emailConf.OAuthConf.ClientSecret = SecreteMask
+	}
+	if emailConf.OAuthConf.RefreshToken != "" {
+		emailConf.OAuthConf.RefreshToken = SecreteMask
+	}
+}
+
+// UnmaskEmailConf restores the masked secrets of the email conf with the old one
+func UnmaskEmailConf(emailConf *EmailAlarmConf, oldConf *EmailAlarmConf) {
+	if emailConf.Password == SecreteMask {
+		emailConf.Password = oldConf.Password
+	}
+	if emailConf.OAuthConf.ClientSecret == SecreteMask {
+		emailConf.OAuthConf.ClientSecret = oldConf.OAuthConf.ClientSecret
+	}
+	if emailConf.OAuthConf.RefreshToken == SecreteMask {
+		emailConf.OAuthConf.RefreshToken = oldConf.OAuthConf.RefreshToken
+	}
+}
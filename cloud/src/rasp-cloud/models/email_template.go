@@ -0,0 +1,247 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"rasp-cloud/mongo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/tools"
+	"rasp-cloud/models/logs"
+	"html/template"
+	textTemplate "text/template"
+	"io/ioutil"
+	"bytes"
+	"errors"
+	"time"
+)
+
+type EmailTemplate struct {
+	Id         string `json:"id" bson:"_id"`
+	AppId      string `json:"app_id" bson:"app_id"`
+	Locale     string `json:"locale" bson:"locale"`
+	Subject    string `json:"subject" bson:"subject"`
+	Content    string `json:"content" bson:"content"`
+	UpdateTime int64  `json:"update_time" bson:"update_time"`
+	IsDefault  bool   `json:"is_default" bson:"-"`
+}
+
+type EmailTemplateVariable struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type emailLocale struct {
+	TemplateFile   string
+	DefaultSubject string
+	TestPrefix     string
+	OtherType      string
+	AttackTypes    map[interface{}]string
+	InterceptTypes map[interface{}]string
+}
+
+const (
+	emailTemplateCollectionName = "email_template"
+	EmailLocaleZhCn             = "zh-CN"
+	EmailLocaleEnUs             = "en-US"
+	DefaultEmailLocale          = EmailLocaleZhCn
+)
+
+var (
+	emailLocales = map[string]*emailLocale{
+		EmailLocaleZhCn: {
+			TemplateFile:   "views/email.tpl",
+			DefaultSubject: "OpenRASP alarm",
+			TestPrefix:     "【测试邮件】",
+			OtherType:      "其他类型",
+			AttackTypes:    logs.AttackTypeMap,
+			InterceptTypes: logs.AttackInterceptMap,
+		},
+		EmailLocaleEnUs: {
+			TemplateFile:   "views/email_en_us.tpl",
+			DefaultSubject: "OpenRASP alarm",
+			TestPrefix:     "[TEST] ",
+			OtherType:      "Other",
+			AttackTypes:    logs.AttackTypeMapEnUs,
+			InterceptTypes: logs.AttackInterceptMapEnUs,
+		},
+	}
+
+	EmailTemplateVariables = []EmailTemplateVariable{
+		{"{{.AppName}}", "name of the app that the alarms belong to"},
+		{"{{.Locale}}", "locale used to render the email, zh-CN or en-US"},
+		{"{{.Total}}", "number of alarms in this period that are not listed in the email"},
+		{"{{.DetailedLink}}", "link to the alarm list of the app, empty if the panel url is not configured"},
+		{"{{.HttpPort}}", "http port of the cloud server"},
+		{"{{range .Alarms}}...{{end}}", "iterate over the alarms listed in the email"},
+		{"{{.index}}", "sequence number of the alarm, starts from 1 (inside range)"},
+		{"{{.id}}", "document id of the alarm (inside range)"},
+		{"{{.event_time}}", "time of the attack (inside range)"},
+		{"{{.attack_type}}", "localized attack type (inside range)"},
+		{"{{.intercept_state}}", "localized intercept state (inside range)"},
+		{"{{.attack_source}}", "source ip of the attack (inside range)"},
+		{"{{.url}}", "attacked url (inside range)"},
+		{"{{.domain}}", "host of the attacked url (inside range)"},
+	}
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"app_id", "locale"},
+		Unique:     true,
+		Background: true,
+		Name:       "app_id_locale",
+	}
+	err := mongo.CreateIndex(emailTemplateCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id_locale index for email_template collection", err)
+	}
+}
+
+func IsValidEmailLocale(locale string) bool {
+	_, ok := emailLocales[locale]
+	return ok
+}
+
+func GetEmailLocales() []string {
+	return []string{EmailLocaleZhCn, EmailLocaleEnUs}
+}
+
+func getEmailLocale(locale string) *emailLocale {
+	if l, ok := emailLocales[locale]; ok {
+		return l
+	}
+	return emailLocales[DefaultEmailLocale]
+}
+
+func getDefaultEmailTemplate(appId string, locale string) (*EmailTemplate, error) {
+	content, err := ioutil.ReadFile(getEmailLocale(locale).TemplateFile)
+	if err != nil {
+		return nil, errors.New("failed to read default email template: " + err.Error())
+	}
+	return &EmailTemplate{
+		AppId:     appId,
+		Locale:    locale,
+		Content:   string(content),
+		IsDefault: true,
+	}, nil
+}
+
+// GetEmailTemplate returns the template of the app for the locale, or the built-in one if it has not been edited.
+func GetEmailTemplate(appId string, locale string) (*EmailTemplate, error) {
+	var emailTemplate *EmailTemplate
+	err := mongo.FindOne(emailTemplateCollectionName, bson.M{"app_id": appId, "locale": locale}, &emailTemplate)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return getDefaultEmailTemplate(appId, locale)
+		}
+		return nil, err
+	}
+	return emailTemplate, nil
+}
+
+func UpsertEmailTemplate(emailTemplate *EmailTemplate) (*EmailTemplate, error) {
+	err := ValidEmailTemplate(emailTemplate.Subject, emailTemplate.Content)
+	if err != nil {
+		return nil, err
+	}
+	emailTemplate.Id = emailTemplate.AppId + "-" + emailTemplate.Locale
+	emailTemplate.UpdateTime = time.Now().UnixNano() / 1000000
+	emailTemplate.IsDefault = false
+	err = mongo.UpsertId(emailTemplateCollectionName, emailTemplate.Id, emailTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return emailTemplate, nil
+}
+
+func RemoveEmailTemplate(appId string, locale string) error {
+	err := mongo.RemoveId(emailTemplateCollectionName, appId+"-"+locale)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func RemoveEmailTemplateByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(emailTemplateCollectionName, bson.M{"app_id": appId})
+	return
+}
+
+func ValidEmailTemplate(subject string, content string) error {
+	if content == "" {
+		return errors.New("the content of email template can not be empty")
+	}
+	if _, err := template.New("email").Parse(content); err != nil {
+		return errors.New("invalid email template content: " + err.Error())
+	}
+	if _, err := textTemplate.New("subject").Parse(subject); err != nil {
+		return errors.New("invalid email template subject: " + err.Error())
+	}
+	return nil
+}
+
+func renderEmailTemplate(emailTemplate *EmailTemplate, param *emailTemplateParam) (subject string,
+	content string, err error) {
+	t, err := template.New("email").Parse(emailTemplate.Content)
+	if err != nil {
+		return "", "", errors.New("failed to parse email template: " + err.Error())
+	}
+	contentBuffer := new(bytes.Buffer)
+	err = t.Execute(contentBuffer, param)
+	if err != nil {
+		return "", "", errors.New("failed to execute email template: " + err.Error())
+	}
+	if emailTemplate.Subject != "" {
+		st, err := textTemplate.New("subject").Parse(emailTemplate.Subject)
+		if err != nil {
+			return "", "", errors.New("failed to parse email subject template: " + err.Error())
+		}
+		subjectBuffer := new(bytes.Buffer)
+		err = st.Execute(subjectBuffer, param)
+		if err != nil {
+			return "", "", errors.New("failed to execute email subject template: " + err.Error())
+		}
+		// the alarm fields in the subject may contain line breaks, which would inject email headers
+		subject = cleanEmailHeader(subjectBuffer.String())
+	}
+	return subject, contentBuffer.String(), nil
+}
+
+// PreviewEmailTemplate renders the template with the test alarm data.
+func PreviewEmailTemplate(app *App, emailTemplate *EmailTemplate) (subject string, content string, err error) {
+	alarms := handleAlarms(getTestAlarmData(), emailTemplate.Locale)
+	panelUrl, port := getPanelServerUrl()
+	param := &emailTemplateParam{
+		Total:        0,
+		Alarms:       alarms,
+		AppName:      app.Name,
+		Locale:       emailTemplate.Locale,
+		DetailedLink: getDetailedLink(panelUrl, app.Id),
+		HttpPort:     port,
+	}
+	subject, content, err = renderEmailTemplate(emailTemplate, param)
+	if err != nil {
+		return
+	}
+	if subject == "" {
+		subject = getEmailSubject(app.EmailAlarmConf, emailTemplate.Locale, true)
+	} else {
+		subject = getEmailLocale(emailTemplate.Locale).TestPrefix + subject
+	}
+	return
+}
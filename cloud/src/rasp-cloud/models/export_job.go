@@ -0,0 +1,317 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"os"
+	"path"
+	"rasp-cloud/conf"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"strconv"
+	"time"
+)
+
+type ExportJob struct {
+	Id         string   `json:"id" bson:"_id"`
+	AppId      string   `json:"app_id" bson:"app_id"`
+	LogType    string   `json:"log_type" bson:"log_type"`
+	Format     string   `json:"format" bson:"format"`
+	Columns    []string `json:"columns" bson:"columns"`
+	Status     string   `json:"status" bson:"status"`
+	Total      int64    `json:"total" bson:"total"`
+	Count      int64    `json:"count" bson:"count"`
+	FileSize   int64    `json:"file_size" bson:"file_size"`
+	Error      string   `json:"error" bson:"error"`
+	Host       string   `json:"host" bson:"host"`
+	CreateTime int64    `json:"create_time" bson:"create_time"`
+	FinishTime int64    `json:"finish_time" bson:"finish_time"`
+}
+
+// exportLock serializes the admission of the export jobs on a host
+type exportLock struct {
+	Id       string `bson:"_id"`
+	LockTime int64  `bson:"lock_time,omitempty"`
+}
+
+const (
+	exportJobCollectionName  = "export_job"
+	ExportJobStatusRunning   = "running"
+	ExportJobStatusSuccess   = "success"
+	ExportJobStatusFailed    = "failed"
+	exportDirName            = "openrasp-export"
+	maxRunningExportJobs     = 3
+	exportLockCollectionName = "export_lock"
+	exportLockTime           = time.Minute
+	exportLockRetryTimes     = 20
+	exportLockRetryInterval  = 100 * time.Millisecond
+)
+
+var exportHost string
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"app_id"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id",
+	}
+	err := mongo.CreateIndex(exportJobCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id index for export_job collection", err)
+	}
+	exportHost, err = os.Hostname()
+	if err != nil {
+		exportHost = "unknown"
+	}
+	if *conf.AppConfig.Flag.StartType == conf.StartTypeDefault ||
+		*conf.AppConfig.Flag.StartType == conf.StartTypeForeground {
+		// the jobs of this host are interrupted by the restart
+		_, err = mongo.UpdateAll(exportJobCollectionName,
+			bson.M{"host": exportHost, "status": ExportJobStatusRunning},
+			bson.M{"status": ExportJobStatusFailed, "error": "interrupted by the restart of server"})
+		if err != nil {
+			beego.Error("failed to update the interrupted export jobs: " + err.Error())
+		}
+		err = mongo.Insert(exportLockCollectionName, &exportLock{Id: exportHost})
+		if err != nil && !mgo.IsDup(err) {
+			beego.Error("failed to init the export lock: " + err.Error())
+		}
+		unlockExportHost()
+		go startExportCleanTicker(time.Hour)
+	}
+}
+
+func startExportCleanTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			removeExpiredExportJobs()
+		}
+	}
+}
+
+func removeExpiredExportJobs() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to remove expired export jobs: ", r)
+		}
+	}()
+	expireTime := time.Now().Add(-time.Duration(conf.AppConfig.ExportExpireTime) * time.Hour).Unix()
+	var jobs []*ExportJob
+	_, err := mongo.FindAllWithoutLimit(exportJobCollectionName,
+		bson.M{"host": exportHost, "create_time": bson.M{"$lt": expireTime},
+			"status": bson.M{"$ne": ExportJobStatusRunning}}, &jobs)
+	if err != nil {
+		beego.Error("failed to get expired export jobs: " + err.Error())
+		return
+	}
+	for _, job := range jobs {
+		_, err = RemoveExportJob(job.Id)
+		if err != nil {
+			beego.Error("failed to remove expired export job " + job.Id + ": " + err.Error())
+		}
+	}
+}
+
+// AddExportJob starts a background job that writes the export file with the export function
+func AddExportJob(job *ExportJob, export func(writer io.Writer) (int64, error)) (*ExportJob, error) {
+	// the count of running jobs is checked and the job is inserted under the lock of host,
+	// so that the concurrent requests cannot exceed maxRunningExportJobs
+	err := lockExportHost()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockExportHost()
+	count, err := mongo.CountWithQuery(exportJobCollectionName,
+		bson.M{"host": exportHost, "status": ExportJobStatusRunning})
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxRunningExportJobs {
+		return nil, errors.New("the count of running export jobs cannot be greater than " +
+			strconv.Itoa(maxRunningExportJobs) + ", please try again later")
+	}
+	exportDir, err := getExportDir()
+	if err != nil {
+		return nil, err
+	}
+	job.Id = mongo.GenerateObjectId()
+	job.Status = ExportJobStatusRunning
+	job.Host = exportHost
+	job.CreateTime = time.Now().Unix()
+	err = mongo.Insert(exportJobCollectionName, job)
+	if err != nil {
+		return nil, err
+	}
+	go runExportJob(job.Id, path.Join(exportDir, job.Id+"."+job.Format), export)
+	return job, nil
+}
+
+// lockExportHost locks the export jobs of this host, the lock of a crashed server expires after exportLockTime
+func lockExportHost() error {
+	for i := 0; i < exportLockRetryTimes; i++ {
+		now := time.Now()
+		err := mongo.Update(exportLockCollectionName,
+			bson.M{
+				"_id": exportHost,
+				"$or": []bson.M{
+					{"lock_time": bson.M{"$exists": false}},
+					{"lock_time": bson.M{"$lt": now.Add(-exportLockTime).UnixNano() / 1000000}},
+				},
+			},
+			bson.M{"$set": bson.M{"lock_time": now.UnixNano() / 1000000}})
+		if err != mgo.ErrNotFound {
+			return err
+		}
+		time.Sleep(exportLockRetryInterval)
+	}
+	return errors.New("another export job is being created, please try again later")
+}
+
+func unlockExportHost() {
+	err := mongo.Update(exportLockCollectionName, bson.M{"_id": exportHost},
+		bson.M{"$unset": bson.M{"lock_time": 1}})
+	if err != nil && err != mgo.ErrNotFound {
+		beego.Error("failed to unlock the export jobs of host " + exportHost + ": " + err.Error())
+	}
+}
+
+func runExportJob(id string, fileName string, export func(writer io.Writer) (int64, error)) {
+	update := bson.M{"finish_time": time.Now().Unix()}
+	count, fileSize, err := writeExportFile(fileName, export)
+	update["count"] = count
+	update["file_size"] = fileSize
+	if err != nil {
+		beego.Error("failed to run export job " + id + ": " + err.Error())
+		update["status"] = ExportJobStatusFailed
+		update["error"] = err.Error()
+		os.Remove(fileName)
+	} else {
+		update["status"] = ExportJobStatusSuccess
+	}
+	update["finish_time"] = time.Now().Unix()
+	err = mongo.UpdateId(exportJobCollectionName, id, update)
+	if err != nil {
+		beego.Error("failed to update the status of export job " + id + ": " + err.Error())
+	}
+}
+
+func writeExportFile(fileName string, export func(writer io.Writer) (int64, error)) (count int64,
+	fileSize int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("export panic: %v", r)
+		}
+	}()
+	file, err := os.Create(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	writer := bufio.NewWriterSize(file, 64*1024)
+	count, err = export(writer)
+	if err != nil {
+		return
+	}
+	if err = writer.Flush(); err != nil {
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	return count, info.Size(), nil
+}
+
+func getExportDir() (string, error) {
+	currentPath, err := tools.GetCurrentPath()
+	if err != nil {
+		return "", err
+	}
+	exportDir := path.Join(currentPath, exportDirName)
+	if isExists, _ := tools.PathExists(exportDir); !isExists {
+		err = os.MkdirAll(exportDir, os.ModePerm)
+		if err != nil {
+			return "", err
+		}
+	}
+	return exportDir, nil
+}
+
+// GetExportFile returns the file path of the finished export job
+func GetExportFile(job *ExportJob) (string, error) {
+	if job.Status != ExportJobStatusSuccess {
+		return "", errors.New("the export job is " + job.Status)
+	}
+	if job.Host != exportHost {
+		return "", errors.New("the export file is on the server: " + job.Host)
+	}
+	exportDir, err := getExportDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(exportDir, job.Id+"."+job.Format), nil
+}
+
+func GetExportJobById(id string) (job *ExportJob, err error) {
+	err = mongo.FindId(exportJobCollectionName, id, &job)
+	return
+}
+
+func GetExportJobs(appId string, page int, perpage int) (count int, result []*ExportJob, err error) {
+	query := bson.M{}
+	if appId != "" {
+		query["app_id"] = appId
+	}
+	count, err = mongo.FindAll(exportJobCollectionName, query, &result, perpage*(page-1), perpage, "-create_time")
+	if result == nil {
+		result = make([]*ExportJob, 0)
+	}
+	return
+}
+
+func RemoveExportJob(id string) (job *ExportJob, err error) {
+	job, err = GetExportJobById(id)
+	if err != nil {
+		return
+	}
+	if job.Status == ExportJobStatusRunning {
+		return nil, errors.New("can not remove the running export job")
+	}
+	if job.Host == exportHost {
+		exportDir, err := getExportDir()
+		if err != nil {
+			return nil, err
+		}
+		fileName := path.Join(exportDir, job.Id+"."+job.Format)
+		if isExists, _ := tools.PathExists(fileName); isExists {
+			if err = os.Remove(fileName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return job, mongo.RemoveId(exportJobCollectionName, id)
+}
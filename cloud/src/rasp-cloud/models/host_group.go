@@ -0,0 +1,544 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HostGroup is a group of rasps of an app selected by their labels, the general config and algorithm config
+// of the group override the config of app for the rasps in it
+type HostGroup struct {
+	Id              string                 `json:"id" bson:"_id"`
+	AppId           string                 `json:"app_id" bson:"app_id"`
+	Name            string                 `json:"name" bson:"name"`
+	Description     string                 `json:"description" bson:"description"`
+	Priority        int                    `json:"priority" bson:"priority"`
+	Selector        []*LabelRequirement    `json:"selector" bson:"selector"`
+	GeneralConfig   map[string]interface{} `json:"general_config" bson:"general_config"`
+	AlgorithmConfig map[string]interface{} `json:"algorithm_config" bson:"algorithm_config"`
+	CreateTime      int64                  `json:"create_time" bson:"create_time"`
+	UpdateTime      int64                  `json:"update_time" bson:"update_time"`
+}
+
+// LabelRequirement is a condition on a label of rasp, the rasp is in the group if it meets all of them
+type LabelRequirement struct {
+	Key      string   `json:"key" bson:"key"`
+	Operator string   `json:"operator" bson:"operator"`
+	Values   []string `json:"values" bson:"values"`
+}
+
+// RaspConfig is the config sent to a rasp by heartbeat, the app config is overridden by the matched groups
+// in the order of their priority, and the group with greater priority wins
+type RaspConfig struct {
+	ConfigTime    int64                  `json:"config_time"`
+	Labels        map[string]string      `json:"labels"`
+	HostGroups    []*HostGroup           `json:"host_groups"`
+	GeneralConfig map[string]interface{} `json:"general_config"`
+	Plugin        *Plugin                `json:"plugin"`
+}
+
+const (
+	hostGroupCollectionName = "host_group"
+	maxHostGroupCount       = 100
+	maxLabelRequirements    = 16
+	LabelOperatorIn         = "in"
+	LabelOperatorNotIn      = "notin"
+	LabelOperatorExists     = "exists"
+	LabelOperatorNotExists  = "notexists"
+	// the max count of the plugin contents built with the algorithm config of groups which are cached
+	maxAlgorithmContentCache = 100
+)
+
+// algorithmContent is the plugin content built with the merged algorithm config and its md5
+type algorithmContent struct {
+	content string
+	md5     string
+}
+
+var (
+	// the plugin contents are cached by the md5 of plugin and the merged algorithm config, so that the plugin
+	// is not rebuilt on every heartbeat of the rasps in groups
+	algorithmContents     = make(map[string]*algorithmContent)
+	algorithmContentsLock sync.RWMutex
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"app_id"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id",
+	}
+	err := mongo.CreateIndex(hostGroupCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id index for host_group collection", err)
+	}
+}
+
+// ValidateHostGroup checks the selector and the config overrides of group, the algorithm config is checked
+// by the default algorithm config of the selected plugin of app
+func ValidateHostGroup(group *HostGroup) error {
+	if group.Name == "" {
+		return errors.New("the host group name cannot be empty")
+	}
+	if len(group.Name) > 64 {
+		return errors.New("the length of host group name cannot be greater than 64")
+	}
+	if len(group.Description) > 1024 {
+		return errors.New("the length of host group description cannot be greater than 1024")
+	}
+	if len(group.Selector) == 0 {
+		return errors.New("the selector of host group cannot be empty")
+	}
+	if len(group.Selector) > maxLabelRequirements {
+		return errors.New("the count of selector requirements cannot be greater than " +
+			strconv.Itoa(maxLabelRequirements))
+	}
+	for _, requirement := range group.Selector {
+		if err := validLabelRequirement(requirement); err != nil {
+			return err
+		}
+	}
+	if group.GeneralConfig == nil {
+		group.GeneralConfig = make(map[string]interface{})
+	}
+	for key, value := range group.GeneralConfig {
+		if key == "" {
+			return errors.New("the config key can not be empty")
+		}
+		if len(key) > 512 {
+			return errors.New("the length of config key '" + key + "' must be less than 512")
+		}
+		if key == "hook.white" {
+			return errors.New("the whitelist can not be overridden by host group")
+		}
+		if value == nil {
+			return errors.New("the value of " + key + " config cannot be nil")
+		}
+		if v, ok := value.(string); ok && len(v) >= 2048 {
+			return errors.New("the value's length of config key '" + key + "' must be less than 2048")
+		}
+	}
+	if group.AlgorithmConfig == nil {
+		group.AlgorithmConfig = make(map[string]interface{})
+	}
+	if len(group.AlgorithmConfig) > 0 {
+		plugin, err := GetSelectedPlugin(group.AppId, false)
+		if err != nil {
+			return errors.New("failed to get the selected plugin of app: " + err.Error())
+		}
+		for key, value := range group.AlgorithmConfig {
+			defaultValue, ok := plugin.DefaultAlgorithmConfig[key]
+			if !ok {
+				return errors.New("can not find the key '" + key + "' in the algorithm config of selected plugin")
+			}
+			if value == nil {
+				return errors.New("the value of algorithm config '" + key + "' cannot be nil")
+			}
+			if defaultItem, ok := toConfigMap(defaultValue); ok {
+				item, ok := toConfigMap(value)
+				if !ok {
+					return errors.New("the key '" + key + "' must be an object")
+				}
+				for subKey := range item {
+					if _, ok := defaultItem[subKey]; !ok {
+						return errors.New("can not find the key '" + key + "." + subKey +
+							"' in the algorithm config of selected plugin")
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validLabelRequirement(requirement *LabelRequirement) error {
+	if requirement == nil {
+		return errors.New("the selector requirement cannot be nil")
+	}
+	if !labelKeyRegex.MatchString(requirement.Key) {
+		return errors.New("invalid label key in selector: " + requirement.Key)
+	}
+	switch requirement.Operator {
+	case LabelOperatorIn, LabelOperatorNotIn:
+		if len(requirement.Values) == 0 {
+			return errors.New("the values of operator " + requirement.Operator + " cannot be empty")
+		}
+		for _, value := range requirement.Values {
+			if len(value) > maxLabelValueLength {
+				return errors.New("the length of label value cannot be greater than " +
+					strconv.Itoa(maxLabelValueLength))
+			}
+		}
+	case LabelOperatorExists, LabelOperatorNotExists:
+		if len(requirement.Values) > 0 {
+			return errors.New("the values of operator " + requirement.Operator + " must be empty")
+		}
+	default:
+		return errors.New("unsupported selector operator: " + requirement.Operator +
+			", it must be one of in, notin, exists and notexists")
+	}
+	return nil
+}
+
+// MatchHostGroup checks whether the labels meet all requirements of the selector of group
+func MatchHostGroup(group *HostGroup, labels map[string]string) bool {
+	for _, requirement := range group.Selector {
+		value, exists := labels[requirement.Key]
+		matched := false
+		switch requirement.Operator {
+		case LabelOperatorIn, LabelOperatorNotIn:
+			if exists {
+				for _, item := range requirement.Values {
+					if item == value {
+						matched = true
+						break
+					}
+				}
+			}
+			if requirement.Operator == LabelOperatorNotIn {
+				matched = !matched
+			}
+		case LabelOperatorExists:
+			matched = exists
+		case LabelOperatorNotExists:
+			matched = !exists
+		}
+		if !matched {
+			return false
+		}
+	}
+	return len(group.Selector) > 0
+}
+
+func AddHostGroup(group *HostGroup) (*HostGroup, error) {
+	count, err := mongo.CountWithQuery(hostGroupCollectionName, bson.M{"app_id": group.AppId})
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxHostGroupCount {
+		return nil, errors.New("the count of host groups of an app cannot be greater than " +
+			strconv.Itoa(maxHostGroupCount))
+	}
+	if err = checkHostGroupName(group); err != nil {
+		return nil, err
+	}
+	group.Id = mongo.GenerateObjectId()
+	group.CreateTime = time.Now().Unix()
+	group.UpdateTime = group.CreateTime
+	if err = mongo.Insert(hostGroupCollectionName, group); err != nil {
+		return nil, err
+	}
+	return group, updateAppConfigTime(group.AppId)
+}
+
+func UpdateHostGroup(group *HostGroup) (*HostGroup, error) {
+	if err := checkHostGroupName(group); err != nil {
+		return nil, err
+	}
+	err := mongo.UpdateId(hostGroupCollectionName, group.Id, bson.M{
+		"name":             group.Name,
+		"description":      group.Description,
+		"priority":         group.Priority,
+		"selector":         group.Selector,
+		"general_config":   group.GeneralConfig,
+		"algorithm_config": group.AlgorithmConfig,
+		"update_time":      time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = updateAppConfigTime(group.AppId); err != nil {
+		return nil, err
+	}
+	return GetHostGroupById(group.Id)
+}
+
+func checkHostGroupName(group *HostGroup) error {
+	var groups []*HostGroup
+	_, err := mongo.FindAllWithoutLimit(hostGroupCollectionName,
+		bson.M{"app_id": group.AppId, "name": group.Name}, &groups)
+	if err != nil {
+		return err
+	}
+	for _, item := range groups {
+		if item.Id != group.Id {
+			return errors.New("the host group name already exists: " + group.Name)
+		}
+	}
+	return nil
+}
+
+// updateAppConfigTime makes the rasps of app fetch the config again on the next heartbeat
+func updateAppConfigTime(appId string) error {
+	return mongo.UpdateId(appCollectionName, appId, bson.M{"config_time": time.Now().UnixNano()})
+}
+
+func GetHostGroupById(id string) (group *HostGroup, err error) {
+	err = mongo.FindId(hostGroupCollectionName, id, &group)
+	if err == nil {
+		HandleHostGroup(group)
+	}
+	return
+}
+
+func GetHostGroups(appId string, page int, perpage int) (count int, result []*HostGroup, err error) {
+	count, err = mongo.FindAll(hostGroupCollectionName, bson.M{"app_id": appId}, &result,
+		perpage*(page-1), perpage, "-priority", "_id")
+	if err == nil {
+		for _, group := range result {
+			HandleHostGroup(group)
+		}
+	}
+	if result == nil {
+		result = make([]*HostGroup, 0)
+	}
+	return
+}
+
+// GetMatchedHostGroups returns the groups of app that the labels match, in the order they are applied
+func GetMatchedHostGroups(appId string, labels map[string]string) ([]*HostGroup, error) {
+	var groups []*HostGroup
+	_, err := mongo.FindAllWithoutLimit(hostGroupCollectionName, bson.M{"app_id": appId}, &groups)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*HostGroup, 0)
+	for _, group := range groups {
+		HandleHostGroup(group)
+		if MatchHostGroup(group, labels) {
+			result = append(result, group)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Priority != result[j].Priority {
+			return result[i].Priority < result[j].Priority
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+// GetHostGroupRasps returns the rasps of app in the group, ordered by register time
+func GetHostGroupRasps(group *HostGroup, page int, perpage int) (int, []*Rasp, error) {
+	var rasps []*Rasp
+	_, err := mongo.FindAllWithSelectBySort(raspCollectionName, bson.M{"app_id": group.AppId}, &rasps,
+		bson.M{"environ": 0}, 0, 0, "-register_time")
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]*Rasp, 0)
+	for _, rasp := range rasps {
+		if MatchHostGroup(group, GetRaspLabels(rasp)) {
+			result = append(result, rasp)
+		}
+	}
+	count := len(result)
+	start := perpage * (page - 1)
+	if start > count {
+		start = count
+	}
+	end := start + perpage
+	if end > count {
+		end = count
+	}
+	result = result[start:end]
+	for _, rasp := range result {
+		HandleRasp(rasp)
+	}
+	return count, result, nil
+}
+
+func RemoveHostGroupById(id string) (group *HostGroup, err error) {
+	group, err = GetHostGroupById(id)
+	if err != nil {
+		return
+	}
+	if err = mongo.RemoveId(hostGroupCollectionName, id); err != nil {
+		return nil, err
+	}
+	return group, updateAppConfigTime(group.AppId)
+}
+
+func RemoveHostGroupByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(hostGroupCollectionName, bson.M{"app_id": appId})
+	return
+}
+
+func HandleHostGroup(group *HostGroup) {
+	if group.Selector == nil {
+		group.Selector = make([]*LabelRequirement, 0)
+	}
+	for _, requirement := range group.Selector {
+		if requirement.Values == nil {
+			requirement.Values = make([]string, 0)
+		}
+	}
+	if group.GeneralConfig == nil {
+		group.GeneralConfig = make(map[string]interface{})
+	}
+	if group.AlgorithmConfig == nil {
+		group.AlgorithmConfig = make(map[string]interface{})
+	}
+}
+
+// GetRaspConfig merges the config of app with the config of host groups that the rasp is in,
+// the plugin is rebuilt with the merged algorithm config if any group overrides it
+func GetRaspConfig(app *App, rasp *Rasp) (*RaspConfig, error) {
+	labels := GetRaspLabels(rasp)
+	groups, err := GetMatchedHostGroups(app.Id, labels)
+	if err != nil {
+		return nil, err
+	}
+	config := &RaspConfig{
+		ConfigTime: app.ConfigTime,
+		Labels:     labels,
+		HostGroups: groups,
+	}
+	if rasp.ConfigTime > config.ConfigTime {
+		config.ConfigTime = rasp.ConfigTime
+	}
+
+	generalConfig := make(map[string]interface{}, len(app.GeneralConfig)+1)
+	for key, value := range app.GeneralConfig {
+		generalConfig[key] = value
+	}
+	for _, group := range groups {
+		for key, value := range group.GeneralConfig {
+			generalConfig[key] = value
+		}
+	}
+	whitelistConfig := make(map[string]interface{})
+	for _, configItem := range app.WhitelistConfig {
+		whiteHookTypes := make([]string, 0, len(configItem.Hook))
+		for hookType, isWhite := range configItem.Hook {
+			if isWhite {
+				whiteHookTypes = append(whiteHookTypes, hookType)
+			}
+		}
+		whitelistConfig[configItem.Url] = whiteHookTypes
+	}
+	generalConfig["hook.white"] = whitelistConfig
+	config.GeneralConfig = generalConfig
+
+	plugin, err := GetSelectedPlugin(app.Id, true)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	if plugin != nil {
+		config.Plugin, err = mergeAlgorithmConfig(plugin, groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// mergeAlgorithmConfig overrides the algorithm config of plugin by the groups, the keys not in the plugin
+// are ignored, since the plugin can be changed after the groups are saved
+func mergeAlgorithmConfig(plugin *Plugin, groups []*HostGroup) (*Plugin, error) {
+	algorithmConfig := make(map[string]interface{}, len(plugin.AlgorithmConfig))
+	for key, value := range plugin.AlgorithmConfig {
+		algorithmConfig[key] = value
+	}
+	isOverridden := false
+	for _, group := range groups {
+		for key, value := range group.AlgorithmConfig {
+			oldValue, ok := algorithmConfig[key]
+			if !ok {
+				continue
+			}
+			isOverridden = true
+			oldItem, isOldMap := toConfigMap(oldValue)
+			item, isMap := toConfigMap(value)
+			if !isOldMap || !isMap {
+				algorithmConfig[key] = value
+				continue
+			}
+			newItem := make(map[string]interface{}, len(oldItem))
+			for subKey, subValue := range oldItem {
+				newItem[subKey] = subValue
+			}
+			for subKey, subValue := range item {
+				newItem[subKey] = subValue
+			}
+			algorithmConfig[key] = newItem
+		}
+	}
+	if !isOverridden {
+		return plugin, nil
+	}
+	built, err := getAlgorithmContent(plugin, algorithmConfig)
+	if err != nil {
+		return nil, err
+	}
+	newPlugin := *plugin
+	newPlugin.Content = built.content
+	newPlugin.Md5 = built.md5
+	newPlugin.AlgorithmConfig = algorithmConfig
+	return &newPlugin, nil
+}
+
+// getAlgorithmContent returns the cached content of plugin with the algorithm config, or builds it
+func getAlgorithmContent(plugin *Plugin, algorithmConfig map[string]interface{}) (*algorithmContent, error) {
+	configContent, err := json.Marshal(algorithmConfig)
+	if err != nil {
+		return nil, err
+	}
+	key := plugin.Md5 + ":" + fmt.Sprintf("%x", md5.Sum(configContent))
+	algorithmContentsLock.RLock()
+	cached, ok := algorithmContents[key]
+	algorithmContentsLock.RUnlock()
+	if ok {
+		return cached, nil
+	}
+	content, contentMd5, err := buildAlgorithmContent(plugin.Content, algorithmConfig)
+	if err != nil {
+		return nil, err
+	}
+	cached = &algorithmContent{content: content, md5: contentMd5}
+	algorithmContentsLock.Lock()
+	defer algorithmContentsLock.Unlock()
+	// the contents of the old plugins and configs are dropped all together
+	if len(algorithmContents) >= maxAlgorithmContentCache {
+		algorithmContents = make(map[string]*algorithmContent)
+	}
+	algorithmContents[key] = cached
+	return cached, nil
+}
+
+func toConfigMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case bson.M:
+		return v, true
+	}
+	return nil, false
+}
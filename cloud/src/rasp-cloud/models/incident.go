@@ -0,0 +1,630 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"rasp-cloud/conf"
+	"rasp-cloud/es"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Incident is a group of attack events correlated by attack_source, request_id and session,
+// the events of an incident may come from different hosts and apps
+type Incident struct {
+	Id              string           `json:"id" bson:"_id"`
+	Keys            []string         `json:"keys" bson:"keys"`
+	AppIds          []string         `json:"app_ids" bson:"app_ids"`
+	ServerHostnames []string         `json:"server_hostnames" bson:"server_hostnames"`
+	AttackSources   []string         `json:"attack_sources" bson:"attack_sources"`
+	AttackTypes     []string         `json:"attack_types" bson:"attack_types"`
+	Urls            []string         `json:"urls" bson:"urls"`
+	FirstSeen       int64            `json:"first_seen" bson:"first_seen"`
+	LastSeen        int64            `json:"last_seen" bson:"last_seen"`
+	EventCount      int64            `json:"event_count" bson:"event_count"`
+	BlockCount      int64            `json:"block_count" bson:"block_count"`
+	LogCount        int64            `json:"log_count" bson:"log_count"`
+	Breached        bool             `json:"breached" bson:"breached"`
+	Timeline        []*IncidentEvent `json:"timeline,omitempty" bson:"timeline"`
+	CreateTime      int64            `json:"create_time" bson:"create_time"`
+	UpdateTime      int64            `json:"update_time" bson:"update_time"`
+}
+
+type IncidentEvent struct {
+	Id             string `json:"id" bson:"id"`
+	AppId          string `json:"app_id" bson:"app_id"`
+	EventTime      int64  `json:"event_time" bson:"event_time"`
+	AttackType     string `json:"attack_type" bson:"attack_type"`
+	InterceptState string `json:"intercept_state" bson:"intercept_state"`
+	Url            string `json:"url" bson:"url"`
+	AttackSource   string `json:"attack_source" bson:"attack_source"`
+	ServerHostname string `json:"server_hostname" bson:"server_hostname"`
+	RequestId      string `json:"request_id" bson:"request_id"`
+}
+
+type IncidentSearchParam struct {
+	AppId        string `json:"app_id"`
+	AttackSource string `json:"attack_source"`
+	AttackType   string `json:"attack_type"`
+	Breached     *bool  `json:"breached"`
+	StartTime    int64  `json:"start_time"`
+	EndTime      int64  `json:"end_time"`
+}
+
+type incidentCursor struct {
+	Id       string `bson:"_id"`
+	LastTime int64  `bson:"last_time"`
+	// the time when a server starts to correlate the attacks after the cursor, the cursor is locked until it expires
+	LockTime int64 `bson:"lock_time"`
+}
+
+const (
+	incidentCollectionName       = "incident"
+	incidentCursorCollectionName = "incident_cursor"
+	incidentCursorId             = "attack"
+	// the events sharing a key are correlated when the interval between them is not greater than the window
+	incidentWindow = 30 * time.Minute
+	// the attacks are scanned with a delay, so that the logs in the bulk buffer of es are not missed
+	incidentScanDelay   = time.Minute
+	incidentLockTime    = 10 * time.Minute
+	incidentScanSize    = 5000
+	maxIncidentKeys     = 500
+	maxIncidentValues   = 100
+	maxIncidentTimeline = 500
+	incidentKeySource   = "source:"
+	incidentKeyRequest  = "request:"
+	incidentKeySession  = "session:"
+)
+
+var (
+	incidentEventFields = []string{"event_time", "app_id", "attack_type", "intercept_state", "url",
+		"attack_source", "server_hostname", "request_id", "header"}
+	sessionCookieNames = map[string]bool{
+		"jsessionid":        true,
+		"phpsessid":         true,
+		"asp.net_sessionid": true,
+		"connect.sid":       true,
+		"laravel_session":   true,
+		"sessionid":         true,
+		"session":           true,
+		"sid":               true,
+	}
+	eventTimeLayouts = []string{"2006-01-02T15:04:05-0700", time.RFC3339, "2006-01-02 15:04:05"}
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"keys", "last_seen"},
+		Unique:     false,
+		Background: true,
+		Name:       "keys_last_seen",
+	}
+	err := mongo.CreateIndex(incidentCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create keys index for incident collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"app_ids", "last_seen"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_ids_last_seen",
+	}
+	err = mongo.CreateIndex(incidentCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_ids index for incident collection", err)
+	}
+	if *conf.AppConfig.Flag.StartType == conf.StartTypeDefault ||
+		*conf.AppConfig.Flag.StartType == conf.StartTypeForeground {
+		go startIncidentTicker(time.Second * time.Duration(conf.AppConfig.AlarmCheckInterval))
+	}
+}
+
+func startIncidentTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			HandleIncidentCorrelation()
+		}
+	}
+}
+
+// HandleIncidentCorrelation correlates the attacks inserted since the last correlation into incidents
+func HandleIncidentCorrelation() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to handle incident correlation: ", r)
+		}
+	}()
+	var cursor incidentCursor
+	err := mongo.FindId(incidentCursorCollectionName, incidentCursorId, &cursor)
+	if err == mgo.ErrNotFound {
+		// only the attacks after the first start are correlated
+		err = mongo.Insert(incidentCursorCollectionName, &incidentCursor{
+			Id:       incidentCursorId,
+			LastTime: time.Now().Add(-incidentScanDelay).UnixNano() / 1000000,
+		})
+		if err != nil && !mgo.IsDup(err) {
+			beego.Error("failed to init the incident cursor: " + err.Error())
+		}
+		return
+	}
+	if err != nil {
+		beego.Error("failed to get the incident cursor: " + err.Error())
+		return
+	}
+	now := time.Now()
+	endTime := now.Add(-incidentScanDelay).UnixNano() / 1000000
+	if endTime <= cursor.LastTime {
+		return
+	}
+	// lock the cursor first so that only one server correlates the attacks, the cursor is moved after
+	// the incidents are saved, and the attacks are correlated again by any server if the lock expires
+	locked, err := lockIncidentCursor(cursor.LastTime, now)
+	if err != nil {
+		beego.Error("failed to lock the incident cursor: " + err.Error())
+		return
+	}
+	if !locked {
+		return
+	}
+	endTime, err = correlateIncidents(cursor.LastTime, endTime)
+	update := bson.M{"$unset": bson.M{"lock_time": 1}}
+	if err != nil {
+		beego.Error("failed to correlate incidents: " + err.Error())
+	} else {
+		update["$set"] = bson.M{"last_time": endTime}
+	}
+	err = mongo.Update(incidentCursorCollectionName, bson.M{"_id": incidentCursorId}, update)
+	if err != nil {
+		beego.Error("failed to update the incident cursor: " + err.Error())
+	}
+}
+
+// correlateIncidents saves the incidents of the attacks inserted in (startTime, endTime], the end time of
+// correlated attacks is returned
+func correlateIncidents(startTime int64, endTime int64) (int64, error) {
+	events, err := logs.GetAttacksWithInsertTime(startTime, endTime, incidentScanSize, incidentEventFields...)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) >= incidentScanSize {
+		// the rest of attacks are correlated next time, the attacks with the same insert time are not split
+		var trimmed bool
+		events, endTime, trimmed = trimIncidentEvents(events)
+		if !trimmed {
+			// all of the attacks have the same insert time, they are read at once to avoid skipping the rest
+			if events, err = logs.GetAttacksAtInsertTime(endTime, incidentEventFields...); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, incident := range CorrelateIncidentEvents(events) {
+		if err := saveIncident(incident); err != nil {
+			return 0, err
+		}
+	}
+	return endTime, nil
+}
+
+// trimIncidentEvents removes the events of the last insert time, trimmed is false if all events have the same
+// insert time
+func trimIncidentEvents(events []map[string]interface{}) (result []map[string]interface{}, endTime int64,
+	trimmed bool) {
+	lastTime := getEventInt64(events[len(events)-1][es.IndexTimeField])
+	for i := len(events) - 1; i >= 0; i-- {
+		insertTime := getEventInt64(events[i][es.IndexTimeField])
+		if insertTime < lastTime {
+			return events[:i+1], insertTime, true
+		}
+	}
+	return events, lastTime, false
+}
+
+// lockIncidentCursor locks the cursor which is not moved by the others, the lock of a failed or crashed
+// server expires after incidentLockTime
+func lockIncidentCursor(lastTime int64, now time.Time) (bool, error) {
+	err := mongo.Update(incidentCursorCollectionName,
+		bson.M{
+			"_id":       incidentCursorId,
+			"last_time": lastTime,
+			"$or": []bson.M{
+				{"lock_time": bson.M{"$exists": false}},
+				{"lock_time": bson.M{"$lt": now.Add(-incidentLockTime).UnixNano() / 1000000}},
+			},
+		},
+		bson.M{"$set": bson.M{"lock_time": now.UnixNano() / 1000000}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CorrelateIncidentEvents groups the attack events into incidents, the events are correlated
+// when they share the attack_source, request_id or session and are close in time
+func CorrelateIncidentEvents(events []map[string]interface{}) []*Incident {
+	incidentEvents := make([]*IncidentEvent, 0, len(events))
+	eventKeys := make(map[*IncidentEvent][]string, len(events))
+	for _, event := range events {
+		incidentEvent := newIncidentEvent(event)
+		keys := getIncidentKeys(event)
+		if len(keys) == 0 {
+			continue
+		}
+		incidentEvents = append(incidentEvents, incidentEvent)
+		eventKeys[incidentEvent] = keys
+	}
+	sort.SliceStable(incidentEvents, func(i, j int) bool {
+		return incidentEvents[i].EventTime < incidentEvents[j].EventTime
+	})
+	window := int64(incidentWindow / time.Millisecond)
+	keyIncidents := make(map[string]*Incident)
+	mergedIncidents := make(map[*Incident]bool)
+	incidents := make([]*Incident, 0)
+	for _, event := range incidentEvents {
+		var matched *Incident
+		for _, key := range eventKeys[event] {
+			incident := keyIncidents[key]
+			if incident == nil || incident == matched || event.EventTime-incident.LastSeen > window {
+				continue
+			}
+			if matched == nil {
+				matched = incident
+				continue
+			}
+			// the event connects two incidents
+			mergeIncident(matched, incident)
+			mergedIncidents[incident] = true
+			for _, incidentKey := range incident.Keys {
+				keyIncidents[incidentKey] = matched
+			}
+		}
+		if matched == nil {
+			matched = &Incident{FirstSeen: event.EventTime}
+			incidents = append(incidents, matched)
+		}
+		addIncidentEvent(matched, event, eventKeys[event])
+		for _, key := range eventKeys[event] {
+			keyIncidents[key] = matched
+		}
+	}
+	result := make([]*Incident, 0, len(incidents))
+	for _, incident := range incidents {
+		if !mergedIncidents[incident] {
+			result = append(result, incident)
+		}
+	}
+	return result
+}
+
+func newIncidentEvent(event map[string]interface{}) *IncidentEvent {
+	return &IncidentEvent{
+		Id:             getEventString(event["id"]),
+		AppId:          getEventString(event["app_id"]),
+		EventTime:      getEventTime(event),
+		AttackType:     getEventString(event["attack_type"]),
+		InterceptState: getEventString(event["intercept_state"]),
+		Url:            getEventString(event["url"]),
+		AttackSource:   getEventString(event["attack_source"]),
+		ServerHostname: getEventString(event["server_hostname"]),
+		RequestId:      getEventString(event["request_id"]),
+	}
+}
+
+// getIncidentKeys returns the correlation keys of the event, the session is only meaningful in its app
+func getIncidentKeys(event map[string]interface{}) []string {
+	keys := make([]string, 0, 3)
+	if attackSource := getEventString(event["attack_source"]); attackSource != "" {
+		keys = append(keys, incidentKeySource+attackSource)
+	}
+	if requestId := getEventString(event["request_id"]); requestId != "" {
+		keys = append(keys, incidentKeyRequest+requestId)
+	}
+	if header, ok := event["header"].(map[string]interface{}); ok {
+		for name, value := range header {
+			if strings.ToLower(name) != "cookie" {
+				continue
+			}
+			request := &http.Request{Header: http.Header{"Cookie": {getEventString(value)}}}
+			for _, cookie := range request.Cookies() {
+				if sessionCookieNames[strings.ToLower(cookie.Name)] && cookie.Value != "" {
+					session := fmt.Sprintf("%x", md5.Sum([]byte(cookie.Name+"="+cookie.Value)))
+					keys = append(keys, incidentKeySession+getEventString(event["app_id"])+"/"+session)
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
+
+func addIncidentEvent(incident *Incident, event *IncidentEvent, keys []string) {
+	incident.Keys = appendIncidentValues(incident.Keys, keys...)
+	incident.AppIds = appendIncidentValues(incident.AppIds, event.AppId)
+	incident.ServerHostnames = appendIncidentValues(incident.ServerHostnames, event.ServerHostname)
+	incident.AttackSources = appendIncidentValues(incident.AttackSources, event.AttackSource)
+	incident.AttackTypes = appendIncidentValues(incident.AttackTypes, event.AttackType)
+	incident.Urls = appendIncidentValues(incident.Urls, event.Url)
+	if event.EventTime < incident.FirstSeen {
+		incident.FirstSeen = event.EventTime
+	}
+	if event.EventTime > incident.LastSeen {
+		incident.LastSeen = event.EventTime
+	}
+	incident.EventCount++
+	if event.InterceptState == "block" {
+		incident.BlockCount++
+	} else if event.InterceptState == "log" {
+		incident.LogCount++
+		incident.Breached = true
+	}
+	incident.Timeline = append(incident.Timeline, event)
+}
+
+// mergeIncident merges the src incident into the dst incident
+func mergeIncident(dst *Incident, src *Incident) {
+	dst.Keys = appendIncidentValues(dst.Keys, src.Keys...)
+	dst.AppIds = appendIncidentValues(dst.AppIds, src.AppIds...)
+	dst.ServerHostnames = appendIncidentValues(dst.ServerHostnames, src.ServerHostnames...)
+	dst.AttackSources = appendIncidentValues(dst.AttackSources, src.AttackSources...)
+	dst.AttackTypes = appendIncidentValues(dst.AttackTypes, src.AttackTypes...)
+	dst.Urls = appendIncidentValues(dst.Urls, src.Urls...)
+	if src.FirstSeen < dst.FirstSeen {
+		dst.FirstSeen = src.FirstSeen
+	}
+	if src.LastSeen > dst.LastSeen {
+		dst.LastSeen = src.LastSeen
+	}
+	dst.EventCount += src.EventCount
+	dst.BlockCount += src.BlockCount
+	dst.LogCount += src.LogCount
+	dst.Breached = dst.Breached || src.Breached
+	dst.Timeline = append(dst.Timeline, src.Timeline...)
+	sort.SliceStable(dst.Timeline, func(i, j int) bool {
+		return dst.Timeline[i].EventTime < dst.Timeline[j].EventTime
+	})
+}
+
+func appendIncidentValues(values []string, newValues ...string) []string {
+	for _, newValue := range newValues {
+		if newValue == "" {
+			continue
+		}
+		exists := false
+		for _, value := range values {
+			if value == newValue {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			values = append(values, newValue)
+		}
+	}
+	return values
+}
+
+// saveIncident merges the incident into the latest incident which shares a key with it in the window,
+// or inserts it as a new incident
+func saveIncident(incident *Incident) error {
+	window := int64(incidentWindow / time.Millisecond)
+	var existing []*Incident
+	_, err := mongo.FindAllBySort(incidentCollectionName, bson.M{
+		"keys":      bson.M{"$in": incident.Keys},
+		"last_seen": bson.M{"$gte": incident.FirstSeen - window},
+	}, 0, 1, &existing, "-last_seen")
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if len(existing) > 0 {
+		// the incident is saved before if the attacks are correlated again after a failure
+		if containsIncidentEvents(existing[0], incident.Timeline) {
+			return nil
+		}
+		mergeIncident(existing[0], incident)
+		incident = existing[0]
+	} else {
+		incident.Id = mongo.GenerateObjectId()
+		incident.CreateTime = now
+	}
+	incident.UpdateTime = now
+	limitIncident(incident)
+	return mongo.UpsertId(incidentCollectionName, incident.Id, incident)
+}
+
+func containsIncidentEvents(incident *Incident, events []*IncidentEvent) bool {
+	ids := make(map[string]bool, len(incident.Timeline))
+	for _, event := range incident.Timeline {
+		ids[event.Id] = true
+	}
+	for _, event := range events {
+		if !ids[event.Id] {
+			return false
+		}
+	}
+	return true
+}
+
+// limitIncident limits the size of incident document, the latest events of timeline are kept
+func limitIncident(incident *Incident) {
+	if len(incident.Keys) > maxIncidentKeys {
+		incident.Keys = incident.Keys[len(incident.Keys)-maxIncidentKeys:]
+	}
+	for _, values := range []*[]string{&incident.AppIds, &incident.ServerHostnames, &incident.AttackSources,
+		&incident.AttackTypes, &incident.Urls} {
+		if len(*values) > maxIncidentValues {
+			*values = (*values)[:maxIncidentValues]
+		}
+	}
+	if len(incident.Timeline) > maxIncidentTimeline {
+		incident.Timeline = incident.Timeline[len(incident.Timeline)-maxIncidentTimeline:]
+	}
+}
+
+func getEventString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if str, ok := value.(string); ok {
+		return str
+	}
+	return fmt.Sprint(value)
+}
+
+func getEventInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
+
+// getEventTime returns the event_time of the event in milliseconds, the insert time is used if it is invalid
+func getEventTime(event map[string]interface{}) int64 {
+	if eventTime, ok := event["event_time"].(string); ok {
+		for _, layout := range eventTimeLayouts {
+			if t, err := time.Parse(layout, eventTime); err == nil {
+				return t.UnixNano() / 1000000
+			}
+		}
+	}
+	if eventTime := getEventInt64(event["event_time"]); eventTime > 0 {
+		return eventTime
+	}
+	return getEventInt64(event["@timestamp"])
+}
+
+func GetIncidentById(id string) (incident *Incident, err error) {
+	err = mongo.FindId(incidentCollectionName, id, &incident)
+	return
+}
+
+// FindIncidents returns the incidents overlapped with [StartTime, EndTime] without timeline,
+// the latest incidents are returned first
+func FindIncidents(param *IncidentSearchParam, page int, perpage int) (count int, result []*Incident, err error) {
+	query := bson.M{}
+	if param.AppId != "" {
+		query["app_ids"] = param.AppId
+	}
+	if param.AttackSource != "" {
+		query["attack_sources"] = param.AttackSource
+	}
+	if param.AttackType != "" {
+		query["attack_types"] = param.AttackType
+	}
+	if param.Breached != nil {
+		query["breached"] = *param.Breached
+	}
+	if param.StartTime > 0 {
+		query["last_seen"] = bson.M{"$gte": param.StartTime}
+	}
+	if param.EndTime > 0 {
+		query["first_seen"] = bson.M{"$lte": param.EndTime}
+	}
+	count, err = mongo.FindAllWithSelectBySort(incidentCollectionName, query, &result,
+		bson.M{"timeline": 0, "keys": 0}, perpage*(page-1), perpage, "-last_seen")
+	if result == nil {
+		result = make([]*Incident, 0)
+	}
+	return
+}
+
+// RemoveIncidentByAppId removes the incidents which only belong to the app,
+// and removes the app and its events from the other incidents
+func RemoveIncidentByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(incidentCollectionName, bson.M{"app_ids": []string{appId}})
+	if err != nil {
+		return
+	}
+	var incidents []*Incident
+	_, err = mongo.FindAllWithoutLimit(incidentCollectionName, bson.M{"app_ids": appId}, &incidents)
+	if err != nil {
+		return
+	}
+	for _, incident := range incidents {
+		removeIncidentApp(incident, appId)
+		if incident.EventCount <= 0 {
+			err = mongo.RemoveId(incidentCollectionName, incident.Id)
+		} else {
+			err = mongo.UpsertId(incidentCollectionName, incident.Id, incident)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// removeIncidentApp removes the events of the app and computes the incident again with the rest of them,
+// the counts of the events out of the limited timeline are kept
+func removeIncidentApp(incident *Incident, appId string) {
+	rest := &Incident{}
+	removed := &Incident{}
+	for _, event := range incident.Timeline {
+		if event.AppId == appId {
+			addIncidentEvent(removed, event, nil)
+		} else {
+			if rest.EventCount == 0 {
+				rest.FirstSeen = event.EventTime
+			}
+			addIncidentEvent(rest, event, nil)
+		}
+	}
+	appIds := make([]string, 0, len(incident.AppIds))
+	for _, id := range incident.AppIds {
+		if id != appId {
+			appIds = append(appIds, id)
+		}
+	}
+	incident.AppIds = appIds
+	incident.Timeline = rest.Timeline
+	incident.EventCount -= removed.EventCount
+	incident.BlockCount -= removed.BlockCount
+	incident.LogCount -= removed.LogCount
+	incident.Breached = incident.LogCount > 0
+	keys := make([]string, 0, len(incident.Keys))
+	for _, key := range incident.Keys {
+		if !strings.HasPrefix(key, incidentKeySession+appId+"/") {
+			keys = append(keys, key)
+		}
+	}
+	incident.Keys = keys
+	// the other values are only computed again if all events are in the timeline
+	if incident.EventCount == rest.EventCount {
+		incident.ServerHostnames = rest.ServerHostnames
+		incident.AttackSources = rest.AttackSources
+		incident.AttackTypes = rest.AttackTypes
+		incident.Urls = rest.Urls
+		incident.FirstSeen = rest.FirstSeen
+		incident.LastSeen = rest.LastSeen
+	}
+	incident.UpdateTime = time.Now().Unix()
+}
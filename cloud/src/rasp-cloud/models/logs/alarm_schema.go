@@ -0,0 +1,200 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"rasp-cloud/es"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// the alarms uploaded by agents are validated by the schema of each type before they are stored,
+// the types of fields follow the es template, and the keyword longer than its ignore_above is truncated,
+// the fields out of the template are kept as they are
+
+var (
+	alarmRequiredFields = map[string][]string{
+		AttackAlarmInfo.EsType: {"rasp_id", "attack_type", "event_time"},
+		PolicyAlarmInfo.EsType: {"rasp_id", "policy_id", "event_time"},
+		ErrorAlarmInfo.EsType:  {"rasp_id", "message", "event_time"},
+	}
+)
+
+// ValidateAlarm checks the required fields and the types of fields in the es template,
+// it returns the names of truncated fields
+func ValidateAlarm(esType string, alarm map[string]interface{}) ([]string, error) {
+	required, ok := alarmRequiredFields[esType]
+	if !ok {
+		return nil, errors.New("unrecognized alarm type: " + esType)
+	}
+	for _, name := range required {
+		if value, ok := alarm[name]; !ok || value == nil || value == "" {
+			return nil, errors.New("the required field " + name + " is missing")
+		}
+	}
+	fields, err := es.GetTemplateFields(esType)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	// the validation is in a stable order, so that the first error of an alarm is always the same
+	sort.Strings(names)
+	truncated := make([]string, 0)
+	for _, name := range names {
+		isTruncated, err := validateAlarmField(alarm, strings.Split(name, "."), fields[name])
+		if err != nil {
+			return nil, err
+		}
+		if isTruncated {
+			truncated = append(truncated, name)
+		}
+	}
+	return truncated, nil
+}
+
+// validateAlarmField finds the values of field by its path, the objects in array are walked through
+func validateAlarmField(doc map[string]interface{}, path []string, field *es.TemplateField) (bool, error) {
+	value, ok := doc[path[0]]
+	if !ok || value == nil {
+		return false, nil
+	}
+	if len(path) > 1 {
+		objects := make([]map[string]interface{}, 0, 1)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			objects = append(objects, v)
+		case []interface{}:
+			for _, item := range v {
+				object, ok := item.(map[string]interface{})
+				if !ok {
+					return false, errors.New("the field " + path[0] + " must be an object or an array of objects")
+				}
+				objects = append(objects, object)
+			}
+		default:
+			return false, errors.New("the field " + path[0] + " must be an object or an array of objects")
+		}
+		isTruncated := false
+		for _, object := range objects {
+			truncated, err := validateAlarmField(object, path[1:], field)
+			if err != nil {
+				return false, err
+			}
+			isTruncated = isTruncated || truncated
+		}
+		return isTruncated, nil
+	}
+
+	if values, ok := value.([]interface{}); ok {
+		isTruncated := false
+		for i, item := range values {
+			truncated, err := validateAlarmValue(item, field)
+			if err != nil {
+				return false, err
+			}
+			if truncated {
+				values[i] = truncateAlarmValue(item.(string), field.IgnoreAbove)
+				isTruncated = true
+			}
+		}
+		return isTruncated, nil
+	}
+	truncated, err := validateAlarmValue(value, field)
+	if err != nil {
+		return false, err
+	}
+	if truncated {
+		doc[path[0]] = truncateAlarmValue(value.(string), field.IgnoreAbove)
+	}
+	return truncated, nil
+}
+
+// validateAlarmValue checks the value like the coercion of es, it returns true if the keyword must be truncated
+func validateAlarmValue(value interface{}, field *es.TemplateField) (bool, error) {
+	if value == nil {
+		return false, nil
+	}
+	switch field.Type {
+	case "keyword", "text":
+		switch v := value.(type) {
+		case string:
+			return field.IgnoreAbove > 0 && utf8.RuneCountInString(v) > field.IgnoreAbove, nil
+		case float64, json.Number, bool:
+			return false, nil
+		}
+		return false, errors.New("the field " + field.Name + " must be a string")
+	case "long", "integer", "short", "byte", "double", "float":
+		number, ok := getAlarmNumber(value)
+		if !ok {
+			return false, errors.New("the field " + field.Name + " must be a number")
+		}
+		if field.Type == "short" && (number < math.MinInt16 || number > math.MaxInt16) {
+			return false, errors.New("the field " + field.Name + " is out of the range of short")
+		}
+		return false, nil
+	case "date":
+		switch v := value.(type) {
+		case float64, json.Number:
+			return false, nil
+		case string:
+			if v != "" {
+				return false, nil
+			}
+		}
+		return false, errors.New("the field " + field.Name + " must be a timestamp or a date string")
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return false, nil
+		case string:
+			if v == "true" || v == "false" {
+				return false, nil
+			}
+		}
+		return false, errors.New("the field " + field.Name + " must be a boolean")
+	}
+	return false, nil
+}
+
+func getAlarmNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil && !math.IsNaN(number) && !math.IsInf(number, 0)
+	}
+	return 0, false
+}
+
+func truncateAlarmValue(value string, maxLength int) string {
+	runes := []rune(value)
+	if len(runes) <= maxLength {
+		return value
+	}
+	return string(runes[:maxLength])
+}
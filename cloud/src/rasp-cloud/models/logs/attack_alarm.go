@@ -21,14 +21,35 @@ import (
 	"github.com/olivere/elastic"
 	"time"
 	"context"
-	"github.com/oschwald/geoip2-golang"
 	"github.com/astaxie/beego"
 	"net"
-	"rasp-cloud/tools"
 	"encoding/json"
 	"rasp-cloud/conf"
+	"strings"
+	"sort"
 )
 
+type AttackGeoCell struct {
+	Latitude  float64         `json:"latitude"`
+	Longitude float64         `json:"longitude"`
+	Count     int64           `json:"count"`
+	Block     int64           `json:"block"`
+	Log       int64           `json:"log"`
+	Apps      [][]interface{} `json:"apps"`
+}
+
+// AttackFieldItem is a top value of the field with the count of attacks, the block/log count and the top apps
+type AttackFieldItem struct {
+	Value interface{}     `json:"value"`
+	Count int64           `json:"count"`
+	Block int64           `json:"block"`
+	Log   int64           `json:"log"`
+	Apps  [][]interface{} `json:"apps"`
+}
+
+// the page size of the stack_md5 groups when the new vulnerabilities are searched
+const newVulnBatchSize = 1000
+
 var (
 	AttackAlarmInfo = AlarmLogInfo{
 		EsType:       "attack-alarm",
@@ -36,10 +57,9 @@ var (
 		EsAliasIndex: "real-openrasp-attack-alarm",
 		TtlTime:      24 * 365 * time.Hour,
 		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
-		FileLogger:   initAlarmFileLogger("/openrasp-logs/attack-alarm", "attack.log"),
+		FileDir:      "/openrasp-logs/attack-alarm",
+		FileName:     "attack.log",
 	}
-	geoIpDbPath string
-	geoIpDb     *geoip2.Reader
 
 	AttackTypeMap = map[interface{}]string{
 		"sql":                        "SQL 注入",
@@ -65,23 +85,48 @@ var (
 		"webshell_ld_preload":        "WebShell - LD_PRELOAD 后门",
 	}
 
+	// AttackAggrFields are the fields which can be aggregated by the top values
+	AttackAggrFields = []string{"attack_type", "intercept_state", "attack_source", "url", "path", "server_hostname",
+		"rasp_id", "plugin_algorithm", "user_agent", "app_id", "attack_location.location_zh_cn",
+		"attack_location.location_en", "attack_intel.as_org", "attack_intel.reputation", "attack_intel.zone"}
+
 	AttackInterceptMap = map[interface{}]string{
 		"block": "拦截请求",
 		"log":   "记录日志",
 	}
+
+	AttackTypeMapEnUs = map[interface{}]string{
+		"sql":                        "SQL Injection",
+		"sql_exception":              "SQL Exception",
+		"command":                    "Command Execution",
+		"xxe":                        "XXE External Entity Loading",
+		"directory":                  "Directory Traversal",
+		"rename":                     "File Rename",
+		"readFile":                   "Arbitrary File Download",
+		"include":                    "Arbitrary File Inclusion",
+		"writeFile":                  "Arbitrary File Write",
+		"ssrf":                       "SSRF Server Side Request Forgery",
+		"ognl":                       "OGNL Code Execution",
+		"webdav":                     "Arbitrary File Upload (PUT)",
+		"fileUpload":                 "Arbitrary File Upload",
+		"deserialization":            "Transformer Deserialization",
+		"xss_echo":                   "Echo XSS",
+		"xss_userinput":              "BODY XSS",
+		"webshell_callable":          "WebShell - Callable Backdoor",
+		"webshell_eval":              "WebShell - China Chopper",
+		"webshell_command":           "WebShell - Command Execution",
+		"webshell_file_put_contents": "WebShell - Backdoor Upload",
+		"webshell_ld_preload":        "WebShell - LD_PRELOAD Backdoor",
+	}
+
+	AttackInterceptMapEnUs = map[interface{}]string{
+		"block": "Blocked",
+		"log":   "Logged",
+	}
 )
 
 func init() {
 	registerAlarmInfo(&AttackAlarmInfo)
-	currentPath, err := tools.GetCurrentPath()
-	if err != nil {
-		tools.Panic(tools.ErrCodeLogInitFailed, "failed to get current directory path", err)
-	}
-	geoIpDbPath = currentPath + "/geoip/GeoLite2-City.mmdb"
-	geoIpDb, err = geoip2.Open(geoIpDbPath)
-	if err != nil {
-		tools.Panic(tools.ErrCodeGeoipInit, "failed to open geoip database", err)
-	}
 }
 
 func AddAttackAlarm(alarm map[string]interface{}) error {
@@ -96,7 +141,8 @@ func AddAttackAlarm(alarm map[string]interface{}) error {
 			alarm["stack_md5"] = fmt.Sprintf("%x", md5.Sum([]byte(stack.(string))))
 		}
 	}
-	setAlarmLocation(alarm)
+	enrichAttackAlarm(alarm)
+	maskAlarm(alarm)
 	return AddAlarmFunc(AttackAlarmInfo.EsType, alarm)
 }
 
@@ -105,7 +151,7 @@ func setAlarmLocation(alarm map[string]interface{}) {
 		_, ok = attackSource.(string)
 		if ok {
 			attackIp := net.ParseIP(attackSource.(string))
-			record, err := geoIpDb.City(attackIp)
+			record, err := geoIpCity.City(attackIp)
 			if err != nil {
 				beego.Error("failed to parse attack ip to location: " + err.Error())
 			}
@@ -132,9 +178,9 @@ func AggregationAttackWithTime(startTime int64, endTime int64, interval string,
 	interceptAggr := elastic.NewTermsAggregation().Field("intercept_state")
 	timeAggr.SubAggregation(interceptAggrName, interceptAggr)
 	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+	aggrResult, err := es.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
 		Query(elastic.NewBoolQuery().Must(timeQuery)).
-		Aggregation(timeAggrName, timeAggr).
+		Aggregation(timeAggrName, es.DateHistogram(timeAggr)).
 		Size(0).
 		Do(ctx)
 	if err != nil {
@@ -177,72 +223,376 @@ func AggregationAttackWithTime(startTime int64, endTime int64, interval string,
 	return result, nil
 }
 
-func AggregationAttackWithUserAgent(startTime int64, endTime int64, size int,
-	appId string) ([][]interface{}, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+// AggregationAttackWithGeo aggregates the attacks into the grid cells of attack_location,
+// the cells are gridSize degrees wide and the block/log count and the top apps of each cell are returned
+func AggregationAttackWithGeo(startTime int64, endTime int64, gridSize float64, appSize int,
+	appId string) ([]*AttackGeoCell, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
 	defer cancel()
-	uaAggr := elastic.NewTermsAggregation().Field("user_agent").Size(size).OrderByCount(false)
-	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
-	aggrName := "aggr_ua"
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
-		Query(timeQuery).
-		Aggregation(aggrName, uaAggr).
+	latitudeAggrName := "aggr_latitude"
+	longitudeAggrName := "aggr_longitude"
+	interceptAggrName := "aggr_intercept"
+	appAggrName := "aggr_app"
+	longitudeAggr := elastic.NewHistogramAggregation().Field("attack_location.longitude").
+		Interval(gridSize).MinDocCount(1).
+		SubAggregation(interceptAggrName, elastic.NewTermsAggregation().Field("intercept_state")).
+		SubAggregation(appAggrName, elastic.NewTermsAggregation().Field("app_id").Size(appSize))
+	latitudeAggr := elastic.NewHistogramAggregation().Field("attack_location.latitude").
+		Interval(gridSize).MinDocCount(1).
+		SubAggregation(longitudeAggrName, longitudeAggr)
+	aggrResult, err := es.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+		Query(elastic.NewBoolQuery().Filter(
+		elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime),
+		elastic.NewExistsQuery("attack_location.latitude"))).
+		Aggregation(latitudeAggrName, latitudeAggr).
 		Size(0).
 		Do(ctx)
 	if err != nil {
 		if aggrResult != nil && aggrResult.Error != nil {
-			errMsg, err := json.Marshal(aggrResult.Error)
-			if err != nil {
-				beego.Error(string(errMsg))
-			}
+			beego.Error(aggrResult.Error)
 		}
 		return nil, err
 	}
-	result := make([][]interface{}, 0)
-	if aggrResult != nil && aggrResult.Aggregations != nil {
-		if terms, ok := aggrResult.Aggregations.Terms(aggrName); ok && terms.Buckets != nil {
-			result = make([][]interface{}, len(terms.Buckets))
-			for index, item := range terms.Buckets {
-				result[index] = make([]interface{}, 2, 2)
-				result[index][0] = item.Key
-				result[index][1] = item.DocCount
+	result := make([]*AttackGeoCell, 0)
+	if aggrResult == nil || aggrResult.Aggregations == nil {
+		return result, nil
+	}
+	latitudeTerms, ok := aggrResult.Aggregations.Histogram(latitudeAggrName)
+	if !ok {
+		return result, nil
+	}
+	for _, latitudeItem := range latitudeTerms.Buckets {
+		longitudeTerms, ok := latitudeItem.Histogram(longitudeAggrName)
+		if !ok {
+			continue
+		}
+		for _, longitudeItem := range longitudeTerms.Buckets {
+			// the key of histogram is the lower bound of cell, the center of cell is returned
+			cell := &AttackGeoCell{
+				Latitude:  latitudeItem.Key + gridSize/2,
+				Longitude: longitudeItem.Key + gridSize/2,
+				Count:     longitudeItem.DocCount,
 			}
+			cell.Block, cell.Log, cell.Apps =
+				getAttackBreakdown(longitudeItem.Aggregations, interceptAggrName, appAggrName)
+			result = append(result, cell)
 		}
 	}
 	return result, nil
 }
 
-func AggregationAttackWithType(startTime int64, endTime int64, size int,
-	appId string) ([][]interface{}, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+// AggregationAttackWithTopField returns the top values of the field, the block/log count and the top apps
+// of each value are returned with the count of attacks
+func AggregationAttackWithTopField(startTime int64, endTime int64, field string, size int, appSize int,
+	appId string) ([]*AttackFieldItem, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
 	defer cancel()
-	typeAggr := elastic.NewTermsAggregation().Field("attack_type").Size(size).OrderByCount(false)
-	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
-	aggrName := "aggr_type"
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
-		Query(timeQuery).
-		Aggregation(aggrName, typeAggr).
+	fieldAggrName := "aggr_field"
+	interceptAggrName := "aggr_intercept"
+	appAggrName := "aggr_app"
+	fieldAggr := elastic.NewTermsAggregation().Field(field).Size(size).OrderByCount(false).
+		SubAggregation(interceptAggrName, elastic.NewTermsAggregation().Field("intercept_state")).
+		SubAggregation(appAggrName, elastic.NewTermsAggregation().Field("app_id").Size(appSize))
+	aggrResult, err := es.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+		Query(buildSearchQuery(startTime, endTime, nil)).
+		Aggregation(fieldAggrName, fieldAggr).
 		Size(0).
 		Do(ctx)
 	if err != nil {
 		if aggrResult != nil && aggrResult.Error != nil {
-			errMsg, err := json.Marshal(aggrResult.Error)
-			if err != nil {
-				beego.Error(string(errMsg))
+			beego.Error(aggrResult.Error)
+		}
+		return nil, err
+	}
+	result := make([]*AttackFieldItem, 0)
+	if aggrResult == nil || aggrResult.Aggregations == nil {
+		return result, nil
+	}
+	if terms, ok := aggrResult.Aggregations.Terms(fieldAggrName); ok {
+		for _, bucket := range terms.Buckets {
+			item := &AttackFieldItem{Value: bucket.Key, Count: bucket.DocCount}
+			item.Block, item.Log, item.Apps = getAttackBreakdown(bucket.Aggregations, interceptAggrName, appAggrName)
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+// getAttackBreakdown returns the block/log count and the top apps in the sub aggregations of a bucket
+func getAttackBreakdown(aggrs elastic.Aggregations, interceptAggrName string,
+	appAggrName string) (block int64, log int64, apps [][]interface{}) {
+	apps = make([][]interface{}, 0)
+	if interceptTerms, ok := aggrs.Terms(interceptAggrName); ok {
+		for _, item := range interceptTerms.Buckets {
+			if item.Key == "block" {
+				block = item.DocCount
+			} else if item.Key == "log" {
+				log = item.DocCount
 			}
 		}
+	}
+	if appTerms, ok := aggrs.Terms(appAggrName); ok {
+		for _, item := range appTerms.Buckets {
+			apps = append(apps, []interface{}{item.Key, item.DocCount})
+		}
+	}
+	return
+}
+
+func AggregationAttackWithUserAgent(startTime int64, endTime int64, size int,
+	appId string) ([][]interface{}, error) {
+	return AggregationAttackWithField(startTime, endTime, "user_agent", size, appId)
+}
+
+func AggregationAttackWithType(startTime int64, endTime int64, size int,
+	appId string) ([][]interface{}, error) {
+	return AggregationAttackWithField(startTime, endTime, "attack_type", size, appId)
+}
+
+// AggregationAttackWithField returns the top values of the field with their attack count, like [[value, count]]
+func AggregationAttackWithField(startTime int64, endTime int64, field string, size int,
+	appId string) ([][]interface{}, error) {
+	return AggregationAttackWithQuery(startTime, endTime, field, size, nil, appId)
+}
+
+// AggregationAttackWithQuery is like AggregationAttackWithField, but only the attacks matched by the search data
+// are aggregated
+func AggregationAttackWithQuery(startTime int64, endTime int64, field string, size int,
+	query map[string]interface{}, appId string) ([][]interface{}, error) {
+	return AggregationLogWithField(&AttackAlarmInfo, startTime, endTime, field, size, query, appId)
+}
+
+// GetNewVulns returns the stack_md5 groups whose first attack happened in [startTime, endTime],
+// the attacks are filtered by the search data if it is not nil
+func GetNewVulns(startTime int64, endTime int64, query map[string]interface{},
+	appId string) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(60*time.Second))
+	defer cancel()
+	index := AttackAlarmInfo.EsAliasIndex + "-" + appId
+	vulns, err := getNewVulnGroups(ctx, index, startTime, endTime, query)
+	if err != nil {
 		return nil, err
 	}
-	result := make([][]interface{}, 0)
-	if aggrResult != nil && aggrResult.Aggregations != nil {
+	result := make([]map[string]interface{}, 0, len(vulns))
+	keys := make([]interface{}, 0, len(vulns))
+	for key := range vulns {
+		keys = append(keys, key)
+	}
+	// the first attacks of the new groups are fetched in batches
+	aggrName := "aggr_vuln"
+	topHitName := "top_hit"
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > newVulnBatchSize {
+			batch = batch[:newVulnBatchSize]
+		}
+		keys = keys[len(batch):]
+		vulnAggr := elastic.NewTermsAggregation().
+			Field("stack_md5").
+			Size(len(batch)).
+			SubAggregation(topHitName, elastic.NewTopHitsAggregation().Size(1).Sort("event_time", true).
+				FetchSourceContext(elastic.NewFetchSourceContext(true).
+					Include("attack_type", "intercept_state", "url", "app_id", "plugin_message")))
+		aggrResult, err := es.Search(index).
+			Query(buildSearchQuery(0, endTime, query).Filter(elastic.NewTermsQuery("stack_md5", batch...))).
+			Aggregation(aggrName, vulnAggr).
+			Size(0).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if aggrResult == nil || aggrResult.Aggregations == nil {
+			continue
+		}
 		if terms, ok := aggrResult.Aggregations.Terms(aggrName); ok && terms.Buckets != nil {
-			result = make([][]interface{}, len(terms.Buckets))
-			for index, item := range terms.Buckets {
-				result[index] = make([]interface{}, 2, 2)
-				result[index][0] = item.Key
-				result[index][1] = item.DocCount
+			for _, item := range terms.Buckets {
+				vuln := make(map[string]interface{})
+				if topHit, ok := item.TopHits(topHitName); ok && topHit.Hits != nil && len(topHit.Hits.Hits) > 0 {
+					err := json.Unmarshal(*topHit.Hits.Hits[0].Source, &vuln)
+					if err != nil {
+						return nil, err
+					}
+				}
+				key := fmt.Sprint(item.Key)
+				vuln["stack_md5"] = key
+				vuln["first_time"] = vulns[key].firstTime
+				vuln["attack_count"] = vulns[key].count
+				result = append(result, vuln)
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i]["attack_count"].(int64) != result[j]["attack_count"].(int64) {
+			return result[i]["attack_count"].(int64) > result[j]["attack_count"].(int64)
+		}
+		return result[i]["first_time"].(int64) < result[j]["first_time"].(int64)
+	})
+	return result, nil
+}
+
+type vulnGroup struct {
+	firstTime int64
+	count     int64
+}
+
+// getNewVulnGroups returns the first time and the attack count of the stack_md5 groups whose first attack
+// happened in [startTime, endTime], all groups are paged through by the composite aggregation,
+// the groups with the latest first attacks are selected before ElasticSearch 6.1
+func getNewVulnGroups(ctx context.Context, index string, startTime int64, endTime int64,
+	query map[string]interface{}) (map[string]vulnGroup, error) {
+	aggrName := "aggr_vuln"
+	firstTimeAggrName := "first_time"
+	vulns := make(map[string]vulnGroup)
+	addVuln := func(key interface{}, aggr elastic.Aggregations, docCount int64) bool {
+		firstTime, ok := aggr.Min(firstTimeAggrName)
+		if !ok || firstTime.Value == nil || int64(*firstTime.Value) < startTime {
+			return false
+		}
+		vulns[fmt.Sprint(key)] = vulnGroup{firstTime: int64(*firstTime.Value), count: docCount}
+		return true
+	}
+	if !es.Cluster.SupportComposite() {
+		vulnAggr := elastic.NewTermsAggregation().
+			Field("stack_md5").
+			Size(10000).
+			Order(firstTimeAggrName, false).
+			SubAggregation(firstTimeAggrName, elastic.NewMinAggregation().Field("event_time"))
+		aggrResult, err := es.Search(index).
+			Query(buildSearchQuery(0, endTime, query)).
+			Aggregation(aggrName, vulnAggr).
+			Size(0).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if aggrResult != nil && aggrResult.Aggregations != nil {
+			if terms, ok := aggrResult.Aggregations.Terms(aggrName); ok && terms.Buckets != nil {
+				for _, item := range terms.Buckets {
+					if !addVuln(item.Key, item.Aggregations, item.DocCount) {
+						break
+					}
+				}
+			}
+		}
+		return vulns, nil
+	}
+	var afterKey map[string]interface{}
+	for {
+		vulnAggr := elastic.NewCompositeAggregation().
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("stack_md5").Field("stack_md5")).
+			Size(newVulnBatchSize).
+			SubAggregation(firstTimeAggrName, elastic.NewMinAggregation().Field("event_time"))
+		if afterKey != nil {
+			vulnAggr.AggregateAfter(afterKey)
+		}
+		aggrResult, err := es.Search(index).
+			Query(buildSearchQuery(0, endTime, query)).
+			Aggregation(aggrName, vulnAggr).
+			Size(0).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if aggrResult == nil || aggrResult.Aggregations == nil {
+			return vulns, nil
+		}
+		composite, ok := aggrResult.Aggregations.Composite(aggrName)
+		if !ok || len(composite.Buckets) == 0 {
+			return vulns, nil
+		}
+		for _, item := range composite.Buckets {
+			addVuln(item.Key["stack_md5"], item.Aggregations, item.DocCount)
+		}
+		// the after_key is not returned before ElasticSearch 6.3
+		afterKey = composite.Buckets[len(composite.Buckets)-1].Key
+	}
+}
+
+// CountAttackWithUrlPrefix returns the count of attacks whose url without the scheme starts with the prefix,
+// the attacks are limited to the attack types if it is not empty
+func CountAttackWithUrlPrefix(appId string, urlPrefix string, attackTypes []string) (int64, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	// the url field is normalized to lowercase
+	urlPrefix = strings.ToLower(urlPrefix)
+	query := elastic.NewBoolQuery().
+		Should(elastic.NewPrefixQuery("url", "http://"+urlPrefix),
+		elastic.NewPrefixQuery("url", "https://"+urlPrefix)).
+		MinimumNumberShouldMatch(1)
+	if len(attackTypes) > 0 {
+		types := make([]interface{}, 0, len(attackTypes))
+		for _, attackType := range attackTypes {
+			types = append(types, attackType)
+		}
+		query.Filter(elastic.NewTermsQuery("attack_type", types...))
+	}
+	return es.Count(AttackAlarmInfo.EsAliasIndex + "-" + appId).Query(query).Do(ctx)
+}
+
+// GetAttacksWithInsertTime returns at most size attacks of all apps which are inserted in (startTime, endTime],
+// sorted by the insert time, the time when the attacks are written to ES is used rather than event_time
+// or @timestamp so that the delayed logs are not missed
+func GetAttacksWithInsertTime(startTime int64, endTime int64, size int,
+	fields ...string) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	fields = append(fields, "@timestamp", es.IndexTimeField)
+	queryResult, err := es.Search(AttackAlarmInfo.EsAliasIndex + "-*").
+		Query(elastic.NewBoolQuery().Filter(elastic.NewRangeQuery(es.IndexTimeField).Gt(startTime).Lte(endTime))).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...)).
+		Sort(es.IndexTimeField, true).
+		Size(size).
+		Do(ctx)
+	if err != nil {
+		if queryResult != nil && queryResult.Error != nil {
+			beego.Error(queryResult.Error)
+		}
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0)
+	if queryResult != nil && queryResult.Hits != nil {
+		for _, hit := range queryResult.Hits.Hits {
+			source, err := getAttackSource(hit)
+			if err != nil {
+				return nil, err
 			}
+			result = append(result, source)
 		}
 	}
 	return result, nil
 }
+
+// GetAttacksAtInsertTime returns all attacks of all apps which are inserted at the time
+func GetAttacksAtInsertTime(insertTime int64, fields ...string) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	fields = append(fields, "@timestamp", es.IndexTimeField)
+	result := make([]map[string]interface{}, 0)
+	err := es.Scan(AttackAlarmInfo.EsAliasIndex + "-*").
+		Query(elastic.NewBoolQuery().Filter(elastic.NewRangeQuery(es.IndexTimeField).Gte(insertTime).Lte(insertTime))).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...)).
+		Size(1000).
+		Do(ctx, func(hit *elastic.SearchHit) error {
+			source, err := getAttackSource(hit)
+			if err != nil {
+				return err
+			}
+			result = append(result, source)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getAttackSource(hit *elastic.SearchHit) (map[string]interface{}, error) {
+	source := make(map[string]interface{})
+	if hit.Source != nil {
+		if err := json.Unmarshal(*hit.Source, &source); err != nil {
+			return nil, err
+		}
+	}
+	source["id"] = hit.Id
+	return source, nil
+}
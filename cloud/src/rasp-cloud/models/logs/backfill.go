@@ -0,0 +1,261 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego"
+	"io/ioutil"
+	"os"
+	"path"
+	"rasp-cloud/es"
+	"rasp-cloud/tools"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"compress/gzip"
+	"io"
+)
+
+// the backfill imports the alarm files written by the file and hybrid mode to ES, the id of each doc
+// is the md5 of its line, so that the import can run again without duplicated alarms
+
+const (
+	backfillBatchSize     = 500
+	backfillProgressLines = 10000
+	backfillMaxLineSize   = 16 * 1024 * 1024
+)
+
+type BackfillFilter struct {
+	// the range of @timestamp in milliseconds, 0 means no limit
+	StartTime int64
+	EndTime   int64
+	AppId     string
+}
+
+type BackfillResult struct {
+	Files    int
+	Lines    int64
+	Imported int64
+	Skipped  int64
+	Invalid  int64
+}
+
+// Backfill imports the current and rotated files of attack, policy and error alarms to ES
+func Backfill(filter *BackfillFilter) (*BackfillResult, error) {
+	result := &BackfillResult{}
+	for _, info := range []*AlarmLogInfo{&AttackAlarmInfo, &PolicyAlarmInfo, &ErrorAlarmInfo} {
+		files, err := getBackfillFiles(info, filter)
+		if err != nil {
+			return result, err
+		}
+		for i, file := range files {
+			fmt.Printf("[%s] (%d/%d) importing %s\n", info.EsType, i+1, len(files), file)
+			if err := backfillFile(info, file, filter, result); err != nil {
+				return result, fmt.Errorf("failed to import %s: %s", file, err)
+			}
+			result.Files++
+		}
+	}
+	return result, nil
+}
+
+// getBackfillFiles returns the alarm files in the order of writing, like attack.2019-01-01.001.log.gz and attack.log,
+// the files of each app directory follow the shared files, the rotated files out of the date range are skipped,
+// the date in name may be the next day of the logs in it
+func getBackfillFiles(info *AlarmLogInfo, filter *BackfillFilter) ([]string, error) {
+	currentPath, err := tools.GetCurrentPath()
+	if err != nil {
+		return nil, err
+	}
+	dir := currentPath + info.FileDir
+	files, appDirs, err := getBackfillDirFiles(dir, info, filter)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	for _, appDir := range appDirs {
+		if filter.AppId != "" && appDir != filter.AppId {
+			continue
+		}
+		appFiles, _, err := getBackfillDirFiles(path.Join(dir, appDir), info, filter)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, appFiles...)
+	}
+	return files, nil
+}
+
+// getBackfillDirFiles returns the alarm files and the sub directories in the directory
+func getBackfillDirFiles(dir string, info *AlarmLogInfo, filter *BackfillFilter) ([]string, []string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	suffix := path.Ext(info.FileName)
+	prefix := strings.TrimSuffix(info.FileName, suffix) + "."
+	rotatedFiles := make([]string, 0)
+	subDirs := make([]string, 0)
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() {
+			subDirs = append(subDirs, name)
+			continue
+		}
+		if name == info.FileName || !strings.HasPrefix(name, prefix) ||
+			!(strings.HasSuffix(name, suffix) || strings.HasSuffix(name, suffix+tools.GzipSuffix)) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(name, prefix), ".", 2)
+		if date, err := time.ParseInLocation("2006-01-02", fields[0], time.Local); err == nil {
+			dayStart := date.AddDate(0, 0, -1).UnixNano() / 1000000
+			dayEnd := date.AddDate(0, 0, 1).UnixNano() / 1000000
+			if (filter.EndTime > 0 && dayStart > filter.EndTime) || (filter.StartTime > 0 && dayEnd < filter.StartTime) {
+				continue
+			}
+		}
+		rotatedFiles = append(rotatedFiles, name)
+	}
+	sort.Strings(rotatedFiles)
+	files := make([]string, 0, len(rotatedFiles)+1)
+	for _, name := range rotatedFiles {
+		files = append(files, path.Join(dir, name))
+	}
+	if isExists, _ := tools.PathExists(path.Join(dir, info.FileName)); isExists {
+		files = append(files, path.Join(dir, info.FileName))
+	}
+	return files, subDirs, nil
+}
+
+func backfillFile(info *AlarmLogInfo, file string, filter *BackfillFilter, result *BackfillResult) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var reader io.Reader = f
+	if strings.HasSuffix(file, tools.GzipSuffix) {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), backfillMaxLineSize)
+	alarms := make([]map[string]interface{}, 0, backfillBatchSize)
+	for scanner.Scan() {
+		result.Lines++
+		if result.Lines%backfillProgressLines == 0 {
+			fmt.Printf("[%s] %d lines are read, %d alarms are imported\n",
+				info.EsType, result.Lines, result.Imported)
+		}
+		// the line of file logger is like " {...}"
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		alarm, err := decodeBackfillLine(line)
+		if err != nil {
+			result.Invalid++
+			continue
+		}
+		// the write index of alarm is found by its app_id
+		if _, ok := alarm["app_id"].(string); !ok {
+			result.Invalid++
+			continue
+		}
+		if !matchBackfillFilter(alarm, filter) {
+			result.Skipped++
+			continue
+		}
+		if info.EsType != PolicyAlarmInfo.EsType {
+			alarm[es.BulkIdField] = getBackfillDocId(line)
+		}
+		alarms = append(alarms, alarm)
+		if len(alarms) >= backfillBatchSize {
+			if err := es.BulkInsert(info.EsType, alarms); err != nil {
+				return err
+			}
+			result.Imported += int64(len(alarms))
+			alarms = alarms[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(alarms) > 0 {
+		if err := es.BulkInsert(info.EsType, alarms); err != nil {
+			return err
+		}
+		result.Imported += int64(len(alarms))
+	}
+	return nil
+}
+
+func decodeBackfillLine(line []byte) (map[string]interface{}, error) {
+	var alarm map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	// the numbers are kept as they are, like the large integers
+	decoder.UseNumber()
+	if err := decoder.Decode(&alarm); err != nil {
+		return nil, err
+	}
+	if alarm == nil {
+		return nil, fmt.Errorf("the alarm is null")
+	}
+	return alarm, nil
+}
+
+func matchBackfillFilter(alarm map[string]interface{}, filter *BackfillFilter) bool {
+	if filter.AppId != "" && alarm["app_id"] != filter.AppId {
+		return false
+	}
+	if filter.StartTime <= 0 && filter.EndTime <= 0 {
+		return true
+	}
+	timestamp, err := strconv.ParseInt(fmt.Sprint(alarm["@timestamp"]), 10, 64)
+	if err != nil {
+		return false
+	}
+	return (filter.StartTime <= 0 || timestamp >= filter.StartTime) &&
+		(filter.EndTime <= 0 || timestamp <= filter.EndTime)
+}
+
+// getBackfillDocId returns the deterministic id of the alarm, which is the md5 of its json line
+func getBackfillDocId(content []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(content))
+}
+
+// PrintBackfillResult prints the summary of backfill
+func PrintBackfillResult(result *BackfillResult) {
+	summary := "backfill " + strconv.Itoa(result.Files) + " files, " +
+		strconv.FormatInt(result.Lines, 10) + " lines are read, " +
+		strconv.FormatInt(result.Imported, 10) + " alarms are imported, " +
+		strconv.FormatInt(result.Skipped, 10) + " alarms are skipped by the filter, " +
+		strconv.FormatInt(result.Invalid, 10) + " lines are invalid"
+	fmt.Println(summary)
+	beego.Info(summary)
+}
@@ -0,0 +1,559 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"github.com/astaxie/beego"
+	"github.com/oschwald/geoip2-golang"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"rasp-cloud/conf"
+	"rasp-cloud/tools"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the enrichers add the threat intelligence of attack_source to the attack alarm at ingest time,
+// the intelligence except the location is stored in the attack_intel field
+type attackEnricher func(ip net.IP, alarm map[string]interface{}, intel map[string]interface{})
+
+// CidrTable finds the values of the cidrs which contain an ip
+type CidrTable struct {
+	// the prefix lengths of the cidrs, the longer prefix is in front
+	prefixes []cidrPrefix
+	values   map[cidrPrefix]map[string][]string
+}
+
+type cidrPrefix struct {
+	ones int
+	bits int
+}
+
+// GeoIpDb is a geoip database which can be reloaded without blocking the enrichment,
+// the database is read into memory, so that it is safe to overwrite the file
+type GeoIpDb struct {
+	name     string
+	file     *watchedFile
+	lock     sync.RWMutex
+	reader   *geoip2.Reader
+	loadTime int64
+	err      error
+}
+
+type GeoIpDbStatus struct {
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	Enabled      bool   `json:"enabled"`
+	Loaded       bool   `json:"loaded"`
+	DatabaseType string `json:"database_type"`
+	BuildTime    int64  `json:"build_time"`
+	LoadTime     int64  `json:"load_time"`
+	Error        string `json:"error"`
+}
+
+// watchedFile checks whether the file is changed by its modification time and size
+type watchedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+const (
+	attackIntelField         = "attack_intel"
+	AttackEnricherGeo        = "geo"
+	AttackEnricherAsn        = "asn"
+	AttackEnricherReputation = "reputation"
+	AttackEnricherZone       = "zone"
+)
+
+var (
+	attackEnrichers = map[string]attackEnricher{
+		AttackEnricherGeo:        enrichAttackLocation,
+		AttackEnricherAsn:        enrichAttackAsn,
+		AttackEnricherReputation: enrichAttackReputation,
+		AttackEnricherZone:       enrichAttackZone,
+	}
+	enabledAttackEnrichers []attackEnricher
+	geoIpCity              = &GeoIpDb{name: AttackEnricherGeo}
+	geoIpAsn               = &GeoIpDb{name: AttackEnricherAsn}
+	geoIpReloadLock        sync.Mutex
+	networkZones           *CidrTable
+	ipReputation           *CidrTable
+	ipReputationFeeds      []*watchedFile
+	ipReputationLock       sync.RWMutex
+)
+
+func init() {
+	for _, name := range conf.AppConfig.AttackEnrichers {
+		enricher, ok := attackEnrichers[name]
+		if !ok {
+			tools.Panic(tools.ErrCodeConfigInitFailed, "unsupported attack enricher: "+name, nil)
+		}
+		enabledAttackEnrichers = append(enabledAttackEnrichers, enricher)
+	}
+	initGeoIpDbs()
+	var err error
+	networkZones, err = ParseNetworkZones(conf.AppConfig.NetworkZones)
+	if err != nil {
+		tools.Panic(tools.ErrCodeConfigInitFailed, "failed to parse the 'NetworkZones' config", err)
+	}
+	for _, feedPath := range conf.AppConfig.IpReputationFiles {
+		ipReputationFeeds = append(ipReputationFeeds, &watchedFile{path: getConfigFilePath(feedPath)})
+	}
+	reloadIpReputation()
+	if len(ipReputationFeeds) > 0 {
+		go startIpReputationReloadTicker(time.Second * time.Duration(conf.AppConfig.IpReputationReloadInterval))
+	}
+}
+
+// getConfigFilePath returns the path relative to the directory of executable if it is not absolute
+func getConfigFilePath(filePath string) string {
+	if filepath.IsAbs(filePath) {
+		return filePath
+	}
+	currentPath, err := tools.GetCurrentPath()
+	if err != nil {
+		tools.Panic(tools.ErrCodeLogInitFailed, "failed to get current directory path", err)
+	}
+	return path.Join(currentPath, filePath)
+}
+
+func initGeoIpDbs() {
+	geoIpCity.file = &watchedFile{path: getConfigFilePath(conf.AppConfig.GeoIpCityDbPath)}
+	geoIpAsn.file = &watchedFile{path: getConfigFilePath(conf.AppConfig.GeoIpAsnDbPath)}
+	for _, status := range ReloadGeoIpDbs(false) {
+		if status.Enabled && !status.Loaded {
+			beego.Warning("the " + status.Name + " enricher is disabled until the geoip database is loaded: " +
+				status.Error)
+		}
+	}
+	go startGeoIpReloadTicker(time.Second * time.Duration(conf.AppConfig.GeoIpReloadInterval))
+	go handleGeoIpReloadSignal()
+}
+
+func startGeoIpReloadTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			ReloadGeoIpDbs(false)
+		}
+	}
+}
+
+// handleGeoIpReloadSignal reloads the geoip databases on SIGUSR1,
+// the SIGHUP is not used because it is the graceful restart signal of beego
+func handleGeoIpReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		beego.Info("received SIGUSR1, reload the geoip databases")
+		ReloadGeoIpDbs(true)
+	}
+}
+
+// ReloadGeoIpDbs reloads the geoip databases of the enabled enrichers, only the changed databases are
+// reloaded unless force is true, the old database is kept when it fails to load the new one
+func ReloadGeoIpDbs(force bool) []*GeoIpDbStatus {
+	geoIpReloadLock.Lock()
+	defer geoIpReloadLock.Unlock()
+	result := make([]*GeoIpDbStatus, 0, 2)
+	for _, db := range []*GeoIpDb{geoIpCity, geoIpAsn} {
+		if isAttackEnricherEnabled(db.name) {
+			lastStatus := db.Status()
+			// the missing database means that the enricher is disabled, the same error is logged only once
+			err := db.reload(force)
+			if err != nil && !os.IsNotExist(err) && err.Error() != lastStatus.Error {
+				beego.Error("failed to load the geoip database " + db.file.path + ": " + err.Error())
+			}
+		}
+		result = append(result, db.Status())
+	}
+	return result
+}
+
+func GetGeoIpDbStatus() []*GeoIpDbStatus {
+	return []*GeoIpDbStatus{geoIpCity.Status(), geoIpAsn.Status()}
+}
+
+func (db *GeoIpDb) reload(force bool) error {
+	info, changed, err := db.file.changed()
+	if err == nil && !changed && !force {
+		return nil
+	}
+	if err == nil {
+		var content []byte
+		content, err = ioutil.ReadFile(db.file.path)
+		if err == nil {
+			var reader *geoip2.Reader
+			reader, err = geoip2.FromBytes(content)
+			if err == nil {
+				db.lock.Lock()
+				db.reader, reader = reader, db.reader
+				db.loadTime = time.Now().Unix()
+				db.err = nil
+				db.lock.Unlock()
+				if reader != nil {
+					reader.Close()
+				}
+				db.file.loaded(info)
+				beego.Info("the geoip database is loaded: " + db.file.path)
+				return nil
+			}
+		}
+	}
+	db.lock.Lock()
+	db.err = err
+	db.lock.Unlock()
+	return err
+}
+
+func (db *GeoIpDb) Status() *GeoIpDbStatus {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	status := &GeoIpDbStatus{
+		Name:     db.name,
+		Path:     db.file.path,
+		Enabled:  isAttackEnricherEnabled(db.name),
+		Loaded:   db.reader != nil,
+		LoadTime: db.loadTime,
+	}
+	if db.reader != nil {
+		metadata := db.reader.Metadata()
+		status.DatabaseType = metadata.DatabaseType
+		status.BuildTime = int64(metadata.BuildEpoch)
+	}
+	if db.err != nil {
+		status.Error = db.err.Error()
+	}
+	return status
+}
+
+// City returns nil when the database is not loaded
+func (db *GeoIpDb) City(ip net.IP) (*geoip2.City, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.reader == nil {
+		return nil, nil
+	}
+	return db.reader.City(ip)
+}
+
+// ASN returns nil when the database is not loaded
+func (db *GeoIpDb) ASN(ip net.IP) (*geoip2.ASN, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.reader == nil {
+		return nil, nil
+	}
+	return db.reader.ASN(ip)
+}
+
+// changed returns true when the file is changed since it is loaded successfully last time,
+// the returned info must be passed to loaded after the file is loaded, so that a failed load is retried
+func (f *watchedFile) changed() (os.FileInfo, bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	return info, !info.ModTime().Equal(f.modTime) || info.Size() != f.size, nil
+}
+
+// loaded records the info of the file which is loaded successfully
+func (f *watchedFile) loaded(info os.FileInfo) {
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+}
+
+func isAttackEnricherEnabled(name string) bool {
+	for _, enabled := range conf.AppConfig.AttackEnrichers {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// enrichAttackAlarm runs the enabled enrichers in order
+func enrichAttackAlarm(alarm map[string]interface{}) {
+	attackSource, ok := alarm["attack_source"].(string)
+	if !ok || attackSource == "" {
+		return
+	}
+	ip := net.ParseIP(attackSource)
+	if ip == nil {
+		return
+	}
+	intel := make(map[string]interface{})
+	for _, enricher := range enabledAttackEnrichers {
+		enricher(ip, alarm, intel)
+	}
+	if len(intel) > 0 {
+		alarm[attackIntelField] = intel
+	}
+}
+
+func enrichAttackLocation(ip net.IP, alarm map[string]interface{}, intel map[string]interface{}) {
+	setAlarmLocation(alarm)
+}
+
+func enrichAttackAsn(ip net.IP, alarm map[string]interface{}, intel map[string]interface{}) {
+	record, err := geoIpAsn.ASN(ip)
+	if err != nil {
+		beego.Error("failed to parse attack ip to asn: " + err.Error())
+		return
+	}
+	if record != nil && record.AutonomousSystemNumber > 0 {
+		intel["asn"] = record.AutonomousSystemNumber
+		intel["as_org"] = record.AutonomousSystemOrganization
+	}
+}
+
+func enrichAttackReputation(ip net.IP, alarm map[string]interface{}, intel map[string]interface{}) {
+	ipReputationLock.RLock()
+	table := ipReputation
+	ipReputationLock.RUnlock()
+	if table == nil {
+		return
+	}
+	if categories := table.Lookup(ip, true); len(categories) > 0 {
+		intel["reputation"] = categories
+	}
+}
+
+func enrichAttackZone(ip net.IP, alarm map[string]interface{}, intel map[string]interface{}) {
+	if networkZones == nil {
+		return
+	}
+	if zones := networkZones.Lookup(ip, false); len(zones) > 0 {
+		intel["zone"] = zones[0]
+	}
+}
+
+func NewCidrTable() *CidrTable {
+	return &CidrTable{values: make(map[cidrPrefix]map[string][]string)}
+}
+
+// Add adds the value of the cidr, the single ip is regarded as the cidr with the full prefix
+func (t *CidrTable) Add(cidr string, value string) error {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return errors.New("invalid ip: " + cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipNet.Mask.Size()
+	prefix := cidrPrefix{ones: ones, bits: bits}
+	prefixValues, ok := t.values[prefix]
+	if !ok {
+		prefixValues = make(map[string][]string)
+		t.values[prefix] = prefixValues
+		t.prefixes = append(t.prefixes, prefix)
+		sort.Slice(t.prefixes, func(i, j int) bool {
+			return t.prefixes[i].ones > t.prefixes[j].ones
+		})
+	}
+	key := string(ipNet.IP)
+	for _, existing := range prefixValues[key] {
+		if existing == value {
+			return nil
+		}
+	}
+	prefixValues[key] = append(prefixValues[key], value)
+	return nil
+}
+
+// Lookup returns the values of the cidrs which contain the ip, the value of the longest prefix is in front,
+// only the values of the longest prefix are returned if all is false
+func (t *CidrTable) Lookup(ip net.IP, all bool) []string {
+	var result []string
+	ip4 := ip.To4()
+	for _, prefix := range t.prefixes {
+		var key string
+		if prefix.bits == 32 {
+			if ip4 == nil {
+				continue
+			}
+			key = string(ip4.Mask(net.CIDRMask(prefix.ones, prefix.bits)))
+		} else {
+			if ip4 != nil {
+				continue
+			}
+			key = string(ip.To16().Mask(net.CIDRMask(prefix.ones, prefix.bits)))
+		}
+		for _, value := range t.values[prefix][key] {
+			exists := false
+			for _, existing := range result {
+				if existing == value {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				result = append(result, value)
+			}
+		}
+		if len(result) > 0 && !all {
+			break
+		}
+	}
+	return result
+}
+
+// ParseNetworkZones parses the mappings from cidr to zone, like "10.0.0.0/8=office,192.168.0.0/16=dmz"
+func ParseNetworkZones(config string) (*CidrTable, error) {
+	table := NewCidrTable()
+	for _, item := range strings.Split(config, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("invalid network zone: " + item + ", it must be like 10.0.0.0/8=office")
+		}
+		if err := table.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err != nil {
+			return nil, errors.New("invalid network zone: " + item + ", " + err.Error())
+		}
+	}
+	return table, nil
+}
+
+// LoadIpReputationFeed adds the cidrs of the feed to the table, each line of the feed is a cidr or an ip
+// with an optional category separated by comma or space, and the lines starting with # are ignored,
+// the file name is used as the category if it is empty
+func LoadIpReputationFeed(table *CidrTable, feedPath string) error {
+	file, err := os.Open(feedPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defaultCategory := strings.TrimSuffix(filepath.Base(feedPath), filepath.Ext(feedPath))
+	addRecord := func(lineNum int, fields []string) error {
+		if len(fields) == 0 || fields[0] == "" || strings.HasPrefix(fields[0], "#") {
+			return nil
+		}
+		category := defaultCategory
+		if len(fields) > 1 && strings.TrimSpace(fields[1]) != "" {
+			category = strings.TrimSpace(fields[1])
+		}
+		if err := table.Add(strings.TrimSpace(fields[0]), category); err != nil {
+			// the header of csv is skipped
+			if lineNum == 1 {
+				return nil
+			}
+			return errors.New("line " + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+		return nil
+	}
+	if strings.ToLower(filepath.Ext(feedPath)) == ".csv" {
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.Comment = '#'
+		for lineNum := 1; ; lineNum++ {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err = addRecord(lineNum, fields); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if err := addRecord(lineNum, fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func startIpReputationReloadTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			reloadIpReputation()
+		}
+	}
+}
+
+// reloadIpReputation reloads all feeds when any of them is changed, the old table is kept if it fails
+func reloadIpReputation() {
+	if !isAttackEnricherEnabled(AttackEnricherReputation) || len(ipReputationFeeds) == 0 {
+		return
+	}
+	changed := false
+	infos := make([]os.FileInfo, len(ipReputationFeeds))
+	for i, feed := range ipReputationFeeds {
+		info, feedChanged, err := feed.changed()
+		if err != nil {
+			beego.Error("failed to stat ip reputation feed " + feed.path + ": " + err.Error())
+			continue
+		}
+		infos[i] = info
+		changed = changed || feedChanged
+	}
+	if !changed {
+		return
+	}
+	table := NewCidrTable()
+	for _, feed := range ipReputationFeeds {
+		if err := LoadIpReputationFeed(table, feed.path); err != nil {
+			// the feeds are not marked as loaded, so that they are tried again next time
+			beego.Error("failed to load ip reputation feed " + feed.path + ": " + err.Error())
+			return
+		}
+	}
+	ipReputationLock.Lock()
+	ipReputation = table
+	ipReputationLock.Unlock()
+	for i, feed := range ipReputationFeeds {
+		if infos[i] != nil {
+			feed.loaded(infos[i])
+		}
+	}
+	beego.Info("the ip reputation feeds are loaded")
+}
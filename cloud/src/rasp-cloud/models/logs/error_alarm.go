@@ -13,8 +13,11 @@ var (
 		EsAliasIndex: "real-openrasp-error-alarm",
 		TtlTime:      24 * 365 * time.Hour,
 		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
-		FileLogger:   initAlarmFileLogger("/openrasp-logs/error-alarm", "error.log"),
+		FileDir:      "/openrasp-logs/error-alarm",
+		FileName:     "error.log",
 	}
+	// ErrorAggrFields are the fields which can be aggregated by the top values
+	ErrorAggrFields = []string{"err_code", "level", "rasp_id", "server_hostname", "app_id"}
 )
 
 func init() {
@@ -27,5 +30,19 @@ func AddErrorAlarm(alarm map[string]interface{}) error {
 			beego.Error("failed to add error alarm: ", r)
 		}
 	}()
+	maskAlarm(alarm)
 	return AddAlarmFunc(ErrorAlarmInfo.EsType, alarm)
 }
+
+// AggregationErrorWithTime returns the count of error alarms in each interval grouped by level,
+// and the count of agents which report errors
+func AggregationErrorWithTime(startTime int64, endTime int64, interval string, timeZone string,
+	size int, appId string) (map[string]interface{}, error) {
+	return AggregationLogWithTime(&ErrorAlarmInfo, startTime, endTime, interval, timeZone,
+		"level", size, appId)
+}
+
+func AggregationErrorWithField(startTime int64, endTime int64, field string, size int,
+	appId string) ([][]interface{}, error) {
+	return AggregationLogWithField(&ErrorAlarmInfo, startTime, endTime, field, size, nil, appId)
+}
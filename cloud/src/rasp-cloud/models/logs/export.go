@@ -0,0 +1,245 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"rasp-cloud/es"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/olivere/elastic"
+)
+
+type ExportParam struct {
+	Format  string   `json:"format"`
+	Columns []string `json:"columns"`
+	MaxSize int64    `json:"max_size"`
+	Async   bool     `json:"async"`
+}
+
+const (
+	ExportFormatCsv    = "csv"
+	ExportFormatNdjson = "ndjson"
+	exportScrollSize   = 1000
+	// the first characters of the cell which is run as a formula by the spreadsheet
+	csvFormulaPrefixes = "=+-@\t\r"
+)
+
+var (
+	ExportFormats = map[string]string{
+		ExportFormatCsv:    "text/csv; charset=UTF-8",
+		ExportFormatNdjson: "application/x-ndjson",
+	}
+	defaultExportColumns = map[string][]string{
+		"attack-alarm": {"event_time", "attack_type", "intercept_state", "attack_source", "url", "target",
+			"server_hostname", "plugin_message", "plugin_algorithm", "stack_md5", "app_id", "rasp_id"},
+		"policy-alarm": {"event_time", "policy_id", "message", "server_hostname", "server_type",
+			"stack_md5", "app_id", "rasp_id"},
+		"error-alarm": {"event_time", "level", "err_code", "message", "server_hostname", "pid",
+			"app_id", "rasp_id"},
+	}
+	// the internal fields added by logstash or es
+	internalLogFields = []string{"_@timestamp", "@timestamp", "@version", "tags", "host"}
+	// errExportLimit stops the scan when the max size of export is reached
+	errExportLimit = errors.New("the max size of export is reached")
+)
+
+// ValidExportColumns checks the columns against the es template, the default columns are returned when it is empty
+func ValidExportColumns(esType string, columns []string) ([]string, error) {
+	if len(columns) == 0 {
+		return defaultExportColumns[esType], nil
+	}
+	fields, err := es.GetTemplateFields(esType)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range columns {
+		if column == "id" {
+			continue
+		}
+		if _, ok := fields[column]; ok {
+			continue
+		}
+		// the whole object field such as server_nic
+		isObject := false
+		for name := range fields {
+			if strings.HasPrefix(name, column+".") {
+				isObject = true
+				break
+			}
+		}
+		if !isObject {
+			return nil, errors.New("unknown export column: " + column)
+		}
+	}
+	return columns, nil
+}
+
+// CountLogs returns the count of logs matched by the search data
+func CountLogs(startTime int64, endTime int64, query map[string]interface{}, index ...string) (int64, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	return es.Count(index...).Query(buildSearchQuery(startTime, endTime, query)).Do(ctx)
+}
+
+// ExportLogs writes the logs matched by the search data to the writer in batches,
+// at most maxSize logs are written, the count of written logs is returned
+func ExportLogs(writer io.Writer, format string, columns []string, maxSize int64, startTime int64, endTime int64,
+	query map[string]interface{}, index ...string) (count int64, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var csvWriter *csv.Writer
+	if format == ExportFormatCsv {
+		// BOM makes the utf-8 content readable for excel
+		if _, err = writer.Write([]byte("\xEF\xBB\xBF")); err != nil {
+			return 0, err
+		}
+		csvWriter = csv.NewWriter(writer)
+		if err = csvWriter.Write(columns); err != nil {
+			return 0, err
+		}
+	}
+	// the written logs are flushed after each batch
+	flush := func() error {
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher, ok := writer.(interface{ Flush() }); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if maxSize <= 0 {
+		return 0, flush()
+	}
+	err = es.Scan(index...).
+		Query(buildSearchQuery(startTime, endTime, query)).
+		Sort("event_time", false).
+		Size(exportScrollSize).
+		Do(ctx, func(hit *elastic.SearchHit) error {
+			var source map[string]interface{}
+			if hit.Source != nil {
+				if err := json.Unmarshal(*hit.Source, &source); err != nil {
+					return err
+				}
+			}
+			if source == nil {
+				source = make(map[string]interface{})
+			}
+			source["id"] = hit.Id
+			for _, field := range internalLogFields {
+				delete(source, field)
+			}
+			var err error
+			if csvWriter != nil {
+				row := make([]string, len(columns))
+				for i, column := range columns {
+					row[i] = EscapeCsvCell(formatExportValue(getExportValue(source, column)))
+				}
+				err = csvWriter.Write(row)
+			} else {
+				err = writeNdjsonLine(writer, source, columns)
+			}
+			if err != nil {
+				return err
+			}
+			count++
+			if count%exportScrollSize == 0 || count >= maxSize {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+			if count >= maxSize {
+				return errExportLimit
+			}
+			return nil
+		})
+	if err != nil && err != errExportLimit {
+		return count, err
+	}
+	return count, flush()
+}
+
+func writeNdjsonLine(writer io.Writer, source map[string]interface{}, columns []string) error {
+	line := source
+	if len(columns) > 0 {
+		line = make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			line[column] = getExportValue(source, column)
+		}
+	}
+	content, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(content, '\n'))
+	return err
+}
+
+// getExportValue gets the value of the column, the dot in column means the field of object
+func getExportValue(source map[string]interface{}, column string) interface{} {
+	if value, ok := source[column]; ok {
+		return value
+	}
+	var current interface{} = source
+	for _, key := range strings.Split(column, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
+
+// EscapeCsvCell prefixes the cell which may be run as a formula by the spreadsheet with a single quote,
+// the fields of attack like url and params are controlled by the attacker
+func EscapeCsvCell(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func formatExportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// avoid the exponent format of the large numbers such as event_time
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(content)
+	default:
+		return fmt.Sprint(v)
+	}
+}
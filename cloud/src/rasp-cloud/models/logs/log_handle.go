@@ -17,6 +17,7 @@ package logs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -27,6 +28,9 @@ import (
 	"rasp-cloud/tools"
 	"time"
 	"rasp-cloud/conf"
+	"regexp"
+	"strconv"
+	"sync"
 )
 
 type AggrTimeParam struct {
@@ -42,6 +46,24 @@ type AggrFieldParam struct {
 	StartTime int64  `json:"start_time"`
 	EndTime   int64  `json:"end_time"`
 	Size      int    `json:"size"`
+	Field     string `json:"field"`
+}
+
+type AggrTopFieldParam struct {
+	AppId     string `json:"app_id"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+	Size      int    `json:"size"`
+	Field     string `json:"field"`
+	AppSize   int    `json:"app_size"`
+}
+
+type AggrGeoParam struct {
+	AppId     string  `json:"app_id"`
+	StartTime int64   `json:"start_time"`
+	EndTime   int64   `json:"end_time"`
+	GridSize  float64 `json:"grid_size"`
+	AppSize   int     `json:"app_size"`
 }
 
 type SearchAttackParam struct {
@@ -60,6 +82,10 @@ type SearchAttackParam struct {
 		StackMd5       string    `json:"stack_md5,omitempty"`
 		AttackType     *[]string `json:"attack_type,omitempty"`
 		InterceptState *[]string `json:"intercept_state,omitempty"`
+		Query          string    `json:"query,omitempty"`
+		TriageState    *[]string `json:"triage_state,omitempty"`
+		Assignee       string    `json:"assignee,omitempty"`
+		Tag            string    `json:"tag,omitempty"`
 	} `json:"data"`
 }
 
@@ -75,6 +101,7 @@ type SearchPolicyParam struct {
 		HostName  string    `json:"server_hostname,omitempty"`
 		LocalIp   string    `json:"local_ip,omitempty"`
 		PolicyId  *[]string `json:"policy_id,omitempty"`
+		Query     string    `json:"query,omitempty"`
 	} `json:"data"`
 }
 
@@ -89,6 +116,7 @@ type SearchErrorParam struct {
 		RaspId    string `json:"rasp_id,omitempty"`
 		HostName  string `json:"server_hostname,omitempty"`
 		LocalIp   string `json:"local_ip,omitempty"`
+		Query     string `json:"query,omitempty"`
 	} `json:"data"`
 }
 
@@ -97,6 +125,8 @@ type AlarmLogInfo struct {
 	EsIndex      string
 	EsAliasIndex string
 	TtlTime      time.Duration
+	FileDir      string
+	FileName     string
 	FileLogger   *logs.BeeLogger
 	AlarmBuffer  chan map[string]interface{}
 }
@@ -104,48 +134,113 @@ type AlarmLogInfo struct {
 var (
 	AddAlarmFunc func(string, map[string]interface{}) error
 	alarmInfos   = make(map[string]*AlarmLogInfo)
+	// the file loggers of each alarm type and app, like attack-alarm/<app_id>
+	appFileLoggers     = make(map[string]*logs.BeeLogger)
+	appFileLoggerLock  sync.RWMutex
+	appFileLoggerRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 )
 
 func init() {
+	if *conf.AppConfig.Flag.StartType == conf.StartTypeBackfill {
+		// the backfill imports the alarm files only, it runs with the rasp-cloud which owns the spill queue
+		return
+	}
 	if conf.AppConfig.AlarmLogMode == "file" {
 		AddAlarmFunc = AddLogWithFile
 	} else if conf.AppConfig.AlarmLogMode == "es" {
+		initAlarmSpillQueue()
 		startEsAlarmLogPush()
 		AddAlarmFunc = AddLogWithES
+	} else if conf.AppConfig.AlarmLogMode == "hybrid" {
+		initAlarmSpillQueue()
+		startEsAlarmLogPush()
+		AddAlarmFunc = AddLogWithFileAndES
 	} else {
 		tools.Panic(tools.ErrCodeConfigInitFailed, "Unrecognized the value of RaspLogMode config", nil)
 	}
 }
 
 func registerAlarmInfo(info *AlarmLogInfo) {
+	info.FileLogger = initAlarmFileLogger(info.FileDir, info.FileName)
 	alarmInfos[info.EsType] = info
-	es.RegisterTTL(info.TtlTime, info.EsAliasIndex+"-*")
+	es.RegisterTTL(info.TtlTime, info.EsIndex)
 }
 
 func initAlarmFileLogger(dirName string, fileName string) *logs.BeeLogger {
-	currentPath, err := tools.GetCurrentPath()
+	logger, err := newAlarmFileLogger(dirName, fileName, dirName)
 	if err != nil {
 		tools.Panic(tools.ErrCodeLogInitFailed, "failed to init alarm logger", err)
 	}
+	return logger
+}
+
+// newAlarmFileLogger creates the file logger in the directory relative to rasp-cloud, the rotated files are
+// compressed and limited by the total size as the config, the total size is counted in the directory of
+// the alarm type, which includes the directories of apps
+func newAlarmFileLogger(dirName string, fileName string, typeDirName string) (*logs.BeeLogger, error) {
+	currentPath, err := tools.GetCurrentPath()
+	if err != nil {
+		return nil, err
+	}
 	dirName = currentPath + dirName
 	if isExists, _ := tools.PathExists(dirName); !isExists {
 		err := os.MkdirAll(dirName, os.ModePerm)
 		if err != nil {
-			tools.Panic(tools.ErrCodeLogInitFailed, "failed to init alarm logger", err)
+			return nil, err
 		}
 	}
 
 	logger := logs.NewLogger()
 	logPath := path.Join(dirName, fileName)
 	err = logger.SetLogger(tools.AdapterAlarmFile,
-		`{"filename":"`+logPath+`", "daily":true, "maxdays":10, "perm":"0777"}`)
+		`{"filename":"`+logPath+`", "daily":true, "maxdays":10, "perm":"0777", "compress":"`+
+			conf.AppConfig.AlarmFileCompress+`", "maxtotalsize":`+
+			strconv.FormatInt(conf.AppConfig.AlarmFileMaxTotalSize*1024*1024, 10)+`, "totalsizedir":"`+
+			currentPath+typeDirName+`"}`)
 	if err != nil {
-		tools.Panic(tools.ErrCodeLogInitFailed, "failed to init alarm logger", err)
+		return nil, err
 	}
+	return logger, nil
+}
+
+// getAlarmFileLogger returns the file logger of the app in the alarm if AlarmFilePerApp is enabled,
+// the shared file logger is used for the invalid app id
+func getAlarmFileLogger(info *AlarmLogInfo, alarm map[string]interface{}) *logs.BeeLogger {
+	if !conf.AppConfig.AlarmFilePerApp {
+		return info.FileLogger
+	}
+	appId, ok := alarm["app_id"].(string)
+	if !ok || !appFileLoggerRegex.MatchString(appId) {
+		return info.FileLogger
+	}
+	key := info.EsType + "/" + appId
+	appFileLoggerLock.RLock()
+	logger, ok := appFileLoggers[key]
+	appFileLoggerLock.RUnlock()
+	if ok {
+		return logger
+	}
+
+	appFileLoggerLock.Lock()
+	defer appFileLoggerLock.Unlock()
+	if logger, ok := appFileLoggers[key]; ok {
+		return logger
+	}
+	logger, err := newAlarmFileLogger(path.Join(info.FileDir, appId), info.FileName, info.FileDir)
+	if err != nil {
+		beego.Error("failed to init the alarm logger of app " + appId + ": " + err.Error())
+		return info.FileLogger
+	}
+	appFileLoggers[key] = logger
 	return logger
 }
 
+// startEsAlarmLogPush pushes the alarms in the buffers to ES, the alarms are pushed by the replay of
+// spill queue instead if it is enabled
 func startEsAlarmLogPush() {
+	if spillQueue != nil {
+		return
+	}
 	go func() {
 		for {
 			handleEsLogPush()
@@ -170,6 +265,7 @@ func handleEsLogPush() {
 		err := es.BulkInsert(AttackAlarmInfo.EsType, alarms)
 		if err != nil {
 			beego.Error("failed to execute es bulk insert for attack alarm: " + err.Error())
+			spillAlarms(AttackAlarmInfo.EsType, failedAlarms(err, alarms))
 		}
 	case alarm := <-PolicyAlarmInfo.AlarmBuffer:
 		alarms := make([]map[string]interface{}, 0, 200)
@@ -181,6 +277,7 @@ func handleEsLogPush() {
 		err := es.BulkInsert(PolicyAlarmInfo.EsType, alarms)
 		if err != nil {
 			beego.Error("failed to execute es bulk insert for policy alarm: " + err.Error())
+			spillAlarms(PolicyAlarmInfo.EsType, failedAlarms(err, alarms))
 		}
 	case alarm := <-ErrorAlarmInfo.AlarmBuffer:
 		alarms := make([]map[string]interface{}, 0, 200)
@@ -192,6 +289,7 @@ func handleEsLogPush() {
 		err := es.BulkInsert(ErrorAlarmInfo.EsType, alarms)
 		if err != nil {
 			beego.Error("failed to execute es bulk insert for error alarm: " + err.Error())
+			spillAlarms(ErrorAlarmInfo.EsType, failedAlarms(err, alarms))
 		}
 	}
 }
@@ -202,7 +300,7 @@ func AddLogWithFile(alarmType string, alarm map[string]interface{}) error {
 		if err != nil {
 			return err
 		}
-		_, err = info.FileLogger.Write(content)
+		_, err = getAlarmFileLogger(info, alarm).Write(content)
 		if err != nil {
 			logs.Error("failed to write rasp log: " + err.Error())
 			return err
@@ -213,16 +311,42 @@ func AddLogWithFile(alarmType string, alarm map[string]interface{}) error {
 	return nil
 }
 
+// AddLogWithES returns after the alarm is persisted in the spill queue, the alarm is only buffered in memory
+// if the spill queue is disabled
 func AddLogWithES(alarmType string, alarm map[string]interface{}) error {
+	if spillQueue != nil {
+		return spillAlarm(alarmType, alarm)
+	}
 	select {
 	case alarmInfos[alarmType].AlarmBuffer <- alarm:
 	default:
-		logs.Error("Failed to write attack alarm to ES, " +
-			"the buffer is full. Consider increase AlarmBufferSize value: " + fmt.Sprintf("%+v", alarm))
+		dropAlarms(alarmType, 1, "the alarm buffer is full")
+		return errors.New("failed to write " + alarmType + " to ES, the buffer is full")
 	}
 	return nil
 }
 
+// AddLogWithFileAndES writes the alarm to both of the file and ES, the id of ES doc is generated from the line
+// in file like the backfill, and the doc is written to the rolling index of its @timestamp, so that the alarms
+// imported by backfill later replace themselves unless the rollover period is changed in between
+func AddLogWithFileAndES(alarmType string, alarm map[string]interface{}) error {
+	if info, ok := alarmInfos[alarmType]; ok && info.FileLogger != nil {
+		content, err := json.Marshal(alarm)
+		if err != nil {
+			return err
+		}
+		if _, err = getAlarmFileLogger(info, alarm).Write(content); err != nil {
+			logs.Error("failed to write rasp log: " + err.Error())
+		}
+		if alarmType != PolicyAlarmInfo.EsType {
+			alarm[es.BulkIdField] = getBackfillDocId(content)
+		}
+	} else {
+		logs.Error("failed to write rasp log, unrecognized log type: " + alarmType)
+	}
+	return AddLogWithES(alarmType, alarm)
+}
+
 func getVulnAggr(attackTimeTopHitName string) (*elastic.TermsAggregation) {
 	attackMaxAggrName := "attack_max_aggr"
 	attackTimeTopHitAggr := elastic.NewTopHitsAggregation().
@@ -239,11 +363,8 @@ func getVulnAggr(attackTimeTopHitName string) (*elastic.TermsAggregation) {
 		SubAggregation(attackTimeTopHitName, attackTimeTopHitAggr)
 }
 
-func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[string]interface{}, sortField string,
-	page int, perpage int, ascending bool, index ...string) (int64, []map[string]interface{}, error) {
-	var total int64
-	var attackAggrName = "attack_aggr"
-	var attackTimeTopHitName = "attack_time_top_hit"
+// buildSearchQuery builds the es query of the search data, which is limited in [startTime, endTime]
+func buildSearchQuery(startTime int64, endTime int64, query map[string]interface{}) *elastic.BoolQuery {
 	filterQueries := make([]elastic.Query, 0, len(query)+1)
 	shouldQueries := make([]elastic.Query, 0, len(query)+1)
 	if query != nil {
@@ -280,20 +401,130 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 			} else if key == "url" {
 				filterQueries = append(filterQueries,
 					elastic.NewWildcardQuery("url", "*"+fmt.Sprint(value)+"*"))
+			} else if key == "query" || key == "triage" {
+				// compiled by HandleSearchQuery, or the triage filter compiled from mongo
+				if v, ok := value.(elastic.Query); ok {
+					filterQueries = append(filterQueries, v)
+				}
 			} else {
 				filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
 			}
 		}
 	}
 	filterQueries = append(filterQueries, elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime))
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
-	defer cancel()
 	boolQuery := elastic.NewBoolQuery().Filter(filterQueries...)
 	if len(shouldQueries) > 0 {
 		boolQuery.Should(shouldQueries...).MinimumNumberShouldMatch(1)
 	}
+	return boolQuery
+}
+
+// AggregationLogWithTime returns the count of logs in each interval, grouped by the top values of the field,
+// like {"labels": [time], "total": [count], "rasp_count": [count], "data": {value: [count]}}
+func AggregationLogWithTime(info *AlarmLogInfo, startTime int64, endTime int64, interval string, timeZone string,
+	field string, size int, appId string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	timeAggrName := "aggr_time"
+	fieldAggrName := "aggr_field"
+	raspAggrName := "aggr_rasp"
+	timeAggr := elastic.NewDateHistogramAggregation().Field("event_time").TimeZone(timeZone).
+		Interval(interval).ExtendedBounds(startTime, endTime).
+		SubAggregation(fieldAggrName, elastic.NewTermsAggregation().Field(field).Size(size)).
+		SubAggregation(raspAggrName, elastic.NewCardinalityAggregation().Field("rasp_id"))
+	aggrResult, err := es.Search(info.EsAliasIndex + "-" + appId).
+		Query(buildSearchQuery(startTime, endTime, nil)).
+		Aggregation(timeAggrName, es.DateHistogram(timeAggr)).
+		Size(0).
+		Do(ctx)
+	if err != nil {
+		if aggrResult != nil && aggrResult.Error != nil {
+			beego.Error(aggrResult.Error)
+		}
+		return nil, err
+	}
+	labels := make([]interface{}, 0)
+	total := make([]int64, 0)
+	raspCount := make([]int64, 0)
+	data := make(map[string][]int64)
+	if aggrResult != nil && aggrResult.Aggregations != nil {
+		if terms, ok := aggrResult.Aggregations.DateHistogram(timeAggrName); ok && terms.Buckets != nil {
+			labelCount := len(terms.Buckets)
+			labels = make([]interface{}, labelCount)
+			total = make([]int64, labelCount)
+			raspCount = make([]int64, labelCount)
+			for index, timeTerm := range terms.Buckets {
+				labels[index] = timeTerm.Key
+				total[index] = timeTerm.DocCount
+				if cardinality, ok := timeTerm.Cardinality(raspAggrName); ok && cardinality.Value != nil {
+					raspCount[index] = int64(*cardinality.Value)
+				}
+				if fieldTerms, ok := timeTerm.Terms(fieldAggrName); ok {
+					for _, item := range fieldTerms.Buckets {
+						key := fmt.Sprint(item.Key)
+						if _, ok := data[key]; !ok {
+							data[key] = make([]int64, labelCount)
+						}
+						data[key][index] = item.DocCount
+					}
+				}
+			}
+		}
+	}
+	return map[string]interface{}{
+		"labels":     labels,
+		"total":      total,
+		"rasp_count": raspCount,
+		"data":       data,
+	}, nil
+}
+
+// AggregationLogWithField returns the top values of the field with their log count, like [[value, count]],
+// only the logs matched by the search data are aggregated if it is not nil
+func AggregationLogWithField(info *AlarmLogInfo, startTime int64, endTime int64, field string, size int,
+	query map[string]interface{}, appId string) ([][]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	fieldAggr := elastic.NewTermsAggregation().Field(field).Size(size).OrderByCount(false)
+	aggrName := "aggr_field"
+	aggrResult, err := es.Search(info.EsAliasIndex + "-" + appId).
+		Query(buildSearchQuery(startTime, endTime, query)).
+		Aggregation(aggrName, fieldAggr).
+		Size(0).
+		Do(ctx)
+	if err != nil {
+		if aggrResult != nil && aggrResult.Error != nil {
+			errMsg, err := json.Marshal(aggrResult.Error)
+			if err != nil {
+				beego.Error(string(errMsg))
+			}
+		}
+		return nil, err
+	}
+	result := make([][]interface{}, 0)
+	if aggrResult != nil && aggrResult.Aggregations != nil {
+		if terms, ok := aggrResult.Aggregations.Terms(aggrName); ok && terms.Buckets != nil {
+			result = make([][]interface{}, len(terms.Buckets))
+			for index, item := range terms.Buckets {
+				result[index] = make([]interface{}, 2, 2)
+				result[index][0] = item.Key
+				result[index][1] = item.DocCount
+			}
+		}
+	}
+	return result, nil
+}
+
+func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[string]interface{}, sortField string,
+	page int, perpage int, ascending bool, index ...string) (int64, []map[string]interface{}, error) {
+	var total int64
+	var attackAggrName = "attack_aggr"
+	var attackTimeTopHitName = "attack_time_top_hit"
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	boolQuery := buildSearchQuery(startTime, endTime, query)
 
-	queryService := es.ElasticClient.Search(index...).Query(boolQuery)
+	queryService := es.Search(index...).Query(boolQuery)
 
 	if isAttachAggr {
 		attackAggr := getVulnAggr(attackTimeTopHitName)
@@ -324,11 +555,9 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 					return 0, nil, err
 				}
 				result[index]["id"] = item.Id
-				delete(result[index], "_@timestamp")
-				delete(result[index], "@timestamp")
-				delete(result[index], "@version")
-				delete(result[index], "tags")
-				delete(result[index], "host")
+				for _, field := range internalLogFields {
+					delete(result[index], field)
+				}
 			}
 		}
 	} else {
@@ -365,9 +594,36 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 	return total, result, nil
 }
 
+// GetAlarmById returns the alarm log with the es id in the alarm index of app
+func GetAlarmById(info *AlarmLogInfo, appId string, id string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+	queryResult, err := es.Search(info.EsAliasIndex + "-" + appId).
+		Query(elastic.NewIdsQuery().Ids(id)).
+		Size(1).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queryResult == nil || queryResult.Hits == nil || len(queryResult.Hits.Hits) == 0 {
+		return nil, errors.New("can not find the alarm: " + id)
+	}
+	hit := queryResult.Hits.Hits[0]
+	result := make(map[string]interface{})
+	err = json.Unmarshal(*hit.Source, &result)
+	if err != nil {
+		return nil, err
+	}
+	result["id"] = hit.Id
+	for _, field := range internalLogFields {
+		delete(result, field)
+	}
+	return result, nil
+}
+
 func CreateAlarmEsIndex(appId string) (err error) {
 	for _, alarmInfo := range alarmInfos {
-		err = es.CreateEsIndex(alarmInfo.EsIndex + "-" + appId)
+		err = es.CreateRollingIndex(alarmInfo.EsIndex, appId)
 		if err != nil {
 			return
 		}
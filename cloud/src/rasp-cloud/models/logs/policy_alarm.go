@@ -29,8 +29,11 @@ var (
 		EsAliasIndex: "real-openrasp-policy-alarm",
 		TtlTime:      24 * 365 * time.Hour,
 		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
-		FileLogger:   initAlarmFileLogger("/openrasp-logs/policy-alarm", "policy.log"),
+		FileDir:      "/openrasp-logs/policy-alarm",
+		FileName:     "policy.log",
 	}
+	// PolicyAggrFields are the fields which can be aggregated by the top values
+	PolicyAggrFields = []string{"policy_id", "server_hostname", "server_type", "rasp_id", "app_id"}
 )
 
 func init() {
@@ -68,5 +71,19 @@ func AddPolicyAlarm(alarm map[string]interface{}) error {
 		}
 	}
 	alarm["upsert_id"] = fmt.Sprintf("%x", md5.Sum([]byte(idContent)))
+	maskAlarm(alarm)
 	return AddAlarmFunc(PolicyAlarmInfo.EsType, alarm)
 }
+
+// AggregationPolicyWithTime returns the count of policy alarms in each interval grouped by policy_id,
+// and the count of agents which violate the policies
+func AggregationPolicyWithTime(startTime int64, endTime int64, interval string, timeZone string,
+	size int, appId string) (map[string]interface{}, error) {
+	return AggregationLogWithTime(&PolicyAlarmInfo, startTime, endTime, interval, timeZone,
+		"policy_id", size, appId)
+}
+
+func AggregationPolicyWithField(startTime int64, endTime int64, field string, size int,
+	appId string) ([][]interface{}, error) {
+	return AggregationLogWithField(&PolicyAlarmInfo, startTime, endTime, field, size, nil, appId)
+}
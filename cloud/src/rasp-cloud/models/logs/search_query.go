@@ -0,0 +1,619 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/olivere/elastic"
+	"net"
+	"rasp-cloud/es"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// the query language of log search, for example:
+//   attack_type:(sql OR xxe) AND NOT intercept_state:log AND attack_source:10.0.0.0/8
+//   url:*login* AND event_time:[2019-01-01 TO now] AND plugin_message:"the sql statement"
+const (
+	maxSearchQueryLength  = 4096
+	maxSearchQueryClauses = 1024
+	maxSearchQueryDepth   = 32
+)
+
+var (
+	// the fields that are not in the es template but can be searched
+	searchFieldAliases = map[string]string{
+		"local_ip": "server_nic.ip",
+	}
+	// the keyword fields whose value is ip address, the CIDR can be used for them
+	searchIpFields = map[string]bool{
+		"attack_source": true,
+		"client_ip":     true,
+		"server_ip":     true,
+		"server_nic.ip": true,
+	}
+)
+
+type SearchQuerySyntaxError struct {
+	Position int
+	Message  string
+}
+
+func (e *SearchQuerySyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Position+1, e.Message)
+}
+
+type searchQueryParser struct {
+	input   []rune
+	pos     int
+	depth   int
+	clauses int
+	fields  map[string]*es.TemplateField
+}
+
+// HandleSearchQuery compiles the query string in the search data into es query
+func HandleSearchQuery(esType string, searchData map[string]interface{}) error {
+	value, ok := searchData["query"]
+	if !ok {
+		return nil
+	}
+	delete(searchData, "query")
+	queryString, ok := value.(string)
+	if !ok {
+		return &SearchQuerySyntaxError{Message: "the query must be a string"}
+	}
+	query, err := ParseSearchQuery(esType, queryString)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		searchData["query"] = query
+	}
+	return nil
+}
+
+// ParseSearchQuery parses the query string and validates the fields against the es template,
+// nil is returned when the query string is empty
+func ParseSearchQuery(esType string, queryString string) (elastic.Query, error) {
+	if len(queryString) > maxSearchQueryLength {
+		return nil, &SearchQuerySyntaxError{
+			Message: "the length of query cannot be greater than " + strconv.Itoa(maxSearchQueryLength)}
+	}
+	fields, err := es.GetTemplateFields(esType)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchQueryParser{input: []rune(queryString), fields: fields}
+	p.skipSpace()
+	if p.eof() {
+		return nil, nil
+	}
+	query, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected '%c'", p.peek())
+	}
+	return query, nil
+}
+
+func (p *searchQueryParser) parseOr() (elastic.Query, error) {
+	query, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	queries := []elastic.Query{query}
+	for {
+		p.skipSpace()
+		if !p.matchKeyword("OR") && !p.matchString("||") {
+			break
+		}
+		query, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return elastic.NewBoolQuery().Should(queries...).MinimumNumberShouldMatch(1), nil
+}
+
+func (p *searchQueryParser) parseAnd() (elastic.Query, error) {
+	query, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	queries := []elastic.Query{query}
+	for {
+		p.skipSpace()
+		if p.eof() || p.peek() == ')' || p.peekKeyword("OR") || p.peekString("||") {
+			break
+		}
+		// the adjacent clauses are combined with AND implicitly
+		if !p.matchKeyword("AND") {
+			p.matchString("&&")
+		}
+		query, err = p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return elastic.NewBoolQuery().Filter(queries...), nil
+}
+
+func (p *searchQueryParser) parseNot() (elastic.Query, error) {
+	p.skipSpace()
+	if p.matchKeyword("NOT") || p.matchString("-") || p.matchString("!") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		query, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		return elastic.NewBoolQuery().MustNot(query), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchQueryParser) parsePrimary() (elastic.Query, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of query")
+	}
+	if p.peek() == '(' {
+		start := p.pos
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		query, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.matchString(")") {
+			return nil, &SearchQuerySyntaxError{Position: start, Message: "missing closing parenthesis"}
+		}
+		p.depth--
+		return query, nil
+	}
+	start := p.pos
+	name := p.readFieldName()
+	if name == "" {
+		return nil, p.errorf("expected field name but found '%c'", p.peek())
+	}
+	if !p.matchString(":") {
+		return nil, p.errorf("expected ':' after field '%s'", name)
+	}
+	if alias, ok := searchFieldAliases[name]; ok {
+		name = alias
+	}
+	field, ok := p.fields[name]
+	if !ok {
+		return nil, &SearchQuerySyntaxError{Position: start, Message: "unknown field '" + name + "'"}
+	}
+	query, err := p.parseValue(field)
+	if err != nil {
+		return nil, err
+	}
+	if field.NestedPath != "" {
+		query = elastic.NewNestedQuery(field.NestedPath, query)
+	}
+	return query, nil
+}
+
+func (p *searchQueryParser) parseValue(field *es.TemplateField) (elastic.Query, error) {
+	if p.eof() || unicode.IsSpace(p.peek()) {
+		return nil, p.errorf("expected value for field '%s'", field.Name)
+	}
+	switch p.peek() {
+	case '[', '{':
+		return p.parseRange(field)
+	case '>', '<':
+		return p.parseComparison(field)
+	case '(':
+		return p.parseValueGroup(field)
+	}
+	return p.parseSingleValue(field)
+}
+
+// parseValueGroup parses field:(a OR b c), which matches any of the values
+func (p *searchQueryParser) parseValueGroup(field *es.TemplateField) (elastic.Query, error) {
+	start := p.pos
+	p.pos++
+	queries := make([]elastic.Query, 0)
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, &SearchQuerySyntaxError{Position: start, Message: "missing closing parenthesis"}
+		}
+		if p.matchString(")") {
+			break
+		}
+		if p.matchKeyword("OR") || p.matchString("||") {
+			continue
+		}
+		query, err := p.parseSingleValue(field)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		return nil, &SearchQuerySyntaxError{Position: start, Message: "the value group cannot be empty"}
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return elastic.NewBoolQuery().Should(queries...).MinimumNumberShouldMatch(1), nil
+}
+
+func (p *searchQueryParser) parseSingleValue(field *es.TemplateField) (elastic.Query, error) {
+	start := p.pos
+	if err := p.addClause(); err != nil {
+		return nil, err
+	}
+	if p.peek() == '"' {
+		value, err := p.readQuoted()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.validateValue(field, value, start); err != nil {
+			return nil, err
+		}
+		return elastic.NewTermQuery(field.Name, p.normalize(field, value)), nil
+	}
+	value, pattern, wildcard, err := p.readWord("")
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, p.errorf("expected value for field '%s'", field.Name)
+	}
+	if wildcard {
+		if pattern == "*" {
+			return elastic.NewExistsQuery(field.Name), nil
+		}
+		if field.Type != "keyword" {
+			return nil, &SearchQuerySyntaxError{Position: start,
+				Message: "wildcard is only supported by keyword fields, but '" + field.Name + "' is " + field.Type}
+		}
+		return elastic.NewWildcardQuery(field.Name, p.normalize(field, pattern)), nil
+	}
+	if strings.Contains(value, "/") && (searchIpFields[field.Name] || field.Type == "ip") {
+		return p.buildCidrQuery(field, value, start)
+	}
+	if err = p.validateValue(field, value, start); err != nil {
+		return nil, err
+	}
+	return elastic.NewTermQuery(field.Name, p.normalize(field, value)), nil
+}
+
+// parseRange parses [a TO b], {a TO b} and the mixed forms, * means unbounded
+func (p *searchQueryParser) parseRange(field *es.TemplateField) (elastic.Query, error) {
+	start := p.pos
+	if err := p.addClause(); err != nil {
+		return nil, err
+	}
+	includeLower := p.next() == '['
+	p.skipSpace()
+	lower, err := p.readRangeBound(field)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.matchKeyword("TO") {
+		return nil, p.errorf("expected 'TO' in range")
+	}
+	p.skipSpace()
+	upper, err := p.readRangeBound(field)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.eof() || (p.peek() != ']' && p.peek() != '}') {
+		return nil, &SearchQuerySyntaxError{Position: start, Message: "missing closing bracket of range"}
+	}
+	includeUpper := p.next() == ']'
+	query := elastic.NewRangeQuery(field.Name)
+	if lower != "" {
+		if includeLower {
+			query.Gte(lower)
+		} else {
+			query.Gt(lower)
+		}
+	}
+	if upper != "" {
+		if includeUpper {
+			query.Lte(upper)
+		} else {
+			query.Lt(upper)
+		}
+	}
+	return query, nil
+}
+
+func (p *searchQueryParser) readRangeBound(field *es.TemplateField) (string, error) {
+	start := p.pos
+	var value string
+	var err error
+	if !p.eof() && p.peek() == '"' {
+		value, err = p.readQuoted()
+	} else {
+		var wildcard bool
+		value, _, wildcard, err = p.readWord("]}")
+		if err == nil && wildcard && value != "*" {
+			return "", &SearchQuerySyntaxError{Position: start, Message: "wildcard cannot be used in range"}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", p.errorf("expected range bound")
+	}
+	if value == "*" {
+		return "", nil
+	}
+	if err = p.validateValue(field, value, start); err != nil {
+		return "", err
+	}
+	return p.normalize(field, value), nil
+}
+
+// parseComparison parses field:>a, field:>=a, field:<a and field:<=a
+func (p *searchQueryParser) parseComparison(field *es.TemplateField) (elastic.Query, error) {
+	if err := p.addClause(); err != nil {
+		return nil, err
+	}
+	operator := string(p.next())
+	if p.matchString("=") {
+		operator += "="
+	}
+	start := p.pos
+	value, _, wildcard, err := p.readWord("")
+	if err != nil {
+		return nil, err
+	}
+	if value == "" || wildcard {
+		return nil, &SearchQuerySyntaxError{Position: start, Message: "expected value after '" + operator + "'"}
+	}
+	if err = p.validateValue(field, value, start); err != nil {
+		return nil, err
+	}
+	value = p.normalize(field, value)
+	query := elastic.NewRangeQuery(field.Name)
+	switch operator {
+	case ">":
+		query.Gt(value)
+	case ">=":
+		query.Gte(value)
+	case "<":
+		query.Lt(value)
+	default:
+		query.Lte(value)
+	}
+	return query, nil
+}
+
+// buildCidrQuery matches the ip in CIDR, the ip fields in es template are keywords,
+// so the CIDR is expanded to the prefixes of the octet boundary
+func (p *searchQueryParser) buildCidrQuery(field *es.TemplateField, value string, start int) (elastic.Query, error) {
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, &SearchQuerySyntaxError{Position: start, Message: "invalid CIDR '" + value + "'"}
+	}
+	if field.Type == "ip" {
+		return elastic.NewTermQuery(field.Name, ipNet.String()), nil
+	}
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		return nil, &SearchQuerySyntaxError{Position: start,
+			Message: "IPv6 CIDR is not supported by the keyword field '" + field.Name + "'"}
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ones == 0 {
+		return elastic.NewExistsQuery(field.Name), nil
+	}
+	octets := (ones + 7) / 8
+	count := 1 << uint(octets*8-ones)
+	p.clauses += count - 1
+	if p.clauses > maxSearchQueryClauses {
+		return nil, &SearchQuerySyntaxError{Position: start,
+			Message: "the count of query clauses cannot be greater than " + strconv.Itoa(maxSearchQueryClauses)}
+	}
+	base := binary.BigEndian.Uint32(ip)
+	step := uint32(1) << uint(32-octets*8)
+	queries := make([]elastic.Query, 0, count)
+	for i := 0; i < count; i++ {
+		address := make(net.IP, 4)
+		binary.BigEndian.PutUint32(address, base+uint32(i)*step)
+		if octets == 4 {
+			queries = append(queries, elastic.NewTermQuery(field.Name, address.String()))
+			continue
+		}
+		parts := strings.Split(address.String(), ".")
+		queries = append(queries, elastic.NewPrefixQuery(field.Name, strings.Join(parts[:octets], ".")+"."))
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return elastic.NewBoolQuery().Should(queries...).MinimumNumberShouldMatch(1), nil
+}
+
+func (p *searchQueryParser) validateValue(field *es.TemplateField, value string, start int) error {
+	var err error
+	switch field.Type {
+	case "long", "integer", "short", "byte":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "double", "float", "half_float", "scaled_float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return &SearchQuerySyntaxError{Position: start,
+			Message: "the value '" + value + "' of field '" + field.Name + "' must be " + field.Type}
+	}
+	return nil
+}
+
+func (p *searchQueryParser) normalize(field *es.TemplateField, value string) string {
+	if field.Lowercase {
+		return strings.ToLower(value)
+	}
+	return value
+}
+
+func (p *searchQueryParser) readFieldName() string {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '.' {
+			break
+		}
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// readWord reads an unquoted value, the value with the escapes removed and the wildcard pattern are returned
+func (p *searchQueryParser) readWord(stopChars string) (value string, pattern string, wildcard bool, err error) {
+	var valueBuilder, patternBuilder strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		if unicode.IsSpace(c) || c == '(' || c == ')' || c == '"' || strings.ContainsRune(stopChars, c) {
+			break
+		}
+		p.pos++
+		if c == '\\' {
+			if p.eof() {
+				return "", "", false, p.errorf("unfinished escape at the end of query")
+			}
+			escaped := p.next()
+			valueBuilder.WriteRune(escaped)
+			if escaped == '*' || escaped == '?' || escaped == '\\' {
+				patternBuilder.WriteRune('\\')
+			}
+			patternBuilder.WriteRune(escaped)
+			continue
+		}
+		if c == '*' || c == '?' {
+			wildcard = true
+		}
+		valueBuilder.WriteRune(c)
+		patternBuilder.WriteRune(c)
+	}
+	return valueBuilder.String(), patternBuilder.String(), wildcard, nil
+}
+
+func (p *searchQueryParser) readQuoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var builder strings.Builder
+	for !p.eof() {
+		c := p.next()
+		if c == '"' {
+			return builder.String(), nil
+		}
+		if c == '\\' && !p.eof() {
+			c = p.next()
+		}
+		builder.WriteRune(c)
+	}
+	return "", &SearchQuerySyntaxError{Position: start, Message: "missing closing quote"}
+}
+
+func (p *searchQueryParser) enter() error {
+	p.depth++
+	if p.depth > maxSearchQueryDepth {
+		return p.errorf("the query is nested too deeply")
+	}
+	return nil
+}
+
+func (p *searchQueryParser) addClause() error {
+	p.clauses++
+	if p.clauses > maxSearchQueryClauses {
+		return p.errorf("the count of query clauses cannot be greater than %d", maxSearchQueryClauses)
+	}
+	return nil
+}
+
+func (p *searchQueryParser) peekKeyword(keyword string) bool {
+	end := p.pos + len(keyword)
+	if end > len(p.input) || string(p.input[p.pos:end]) != keyword {
+		return false
+	}
+	return end == len(p.input) || unicode.IsSpace(p.input[end]) || p.input[end] == '(' || p.input[end] == '"'
+}
+
+func (p *searchQueryParser) matchKeyword(keyword string) bool {
+	if p.peekKeyword(keyword) {
+		p.pos += len(keyword)
+		return true
+	}
+	return false
+}
+
+func (p *searchQueryParser) peekString(s string) bool {
+	end := p.pos + len(s)
+	return end <= len(p.input) && string(p.input[p.pos:end]) == s
+}
+
+func (p *searchQueryParser) matchString(s string) bool {
+	if p.peekString(s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *searchQueryParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *searchQueryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *searchQueryParser) peek() rune {
+	return p.input[p.pos]
+}
+
+func (p *searchQueryParser) next() rune {
+	c := p.input[p.pos]
+	p.pos++
+	return c
+}
+
+func (p *searchQueryParser) errorf(format string, args ...interface{}) error {
+	return &SearchQuerySyntaxError{Position: p.pos, Message: fmt.Sprintf(format, args...)}
+}
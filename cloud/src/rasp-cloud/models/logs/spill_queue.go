@@ -0,0 +1,362 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package logs
+
+import (
+	"encoding/json"
+	"github.com/astaxie/beego"
+	"rasp-cloud/conf"
+	"rasp-cloud/es"
+	"rasp-cloud/storage"
+	"rasp-cloud/tools"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"errors"
+	"rasp-cloud/mongo"
+)
+
+// the alarms are written ahead to the disk queue before they are acknowledged, the replay of queue is the writer
+// of ES, it inserts the alarms in order and they are kept in the queue until they are inserted, so that the alarms
+// are not lost when ES is unavailable or rasp-cloud crashes, each alarm has a deterministic id before it is
+// written, so the replay of the alarms which are inserted before a crash replaces them instead of duplicating
+
+const (
+	spillReplayBatchSize  = 500
+	spillReplayIdleDelay  = 5 * time.Second
+	spillReplayMaxBackoff = time.Minute
+	spillWriterBatchSize  = 1000
+	spillDropLogInterval  = time.Minute
+)
+
+type spilledAlarm struct {
+	EsType string                 `json:"es_type"`
+	Alarm  map[string]interface{} `json:"alarm"`
+}
+
+// spillRequest is the alarm waiting for the spill writer, the result of writing it is sent to done
+type spillRequest struct {
+	item *spilledAlarm
+	done chan error
+}
+
+type SpillQueueStatus struct {
+	Enabled        bool             `json:"enabled"`
+	Depth          int              `json:"depth"`
+	MaxSize        int              `json:"max_size"`
+	Spilled        map[string]int64 `json:"spilled"`
+	Replayed       map[string]int64 `json:"replayed"`
+	Dropped        map[string]int64 `json:"dropped"`
+	LastReplayTime int64            `json:"last_replay_time"`
+	LastError      string           `json:"last_error"`
+}
+
+type spillCounter struct {
+	spilled  int64
+	replayed int64
+	dropped  int64
+}
+
+var (
+	spillQueue       *storage.DiskQueue
+	spillBuffer      chan *spillRequest
+	// spillNotify wakes up the idle replay after the alarms are written
+	spillNotify      = make(chan struct{}, 1)
+	spillCounters    = make(map[string]*spillCounter)
+	spillCounterLock sync.Mutex
+	spillStatusLock  sync.RWMutex
+	lastReplayTime   int64
+	lastSpillError   string
+	lastDropLogTime  int64
+)
+
+func initAlarmSpillQueue() {
+	if conf.AppConfig.AlarmSpillQueueSize <= 0 {
+		beego.Warning("the alarm spill queue is disabled, the alarms are dropped when the buffer is full")
+		return
+	}
+	queue, err := storage.OpenDiskQueue(conf.AppConfig.AlarmSpillQueuePath, conf.AppConfig.AlarmSpillQueueSize)
+	if err != nil {
+		tools.Panic(tools.ErrCodeLogInitFailed, "failed to open the alarm spill queue", err)
+	}
+	spillQueue = queue
+	spillBuffer = make(chan *spillRequest, conf.AppConfig.AlarmBufferSize)
+	if depth := queue.Len(); depth > 0 {
+		beego.Info("there are " + strconv.Itoa(depth) + " spilled alarms to be replayed")
+	}
+	go startSpillWriter()
+	go startSpillReplay()
+}
+
+// spillAlarm writes the alarm to the disk queue and waits until it is persisted, the alarms are written in batch
+// by the spill writer, the alarm without id is given a generated one, except the policy alarm which is upserted
+// by its upsert_id
+func spillAlarm(alarmType string, alarm map[string]interface{}) error {
+	if _, ok := alarm[es.BulkIdField]; !ok && alarmType != PolicyAlarmInfo.EsType {
+		alarm[es.BulkIdField] = mongo.GenerateObjectId()
+	}
+	request := &spillRequest{item: &spilledAlarm{EsType: alarmType, Alarm: alarm}, done: make(chan error, 1)}
+	select {
+	case spillBuffer <- request:
+	default:
+		dropAlarms(alarmType, 1, "the spill buffer is full")
+		return errors.New("failed to write " + alarmType + " to the spill queue, the buffer is full")
+	}
+	return <-request.done
+}
+
+// spillAlarms writes the alarms which failed to be inserted to the disk queue
+func spillAlarms(alarmType string, alarms []map[string]interface{}) {
+	if spillQueue == nil {
+		dropAlarms(alarmType, len(alarms), "failed to insert them to ES")
+		return
+	}
+	items := make([]*spilledAlarm, len(alarms))
+	for i, alarm := range alarms {
+		items[i] = &spilledAlarm{EsType: alarmType, Alarm: alarm}
+	}
+	writeSpilledAlarms(items)
+}
+
+// requeueAlarms removes the replayed alarms with the keys and appends the failed ones to the tail of queue
+func requeueAlarms(alarmType string, keys []uint64, failed []map[string]interface{}) error {
+	values := make([][]byte, 0, len(failed))
+	for _, alarm := range failed {
+		content, err := json.Marshal(&spilledAlarm{EsType: alarmType, Alarm: alarm})
+		if err != nil {
+			beego.Error("failed to encode the spilled alarm: " + err.Error())
+			dropAlarms(alarmType, 1, "failed to encode it")
+			continue
+		}
+		values = append(values, content)
+	}
+	count, err := spillQueue.Requeue(keys, values...)
+	if err != nil {
+		return err
+	}
+	if count < len(values) {
+		dropAlarms(alarmType, len(values)-count,
+			"the spill queue is full, consider increase AlarmSpillQueueSize value")
+	}
+	return nil
+}
+
+// failedAlarms returns the alarms which are not inserted by the bulk insert with the error
+func failedAlarms(err error, alarms []map[string]interface{}) []map[string]interface{} {
+	if err == nil {
+		return nil
+	}
+	if bulkErr, ok := err.(*es.BulkError); ok {
+		return bulkErr.Docs
+	}
+	return alarms
+}
+
+// startSpillWriter writes the waiting alarms in a transaction, and then acknowledges each of them
+func startSpillWriter() {
+	for {
+		request := <-spillBuffer
+		requests := make([]*spillRequest, 0, spillWriterBatchSize)
+		requests = append(requests, request)
+		for len(spillBuffer) > 0 && len(requests) < spillWriterBatchSize {
+			requests = append(requests, <-spillBuffer)
+		}
+		items := make([]*spilledAlarm, len(requests))
+		for i, request := range requests {
+			items[i] = request.item
+		}
+		errs := writeSpilledAlarms(items)
+		for i, request := range requests {
+			request.done <- errs[i]
+		}
+	}
+}
+
+// writeSpilledAlarms appends the alarms to the disk queue, the error of each alarm is returned in order,
+// it is nil if the alarm is persisted
+func writeSpilledAlarms(items []*spilledAlarm) []error {
+	errs := make([]error, len(items))
+	encodedIndexes := make([]int, 0, len(items))
+	values := make([][]byte, 0, len(items))
+	for i, item := range items {
+		content, err := json.Marshal(item)
+		if err != nil {
+			beego.Error("failed to encode the spilled alarm: " + err.Error())
+			dropAlarms(item.EsType, 1, "failed to encode it")
+			errs[i] = err
+			continue
+		}
+		encodedIndexes = append(encodedIndexes, i)
+		values = append(values, content)
+	}
+	count, err := spillQueue.Push(values...)
+	if err != nil {
+		beego.Error("failed to write alarms to the spill queue: " + err.Error())
+		setSpillError(err)
+	}
+	for i, index := range encodedIndexes {
+		item := items[index]
+		if i < count {
+			atomic.AddInt64(&getSpillCounter(item.EsType).spilled, 1)
+		} else if err != nil {
+			dropAlarms(item.EsType, 1, "failed to write the spill queue")
+			errs[index] = err
+		} else {
+			dropAlarms(item.EsType, 1, "the spill queue is full, consider increase AlarmSpillQueueSize value")
+			errs[index] = errors.New("failed to write " + item.EsType + " to the spill queue, the queue is full")
+		}
+	}
+	if count > 0 {
+		select {
+		case spillNotify <- struct{}{}:
+		default:
+		}
+	}
+	return errs
+}
+
+// startSpillReplay replays the spilled alarms to ES, it backs off when ES is still unavailable
+func startSpillReplay() {
+	backoff := time.Second
+	for {
+		count, err := replaySpilledAlarms()
+		if err != nil {
+			beego.Error("failed to replay the spilled alarms, retry after " + backoff.String() + ": " + err.Error())
+			setSpillError(err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > spillReplayMaxBackoff {
+				backoff = spillReplayMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		if count == 0 {
+			select {
+			case <-spillNotify:
+			case <-time.After(spillReplayIdleDelay):
+			}
+		}
+	}
+}
+
+// replaySpilledAlarms inserts a batch from the head of queue, the alarms of each type are removed
+// from the queue after they are inserted
+func replaySpilledAlarms() (count int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to replay the spilled alarms: ", r)
+		}
+	}()
+	items, err := spillQueue.Peek(spillReplayBatchSize)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+	types := make([]string, 0)
+	alarms := make(map[string][]map[string]interface{})
+	keys := make(map[string][]uint64)
+	invalidKeys := make([]uint64, 0)
+	for _, item := range items {
+		var alarm spilledAlarm
+		if err := json.Unmarshal(item.Value, &alarm); err != nil || alarmInfos[alarm.EsType] == nil {
+			beego.Error("invalid spilled alarm is removed: " + string(item.Value))
+			invalidKeys = append(invalidKeys, item.Key)
+			continue
+		}
+		if _, ok := alarms[alarm.EsType]; !ok {
+			types = append(types, alarm.EsType)
+		}
+		alarms[alarm.EsType] = append(alarms[alarm.EsType], alarm.Alarm)
+		keys[alarm.EsType] = append(keys[alarm.EsType], item.Key)
+	}
+	if err = spillQueue.Remove(invalidKeys...); err != nil {
+		return 0, err
+	}
+	for _, esType := range types {
+		insertErr := es.BulkInsert(esType, alarms[esType])
+		failed := failedAlarms(insertErr, alarms[esType])
+		if insertErr != nil && len(failed) == len(alarms[esType]) {
+			return count, insertErr
+		}
+		// the batch is removed and the alarms not inserted are appended again in a transaction,
+		// so the space of the batch is released for them and they are not lost on a crash in between
+		if err = requeueAlarms(esType, keys[esType], failed); err != nil {
+			return count, err
+		}
+		atomic.AddInt64(&getSpillCounter(esType).replayed, int64(len(keys[esType])-len(failed)))
+		count += len(keys[esType]) - len(failed)
+		if insertErr != nil {
+			return count, insertErr
+		}
+	}
+	atomic.StoreInt64(&lastReplayTime, time.Now().UnixNano()/1000000)
+	return count + len(invalidKeys), nil
+}
+
+// dropAlarms counts the dropped alarms, the error log is limited to once a minute
+func dropAlarms(alarmType string, count int, reason string) {
+	atomic.AddInt64(&getSpillCounter(alarmType).dropped, int64(count))
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&lastDropLogTime)
+	if now-last >= int64(spillDropLogInterval/time.Second) && atomic.CompareAndSwapInt64(&lastDropLogTime, last, now) {
+		beego.Error("failed to write " + alarmType + " to ES, " + strconv.Itoa(count) +
+			" alarms are dropped, " + reason)
+	}
+}
+
+func getSpillCounter(alarmType string) *spillCounter {
+	spillCounterLock.Lock()
+	defer spillCounterLock.Unlock()
+	counter, ok := spillCounters[alarmType]
+	if !ok {
+		counter = &spillCounter{}
+		spillCounters[alarmType] = counter
+	}
+	return counter
+}
+
+func setSpillError(err error) {
+	spillStatusLock.Lock()
+	defer spillStatusLock.Unlock()
+	lastSpillError = err.Error()
+}
+
+// GetSpillQueueStatus returns the depth of the spill queue and the counts of spilled, replayed
+// and dropped alarms of each type since rasp-cloud starts
+func GetSpillQueueStatus() *SpillQueueStatus {
+	status := &SpillQueueStatus{
+		Enabled:        spillQueue != nil,
+		Spilled:        make(map[string]int64),
+		Replayed:       make(map[string]int64),
+		Dropped:        make(map[string]int64),
+		LastReplayTime: atomic.LoadInt64(&lastReplayTime),
+	}
+	if spillQueue != nil {
+		status.Depth = spillQueue.Len()
+		status.MaxSize = spillQueue.MaxSize()
+	}
+	spillCounterLock.Lock()
+	for alarmType, counter := range spillCounters {
+		status.Spilled[alarmType] = atomic.LoadInt64(&counter.spilled)
+		status.Replayed[alarmType] = atomic.LoadInt64(&counter.replayed)
+		status.Dropped[alarmType] = atomic.LoadInt64(&counter.dropped)
+	}
+	spillCounterLock.Unlock()
+	spillStatusLock.RLock()
+	status.LastError = lastSpillError
+	spillStatusLock.RUnlock()
+	return status
+}
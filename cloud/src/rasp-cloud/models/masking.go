@@ -0,0 +1,102 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"time"
+)
+
+// Masking is the masking config of alarms for an app, the default config is used without it
+type Masking struct {
+	AppId              string `json:"app_id" bson:"_id"`
+	logs.MaskingConfig `bson:",inline"`
+	IsDefault          bool  `json:"is_default" bson:"-"`
+	UpdateTime         int64 `json:"update_time" bson:"update_time"`
+}
+
+const (
+	maskingCollectionName = "masking"
+)
+
+func init() {
+	logs.AppMaskingLoader = loadAppMasking
+}
+
+// GetMaskingByAppId returns the masking config of the app, or the default config if the app has none
+func GetMaskingByAppId(appId string) (*Masking, error) {
+	var masking Masking
+	err := mongo.FindId(maskingCollectionName, appId, &masking)
+	if err == mgo.ErrNotFound {
+		return &Masking{AppId: appId, MaskingConfig: *logs.GetDefaultMaskingConfig(), IsDefault: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &masking, nil
+}
+
+// UpdateMasking sets the masking config of the app, it takes effect on this node at once,
+// and on the other nodes after their cached config expires
+func UpdateMasking(appId string, config *logs.MaskingConfig) (*Masking, error) {
+	if config == nil {
+		return nil, errors.New("config can not be empty")
+	}
+	if config.Detectors == nil {
+		config.Detectors = []string{}
+	}
+	if config.Rules == nil {
+		config.Rules = []*logs.MaskingRule{}
+	}
+	if err := logs.ValidateMaskingConfig(config); err != nil {
+		return nil, err
+	}
+	masking := &Masking{
+		AppId:         appId,
+		MaskingConfig: *config,
+		UpdateTime:    time.Now().UnixNano() / 1000000,
+	}
+	if err := mongo.UpsertId(maskingCollectionName, appId, masking); err != nil {
+		return nil, err
+	}
+	logs.ResetAppMasking(appId)
+	return masking, nil
+}
+
+// RemoveMaskingByAppId removes the masking config of the app, the default config is used after it
+func RemoveMaskingByAppId(appId string) error {
+	err := mongo.RemoveId(maskingCollectionName, appId)
+	logs.ResetAppMasking(appId)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func loadAppMasking(appId string) (*logs.MaskingConfig, error) {
+	var masking Masking
+	err := mongo.FindId(maskingCollectionName, appId, &masking)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &masking.MaskingConfig, nil
+}
@@ -55,6 +55,22 @@ const (
 	OperationTypeDeleteApp
 	OperationTypeEditApp
 	OperationTypeRestorePlugin
+	OperationTypeUpdateEmailTemplate
+	OperationTypeAddDigest
+	OperationTypeEditDigest
+	OperationTypeDeleteDigest
+	OperationTypeExportLogs
+	OperationTypeAddSavedSearch
+	OperationTypeEditSavedSearch
+	OperationTypeDeleteSavedSearch
+	OperationTypeUpdateTriage
+	OperationTypeCommentTriage
+	OperationTypeUpdateRetention
+	OperationTypeUpdateMasking
+	OperationTypeAddHostGroup
+	OperationTypeEditHostGroup
+	OperationTypeDeleteHostGroup
+	OperationTypeUpdateRaspLabels
 )
 
 func init() {
@@ -242,45 +242,45 @@ func validAlgorithmConfig(plugin *Plugin, config map[string]interface{}) error {
 }
 
 func handleAlgorithmConfig(plugin *Plugin, config map[string]interface{}) (appId string, err error) {
-	content, err := json.MarshalIndent(config, "", "\t")
+	algorithmContent, newMd5, err := buildAlgorithmContent(plugin.Content, config)
 	if err != nil {
 		return "", err
 	}
+	return plugin.AppId, mongo.UpdateId(pluginCollectionName, plugin.Id, bson.M{"content": algorithmContent,
+		"algorithm_config": config, "md5": newMd5})
+}
+
+// buildAlgorithmContent replaces the algorithmConfig variable in the plugin content, it returns the new
+// content and its md5
+func buildAlgorithmContent(pluginContent string, config map[string]interface{}) (string, string, error) {
+	content, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return "", "", err
+	}
 	regex := `//\s*BEGIN\s*ALGORITHM\s*CONFIG\s*//[\W\w]*?//\s*END\s*ALGORITHM\s*CONFIG\s*//`
 	newContent := "// BEGIN ALGORITHM CONFIG //\n\n" +
 		"var algorithmConfig = " +
 		string(content) + "\n\n// END ALGORITHM CONFIG //"
 	if variable := regexp.MustCompile(regex).
-		FindString(plugin.Content); len(variable) <= 0 {
-		return "", errors.New("failed to find algorithmConfig variable")
+		FindString(pluginContent); len(variable) <= 0 {
+		return "", "", errors.New("failed to find algorithmConfig variable")
 	}
-	algorithmContent := regexp.MustCompile(regex).ReplaceAllString(plugin.Content, newContent)
-	newMd5 := fmt.Sprintf("%x", md5.Sum([]byte(algorithmContent)))
-	return plugin.AppId, mongo.UpdateId(pluginCollectionName, plugin.Id, bson.M{"content": algorithmContent,
-		"algorithm_config": config, "md5": newMd5})
+	algorithmContent := regexp.MustCompile(regex).ReplaceAllString(pluginContent, newContent)
+	return algorithmContent, fmt.Sprintf("%x", md5.Sum([]byte(algorithmContent))), nil
 }
 
 func GetPluginById(id string, hasContent bool) (plugin *Plugin, err error) {
-	newSession := mongo.NewSession()
-	defer newSession.Close()
-	query := newSession.DB(mongo.DbName).C(pluginCollectionName).FindId(id)
 	if hasContent {
-		err = query.One(&plugin)
+		err = mongo.FindId(pluginCollectionName, id, &plugin)
 	} else {
-		err = query.Select(bson.M{"content": 0}).One(&plugin)
+		err = mongo.FindIdWithSelect(pluginCollectionName, id, &plugin, bson.M{"content": 0})
 	}
 	return
 }
 
 func GetPluginsByApp(appId string, skip int, limit int) (total int, plugins []Plugin, err error) {
-	newSession := mongo.NewSession()
-	defer newSession.Close()
-	total, err = newSession.DB(mongo.DbName).C(pluginCollectionName).Find(bson.M{"app_id": appId}).Count()
-	if err != nil {
-		return
-	}
-	err = newSession.DB(mongo.DbName).C(pluginCollectionName).Find(bson.M{"app_id": appId}).Select(bson.M{"content": 0}).
-		Sort("-upload_time").Skip(skip).Limit(limit).All(&plugins)
+	total, err = mongo.FindAllWithSelectBySort(pluginCollectionName, bson.M{"app_id": appId}, &plugins,
+		bson.M{"content": 0}, skip, limit, "-upload_time")
 	if plugins == nil {
 		plugins = make([]Plugin, 0)
 	}
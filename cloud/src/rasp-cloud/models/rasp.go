@@ -22,6 +22,10 @@ import (
 	"time"
 	"strconv"
 	"errors"
+	"fmt"
+	"rasp-cloud/models/logs"
+	"sort"
+	"regexp"
 )
 
 type Rasp struct {
@@ -41,10 +45,22 @@ type Rasp struct {
 	LastHeartbeatTime int64             `json:"last_heartbeat_time" bson:"last_heartbeat_time,omitempty"`
 	RegisterTime      int64             `json:"register_time" bson:"register_time,omitempty"`
 	Environ           map[string]string `json:"environ" bson:"environ,omitempty"`
+	Labels            map[string]string `json:"labels" bson:"labels,omitempty"`
+	CustomLabels      map[string]string `json:"custom_labels" bson:"custom_labels,omitempty"`
+	ConfigTime        int64             `json:"config_time" bson:"config_time,omitempty"`
 }
 
 const (
-	raspCollectionName = "rasp"
+	raspCollectionName     = "rasp"
+	maxVersionAggrRaspSize = 10000
+	unknownRaspVersion     = "unknown"
+	maxLabelCount          = 32
+	maxLabelValueLength    = 256
+)
+
+var (
+	// the key of label is a part of the field path in query, so that the dot is not allowed
+	labelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,62}$`)
 )
 
 func init() {
@@ -119,6 +135,20 @@ func FindRasp(selector *Rasp, page int, perpage int) (count int, result []*Rasp,
 		}
 		delete(bsonModel, "hostname")
 	}
+	delete(bsonModel, "custom_labels")
+	delete(bsonModel, "config_time")
+	if len(selector.Labels) > 0 {
+		// the custom labels set by admins override the labels of agent with the same key
+		delete(bsonModel, "labels")
+		labelQuery := make([]bson.M, 0, len(selector.Labels))
+		for key, value := range selector.Labels {
+			labelQuery = append(labelQuery, bson.M{"$or": []bson.M{
+				{"custom_labels." + key: value},
+				{"labels." + key: value, "custom_labels." + key: bson.M{"$exists": false}},
+			}})
+		}
+		bsonModel["$and"] = labelQuery
+	}
 	if selector.Online != nil {
 		delete(bsonModel, "online")
 		if *selector.Online {
@@ -143,6 +173,22 @@ func FindRasp(selector *Rasp, page int, perpage int) (count int, result []*Rasp,
 	return
 }
 
+// GetRaspOnlineCount returns the count of all rasps and online rasps of the app, the empty app id means all apps
+func GetRaspOnlineCount(appId string) (total int, online int, err error) {
+	query := bson.M{}
+	if appId != "" {
+		query["app_id"] = appId
+	}
+	total, err = mongo.CountWithQuery(raspCollectionName, query)
+	if err != nil {
+		return
+	}
+	query["$where"] = "this.last_heartbeat_time+this.heartbeat_interval+180 >= " +
+		strconv.FormatInt(time.Now().Unix(), 10)
+	online, err = mongo.CountWithQuery(raspCollectionName, query)
+	return
+}
+
 func GetRaspById(id string) (rasp *Rasp, err error) {
 	err = mongo.FindId(raspCollectionName, id, &rasp)
 	if err == nil {
@@ -163,6 +209,53 @@ func HandleRasp(rasp *Rasp) {
 	if rasp.Environ == nil {
 		rasp.Environ = map[string]string{}
 	}
+	if rasp.Labels == nil {
+		rasp.Labels = map[string]string{}
+	}
+	if rasp.CustomLabels == nil {
+		rasp.CustomLabels = map[string]string{}
+	}
+}
+
+// ValidRaspLabels checks the labels of rasp, the key is made of letters, digits, '_' and '-'
+func ValidRaspLabels(labels map[string]string) error {
+	if len(labels) > maxLabelCount {
+		return errors.New("the count of labels cannot be greater than " + strconv.Itoa(maxLabelCount))
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return errors.New("invalid label key: " + key +
+				", it must be made of letters, digits, '_' and '-', and not longer than 63")
+		}
+		if len(value) > maxLabelValueLength {
+			return errors.New("the length of label value cannot be greater than " +
+				strconv.Itoa(maxLabelValueLength))
+		}
+	}
+	return nil
+}
+
+// GetRaspLabels returns the labels of agent overridden by the custom labels set by admins
+func GetRaspLabels(rasp *Rasp) map[string]string {
+	labels := make(map[string]string, len(rasp.Labels)+len(rasp.CustomLabels))
+	for key, value := range rasp.Labels {
+		labels[key] = value
+	}
+	for key, value := range rasp.CustomLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// UpdateRaspCustomLabels sets the custom labels of rasp, the config is sent to the rasp again on its next
+// heartbeat, since the host groups it is in may be changed
+func UpdateRaspCustomLabels(id string, labels map[string]string) (*Rasp, error) {
+	err := mongo.UpdateId(raspCollectionName, id, bson.M{"custom_labels": labels,
+		"config_time": time.Now().UnixNano()})
+	if err != nil {
+		return nil, err
+	}
+	return GetRaspById(id)
 }
 
 func RemoveRaspById(id string) (err error) {
@@ -196,3 +289,51 @@ func RemoveRaspBySelector(selector map[string]interface{}, appId string) (int, e
 	}
 	return info.Removed, nil
 }
+
+// AggregationErrorWithVersion returns the count of error alarms of each agent version, like [[version, count]],
+// the error alarms carry no agent version, so that the version is looked up by the rasp_id of alarms
+func AggregationErrorWithVersion(startTime int64, endTime int64, size int, appId string) ([][]interface{}, error) {
+	raspResult, err := logs.AggregationErrorWithField(startTime, endTime, "rasp_id", maxVersionAggrRaspSize, appId)
+	if err != nil {
+		return nil, err
+	}
+	raspIds := make([]string, 0, len(raspResult))
+	for _, item := range raspResult {
+		raspIds = append(raspIds, fmt.Sprint(item[0]))
+	}
+	var rasps []*Rasp
+	if len(raspIds) > 0 {
+		_, err = mongo.FindAllWithSelect(raspCollectionName, bson.M{"_id": bson.M{"$in": raspIds}}, &rasps,
+			bson.M{"version": 1}, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	raspVersions := make(map[string]string, len(rasps))
+	for _, rasp := range rasps {
+		raspVersions[rasp.Id] = rasp.Version
+	}
+	versionCounts := make(map[string]int64)
+	for _, item := range raspResult {
+		version := raspVersions[fmt.Sprint(item[0])]
+		if version == "" {
+			version = unknownRaspVersion
+		}
+		count, _ := item[1].(int64)
+		versionCounts[version] += count
+	}
+	result := make([][]interface{}, 0, len(versionCounts))
+	for version, count := range versionCounts {
+		result = append(result, []interface{}{version, count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i][1].(int64) != result[j][1].(int64) {
+			return result[i][1].(int64) > result[j][1].(int64)
+		}
+		return result[i][0].(string) < result[j][0].(string)
+	})
+	if len(result) > size {
+		result = result[:size]
+	}
+	return result, nil
+}
@@ -32,19 +32,24 @@ var (
 	ReportIndexName      = "openrasp-report-data"
 	AliasReportIndexName = "real-openrasp-report-data"
 	reportType           = "report-data"
+	ReportDataTtlTime    = 24 * 100 * time.Hour
 )
 
 func init() {
-	es.RegisterTTL(24*100*time.Hour, AliasReportIndexName+"-*")
+	es.RegisterTTL(ReportDataTtlTime, ReportIndexName)
 }
 
 func CreateReportDataEsIndex(appId string) error {
-	return es.CreateEsIndex(ReportIndexName + "-" + appId)
+	return es.CreateRollingIndex(ReportIndexName, appId)
 }
 
 func AddReportData(reportData *ReportData, appId string) error {
 	reportData.InsertTime = time.Now().Unix() * 1000
-	return es.Insert(AliasReportIndexName+"-"+appId, reportType, reportData)
+	index, err := es.GetWriteIndex(ReportIndexName, appId)
+	if err != nil {
+		return err
+	}
+	return es.Insert(index, reportType, reportData)
 }
 
 func GetHistoryRequestSum(startTime int64, endTime int64, interval string, timeZone string,
@@ -58,9 +63,9 @@ func GetHistoryRequestSum(startTime int64, endTime int64, interval string, timeZ
 	requestSumAggr := elastic.NewSumAggregation().Field("request_sum")
 	timeAggr.SubAggregation(sumAggrName, requestSumAggr)
 	timeQuery := elastic.NewRangeQuery("time").Gte(startTime).Lte(endTime)
-	aggrResult, err := es.ElasticClient.Search(AliasReportIndexName + "-" + appId).
+	aggrResult, err := es.Search(AliasReportIndexName + "-" + appId).
 		Query(timeQuery).
-		Aggregation(timeAggrName, timeAggr).
+		Aggregation(timeAggrName, es.DateHistogram(timeAggr)).
 		Size(0).
 		Do(ctx)
 	if err != nil {
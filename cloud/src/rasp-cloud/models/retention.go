@@ -0,0 +1,238 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/es"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Retention struct {
+	AppId      string         `json:"app_id" bson:"_id"`
+	Days       map[string]int `json:"days" bson:"days"`
+	UpdateTime int64          `json:"update_time" bson:"update_time"`
+}
+
+type RetentionInfo struct {
+	AppId       string         `json:"app_id"`
+	Days        map[string]int `json:"days"`
+	DefaultDays map[string]int `json:"default_days"`
+	CustomDays  map[string]int `json:"custom_days"`
+	UpdateTime  int64          `json:"update_time"`
+}
+
+type AppStorage struct {
+	AppId       string                 `json:"app_id"`
+	DocCount    int64                  `json:"doc_count"`
+	SizeInBytes int64                  `json:"size_in_bytes"`
+	Types       map[string]*LogStorage `json:"types"`
+}
+
+type LogStorage struct {
+	Indices     []string `json:"indices"`
+	DocCount    int64    `json:"doc_count"`
+	SizeInBytes int64    `json:"size_in_bytes"`
+}
+
+type retentionLogType struct {
+	index   string
+	ttlTime time.Duration
+}
+
+const (
+	retentionCollectionName = "retention"
+	RetentionTypeAttack     = "attack"
+	RetentionTypePolicy     = "policy"
+	RetentionTypeError      = "error"
+	RetentionTypeReport     = "report"
+	MaxRetentionDays        = 3650
+)
+
+var (
+	RetentionTypes    = []string{RetentionTypeAttack, RetentionTypePolicy, RetentionTypeError, RetentionTypeReport}
+	retentionLogTypes = map[string]*retentionLogType{
+		RetentionTypeAttack: {logs.AttackAlarmInfo.EsIndex, logs.AttackAlarmInfo.TtlTime},
+		RetentionTypePolicy: {logs.PolicyAlarmInfo.EsIndex, logs.PolicyAlarmInfo.TtlTime},
+		RetentionTypeError:  {logs.ErrorAlarmInfo.EsIndex, logs.ErrorAlarmInfo.TtlTime},
+		RetentionTypeReport: {ReportIndexName, ReportDataTtlTime},
+	}
+)
+
+func init() {
+	es.AppTTLLoader = loadAppTTLs
+}
+
+// GetRetentionByAppId returns the retention days of each log type for the app,
+// the default days are used for the types without custom retention
+func GetRetentionByAppId(appId string) (*RetentionInfo, error) {
+	var retention Retention
+	err := mongo.FindId(retentionCollectionName, appId, &retention)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	info := &RetentionInfo{
+		AppId:       appId,
+		Days:        make(map[string]int),
+		DefaultDays: make(map[string]int),
+		CustomDays:  make(map[string]int),
+		UpdateTime:  retention.UpdateTime,
+	}
+	for _, logType := range RetentionTypes {
+		defaultDays := int(retentionLogTypes[logType].ttlTime / (24 * time.Hour))
+		info.DefaultDays[logType] = defaultDays
+		info.Days[logType] = defaultDays
+		if days, ok := retention.Days[logType]; ok && days > 0 {
+			info.Days[logType] = days
+			info.CustomDays[logType] = days
+		}
+	}
+	return info, nil
+}
+
+// UpdateRetention sets the retention days of the log types for the app,
+// the type with 0 days is restored to the default retention
+func UpdateRetention(appId string, days map[string]int) (*RetentionInfo, error) {
+	if len(days) == 0 {
+		return nil, errors.New("days can not be empty")
+	}
+	for logType, day := range days {
+		if _, ok := retentionLogTypes[logType]; !ok {
+			return nil, errors.New("unsupported log type: " + logType)
+		}
+		if day < 0 || day > MaxRetentionDays {
+			return nil, errors.New("the days of " + logType + " must be between 0 and " +
+				strconv.Itoa(MaxRetentionDays))
+		}
+	}
+	var retention Retention
+	err := mongo.FindId(retentionCollectionName, appId, &retention)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	if retention.Days == nil {
+		retention.Days = make(map[string]int)
+	}
+	for logType, day := range days {
+		if day == 0 {
+			delete(retention.Days, logType)
+		} else {
+			retention.Days[logType] = day
+		}
+	}
+	retention.AppId = appId
+	retention.UpdateTime = time.Now().UnixNano() / 1000000
+	err = mongo.UpsertId(retentionCollectionName, appId, &retention)
+	if err != nil {
+		return nil, err
+	}
+	return GetRetentionByAppId(appId)
+}
+
+func RemoveRetentionByAppId(appId string) error {
+	err := mongo.RemoveId(retentionCollectionName, appId)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// loadAppTTLs returns the custom retention of all apps for the TTL task of es,
+// it is loaded before each run so that the changes take effect without restart
+func loadAppTTLs() (map[string]map[string]time.Duration, error) {
+	var retentions []*Retention
+	_, err := mongo.FindAllWithoutLimit(retentionCollectionName, bson.M{}, &retentions)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]time.Duration)
+	for _, retention := range retentions {
+		for logType, days := range retention.Days {
+			logTypeInfo, ok := retentionLogTypes[logType]
+			if !ok || days <= 0 {
+				continue
+			}
+			if result[logTypeInfo.index] == nil {
+				result[logTypeInfo.index] = make(map[string]time.Duration)
+			}
+			result[logTypeInfo.index][retention.AppId] = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return result, nil
+}
+
+// GetAppStorage returns the docs count and store size of the indices for each app,
+// all apps are returned if the appId is empty
+func GetAppStorage(appId string) ([]*AppStorage, error) {
+	storages := make(map[string]*AppStorage)
+	var allIndices []string
+	for _, logType := range RetentionTypes {
+		prefix := es.GetAliasName(retentionLogTypes[logType].index, "")
+		aliasPattern := prefix + "*"
+		if appId != "" {
+			aliasPattern = prefix + appId
+		}
+		aliasIndices, err := es.GetAliasIndices(aliasPattern)
+		if err != nil {
+			return nil, err
+		}
+		for alias, indices := range aliasIndices {
+			aliasAppId := strings.TrimPrefix(alias, prefix)
+			storage, ok := storages[aliasAppId]
+			if !ok {
+				storage = &AppStorage{AppId: aliasAppId, Types: make(map[string]*LogStorage)}
+				storages[aliasAppId] = storage
+			}
+			storage.Types[logType] = &LogStorage{Indices: indices}
+			allIndices = append(allIndices, indices...)
+		}
+	}
+	stats, err := es.GetIndexStats(allIndices...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*AppStorage, 0, len(storages))
+	for _, storage := range storages {
+		for _, logStorage := range storage.Types {
+			for _, index := range logStorage.Indices {
+				stat, ok := stats[index]
+				if !ok || stat == nil {
+					continue
+				}
+				if stat.Primaries != nil && stat.Primaries.Docs != nil {
+					logStorage.DocCount += stat.Primaries.Docs.Count
+				}
+				if stat.Total != nil && stat.Total.Store != nil {
+					logStorage.SizeInBytes += stat.Total.Store.SizeInBytes
+				}
+			}
+			storage.DocCount += logStorage.DocCount
+			storage.SizeInBytes += logStorage.SizeInBytes
+		}
+		result = append(result, storage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SizeInBytes > result[j].SizeInBytes
+	})
+	return result, nil
+}
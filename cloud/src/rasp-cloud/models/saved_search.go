@@ -0,0 +1,332 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/conf"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type SavedSearch struct {
+	Id            string                 `json:"id" bson:"_id"`
+	Name          string                 `json:"name" bson:"name"`
+	Owner         string                 `json:"owner" bson:"owner"`
+	Shared        bool                   `json:"shared" bson:"shared"`
+	LogType       string                 `json:"log_type" bson:"log_type"`
+	AppId         string                 `json:"app_id" bson:"app_id"`
+	TimeRange     string                 `json:"time_range" bson:"time_range"`
+	StartTime     int64                  `json:"start_time" bson:"start_time"`
+	EndTime       int64                  `json:"end_time" bson:"end_time"`
+	Data          map[string]interface{} `json:"data" bson:"data"`
+	Alarm         SavedSearchAlarm       `json:"alarm" bson:"alarm"`
+	LastAlarmTime int64                  `json:"last_alarm_time" bson:"last_alarm_time"`
+	CreateTime    int64                  `json:"create_time" bson:"create_time"`
+	UpdateTime    int64                  `json:"update_time" bson:"update_time"`
+}
+
+// SavedSearchAlarm pushes the alarm with the alarm config of app,
+// when the count of new logs matched by the search reaches the threshold
+type SavedSearchAlarm struct {
+	Enable    bool  `json:"enable" bson:"enable"`
+	Threshold int64 `json:"threshold" bson:"threshold"`
+}
+
+const (
+	savedSearchCollectionName = "saved_search"
+	SavedSearchLogTypeAttack  = "attack"
+	SavedSearchLogTypePolicy  = "policy"
+	SavedSearchLogTypeError   = "error"
+	maxSavedSearchTimeRange   = 366 * 24 * time.Hour
+)
+
+var (
+	SavedSearchLogTypes = map[string]*logs.AlarmLogInfo{
+		SavedSearchLogTypeAttack: &logs.AttackAlarmInfo,
+		SavedSearchLogTypePolicy: &logs.PolicyAlarmInfo,
+		SavedSearchLogTypeError:  &logs.ErrorAlarmInfo,
+	}
+	timeRangeRegex = regexp.MustCompile(`^([1-9][0-9]{0,5})([mhdw])$`)
+	timeRangeUnits = map[string]time.Duration{
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"owner"},
+		Unique:     false,
+		Background: true,
+		Name:       "owner",
+	}
+	err := mongo.CreateIndex(savedSearchCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create owner index for saved_search collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"app_id"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id",
+	}
+	err = mongo.CreateIndex(savedSearchCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id index for saved_search collection", err)
+	}
+	if *conf.AppConfig.Flag.StartType == conf.StartTypeDefault ||
+		*conf.AppConfig.Flag.StartType == conf.StartTypeForeground {
+		go startSavedSearchAlarmTicker(time.Second * time.Duration(conf.AppConfig.AlarmCheckInterval))
+	}
+}
+
+func startSavedSearchAlarmTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			HandleSavedSearchAlarms()
+		}
+	}
+}
+
+// HandleSavedSearchAlarms pushes the alarms of the saved searches whose new logs reach the threshold
+func HandleSavedSearchAlarms() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to handle saved search alarm: ", r)
+		}
+	}()
+	var searches []*SavedSearch
+	_, err := mongo.FindAllWithoutLimit(savedSearchCollectionName, bson.M{"alarm.enable": true}, &searches)
+	if err != nil {
+		beego.Error("failed to get saved search alarms: " + err.Error())
+		return
+	}
+	now := time.Now().UnixNano() / 1000000
+	for _, search := range searches {
+		// claim the period first so that only one server pushes the alarm
+		claimed, err := claimSavedSearchAlarm(search, now)
+		if err != nil {
+			beego.Error("failed to update the alarm time of saved search " + search.Name + ": " + err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		err = pushSavedSearchAlarm(search, search.LastAlarmTime, now)
+		if err != nil {
+			beego.Error("failed to push the alarm of saved search " + search.Name + ": " + err.Error())
+		}
+	}
+}
+
+func claimSavedSearchAlarm(search *SavedSearch, alarmTime int64) (bool, error) {
+	err := mongo.Update(savedSearchCollectionName,
+		bson.M{"_id": search.Id, "last_alarm_time": search.LastAlarmTime},
+		bson.M{"$set": bson.M{"last_alarm_time": alarmTime + 1}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func pushSavedSearchAlarm(search *SavedSearch, startTime int64, endTime int64) error {
+	if search.LogType != SavedSearchLogTypeAttack || search.AppId == "" {
+		return errors.New("only the attack searches of an app support alarm")
+	}
+	app, err := GetAppByIdWithoutMask(search.AppId)
+	if err != nil {
+		return err
+	}
+	query, err := GetSavedSearchQuery(search)
+	if err != nil {
+		return err
+	}
+	total, result, err := logs.SearchLogs(startTime, endTime, false, query, "event_time",
+		1, 10, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+search.AppId)
+	if err != nil {
+		return err
+	}
+	if total > 0 && total >= search.Alarm.Threshold {
+		PushAttackAlarm(app, total, result, false)
+	}
+	return nil
+}
+
+// ParseTimeRange parses the relative time range like "30m", "24h", "7d" and "2w"
+func ParseTimeRange(timeRange string) (time.Duration, error) {
+	matches := timeRangeRegex.FindStringSubmatch(timeRange)
+	if matches == nil {
+		return 0, errors.New("invalid time range: " + timeRange +
+			", it must be a number followed by one of the units m, h, d and w")
+	}
+	count, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, err
+	}
+	duration := time.Duration(count) * timeRangeUnits[matches[2]]
+	if duration > maxSavedSearchTimeRange {
+		return 0, errors.New("the time range can not be greater than 366 days")
+	}
+	return duration, nil
+}
+
+// GetSavedSearchTime returns the time range of the saved search in milliseconds,
+// the relative time range ends at the given time
+func GetSavedSearchTime(search *SavedSearch, now time.Time) (startTime int64, endTime int64, err error) {
+	if search.TimeRange == "" {
+		return search.StartTime, search.EndTime, nil
+	}
+	duration, err := ParseTimeRange(search.TimeRange)
+	if err != nil {
+		return 0, 0, err
+	}
+	endTime = now.UnixNano() / 1000000
+	startTime = now.Add(-duration).UnixNano() / 1000000
+	return
+}
+
+// GetSavedSearchQuery returns the search data of the saved search which can be used to search logs
+func GetSavedSearchQuery(search *SavedSearch) (map[string]interface{}, error) {
+	info, ok := SavedSearchLogTypes[search.LogType]
+	if !ok {
+		return nil, errors.New("unsupported log type: " + search.LogType)
+	}
+	query := make(map[string]interface{}, len(search.Data))
+	for key, value := range search.Data {
+		query[key] = value
+	}
+	delete(query, "start_time")
+	delete(query, "end_time")
+	delete(query, "app_id")
+	err := logs.HandleSearchQuery(info.EsType, query)
+	if err != nil {
+		return nil, err
+	}
+	if search.LogType == SavedSearchLogTypeAttack {
+		err = HandleTriageSearchData(search.AppId, TriageTargetEvent, "_id", query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+func AddSavedSearch(search *SavedSearch) (*SavedSearch, error) {
+	search.Id = mongo.GenerateObjectId()
+	search.CreateTime = time.Now().Unix()
+	search.UpdateTime = search.CreateTime
+	// only the logs after the creation are alarmed
+	search.LastAlarmTime = time.Now().UnixNano() / 1000000
+	err := mongo.Insert(savedSearchCollectionName, search)
+	if err != nil {
+		return nil, err
+	}
+	HandleSavedSearch(search)
+	return search, nil
+}
+
+func UpdateSavedSearch(search *SavedSearch, oldSearch *SavedSearch) (*SavedSearch, error) {
+	update := bson.M{
+		"name":        search.Name,
+		"shared":      search.Shared,
+		"log_type":    search.LogType,
+		"app_id":      search.AppId,
+		"time_range":  search.TimeRange,
+		"start_time":  search.StartTime,
+		"end_time":    search.EndTime,
+		"data":        search.Data,
+		"alarm":       search.Alarm,
+		"update_time": time.Now().Unix(),
+	}
+	if search.Alarm.Enable && !oldSearch.Alarm.Enable {
+		update["last_alarm_time"] = time.Now().UnixNano() / 1000000
+	}
+	err := mongo.UpdateId(savedSearchCollectionName, search.Id, update)
+	if err != nil {
+		return nil, err
+	}
+	return GetSavedSearchById(search.Id)
+}
+
+func GetSavedSearchById(id string) (search *SavedSearch, err error) {
+	err = mongo.FindId(savedSearchCollectionName, id, &search)
+	if err == nil {
+		HandleSavedSearch(search)
+	}
+	return
+}
+
+// GetSavedSearches returns the saved searches of the owner and the searches shared by others
+func GetSavedSearches(owner string, logType string, appId string, page int,
+	perpage int) (count int, result []*SavedSearch, err error) {
+	query := bson.M{"$or": []bson.M{{"owner": owner}, {"shared": true}}}
+	if logType != "" {
+		query["log_type"] = logType
+	}
+	if appId != "" {
+		query["app_id"] = appId
+	}
+	count, err = mongo.FindAll(savedSearchCollectionName, query, &result, perpage*(page-1), perpage, "-update_time")
+	if err == nil {
+		for _, search := range result {
+			HandleSavedSearch(search)
+		}
+	}
+	if result == nil {
+		result = make([]*SavedSearch, 0)
+	}
+	return
+}
+
+func RemoveSavedSearchById(id string) (search *SavedSearch, err error) {
+	search, err = GetSavedSearchById(id)
+	if err != nil {
+		return
+	}
+	count, err := mongo.CountWithQuery(digestCollectionName, bson.M{"saved_search_id": id})
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("the saved search is used by " + strconv.Itoa(count) + " digests")
+	}
+	return search, mongo.RemoveId(savedSearchCollectionName, id)
+}
+
+func RemoveSavedSearchByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(savedSearchCollectionName, bson.M{"app_id": appId})
+	return
+}
+
+func HandleSavedSearch(search *SavedSearch) {
+	if search.Data == nil {
+		search.Data = make(map[string]interface{})
+	}
+}
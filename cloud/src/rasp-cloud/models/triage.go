@@ -0,0 +1,361 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/olivere/elastic"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/mongo"
+	"rasp-cloud/tools"
+	"strconv"
+	"time"
+)
+
+// Triage is the triage state of an attack event or a vulnerability (the attacks with the same stack_md5),
+// the attack logs in es are never modified
+type Triage struct {
+	Id         string           `json:"id" bson:"_id"`
+	AppId      string           `json:"app_id" bson:"app_id"`
+	TargetType string           `json:"target_type" bson:"target_type"`
+	TargetId   string           `json:"target_id" bson:"target_id"`
+	State      string           `json:"state" bson:"state"`
+	Assignee   string           `json:"assignee" bson:"assignee"`
+	Tags       []string         `json:"tags" bson:"tags"`
+	Comments   []*TriageComment `json:"comments" bson:"comments"`
+	CreateTime int64            `json:"create_time" bson:"create_time"`
+	UpdateTime int64            `json:"update_time" bson:"update_time"`
+}
+
+type TriageComment struct {
+	User    string `json:"user" bson:"user"`
+	Content string `json:"content" bson:"content"`
+	Time    int64  `json:"time" bson:"time"`
+}
+
+const (
+	triageCollectionName      = "triage"
+	TriageTargetEvent         = "event"
+	TriageTargetVuln          = "vuln"
+	TriageStateNew            = "new"
+	TriageStateConfirmed      = "confirmed"
+	TriageStateFalsePositive  = "false_positive"
+	TriageStateFixed          = "fixed"
+	TriageStateIgnored        = "ignored"
+	maxTriageComments         = 200
+	maxTriageFilterSize       = 10000
+	triageSearchStateField    = "triage_state"
+	triageSearchAssigneeField = "assignee"
+	triageSearchTagField      = "tag"
+	triageSearchCompiledField = "triage"
+)
+
+var (
+	TriageTargets = []string{TriageTargetEvent, TriageTargetVuln}
+	TriageStates  = []string{TriageStateNew, TriageStateConfirmed, TriageStateFalsePositive,
+		TriageStateFixed, TriageStateIgnored}
+)
+
+func init() {
+	index := &mgo.Index{
+		Key:        []string{"app_id", "target_type", "target_id"},
+		Unique:     true,
+		Background: true,
+		Name:       "app_id_target",
+	}
+	err := mongo.CreateIndex(triageCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create app_id_target index for triage collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"target_type", "state"},
+		Unique:     false,
+		Background: true,
+		Name:       "target_type_state",
+	}
+	err = mongo.CreateIndex(triageCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create target_type_state index for triage collection", err)
+	}
+}
+
+func IsValidTriageState(state string) bool {
+	for _, item := range TriageStates {
+		if item == state {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidTriageTarget(targetType string) bool {
+	for _, item := range TriageTargets {
+		if item == targetType {
+			return true
+		}
+	}
+	return false
+}
+
+func getTriageSelector(appId string, targetType string, targetId string) bson.M {
+	return bson.M{"app_id": appId, "target_type": targetType, "target_id": targetId}
+}
+
+// UpdateTriage creates or updates the state, assignee and tags of the target
+func UpdateTriage(triage *Triage) (*Triage, error) {
+	now := time.Now().Unix()
+	if triage.Tags == nil {
+		triage.Tags = make([]string, 0)
+	}
+	_, err := mongo.Upsert(triageCollectionName,
+		getTriageSelector(triage.AppId, triage.TargetType, triage.TargetId),
+		bson.M{
+			"$set": bson.M{
+				"state":       triage.State,
+				"assignee":    triage.Assignee,
+				"tags":        triage.Tags,
+				"update_time": now,
+			},
+			"$setOnInsert": bson.M{
+				"_id":         mongo.GenerateObjectId(),
+				"comments":    make([]*TriageComment, 0),
+				"create_time": now,
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return GetTriage(triage.AppId, triage.TargetType, triage.TargetId)
+}
+
+// AddTriageComment appends the comment to the target, only the latest comments are kept
+func AddTriageComment(appId string, targetType string, targetId string, comment *TriageComment) (*Triage, error) {
+	now := time.Now().Unix()
+	comment.Time = now
+	_, err := mongo.Upsert(triageCollectionName,
+		getTriageSelector(appId, targetType, targetId),
+		bson.M{
+			"$set": bson.M{"update_time": now},
+			"$push": bson.M{"comments": bson.M{
+				"$each":  []*TriageComment{comment},
+				"$slice": -maxTriageComments,
+			}},
+			"$setOnInsert": bson.M{
+				"_id":         mongo.GenerateObjectId(),
+				"state":       TriageStateNew,
+				"assignee":    "",
+				"tags":        make([]string, 0),
+				"create_time": now,
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return GetTriage(appId, targetType, targetId)
+}
+
+// GetTriage returns the triage of the target, a new triage is returned if it has not been triaged
+func GetTriage(appId string, targetType string, targetId string) (triage *Triage, err error) {
+	err = mongo.FindOne(triageCollectionName, getTriageSelector(appId, targetType, targetId), &triage)
+	if err == mgo.ErrNotFound {
+		triage = &Triage{AppId: appId, TargetType: targetType, TargetId: targetId, State: TriageStateNew}
+		err = nil
+	}
+	if err == nil {
+		HandleTriage(triage)
+	}
+	return
+}
+
+func FindTriages(param *Triage, page int, perpage int) (count int, result []*Triage, err error) {
+	query := bson.M{}
+	if param.AppId != "" {
+		query["app_id"] = param.AppId
+	}
+	if param.TargetType != "" {
+		query["target_type"] = param.TargetType
+	}
+	if param.State != "" {
+		query["state"] = param.State
+	}
+	if param.Assignee != "" {
+		query["assignee"] = param.Assignee
+	}
+	if len(param.Tags) > 0 {
+		query["tags"] = bson.M{"$all": param.Tags}
+	}
+	count, err = mongo.FindAll(triageCollectionName, query, &result, perpage*(page-1), perpage, "-update_time")
+	if err == nil {
+		for _, triage := range result {
+			HandleTriage(triage)
+		}
+	}
+	if result == nil {
+		result = make([]*Triage, 0)
+	}
+	return
+}
+
+func RemoveTriageByAppId(appId string) (err error) {
+	_, err = mongo.RemoveAll(triageCollectionName, bson.M{"app_id": appId})
+	return
+}
+
+func HandleTriage(triage *Triage) {
+	if triage.Tags == nil {
+		triage.Tags = make([]string, 0)
+	}
+	if triage.Comments == nil {
+		triage.Comments = make([]*TriageComment, 0)
+	}
+}
+
+// JoinTriages sets the triage of each search result, the target id of result is read from the idField
+func JoinTriages(targetType string, idField string, results []map[string]interface{}) error {
+	if len(results) == 0 {
+		return nil
+	}
+	targetIds := make([]string, 0, len(results))
+	for _, result := range results {
+		targetIds = append(targetIds, fmt.Sprint(result[idField]))
+	}
+	var triages []*Triage
+	_, err := mongo.FindAllWithoutLimit(triageCollectionName,
+		bson.M{"target_type": targetType, "target_id": bson.M{"$in": targetIds}}, &triages)
+	if err != nil {
+		return err
+	}
+	triageMap := make(map[string]*Triage, len(triages))
+	for _, triage := range triages {
+		HandleTriage(triage)
+		triageMap[triage.AppId+"/"+triage.TargetId] = triage
+	}
+	for _, result := range results {
+		appId := fmt.Sprint(result["app_id"])
+		targetId := fmt.Sprint(result[idField])
+		if triage, ok := triageMap[appId+"/"+targetId]; ok {
+			result["triage"] = triage
+		} else {
+			result["triage"] = &Triage{AppId: appId, TargetType: targetType, TargetId: targetId,
+				State: TriageStateNew, Tags: make([]string, 0), Comments: make([]*TriageComment, 0)}
+		}
+	}
+	return nil
+}
+
+// HandleTriageSearchData replaces the triage fields of the search data with the es query of the matched targets,
+// the target ids are matched with the esField, such as _id for events and stack_md5 for vulnerabilities
+func HandleTriageSearchData(appId string, targetType string, esField string,
+	searchData map[string]interface{}) error {
+	var states []string
+	if value, ok := searchData[triageSearchStateField]; ok {
+		items, ok := value.([]interface{})
+		if !ok {
+			return errors.New("the triage_state must be an array")
+		}
+		for _, item := range items {
+			state := fmt.Sprint(item)
+			if !IsValidTriageState(state) {
+				return errors.New("unsupported triage state: " + state)
+			}
+			states = append(states, state)
+		}
+	}
+	assignee, _ := searchData[triageSearchAssigneeField].(string)
+	tag, _ := searchData[triageSearchTagField].(string)
+	delete(searchData, triageSearchStateField)
+	delete(searchData, triageSearchAssigneeField)
+	delete(searchData, triageSearchTagField)
+	if len(states) == 0 && assignee == "" && tag == "" {
+		return nil
+	}
+	query := bson.M{"target_type": targetType}
+	if appId != "" && appId != "*" {
+		query["app_id"] = appId
+	}
+	if assignee != "" {
+		query["assignee"] = assignee
+	}
+	if tag != "" {
+		query["tags"] = tag
+	}
+	// the targets without triage are new, so they are matched by excluding the targets in other states
+	isExcluded := false
+	if len(states) > 0 {
+		hasNew := false
+		for _, state := range states {
+			if state == TriageStateNew {
+				hasNew = true
+			}
+		}
+		if hasNew && assignee == "" && tag == "" {
+			isExcluded = true
+			query["state"] = bson.M{"$nin": states}
+		} else {
+			query["state"] = bson.M{"$in": states}
+		}
+	}
+	var triages []*Triage
+	_, err := mongo.FindAllWithSelect(triageCollectionName, query, &triages, bson.M{"app_id": 1, "target_id": 1},
+		0, maxTriageFilterSize+1)
+	if err != nil {
+		return err
+	}
+	if len(triages) > maxTriageFilterSize {
+		return errors.New("the count of matched triage records cannot be greater than " +
+			strconv.Itoa(maxTriageFilterSize) + ", please narrow the triage filter")
+	}
+	// the targets are matched in the apps of their triages, since the same stack_md5 may be in the other apps
+	appIds := make([]string, 0)
+	appTargetIds := make(map[string][]string)
+	for _, triage := range triages {
+		if _, ok := appTargetIds[triage.AppId]; !ok {
+			appIds = append(appIds, triage.AppId)
+		}
+		appTargetIds[triage.AppId] = append(appTargetIds[triage.AppId], triage.TargetId)
+	}
+	var targetQuery elastic.Query = buildTriageTargetQuery(esField, nil)
+	if len(appIds) > 0 {
+		appQueries := make([]elastic.Query, 0, len(appIds))
+		for _, id := range appIds {
+			appQueries = append(appQueries, elastic.NewBoolQuery().Filter(elastic.NewTermQuery("app_id", id),
+				buildTriageTargetQuery(esField, appTargetIds[id])))
+		}
+		targetQuery = elastic.NewBoolQuery().Should(appQueries...).MinimumNumberShouldMatch(1)
+	}
+	if isExcluded {
+		searchData[triageSearchCompiledField] = elastic.NewBoolQuery().MustNot(targetQuery)
+	} else {
+		searchData[triageSearchCompiledField] = targetQuery
+	}
+	return nil
+}
+
+// buildTriageTargetQuery returns the es query of the targets, which matches nothing if there is no target
+func buildTriageTargetQuery(esField string, targetIds []string) elastic.Query {
+	if esField == "_id" {
+		return elastic.NewIdsQuery().Ids(targetIds...)
+	}
+	values := make([]interface{}, 0, len(targetIds))
+	for _, id := range targetIds {
+		values = append(values, id)
+	}
+	return elastic.NewTermsQuery(esField, values...)
+}
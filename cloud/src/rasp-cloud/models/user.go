@@ -15,6 +15,8 @@
 package models
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
@@ -154,6 +156,18 @@ func GetLoginUserName() (userName string, err error) {
 //	return user.Password, nil
 //}
 
+// GetRequestUser returns the user of the request authenticated by the cookie or the token,
+// the requests authenticated by a token are identified by the hash of the token
+func GetRequestUser(cookie string, token string) (string, error) {
+	if has, err := HasCookie(cookie); has && err == nil {
+		return GetLoginUserName()
+	}
+	if has, err := HasToken(token); !has || err != nil {
+		return "", errors.New("the request is not authenticated")
+	}
+	return fmt.Sprintf("token:%x", sha1.Sum([]byte(token))), nil
+}
+
 func VerifyUser(userName string, pwd string) error {
 	var user *User
 	err := mongo.FindId(userCollectionName, userId, &user)
@@ -0,0 +1,108 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package mongo
+
+import (
+	"gopkg.in/mgo.v2"
+	"rasp-cloud/storage"
+)
+
+// mgoStore is the metadata store of MongoDB, each operation uses a copy of the session
+type mgoStore struct {
+	session *mgo.Session
+}
+
+func (store *mgoStore) Count(collection string, selector interface{}) (int, error) {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Find(selector).Count()
+}
+
+func (store *mgoStore) CreateIndex(collection string, index *mgo.Index) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).EnsureIndex(*index)
+}
+
+func (store *mgoStore) Insert(collection string, docs ...interface{}) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Insert(docs...)
+}
+
+func (store *mgoStore) Find(collection string, query *storage.Query, result interface{}) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return store.query(newSession, collection, query).All(result)
+}
+
+func (store *mgoStore) FindOne(collection string, query *storage.Query, result interface{}) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return store.query(newSession, collection, query).One(result)
+}
+
+func (store *mgoStore) query(session *mgo.Session, collection string, query *storage.Query) *mgo.Query {
+	result := session.DB(DbName).C(collection).Find(query.Selector)
+	if query.Projection != nil {
+		result = result.Select(query.Projection)
+	}
+	if len(query.Sort) > 0 {
+		result = result.Sort(query.Sort...)
+	}
+	if query.Skip > 0 {
+		result = result.Skip(query.Skip)
+	}
+	if query.Limit > 0 {
+		result = result.Limit(query.Limit)
+	}
+	return result
+}
+
+func (store *mgoStore) Update(collection string, selector interface{}, update interface{}) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Update(selector, update)
+}
+
+func (store *mgoStore) UpdateAll(collection string, selector interface{},
+	update interface{}) (*mgo.ChangeInfo, error) {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).UpdateAll(selector, update)
+}
+
+func (store *mgoStore) Upsert(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Upsert(selector, update)
+}
+
+func (store *mgoStore) Remove(collection string, selector interface{}) error {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Remove(selector)
+}
+
+func (store *mgoStore) RemoveAll(collection string, selector interface{}) (*mgo.ChangeInfo, error) {
+	newSession := store.session.Copy()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).RemoveAll(selector)
+}
+
+func (store *mgoStore) Close() {
+	store.session.Close()
+}
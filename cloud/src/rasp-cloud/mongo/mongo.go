@@ -26,15 +26,22 @@ import (
 	"crypto/sha1"
 	"strings"
 	"rasp-cloud/conf"
+	"rasp-cloud/storage"
 )
 
 var (
 	minMongoVersion = "3.6.0"
-	session         *mgo.Session
-	DbName          = conf.AppConfig.MongoDBName
+	// store is the MongoDB or the embedded metadata store
+	store  storage.MetaStore
+	DbName = conf.AppConfig.MongoDBName
 )
 
 func init() {
+	if storage.IsEmbedded() {
+		store = storage.OpenEmbeddedMetaStore()
+		beego.Info("use the embedded metadata store")
+		return
+	}
 	var err error
 	dialInfo := &mgo.DialInfo{
 		Addrs:     []string{conf.AppConfig.MongoDBAddr},
@@ -46,7 +53,7 @@ func init() {
 		PoolLimit: conf.AppConfig.MongoDBPoolLimit,
 		Database:  DbName,
 	}
-	session, err = mgo.DialWithInfo(dialInfo)
+	session, err := mgo.DialWithInfo(dialInfo)
 	if err != nil {
 		tools.Panic(tools.ErrCodeMongoInitFailed, "failed to find MongoDB server: ", err)
 	}
@@ -64,112 +71,108 @@ func init() {
 	}
 
 	session.SetMode(mgo.Strong, true)
+	store = &mgoStore{session: session}
 }
 
-func NewSession() *mgo.Session {
-	return session.Copy()
+func Count(collection string) (int, error) {
+	return store.Count(collection, nil)
 }
 
-func Count(collection string) (int, error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).Count()
+func CountWithQuery(collection string, query interface{}) (int, error) {
+	return store.Count(collection, query)
 }
 
 func CreateIndex(collection string, index *mgo.Index) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).EnsureIndex(*index)
+	return store.CreateIndex(collection, index)
 }
 
 func Insert(collection string, doc interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).Insert(doc)
+	return store.Insert(collection, doc)
 }
 
 func UpsertId(collection string, id interface{}, doc interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	_, err := newSession.DB(DbName).C(collection).UpsertId(id, doc)
+	_, err := store.Upsert(collection, bson.M{"_id": id}, doc)
 	return err
 }
 
+// Upsert updates the first matched document with the update operators, the document is inserted if not exists
+func Upsert(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return store.Upsert(collection, selector, update)
+}
+
 func FindAll(collection string, query interface{}, result interface{}, skip int, limit int,
 	sortFields ...string) (count int, err error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	count, err = newSession.DB(DbName).C(collection).Find(query).Count()
-	if err != nil {
-		return
-	}
-	err = newSession.DB(DbName).C(collection).Find(query).Skip(skip).Limit(limit).Sort(sortFields...).All(result)
-	return
+	return findAll(collection, &storage.Query{Selector: query, Sort: sortFields, Skip: skip, Limit: limit}, result)
 }
 
 func FindAllWithoutLimit(collection string, query interface{}, result interface{},
 	sortFields ...string) (count int, err error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	count, err = newSession.DB(DbName).C(collection).Find(query).Count()
-	if err != nil {
-		return
-	}
-	err = newSession.DB(DbName).C(collection).Find(query).Sort(sortFields...).All(result)
-	return
+	return findAll(collection, &storage.Query{Selector: query, Sort: sortFields}, result)
 }
 
 func FindAllWithSelect(collection string, query interface{}, result interface{}, selector interface{},
 	skip int, limit int) (count int, err error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	count, err = newSession.DB(DbName).C(collection).Find(query).Count()
-	if err != nil {
-		return
-	}
-	err = newSession.DB(DbName).C(collection).Find(query).Select(selector).Skip(skip).Limit(limit).All(result)
-	return
+	return findAll(collection, &storage.Query{Selector: query, Projection: selector, Skip: skip, Limit: limit},
+		result)
+}
+
+func FindAllWithSelectBySort(collection string, query interface{}, result interface{}, selector interface{},
+	skip int, limit int, sortFields ...string) (count int, err error) {
+	return findAll(collection, &storage.Query{Selector: query, Projection: selector, Sort: sortFields,
+		Skip: skip, Limit: limit}, result)
 }
 
 func FindId(collection string, id string, result interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).FindId(id).One(result)
+	return store.FindOne(collection, &storage.Query{Selector: bson.M{"_id": id}}, result)
+}
+
+func FindIdWithSelect(collection string, id string, result interface{}, selector interface{}) error {
+	return store.FindOne(collection, &storage.Query{Selector: bson.M{"_id": id}, Projection: selector}, result)
 }
 
 func FindOne(collection string, query interface{}, result interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).Find(query).One(result)
+	return store.FindOne(collection, &storage.Query{Selector: query}, result)
 }
 
 func FindAllBySort(collection string, query interface{}, skip int, limit int, result interface{},
 	sortFields ...string) (count int, err error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	count, err = newSession.DB(DbName).C(collection).Find(query).Count()
+	return findAll(collection, &storage.Query{Selector: query, Sort: sortFields, Skip: skip, Limit: limit}, result)
+}
+
+func findAll(collection string, query *storage.Query, result interface{}) (count int, err error) {
+	count, err = store.Count(collection, query.Selector)
 	if err != nil {
 		return
 	}
-	return count, newSession.DB(DbName).C(collection).Find(query).Sort(sortFields...).Skip(skip).Limit(limit).All(result)
+	err = store.Find(collection, query, result)
+	return
 }
 
 func UpdateId(collection string, id interface{}, doc interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).UpdateId(id, bson.M{"$set": doc})
+	return store.Update(collection, bson.M{"_id": id}, bson.M{"$set": doc})
+}
+
+// Update updates the first matched document with the update operators,
+// mgo.ErrNotFound is returned if there is no matched document
+func Update(collection string, selector interface{}, update interface{}) error {
+	return store.Update(collection, selector, update)
+}
+
+func UpdateAll(collection string, selector interface{}, doc interface{}) (*mgo.ChangeInfo, error) {
+	return store.UpdateAll(collection, selector, bson.M{"$set": doc})
+}
+
+// UpdateAllWithModifier updates all matched documents with the update operators
+func UpdateAllWithModifier(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return store.UpdateAll(collection, selector, update)
 }
 
 func RemoveId(collection string, id interface{}) error {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).RemoveId(id)
+	return store.Remove(collection, bson.M{"_id": id})
 }
 
 func RemoveAll(collection string, selector interface{}) (*mgo.ChangeInfo, error) {
-	newSession := NewSession()
-	defer newSession.Close()
-	return newSession.DB(DbName).C(collection).RemoveAll(selector)
+	return store.RemoveAll(collection, selector)
 }
 
 func GenerateObjectId() string {
@@ -7,6 +7,24 @@ import (
 
 func init() {
 
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"],
+        beego.ControllerComments{
+            Method: "AggregationWithField",
+            Router: `/aggr/field`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"],
+        beego.ControllerComments{
+            Method: "AggregationWithGeo",
+            Router: `/aggr/geo`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
     beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"],
         beego.ControllerComments{
             Method: "AggregationWithTime",
@@ -43,6 +61,15 @@ func init() {
             Filters: nil,
             Params: nil})
 
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"],
+        beego.ControllerComments{
+            Method: "Export",
+            Router: `/export`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
     beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:AttackAlarmController"],
         beego.ControllerComments{
             Method: "Search",
@@ -52,6 +79,42 @@ func init() {
             Filters: nil,
             Params: nil})
 
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"],
+        beego.ControllerComments{
+            Method: "AggregationWithField",
+            Router: `/aggr/field`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"],
+        beego.ControllerComments{
+            Method: "AggregationWithTime",
+            Router: `/aggr/time`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"],
+        beego.ControllerComments{
+            Method: "AggregationWithVersion",
+            Router: `/aggr/version`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"],
+        beego.ControllerComments{
+            Method: "Export",
+            Router: `/export`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
     beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:ErrorController"],
         beego.ControllerComments{
             Method: "Search",
@@ -61,6 +124,33 @@ func init() {
             Filters: nil,
             Params: nil})
 
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"],
+        beego.ControllerComments{
+            Method: "AggregationWithField",
+            Router: `/aggr/field`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"],
+        beego.ControllerComments{
+            Method: "AggregationWithTime",
+            Router: `/aggr/time`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
+    beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"],
+        beego.ControllerComments{
+            Method: "Export",
+            Router: `/export`,
+            AllowHTTPMethods: []string{"post"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
     beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers/api/fore_logs:PolicyAlarmController"],
         beego.ControllerComments{
             Method: "Search",
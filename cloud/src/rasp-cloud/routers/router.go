@@ -114,6 +114,36 @@ func InitRouter() {
 				&api.ServerController{},
 			),
 		),
+		beego.NSNamespace("/digest",
+			beego.NSInclude(
+				&api.DigestController{},
+			),
+		),
+		beego.NSNamespace("/export",
+			beego.NSInclude(
+				&api.ExportController{},
+			),
+		),
+		beego.NSNamespace("/search",
+			beego.NSInclude(
+				&api.SavedSearchController{},
+			),
+		),
+		beego.NSNamespace("/triage",
+			beego.NSInclude(
+				&api.TriageController{},
+			),
+		),
+		beego.NSNamespace("/incident",
+			beego.NSInclude(
+				&api.IncidentController{},
+			),
+		),
+		beego.NSNamespace("/host_group",
+			beego.NSInclude(
+				&api.HostGroupController{},
+			),
+		),
 	)
 	userNS := beego.NewNamespace("/user", beego.NSInclude(&api.UserController{}))
 	pingNS := beego.NewNamespace("/ping", beego.NSInclude(&controllers.PingController{}))
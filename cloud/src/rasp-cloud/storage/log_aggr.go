@@ -0,0 +1,887 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the aggregations of the embedded log store, the results are the same as ElasticSearch
+// so that they can be parsed by the elastic client, the matched documents are collected while they are streamed
+
+const defaultTopHitsSize = 3
+
+var (
+	fixedIntervalRegex = regexp.MustCompile(`^(\d+)(ms|s|m|h|d)$`)
+	calendarUnits      = map[string]string{
+		"minute": "minute", "1m": "minute", "hour": "hour", "1h": "hour", "day": "day", "1d": "day",
+		"week": "week", "1w": "week", "month": "month", "1M": "month", "quarter": "quarter", "1q": "quarter",
+		"year": "year", "1y": "year",
+	}
+	fixedIntervalUnits = map[string]time.Duration{
+		"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour,
+	}
+)
+
+// logAggregator collects the matched documents one by one and returns the result of the aggregation,
+// so that the documents are not kept in memory
+type logAggregator interface {
+	collect(doc *logDoc) error
+	result() (map[string]interface{}, error)
+}
+
+type logAggregatorFactory func() logAggregator
+
+// logBucket is a bucket of the bucket aggregations with the sub aggregations of its documents
+type logBucket struct {
+	key      interface{}
+	docCount int
+	subAggrs map[string]logAggregator
+	aggrs    map[string]interface{}
+}
+
+// logBucketCollector groups the documents by the keys of their values, a document is counted once in each bucket
+type logBucketCollector struct {
+	field    string
+	key      func(value interface{}) interface{}
+	subAggrs map[string]logAggregatorFactory
+	buckets  map[interface{}]*logBucket
+	meta     *logIndexMeta
+}
+
+type termsAggregator struct {
+	*logBucketCollector
+	size        int
+	minDocCount int
+	orders      []termsOrder
+}
+
+// compositeAggregator pages through the buckets of all combinations of the source values in the order of keys
+type compositeAggregator struct {
+	sources  []compositeSource
+	size     int
+	after    []interface{}
+	subAggrs map[string]logAggregatorFactory
+	buckets  map[string]*logBucket
+}
+
+type compositeSource struct {
+	name       string
+	field      string
+	descending bool
+}
+
+type histogramAggregator struct {
+	*logBucketCollector
+	minDocCount int
+	bounds      []float64
+	next        func(key float64) float64
+	// location is the time zone of date histogram, nil for histogram
+	location *time.Location
+}
+
+type metricAggregator struct {
+	kind     string
+	field    string
+	value    interface{}
+	count    int
+	distinct map[interface{}]bool
+}
+
+type topHitsAggregator struct {
+	top    *logTopDocs
+	total  int
+	from   int
+	size   int
+	source interface{}
+}
+
+// compileAggregations compiles the aggregations of the search body to the factories of aggregators
+func compileAggregations(aggrs map[string]interface{}) (map[string]logAggregatorFactory, error) {
+	factories := make(map[string]logAggregatorFactory, len(aggrs))
+	for name, value := range aggrs {
+		body, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("the aggregation " + name + " must be an object")
+		}
+		factory, err := compileAggregation(body)
+		if err != nil {
+			return nil, err
+		}
+		factories[name] = factory
+	}
+	return factories, nil
+}
+
+func compileAggregation(body map[string]interface{}) (logAggregatorFactory, error) {
+	subAggrBody, _ := body["aggregations"].(map[string]interface{})
+	if subAggrBody == nil {
+		subAggrBody, _ = body["aggs"].(map[string]interface{})
+	}
+	subAggrs, err := compileAggregations(subAggrBody)
+	if err != nil {
+		return nil, err
+	}
+	for kind, value := range body {
+		if kind == "aggregations" || kind == "aggs" || kind == "meta" {
+			continue
+		}
+		param, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("the param of " + kind + " aggregation must be an object")
+		}
+		switch kind {
+		case "terms":
+			return compileTermsAggr(param, subAggrs)
+		case "composite":
+			return compileCompositeAggr(param, subAggrs)
+		case "date_histogram":
+			return compileDateHistogramAggr(param, subAggrs)
+		case "histogram":
+			return compileHistogramAggr(param, subAggrs)
+		case "min", "max", "sum", "avg", "value_count", "cardinality":
+			field := fmt.Sprint(param["field"])
+			return func() logAggregator {
+				return &metricAggregator{kind: kind, field: field, distinct: make(map[interface{}]bool)}
+			}, nil
+		case "top_hits":
+			return compileTopHitsAggr(param)
+		}
+		return nil, errors.New("unsupported aggregation of the embedded log store: " + kind)
+	}
+	return nil, errors.New("the type of aggregation can not be empty")
+}
+
+func newBucketCollector(field string, key func(value interface{}) interface{},
+	subAggrs map[string]logAggregatorFactory) *logBucketCollector {
+	return &logBucketCollector{field: field, key: key, subAggrs: subAggrs,
+		buckets: make(map[interface{}]*logBucket)}
+}
+
+func (collector *logBucketCollector) newBucket(key interface{}) *logBucket {
+	bucket := &logBucket{key: key, subAggrs: make(map[string]logAggregator, len(collector.subAggrs))}
+	for name, factory := range collector.subAggrs {
+		bucket.subAggrs[name] = factory()
+	}
+	return bucket
+}
+
+func (collector *logBucketCollector) collect(doc *logDoc) error {
+	if collector.meta == nil {
+		collector.meta = doc.meta
+	}
+	var seen map[interface{}]bool
+	for _, value := range docValues(doc, collector.field) {
+		bucketKey := collector.key(value)
+		if bucketKey == nil || seen[bucketKey] {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[interface{}]bool)
+		}
+		seen[bucketKey] = true
+		bucket, ok := collector.buckets[bucketKey]
+		if !ok {
+			bucket = collector.newBucket(bucketKey)
+			collector.buckets[bucketKey] = bucket
+		}
+		bucket.docCount++
+		for _, subAggr := range bucket.subAggrs {
+			if err := subAggr.collect(doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// computeSubAggrs computes the results of the sub aggregations of the buckets
+func computeSubAggrs(buckets []*logBucket) error {
+	for _, bucket := range buckets {
+		if len(bucket.subAggrs) == 0 || bucket.aggrs != nil {
+			continue
+		}
+		bucket.aggrs = make(map[string]interface{}, len(bucket.subAggrs))
+		for name, subAggr := range bucket.subAggrs {
+			result, err := subAggr.result()
+			if err != nil {
+				return err
+			}
+			bucket.aggrs[name] = result
+		}
+	}
+	return nil
+}
+
+func bucketResult(bucket *logBucket, key interface{}) map[string]interface{} {
+	result := map[string]interface{}{
+		"key":       key,
+		"doc_count": bucket.docCount,
+	}
+	for name, value := range bucket.aggrs {
+		result[name] = value
+	}
+	return result
+}
+
+func compileTermsAggr(param map[string]interface{},
+	subAggrs map[string]logAggregatorFactory) (logAggregatorFactory, error) {
+	field := fmt.Sprint(param["field"])
+	size := 10
+	if value, ok := logFloat(param["size"]); ok {
+		size = int(value)
+	}
+	minDocCount := 1
+	if value, ok := logFloat(param["min_doc_count"]); ok {
+		minDocCount = int(value)
+	}
+	orders, err := parseTermsOrder(param["order"])
+	if err != nil {
+		return nil, err
+	}
+	return func() logAggregator {
+		return &termsAggregator{
+			logBucketCollector: newBucketCollector(field, func(value interface{}) interface{} { return value },
+				subAggrs),
+			size:        size,
+			minDocCount: minDocCount,
+			orders:      orders,
+		}
+	}, nil
+}
+
+func (aggr *termsAggregator) result() (map[string]interface{}, error) {
+	buckets := make([]*logBucket, 0, len(aggr.buckets))
+	for _, bucket := range aggr.buckets {
+		if bucket.docCount >= aggr.minDocCount {
+			buckets = append(buckets, bucket)
+		}
+	}
+	// the buckets may be ordered by the sub aggregations
+	if err := computeSubAggrs(buckets); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		for _, order := range aggr.orders {
+			result := compareBuckets(buckets[i], buckets[j], order.key)
+			if result != 0 {
+				return order.descending && result > 0 || !order.descending && result < 0
+			}
+		}
+		result, _ := compareLogValues(buckets[i].key, buckets[j].key)
+		return result < 0
+	})
+	otherCount := 0
+	if aggr.size > 0 && len(buckets) > aggr.size {
+		for _, bucket := range buckets[aggr.size:] {
+			otherCount += bucket.docCount
+		}
+		buckets = buckets[:aggr.size]
+	}
+	fieldMeta := aggr.meta.field(aggr.field)
+	results := make([]interface{}, 0, len(buckets))
+	for _, bucket := range buckets {
+		result := bucketResult(bucket, bucketKey(bucket.key))
+		if fieldMeta.isDate() {
+			if millis, ok := bucket.key.(float64); ok {
+				result["key_as_string"] = formatDateMillis(millis, time.UTC)
+			}
+		}
+		results = append(results, result)
+	}
+	return map[string]interface{}{
+		"doc_count_error_upper_bound": 0,
+		"sum_other_doc_count":         otherCount,
+		"buckets":                     results,
+	}, nil
+}
+
+type termsOrder struct {
+	key        string
+	descending bool
+}
+
+// parseTermsOrder parses the order of terms aggregation, like [{"_count": "desc"}], the default is by count
+func parseTermsOrder(param interface{}) ([]termsOrder, error) {
+	var items []interface{}
+	switch value := param.(type) {
+	case nil:
+		return []termsOrder{{key: "_count", descending: true}}, nil
+	case []interface{}:
+		items = value
+	default:
+		items = []interface{}{value}
+	}
+	orders := make([]termsOrder, 0, len(items))
+	for _, item := range items {
+		orderMap, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid order of terms aggregation")
+		}
+		for key, direction := range orderMap {
+			orders = append(orders, termsOrder{key: key, descending: fmt.Sprint(direction) == "desc"})
+		}
+	}
+	return orders, nil
+}
+
+func compareBuckets(a *logBucket, b *logBucket, key string) int {
+	switch key {
+	case "_count":
+		return a.docCount - b.docCount
+	case "_key", "_term":
+		result, _ := compareLogValues(a.key, b.key)
+		return result
+	}
+	aValue, aOk := bucketMetric(a, key)
+	bValue, bOk := bucketMetric(b, key)
+	if !aOk || !bOk {
+		if aOk == bOk {
+			return 0
+		} else if aOk {
+			return 1
+		}
+		return -1
+	}
+	return compareFloat(aValue, bValue)
+}
+
+// bucketMetric returns the value of the sub metric aggregation, like attack_max_aggr or attack_max_aggr.value
+func bucketMetric(bucket *logBucket, path string) (float64, bool) {
+	name := path
+	property := "value"
+	if index := strings.Index(path, "."); index > 0 {
+		name, property = path[:index], path[index+1:]
+	}
+	aggr, ok := bucket.aggrs[name].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	return logFloat(aggr[property])
+}
+
+// compileCompositeAggr compiles the composite aggregation, only the terms sources are supported
+func compileCompositeAggr(param map[string]interface{},
+	subAggrs map[string]logAggregatorFactory) (logAggregatorFactory, error) {
+	sourceItems, ok := param["sources"].([]interface{})
+	if !ok || len(sourceItems) == 0 {
+		return nil, errors.New("the sources of composite aggregation can not be empty")
+	}
+	sources := make([]compositeSource, 0, len(sourceItems))
+	for _, item := range sourceItems {
+		sourceMap, ok := item.(map[string]interface{})
+		if !ok || len(sourceMap) != 1 {
+			return nil, errors.New("invalid source of composite aggregation")
+		}
+		for name, value := range sourceMap {
+			sourceBody, _ := value.(map[string]interface{})
+			terms, ok := sourceBody["terms"].(map[string]interface{})
+			if !ok {
+				return nil, errors.New("unsupported source of composite aggregation: " + name)
+			}
+			sources = append(sources, compositeSource{name: name, field: fmt.Sprint(terms["field"]),
+				descending: fmt.Sprint(terms["order"]) == "desc"})
+		}
+	}
+	size := 10
+	if value, ok := logFloat(param["size"]); ok {
+		size = int(value)
+	}
+	var after []interface{}
+	if afterMap, ok := param["after"].(map[string]interface{}); ok {
+		for _, source := range sources {
+			value, ok := afterMap[source.name]
+			if !ok {
+				return nil, errors.New("the after key of composite aggregation must contain " + source.name)
+			}
+			after = append(after, value)
+		}
+	}
+	return func() logAggregator {
+		return &compositeAggregator{sources: sources, size: size, after: after, subAggrs: subAggrs,
+			buckets: make(map[string]*logBucket)}
+	}, nil
+}
+
+func (aggr *compositeAggregator) collect(doc *logDoc) error {
+	// the documents without the value of any source are not in the buckets
+	keys := [][]interface{}{nil}
+	for _, source := range aggr.sources {
+		values := docValues(doc, source.field)
+		combinations := make([][]interface{}, 0, len(keys)*len(values))
+		for _, key := range keys {
+			for _, value := range values {
+				combination := make([]interface{}, len(key), len(key)+1)
+				copy(combination, key)
+				combinations = append(combinations, append(combination, value))
+			}
+		}
+		keys = combinations
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if aggr.after != nil && aggr.compareKeys(key, aggr.after) <= 0 {
+			continue
+		}
+		id := fmt.Sprintf("%#v", key)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		bucket, ok := aggr.buckets[id]
+		if !ok {
+			bucket = &logBucket{key: key, subAggrs: make(map[string]logAggregator, len(aggr.subAggrs))}
+			for name, factory := range aggr.subAggrs {
+				bucket.subAggrs[name] = factory()
+			}
+			aggr.buckets[id] = bucket
+		}
+		bucket.docCount++
+		for _, subAggr := range bucket.subAggrs {
+			if err := subAggr.collect(doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareKeys compares the keys by the order of sources, the strings are always compared as strings
+// so that the order of pages is stable
+func (aggr *compositeAggregator) compareKeys(a []interface{}, b []interface{}) int {
+	for i, source := range aggr.sources {
+		var result int
+		aStr, aOk := a[i].(string)
+		bStr, bOk := b[i].(string)
+		if aOk && bOk {
+			result = strings.Compare(aStr, bStr)
+		} else {
+			result, _ = compareLogValues(a[i], b[i])
+		}
+		if source.descending {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func (aggr *compositeAggregator) result() (map[string]interface{}, error) {
+	buckets := make([]*logBucket, 0, len(aggr.buckets))
+	for _, bucket := range aggr.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return aggr.compareKeys(buckets[i].key.([]interface{}), buckets[j].key.([]interface{})) < 0
+	})
+	if aggr.size > 0 && len(buckets) > aggr.size {
+		buckets = buckets[:aggr.size]
+	}
+	if err := computeSubAggrs(buckets); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, len(buckets))
+	var afterKey map[string]interface{}
+	for _, bucket := range buckets {
+		afterKey = make(map[string]interface{}, len(aggr.sources))
+		for i, source := range aggr.sources {
+			afterKey[source.name] = bucketKey(bucket.key.([]interface{})[i])
+		}
+		results = append(results, bucketResult(bucket, afterKey))
+	}
+	result := map[string]interface{}{"buckets": results}
+	if afterKey != nil {
+		result["after_key"] = afterKey
+	}
+	return result, nil
+}
+
+func compileDateHistogramAggr(param map[string]interface{},
+	subAggrs map[string]logAggregatorFactory) (logAggregatorFactory, error) {
+	field := fmt.Sprint(param["field"])
+	interval := ""
+	for _, key := range []string{"interval", "calendar_interval", "fixed_interval"} {
+		if value, ok := param[key]; ok {
+			interval = fmt.Sprint(value)
+		}
+	}
+	location, err := parseTimeZone(param["time_zone"])
+	if err != nil {
+		return nil, err
+	}
+	round, next, err := getDateRounding(interval, location)
+	if err != nil {
+		return nil, err
+	}
+	minDocCount := 0
+	if value, ok := logFloat(param["min_doc_count"]); ok {
+		minDocCount = int(value)
+	}
+	var bounds []float64
+	if extendedBounds, ok := param["extended_bounds"].(map[string]interface{}); ok {
+		for _, key := range []string{"min", "max"} {
+			if millis, ok := parseDateMillis(extendedBounds[key]); ok && extendedBounds[key] != nil {
+				bounds = append(bounds, round(millis))
+			}
+		}
+	}
+	return func() logAggregator {
+		return &histogramAggregator{
+			logBucketCollector: newBucketCollector(field, func(value interface{}) interface{} {
+				millis, ok := value.(float64)
+				if !ok {
+					return nil
+				}
+				return round(millis)
+			}, subAggrs),
+			minDocCount: minDocCount,
+			bounds:      bounds,
+			next:        next,
+			location:    location,
+		}
+	}, nil
+}
+
+func compileHistogramAggr(param map[string]interface{},
+	subAggrs map[string]logAggregatorFactory) (logAggregatorFactory, error) {
+	field := fmt.Sprint(param["field"])
+	interval, ok := logFloat(param["interval"])
+	if !ok || interval <= 0 {
+		return nil, errors.New("the interval of histogram aggregation must be greater than 0")
+	}
+	offset, _ := logFloat(param["offset"])
+	minDocCount := 0
+	if value, ok := logFloat(param["min_doc_count"]); ok {
+		minDocCount = int(value)
+	}
+	round := func(value float64) float64 {
+		return math.Floor((value-offset)/interval)*interval + offset
+	}
+	var bounds []float64
+	if extendedBounds, ok := param["extended_bounds"].(map[string]interface{}); ok {
+		for _, key := range []string{"min", "max"} {
+			if value, ok := logFloat(extendedBounds[key]); ok {
+				bounds = append(bounds, round(value))
+			}
+		}
+	}
+	return func() logAggregator {
+		return &histogramAggregator{
+			logBucketCollector: newBucketCollector(field, func(value interface{}) interface{} {
+				number, ok := logFloat(value)
+				if !ok {
+					return nil
+				}
+				return round(number)
+			}, subAggrs),
+			minDocCount: minDocCount,
+			bounds:      bounds,
+			next: func(key float64) float64 {
+				return key + interval
+			},
+		}
+	}, nil
+}
+
+func (aggr *histogramAggregator) result() (map[string]interface{}, error) {
+	buckets, err := aggr.sortBuckets()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, len(buckets))
+	for _, bucket := range buckets {
+		result := bucketResult(bucket, bucketKey(bucket.key))
+		if aggr.location != nil {
+			result["key_as_string"] = formatDateMillis(bucket.key.(float64), aggr.location)
+		}
+		results = append(results, result)
+	}
+	return map[string]interface{}{"buckets": results}, nil
+}
+
+// sortBuckets sorts the buckets by key, the empty buckets between the min and max keys are filled
+// if the min_doc_count is 0, the extended bounds extend the range of keys
+func (aggr *histogramAggregator) sortBuckets() ([]*logBucket, error) {
+	buckets := make([]*logBucket, 0, len(aggr.buckets))
+	if aggr.minDocCount == 0 {
+		keys := append([]float64(nil), aggr.bounds...)
+		for key := range aggr.buckets {
+			keys = append(keys, key.(float64))
+		}
+		if len(keys) > 0 {
+			sort.Float64s(keys)
+			// too many buckets make the memory exhausted
+			for key, count := keys[0], 0; key <= keys[len(keys)-1]; key, count = aggr.next(key), count+1 {
+				if count >= 100000 {
+					return nil, errors.New("too many buckets of histogram aggregation")
+				}
+				bucket, ok := aggr.buckets[key]
+				if !ok {
+					bucket = aggr.newBucket(key)
+				}
+				buckets = append(buckets, bucket)
+			}
+		}
+	} else {
+		for _, bucket := range aggr.buckets {
+			if bucket.docCount >= aggr.minDocCount {
+				buckets = append(buckets, bucket)
+			}
+		}
+		sort.Slice(buckets, func(i, j int) bool {
+			return buckets[i].key.(float64) < buckets[j].key.(float64)
+		})
+	}
+	return buckets, computeSubAggrs(buckets)
+}
+
+// getDateRounding returns the rounding of the interval and the next key of bucket, in milliseconds
+func getDateRounding(interval string, location *time.Location) (round func(millis float64) float64,
+	next func(key float64) float64, err error) {
+	if unit, ok := calendarUnits[interval]; ok {
+		round = func(millis float64) float64 {
+			return toMillis(roundCalendar(fromMillis(millis).In(location), unit))
+		}
+		next = func(key float64) float64 {
+			t := fromMillis(key).In(location)
+			switch unit {
+			case "minute":
+				t = t.Add(time.Minute)
+			case "hour":
+				t = t.Add(time.Hour)
+			case "day":
+				t = t.AddDate(0, 0, 1)
+			case "week":
+				t = t.AddDate(0, 0, 7)
+			case "month":
+				t = t.AddDate(0, 1, 0)
+			case "quarter":
+				t = t.AddDate(0, 3, 0)
+			default:
+				t = t.AddDate(1, 0, 0)
+			}
+			return toMillis(roundCalendar(t, unit))
+		}
+		return
+	}
+	groups := fixedIntervalRegex.FindStringSubmatch(interval)
+	if groups == nil {
+		return nil, nil, errors.New("unsupported interval of date histogram: " + interval)
+	}
+	amount, _ := strconv.Atoi(groups[1])
+	width := float64(time.Duration(amount)*fixedIntervalUnits[groups[2]]) / float64(time.Millisecond)
+	if width <= 0 {
+		return nil, nil, errors.New("the interval of date histogram must be greater than 0")
+	}
+	// the fixed interval is rounded in the local time of time zone
+	round = func(millis float64) float64 {
+		_, offset := fromMillis(millis).In(location).Zone()
+		offsetMillis := float64(offset * 1000)
+		return math.Floor((millis+offsetMillis)/width)*width - offsetMillis
+	}
+	next = func(key float64) float64 {
+		return round(key + width)
+	}
+	return
+}
+
+func roundCalendar(t time.Time, unit string) time.Time {
+	location := t.Location()
+	switch unit {
+	case "second":
+		return t.Truncate(time.Second)
+	case "minute":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, location)
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	case "week":
+		// the week starts on Monday like ElasticSearch
+		weekday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-weekday, 0, 0, 0, 0, location)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	case "quarter":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, location)
+	}
+	return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, location)
+}
+
+// parseTimeZone parses the time zone of ElasticSearch, like +08:00, -0500, UTC and Asia/Shanghai
+func parseTimeZone(param interface{}) (*time.Location, error) {
+	if param == nil {
+		return time.UTC, nil
+	}
+	zone := strings.TrimSpace(fmt.Sprint(param))
+	if zone == "" || zone == "Z" || strings.EqualFold(zone, "UTC") {
+		return time.UTC, nil
+	}
+	if zone[0] == '+' || zone[0] == '-' {
+		digits := strings.Replace(zone[1:], ":", "", 1)
+		if len(digits) <= 2 {
+			digits += "00"
+		}
+		if len(digits) == 3 {
+			digits = "0" + digits
+		}
+		hours, hourErr := strconv.Atoi(digits[:2])
+		minutes, minuteErr := strconv.Atoi(digits[2:])
+		if hourErr != nil || minuteErr != nil {
+			return nil, errors.New("invalid time zone: " + zone)
+		}
+		offset := hours*3600 + minutes*60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(zone, offset), nil
+	}
+	return time.LoadLocation(zone)
+}
+
+func (aggr *metricAggregator) collect(doc *logDoc) error {
+	for _, value := range docValues(doc, aggr.field) {
+		aggr.count++
+		if aggr.kind == "cardinality" {
+			aggr.distinct[value] = true
+			continue
+		}
+		if aggr.kind == "value_count" {
+			continue
+		}
+		number, ok := logFloat(value)
+		if !ok {
+			continue
+		}
+		current, _ := aggr.value.(float64)
+		switch {
+		case aggr.value == nil:
+			aggr.value = number
+		case aggr.kind == "min" && number < current:
+			aggr.value = number
+		case aggr.kind == "max" && number > current:
+			aggr.value = number
+		case aggr.kind == "sum" || aggr.kind == "avg":
+			aggr.value = current + number
+		}
+	}
+	return nil
+}
+
+func (aggr *metricAggregator) result() (map[string]interface{}, error) {
+	result := aggr.value
+	switch aggr.kind {
+	case "cardinality":
+		result = len(aggr.distinct)
+	case "value_count":
+		result = aggr.count
+	case "sum":
+		if result == nil {
+			result = 0
+		}
+	case "avg":
+		if result != nil {
+			result = result.(float64) / float64(aggr.count)
+		}
+	}
+	return map[string]interface{}{"value": result}, nil
+}
+
+func compileTopHitsAggr(param map[string]interface{}) (logAggregatorFactory, error) {
+	size := defaultTopHitsSize
+	if value, ok := logFloat(param["size"]); ok {
+		size = int(value)
+	}
+	from := 0
+	if value, ok := logFloat(param["from"]); ok {
+		from = int(value)
+	}
+	fields, err := parseSortFields(param["sort"])
+	if err != nil {
+		return nil, err
+	}
+	return func() logAggregator {
+		return &topHitsAggregator{top: newLogTopDocs(from+size, fields), from: from, size: size,
+			source: param["_source"]}
+	}, nil
+}
+
+func (aggr *topHitsAggregator) collect(doc *logDoc) error {
+	aggr.total++
+	aggr.top.add(doc)
+	return nil
+}
+
+func (aggr *topHitsAggregator) result() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"hits": buildHits(aggr.top.sorted(), aggr.total, aggr.from, aggr.size, aggr.source),
+	}, nil
+}
+
+// buildHits returns the hits of search response
+func buildHits(docs []*logDoc, total int, from int, size int, sourceParam interface{}) map[string]interface{} {
+	hits := make([]interface{}, 0)
+	for i := from; i < len(docs) && i < from+size; i++ {
+		hits = append(hits, buildHit(docs[i], sourceParam))
+	}
+	return map[string]interface{}{
+		"total":     total,
+		"max_score": nil,
+		"hits":      hits,
+	}
+}
+
+func buildHit(doc *logDoc, sourceParam interface{}) map[string]interface{} {
+	hit := map[string]interface{}{
+		"_index": doc.Index,
+		"_type":  doc.Type,
+		"_id":    doc.Id,
+		"_score": nil,
+	}
+	if source, ok := filterSource(doc, sourceParam); ok {
+		hit["_source"] = source
+	}
+	return hit
+}
+
+// bucketKey returns the integer key if it is an integer, so that it is encoded without decimal point
+func bucketKey(key interface{}) interface{} {
+	if number, ok := key.(float64); ok && isInteger(number) {
+		return int64(number)
+	}
+	return key
+}
+
+func formatDateMillis(millis float64, location *time.Location) string {
+	return fromMillis(millis).In(location).Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func fromMillis(millis float64) time.Time {
+	return time.Unix(0, int64(millis)*int64(time.Millisecond)).UTC()
+}
+
+func toMillis(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,970 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/bbolt"
+	"github.com/olivere/elastic"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// boltLogStore is the log store of bbolt, each index is a bucket with the documents, the keys of the indexed
+// fields and the doc counts, the searches find the candidates by the keys and stream the matched documents
+// to the hits and aggregations, so that the documents are neither scanned nor kept in memory all together
+
+const (
+	// the version of ElasticSearch that the embedded log store behaves like
+	EmbeddedEsVersion   = "6.8.0"
+	logMetaBucketName   = "_meta"
+	logIndexBucketName  = "index/"
+	logDocsBucketName   = "docs"
+	logKeysBucketName   = "keys"
+	logStatsBucketName  = "stats"
+	logMetaTemplatesKey = "templates"
+	logMetaIndicesKey   = "indices"
+	logDeleteBatchSize  = 1000
+	// the context of search is checked after the count of documents
+	logCheckInterval = 1000
+)
+
+// logFieldMeta is the mapping of a field in the index template
+type logFieldMeta struct {
+	Type        string `json:"type"`
+	Lowercase   bool   `json:"lowercase,omitempty"`
+	IgnoreAbove int    `json:"ignore_above,omitempty"`
+}
+
+type logTemplate struct {
+	Patterns []string                 `json:"patterns"`
+	Type     string                   `json:"type"`
+	Fields   map[string]*logFieldMeta `json:"fields"`
+}
+
+type logIndexMeta struct {
+	Type       string                   `json:"type"`
+	Aliases    []string                 `json:"aliases"`
+	Fields     map[string]*logFieldMeta `json:"fields"`
+	CreateTime int64                    `json:"create_time"`
+}
+
+type logDocKey struct {
+	index string
+	id    string
+}
+
+// logStoreError is the error like the error of ElasticSearch
+type logStoreError struct {
+	status    int
+	errorType string
+	reason    string
+	index     string
+}
+
+// logBulkAction is an action of the bulk requests
+type logBulkAction struct {
+	kind   string
+	index  string
+	id     string
+	source []byte
+}
+
+// logSearchRequest is the parsed search of the embedded log store
+type logSearchRequest struct {
+	indices      []string
+	query        map[string]interface{}
+	sortFields   []logSortField
+	source       interface{}
+	aggregations map[string]logAggregatorFactory
+}
+
+type boltLogStore struct {
+	db        *bolt.DB
+	lock      sync.RWMutex
+	templates map[string]*logTemplate
+	indices   map[string]*logIndexMeta
+}
+
+var unmappedField = &logFieldMeta{}
+
+func (e *logStoreError) Error() string {
+	return e.errorType + ": " + e.reason
+}
+
+func (meta *logIndexMeta) field(name string) *logFieldMeta {
+	if meta != nil {
+		if field, ok := meta.Fields[name]; ok {
+			return field
+		}
+	}
+	return unmappedField
+}
+
+func (field *logFieldMeta) isDate() bool {
+	return field.Type == "date"
+}
+
+func (field *logFieldMeta) isNumeric() bool {
+	switch field.Type {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float":
+		return true
+	}
+	return false
+}
+
+func openBoltLogStore(path string) (*boltLogStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltLogStore{
+		db:        db,
+		templates: make(map[string]*logTemplate),
+		indices:   make(map[string]*logIndexMeta),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(logMetaBucketName))
+		if err != nil {
+			return err
+		}
+		if content := bucket.Get([]byte(logMetaTemplatesKey)); content != nil {
+			if err := json.Unmarshal(content, &store.templates); err != nil {
+				return err
+			}
+		}
+		if content := bucket.Get([]byte(logMetaIndicesKey)); content != nil {
+			if err := json.Unmarshal(content, &store.indices); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *boltLogStore) Close() {
+	store.db.Close()
+}
+
+// PutTemplate saves the mappings of the template, which are applied to the new indices matching the patterns
+func (store *boltLogStore) PutTemplate(name string, esType string, body string) error {
+	var content struct {
+		Template      string                 `json:"template"`
+		IndexPatterns interface{}            `json:"index_patterns"`
+		Settings      map[string]interface{} `json:"settings"`
+		Mappings      map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(body), &content); err != nil {
+		return err
+	}
+	template := &logTemplate{Patterns: toStrings(content.IndexPatterns), Type: esType,
+		Fields: make(map[string]*logFieldMeta)}
+	if content.Template != "" {
+		template.Patterns = append(template.Patterns, content.Template)
+	}
+	if len(template.Patterns) == 0 {
+		return errors.New("the index patterns of template can not be empty")
+	}
+	mappings, ok := content.Mappings[esType].(map[string]interface{})
+	if !ok {
+		mappings = content.Mappings
+	}
+	lowercaseNormalizers := getLowercaseNormalizers(content.Settings)
+	if properties, ok := mappings["properties"].(map[string]interface{}); ok {
+		parseMappingFields(properties, "", lowercaseNormalizers, template.Fields)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.templates[name] = template
+	return store.saveMeta(logMetaTemplatesKey, store.templates)
+}
+
+func getLowercaseNormalizers(settings map[string]interface{}) map[string]bool {
+	result := make(map[string]bool)
+	analysis, _ := settings["analysis"].(map[string]interface{})
+	if index, ok := settings["index"].(map[string]interface{}); ok && analysis == nil {
+		analysis, _ = index["analysis"].(map[string]interface{})
+	}
+	normalizers, _ := analysis["normalizer"].(map[string]interface{})
+	for name, value := range normalizers {
+		normalizer, _ := value.(map[string]interface{})
+		for _, filter := range toStrings(normalizer["filter"]) {
+			if filter == "lowercase" {
+				result[name] = true
+			}
+		}
+	}
+	return result
+}
+
+func parseMappingFields(properties map[string]interface{}, prefix string, lowercaseNormalizers map[string]bool,
+	fields map[string]*logFieldMeta) {
+	for name, value := range properties {
+		property, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if subProperties, ok := property["properties"].(map[string]interface{}); ok {
+			parseMappingFields(subProperties, prefix+name+".", lowercaseNormalizers, fields)
+			continue
+		}
+		field := &logFieldMeta{Type: fmt.Sprint(property["type"])}
+		if normalizer, ok := property["normalizer"].(string); ok {
+			field.Lowercase = lowercaseNormalizers[normalizer]
+		}
+		if ignoreAbove, ok := logFloat(property["ignore_above"]); ok {
+			field.IgnoreAbove = int(ignoreAbove)
+		}
+		fields[prefix+name] = field
+	}
+}
+
+// CreateIndex creates the index with the mappings of the matched templates
+func (store *boltLogStore) CreateIndex(name string, alias string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	meta, ok := store.indices[name]
+	if !ok {
+		if err := store.createIndexLocked(name); err != nil {
+			return err
+		}
+		meta = store.indices[name]
+	}
+	if alias != "" && !containsString(meta.Aliases, alias) {
+		meta.Aliases = append(meta.Aliases, alias)
+	}
+	return store.saveMeta(logMetaIndicesKey, store.indices)
+}
+
+// createIndexLocked creates the index with the mappings of the matched templates, the lock must be held
+func (store *boltLogStore) createIndexLocked(name string) error {
+	if strings.ContainsAny(name, "*?,\" <>|\\/") || strings.HasPrefix(name, "_") || name != strings.ToLower(name) {
+		return &logStoreError{status: http.StatusBadRequest, errorType: "invalid_index_name_exception",
+			reason: "invalid index name [" + name + "]", index: name}
+	}
+	meta := &logIndexMeta{Type: "_doc", Aliases: make([]string, 0), Fields: make(map[string]*logFieldMeta),
+		CreateTime: time.Now().UnixNano() / int64(time.Millisecond)}
+	names := make([]string, 0, len(store.templates))
+	for templateName := range store.templates {
+		names = append(names, templateName)
+	}
+	sort.Strings(names)
+	for _, templateName := range names {
+		template := store.templates[templateName]
+		for _, pattern := range template.Patterns {
+			if matchWildcard(pattern, name) {
+				meta.Type = template.Type
+				for fieldName, field := range template.Fields {
+					meta.Fields[fieldName] = field
+				}
+				break
+			}
+		}
+	}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		_, err := createIndexBuckets(tx, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	store.indices[name] = meta
+	return nil
+}
+
+func (store *boltLogStore) DeleteIndex(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.indices[name]; !ok {
+		return newIndexNotFoundError(name)
+	}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(logIndexBucketName + name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	delete(store.indices, name)
+	return store.saveMeta(logMetaIndicesKey, store.indices)
+}
+
+func (store *boltLogStore) GetAliasIndices(aliasPattern string) (map[string][]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	result := make(map[string][]string)
+	for index, meta := range store.indices {
+		for _, alias := range meta.Aliases {
+			for _, pattern := range strings.Split(aliasPattern, ",") {
+				if pattern == "_all" || matchWildcard(pattern, alias) {
+					result[alias] = append(result[alias], index)
+					break
+				}
+			}
+		}
+	}
+	for _, indices := range result {
+		sort.Strings(indices)
+	}
+	return result, nil
+}
+
+func (store *boltLogStore) IndexStats(indices ...string) (map[string]*elastic.IndexStats, error) {
+	names, err := store.resolveIndices(indices, true)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*elastic.IndexStats)
+	err = store.db.View(func(tx *bolt.Tx) error {
+		for _, index := range names {
+			buckets := getIndexBuckets(tx, index)
+			if buckets == nil {
+				continue
+			}
+			bucketStats := tx.Bucket([]byte(logIndexBucketName + index)).Stats()
+			details := &elastic.IndexStatsDetails{
+				Docs: &elastic.IndexStatsDocs{Count: buckets.count(logStatsDocsKey)},
+				Store: &elastic.IndexStatsStore{SizeInBytes: int64(bucketStats.LeafInuse + bucketStats.BranchInuse +
+					bucketStats.InlineBucketInuse)},
+			}
+			result[index] = &elastic.IndexStats{Primaries: details, Total: details}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Bulk handles the index, create, update and delete actions, the update supports doc and doc_as_upsert,
+// the write to an alias is written to the only index behind it
+func (store *boltLogStore) Bulk(ctx context.Context,
+	requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	start := time.Now()
+	actions := make([]*logBulkAction, 0, len(requests))
+	for _, request := range requests {
+		action, err := parseBulkRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	// the indices are created before the transaction of documents
+	metas := make(map[string]*logIndexMeta)
+	indexErrors := make(map[string]error)
+	for _, action := range actions {
+		index, err := store.resolveWriteIndex(action.index)
+		if err != nil {
+			indexErrors[action.index] = err
+			continue
+		}
+		action.index = index
+		if _, ok := metas[action.index]; ok || indexErrors[action.index] != nil {
+			continue
+		}
+		meta, err := store.getOrCreateIndex(action.index)
+		if err != nil {
+			indexErrors[action.index] = err
+			continue
+		}
+		metas[action.index] = meta
+	}
+	response := &elastic.BulkResponse{Items: make([]map[string]*elastic.BulkResponseItem, len(actions))}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		for i, action := range actions {
+			var item *elastic.BulkResponseItem
+			if err := indexErrors[action.index]; err != nil {
+				item = bulkItemError(action, err)
+			} else if buckets, err := createIndexBuckets(tx, action.index); err != nil {
+				item = bulkItemError(action, err)
+			} else {
+				item = bulkAction(buckets, metas[action.index], action)
+			}
+			if item.Status >= 300 {
+				response.Errors = true
+			}
+			response.Items[i] = map[string]*elastic.BulkResponseItem{action.kind: item}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Took = int(time.Since(start).Nanoseconds() / int64(time.Millisecond))
+	return response, nil
+}
+
+// parseBulkRequest parses the action and source lines of the bulk request
+func parseBulkRequest(request elastic.BulkableRequest) (*logBulkAction, error) {
+	lines, err := request.Source()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("the bulk request is empty")
+	}
+	var header map[string]struct {
+		Index string `json:"_index"`
+		Id    string `json:"_id"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || len(header) != 1 {
+		return nil, errors.New("malformed action of bulk request: " + lines[0])
+	}
+	action := &logBulkAction{}
+	for kind, param := range header {
+		action.kind, action.index, action.id = kind, param.Index, param.Id
+	}
+	if action.kind != "delete" {
+		if len(lines) < 2 {
+			return nil, errors.New("the source of bulk action " + action.kind + " is missing")
+		}
+		action.source = []byte(lines[1])
+	}
+	return action, nil
+}
+
+func bulkItemError(action *logBulkAction, err error) *elastic.BulkResponseItem {
+	storeErr, ok := err.(*logStoreError)
+	if !ok {
+		storeErr = &logStoreError{status: http.StatusBadRequest, errorType: "illegal_argument_exception",
+			reason: err.Error()}
+	}
+	return &elastic.BulkResponseItem{
+		Index:  action.index,
+		Id:     action.id,
+		Status: storeErr.status,
+		Error:  &elastic.ErrorDetails{Type: storeErr.errorType, Reason: storeErr.reason, Index: action.index},
+	}
+}
+
+// bulkAction applies an action of bulk in the transaction, the error of action is returned in the item
+func bulkAction(buckets *logIndexBuckets, meta *logIndexMeta, action *logBulkAction) *elastic.BulkResponseItem {
+	if action.id == "" {
+		if action.kind != "index" && action.kind != "create" {
+			return bulkItemError(action, errors.New("the id of "+action.kind+" action can not be empty"))
+		}
+		action.id = generateDocId()
+	}
+	existing := buckets.docs.Get([]byte(action.id))
+	item := &elastic.BulkResponseItem{Index: action.index, Type: meta.Type, Id: action.id, Version: 1,
+		Status: http.StatusOK}
+	var err error
+	switch action.kind {
+	case "index", "create":
+		if action.kind == "create" && existing != nil {
+			return bulkItemError(action, &logStoreError{status: http.StatusConflict,
+				errorType: "version_conflict_engine_exception",
+				reason:    "[" + action.id + "]: version conflict, document already exists"})
+		}
+		var source map[string]interface{}
+		if source, err = decodeSource(action.source); err != nil {
+			return bulkItemError(action, err)
+		}
+		_, err = buckets.putDoc(meta, action.id, action.source, source)
+		item.Result = "updated"
+		if existing == nil {
+			item.Status, item.Result = http.StatusCreated, "created"
+		}
+	case "update":
+		var update struct {
+			Doc         map[string]interface{} `json:"doc"`
+			DocAsUpsert bool                   `json:"doc_as_upsert"`
+			Upsert      map[string]interface{} `json:"upsert"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(action.source))
+		decoder.UseNumber()
+		if err := decoder.Decode(&update); err != nil {
+			return bulkItemError(action, err)
+		}
+		var doc map[string]interface{}
+		if existing != nil {
+			if doc, err = decodeSource(existing); err != nil {
+				return bulkItemError(action, err)
+			}
+			mergeSource(doc, update.Doc)
+			item.Result = "updated"
+		} else if update.DocAsUpsert || update.Upsert != nil {
+			doc = update.Doc
+			if !update.DocAsUpsert {
+				doc = update.Upsert
+			}
+			item.Status, item.Result = http.StatusCreated, "created"
+		} else {
+			return bulkItemError(action, &logStoreError{status: http.StatusNotFound,
+				errorType: "document_missing_exception",
+				reason:    "[" + meta.Type + "][" + action.id + "]: document missing"})
+		}
+		var content []byte
+		if content, err = json.Marshal(doc); err == nil {
+			// the source is decoded again so that the numbers are the same as the stored ones
+			if doc, err = decodeSource(content); err == nil {
+				_, err = buckets.putDoc(meta, action.id, content, doc)
+			}
+		}
+	case "delete":
+		var found bool
+		found, err = buckets.deleteDoc(meta, action.id)
+		item.Result = "deleted"
+		if !found {
+			item.Status, item.Result = http.StatusNotFound, "not_found"
+		}
+	default:
+		err = errors.New("unsupported bulk action: " + action.kind)
+	}
+	if err != nil {
+		return bulkItemError(action, err)
+	}
+	return item
+}
+
+// Search returns the hits in the range of from and size, the hits are kept in a bounded heap
+// and the aggregations are collected while the matched documents are streamed
+func (store *boltLogStore) Search(ctx context.Context, search *LogSearch) (*elastic.SearchResult, error) {
+	start := time.Now()
+	request, err := store.parseLogSearch(search)
+	if err != nil {
+		return nil, err
+	}
+	aggregators := make(map[string]logAggregator, len(request.aggregations))
+	for name, factory := range request.aggregations {
+		aggregators[name] = factory()
+	}
+	from, size := search.From, search.Size
+	if from < 0 {
+		from = 0
+	}
+	if size < 0 {
+		size = 0
+	}
+	hits := newLogTopDocs(from+size, request.sortFields)
+	total := 0
+	err = store.forEachMatch(ctx, request.indices, request.query, func(doc *logDoc) error {
+		total++
+		hits.add(doc)
+		for _, aggregator := range aggregators {
+			if err := aggregator.collect(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"timed_out": false,
+		"_shards":   shardsResult(),
+		"hits":      buildHits(hits.sorted(), total, from, size, request.source),
+	}
+	if len(aggregators) > 0 {
+		aggregations := make(map[string]interface{}, len(aggregators))
+		for name, aggregator := range aggregators {
+			if aggregations[name], err = aggregator.result(); err != nil {
+				return nil, err
+			}
+		}
+		result["aggregations"] = aggregations
+	}
+	result["took"] = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	// the result is converted by json like the response of ElasticSearch
+	content, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	searchResult := new(elastic.SearchResult)
+	return searchResult, json.Unmarshal(content, searchResult)
+}
+
+func (store *boltLogStore) Count(ctx context.Context, query elastic.Query, indices ...string) (int64, error) {
+	queryMap, err := sourceMap(query)
+	if err != nil {
+		return 0, err
+	}
+	names, err := store.resolveIndices(indices, false)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = store.forEachMatch(ctx, names, queryMap, func(doc *logDoc) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// DeleteByQuery deletes the matched documents in batches, the keys of the matched documents are found first
+func (store *boltLogStore) DeleteByQuery(ctx context.Context, query elastic.Query,
+	indices ...string) (int64, error) {
+	queryMap, err := sourceMap(query)
+	if err != nil {
+		return 0, err
+	}
+	names, err := store.resolveIndices(indices, false)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]logDocKey, 0)
+	err = store.forEachMatch(ctx, names, queryMap, func(doc *logDoc) error {
+		keys = append(keys, logDocKey{index: doc.Index, id: doc.Id})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	metas := store.getIndexMetas(names)
+	var deleted int64
+	for start := 0; start < len(keys); start += logDeleteBatchSize {
+		end := start + logDeleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = store.db.Update(func(tx *bolt.Tx) error {
+			for _, key := range keys[start:end] {
+				buckets := getIndexBuckets(tx, key.index)
+				if buckets == nil || metas[key.index] == nil {
+					continue
+				}
+				found, err := buckets.deleteDoc(metas[key.index], key.id)
+				if err != nil {
+					return err
+				}
+				if found {
+					deleted++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// parseLogSearch parses the search by the json of the query, sorters and aggregations like the elastic client
+func (store *boltLogStore) parseLogSearch(search *LogSearch) (*logSearchRequest, error) {
+	request := &logSearchRequest{}
+	var err error
+	if request.indices, err = store.resolveIndices(search.Indices, false); err != nil {
+		return nil, err
+	}
+	if request.query, err = sourceMap(search.Query); err != nil {
+		return nil, err
+	}
+	sorters := make([]interface{}, 0, len(search.Sorters))
+	for _, sorter := range search.Sorters {
+		sortParam, err := sourceValue(sorter)
+		if err != nil {
+			return nil, err
+		}
+		sorters = append(sorters, sortParam)
+	}
+	if request.sortFields, err = parseSortFields(sorters); err != nil {
+		return nil, err
+	}
+	if search.Source != nil {
+		if request.source, err = sourceValue(search.Source); err != nil {
+			return nil, err
+		}
+	}
+	aggrs := make(map[string]interface{}, len(search.Aggregations))
+	for name, aggr := range search.Aggregations {
+		if aggrs[name], err = sourceValue(aggr); err != nil {
+			return nil, err
+		}
+	}
+	if request.aggregations, err = compileAggregations(aggrs); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// sourceValue returns the json value of the source of the query, sorter or aggregation of elastic client
+func sourceValue(source interface{ Source() (interface{}, error) }) (interface{}, error) {
+	value, err := source.Source()
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	return result, decoder.Decode(&result)
+}
+
+// sourceMap returns the json object of the query, the nil query is the empty object of match_all
+func sourceMap(query elastic.Query) (map[string]interface{}, error) {
+	if query == nil {
+		return nil, nil
+	}
+	value, err := sourceValue(query)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the query must be an object")
+	}
+	return result, nil
+}
+
+// forEachMatch calls the handler with the matched documents of the indices, the candidates of each index
+// are found by the plan of query, or all documents are scanned if the query can not be planned,
+// the raw source of document is only valid in the handler
+func (store *boltLogStore) forEachMatch(ctx context.Context, indices []string, query map[string]interface{},
+	handler func(doc *logDoc) error) error {
+	// the lock can not be acquired in the transaction, the commit of bbolt may wait for the readers
+	metas := store.getIndexMetas(indices)
+	return store.db.View(func(tx *bolt.Tx) error {
+		visited := 0
+		for _, index := range indices {
+			meta := metas[index]
+			buckets := getIndexBuckets(tx, index)
+			if meta == nil || buckets == nil {
+				continue
+			}
+			matcher, err := compileQuery(query, meta)
+			if err != nil {
+				return err
+			}
+			visit := func(id []byte, raw []byte) error {
+				if visited++; visited%logCheckInterval == 0 {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+				}
+				source, err := decodeSource(raw)
+				if err != nil {
+					return err
+				}
+				doc := &logDoc{Index: index, Id: string(id), Type: meta.Type, Raw: raw, Source: source, meta: meta}
+				if !matcher(doc) {
+					return nil
+				}
+				return handler(doc)
+			}
+			plan := planQuery(query, meta, func(plan *logPlan, limit int) int {
+				return plan.countKeys(buckets.keys, limit)
+			})
+			if plan != nil {
+				err = plan.forEachCandidate(buckets, visit)
+			} else {
+				err = buckets.docs.ForEach(visit)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resolveIndices resolves the comma separated indices, aliases and wildcards to the concrete indices,
+// the missing index or alias without wildcard causes the index_not_found_exception like ElasticSearch
+func (store *boltLogStore) resolveIndices(expressions []string, ignoreUnavailable bool) ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	result := make(map[string]bool)
+	for _, item := range strings.Split(strings.Join(expressions, ","), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item == "_all" {
+			item = "*"
+		}
+		if strings.ContainsAny(item, "*?") {
+			for name, meta := range store.indices {
+				if matchWildcard(item, name) {
+					result[name] = true
+					continue
+				}
+				for _, alias := range meta.Aliases {
+					if matchWildcard(item, alias) {
+						result[name] = true
+						break
+					}
+				}
+			}
+			continue
+		}
+		if _, ok := store.indices[item]; ok {
+			result[item] = true
+			continue
+		}
+		found := false
+		for name, meta := range store.indices {
+			if containsString(meta.Aliases, item) {
+				result[name] = true
+				found = true
+			}
+		}
+		if !found && !ignoreUnavailable {
+			return nil, newIndexNotFoundError(item)
+		}
+	}
+	indices := make([]string, 0, len(result))
+	for name := range result {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (store *boltLogStore) getIndexMetas(indices []string) map[string]*logIndexMeta {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	metas := make(map[string]*logIndexMeta, len(indices))
+	for _, index := range indices {
+		if meta, ok := store.indices[index]; ok {
+			metas[index] = meta
+		}
+	}
+	return metas
+}
+
+// resolveWriteIndex resolves the alias to the only index behind it for the writing of documents,
+// the name without alias is returned as it is
+func (store *boltLogStore) resolveWriteIndex(name string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if _, ok := store.indices[name]; ok {
+		return name, nil
+	}
+	indices := make([]string, 0, 1)
+	for index, meta := range store.indices {
+		if containsString(meta.Aliases, name) {
+			indices = append(indices, index)
+		}
+	}
+	if len(indices) > 1 {
+		return "", &logStoreError{status: http.StatusBadRequest, errorType: "illegal_argument_exception",
+			reason: "no write index is defined for alias [" + name + "]"}
+	}
+	if len(indices) == 1 {
+		return indices[0], nil
+	}
+	return name, nil
+}
+
+// getOrCreateIndex returns the index, it is created automatically like ElasticSearch if not exists
+func (store *boltLogStore) getOrCreateIndex(name string) (*logIndexMeta, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if meta, ok := store.indices[name]; ok {
+		return meta, nil
+	}
+	if err := store.createIndexLocked(name); err != nil {
+		return nil, err
+	}
+	if err := store.saveMeta(logMetaIndicesKey, store.indices); err != nil {
+		return nil, err
+	}
+	return store.indices[name], nil
+}
+
+// saveMeta saves the templates or indices, the lock must be held
+func (store *boltLogStore) saveMeta(key string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(logMetaBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), content)
+	})
+}
+
+func decodeSource(content []byte) (map[string]interface{}, error) {
+	var source map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&source); err != nil {
+		return nil, &logStoreError{status: http.StatusBadRequest, errorType: "mapper_parsing_exception",
+			reason: "failed to parse the document: " + err.Error()}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, &logStoreError{status: http.StatusBadRequest, errorType: "mapper_parsing_exception",
+			reason: "the document has the trailing content"}
+	}
+	if source == nil {
+		return nil, &logStoreError{status: http.StatusBadRequest, errorType: "mapper_parsing_exception",
+			reason: "the document must be an object"}
+	}
+	return source, nil
+}
+
+// mergeSource merges the partial document into the source recursively like the update api
+func mergeSource(source map[string]interface{}, doc map[string]interface{}) {
+	for key, value := range doc {
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			if sourceMap, ok := source[key].(map[string]interface{}); ok {
+				mergeSource(sourceMap, valueMap)
+				continue
+			}
+		}
+		source[key] = value
+	}
+}
+
+func shardsResult() map[string]interface{} {
+	return map[string]interface{}{"total": 1, "successful": 1, "skipped": 0, "failed": 0}
+}
+
+func newIndexNotFoundError(index string) error {
+	return &logStoreError{status: http.StatusNotFound, errorType: "index_not_found_exception",
+		reason: "no such index [" + index + "]", index: index}
+}
+
+func generateDocId() string {
+	content := make([]byte, 15)
+	if _, err := rand.Read(content); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func containsString(items []string, target string) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
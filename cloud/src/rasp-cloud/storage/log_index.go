@@ -0,0 +1,613 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/coreos/bbolt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// the secondary indexes of the embedded log store, each value of the mapped keyword, date, numeric and boolean
+// fields is a key like <field> 0x00 <encoded value> <id> <length of id>, the encoded values keep the order
+// of numbers and strings, so that the term, terms, range and prefix queries find the candidates by the keys
+// instead of scanning all documents of the index
+
+const (
+	logNumberTag = 'n'
+	logStringTag = 's'
+	// the doc counts of each index and each indexed field
+	logStatsDocsKey   = "docs"
+	logStatsFieldKey  = "field/"
+	logFieldSeparator = 0x00
+)
+
+// logIndexBuckets are the buckets of an index, the documents, the keys of indexed fields and the stats
+type logIndexBuckets struct {
+	docs  *bolt.Bucket
+	keys  *bolt.Bucket
+	stats *bolt.Bucket
+}
+
+// logKeyRange is the keys of a field which have the prefix and the encoded values in [start, end],
+// the nil start or end is unbounded
+type logKeyRange struct {
+	field  []byte
+	prefix []byte
+	start  []byte
+	end    []byte
+}
+
+// logPlan finds the candidates of a query, the candidates are verified by the matcher of the query
+type logPlan struct {
+	ranges []*logKeyRange
+	ids    []string
+	// unique is true if each candidate is found only once, like the term query
+	unique bool
+}
+
+func (field *logFieldMeta) isIndexed() bool {
+	switch field.Type {
+	case "keyword", "date", "boolean", "ip":
+		return true
+	}
+	return field.isNumeric()
+}
+
+func getIndexBuckets(tx *bolt.Tx, index string) *logIndexBuckets {
+	bucket := tx.Bucket([]byte(logIndexBucketName + index))
+	if bucket == nil {
+		return nil
+	}
+	buckets := &logIndexBuckets{
+		docs:  bucket.Bucket([]byte(logDocsBucketName)),
+		keys:  bucket.Bucket([]byte(logKeysBucketName)),
+		stats: bucket.Bucket([]byte(logStatsBucketName)),
+	}
+	if buckets.docs == nil || buckets.keys == nil || buckets.stats == nil {
+		return nil
+	}
+	return buckets
+}
+
+func createIndexBuckets(tx *bolt.Tx, index string) (*logIndexBuckets, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(logIndexBucketName + index))
+	if err != nil {
+		return nil, err
+	}
+	buckets := &logIndexBuckets{}
+	for name, target := range map[string]**bolt.Bucket{logDocsBucketName: &buckets.docs,
+		logKeysBucketName: &buckets.keys, logStatsBucketName: &buckets.stats} {
+		if *target, err = bucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return buckets, nil
+}
+
+// putDoc puts the document and replaces the keys of the old document with the same id
+func (buckets *logIndexBuckets) putDoc(meta *logIndexMeta, id string, raw []byte,
+	source map[string]interface{}) (created bool, err error) {
+	if existing := buckets.docs.Get([]byte(id)); existing != nil {
+		oldSource, err := decodeSource(existing)
+		if err != nil {
+			return false, err
+		}
+		if err = buckets.updateKeys(meta, id, oldSource, false); err != nil {
+			return false, err
+		}
+	} else {
+		created = true
+		if err = buckets.addCount(logStatsDocsKey, 1); err != nil {
+			return false, err
+		}
+	}
+	if err = buckets.updateKeys(meta, id, source, true); err != nil {
+		return false, err
+	}
+	return created, buckets.docs.Put([]byte(id), raw)
+}
+
+// deleteDoc deletes the document with its keys, found is false if the document does not exist
+func (buckets *logIndexBuckets) deleteDoc(meta *logIndexMeta, id string) (found bool, err error) {
+	existing := buckets.docs.Get([]byte(id))
+	if existing == nil {
+		return false, nil
+	}
+	source, err := decodeSource(existing)
+	if err != nil {
+		return true, err
+	}
+	if err = buckets.updateKeys(meta, id, source, false); err != nil {
+		return true, err
+	}
+	if err = buckets.addCount(logStatsDocsKey, -1); err != nil {
+		return true, err
+	}
+	return true, buckets.docs.Delete([]byte(id))
+}
+
+// updateKeys adds or removes the keys of the indexed fields of the document
+func (buckets *logIndexBuckets) updateKeys(meta *logIndexMeta, id string, source map[string]interface{},
+	add bool) error {
+	doc := &logDoc{Id: id, Source: source, meta: meta}
+	delta := int64(1)
+	if !add {
+		delta = -1
+	}
+	for name, field := range meta.Fields {
+		if !field.isIndexed() {
+			continue
+		}
+		// the field is counted if the document has any key of it
+		counted := false
+		for _, value := range docValues(doc, name) {
+			encoded, ok := encodeLogValue(value)
+			if !ok {
+				continue
+			}
+			if !counted {
+				if err := buckets.addCount(logStatsFieldKey+name, delta); err != nil {
+					return err
+				}
+				counted = true
+			}
+			key := logIndexKey(name, encoded, id)
+			// the document with the immense term is rejected like ElasticSearch, it can not be the key of bbolt
+			if add && len(key) > bolt.MaxKeySize {
+				return &logStoreError{status: http.StatusBadRequest, errorType: "illegal_argument_exception",
+					reason: "Document contains at least one immense term in field=\"" + name + "\""}
+			}
+			var err error
+			if add {
+				err = buckets.keys.Put(key, []byte{})
+			} else {
+				err = buckets.keys.Delete(key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (buckets *logIndexBuckets) addCount(key string, delta int64) error {
+	count := buckets.count(key) + delta
+	if count <= 0 {
+		return buckets.stats.Delete([]byte(key))
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return buckets.stats.Put([]byte(key), value)
+}
+
+func (buckets *logIndexBuckets) count(key string) int64 {
+	value := buckets.stats.Get([]byte(key))
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+// encodeLogValue encodes the normalized value, the numbers are ordered before the strings
+func encodeLogValue(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case float64:
+		bits := math.Float64bits(v)
+		// the sign bit is flipped for the positive numbers and all bits are flipped for the negative numbers,
+		// so that the bytes are ordered like the numbers
+		if bits&(1<<63) == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		encoded := make([]byte, 9)
+		encoded[0] = logNumberTag
+		binary.BigEndian.PutUint64(encoded[1:], bits)
+		return encoded, true
+	case string:
+		return encodeLogString(v, true), true
+	case bool:
+		return encodeLogString(fmt.Sprint(v), true), true
+	}
+	return nil, false
+}
+
+// encodeLogString escapes 0x00 as 0x00 0xff and terminates the string with 0x00 0x01,
+// so that the string is not the prefix of another one and the order is kept
+func encodeLogString(value string, terminated bool) []byte {
+	encoded := make([]byte, 0, len(value)+3)
+	encoded = append(encoded, logStringTag)
+	for i := 0; i < len(value); i++ {
+		encoded = append(encoded, value[i])
+		if value[i] == 0x00 {
+			encoded = append(encoded, 0xff)
+		}
+	}
+	if terminated {
+		encoded = append(encoded, 0x00, 0x01)
+	}
+	return encoded
+}
+
+func logFieldPrefix(field string) []byte {
+	return append([]byte(field), logFieldSeparator)
+}
+
+// concatBytes returns a new slice of the concatenated slices, none of them is modified
+func concatBytes(items ...[]byte) []byte {
+	length := 0
+	for _, item := range items {
+		length += len(item)
+	}
+	result := make([]byte, 0, length)
+	for _, item := range items {
+		result = append(result, item...)
+	}
+	return result
+}
+
+func logIndexKey(field string, encoded []byte, id string) []byte {
+	key := make([]byte, 0, len(field)+len(encoded)+len(id)+3)
+	key = append(key, field...)
+	key = append(key, logFieldSeparator)
+	key = append(key, encoded...)
+	key = append(key, id...)
+	return append(key, byte(len(id)>>8), byte(len(id)))
+}
+
+// parseLogIndexKey returns the encoded value and the id of the key of field
+func parseLogIndexKey(key []byte, prefixLength int) (encoded []byte, id []byte, ok bool) {
+	if len(key) < prefixLength+2 {
+		return nil, nil, false
+	}
+	idLength := int(key[len(key)-2])<<8 | int(key[len(key)-1])
+	end := len(key) - 2 - idLength
+	if end < prefixLength {
+		return nil, nil, false
+	}
+	return key[prefixLength:end], key[end : len(key)-2], true
+}
+
+// prefixEnd returns the smallest key which is greater than all keys with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// forEachKey calls the handler with the encoded value and id of each key in the range in order,
+// the keys after the given key are iterated if it is not nil, the iteration stops if the handler returns false
+func (keyRange *logKeyRange) forEachKey(keys *bolt.Bucket, descending bool, after []byte,
+	handler func(key []byte, encoded []byte, id []byte) (bool, error)) error {
+	cursor := keys.Cursor()
+	var key []byte
+	if !descending {
+		start := keyRange.prefix
+		if keyRange.start != nil {
+			if rangeStart := concatBytes(keyRange.field, keyRange.start); bytes.Compare(rangeStart, start) > 0 {
+				start = rangeStart
+			}
+		}
+		if after != nil && bytes.Compare(after, start) >= 0 {
+			start = after
+		}
+		key, _ = cursor.Seek(start)
+		if after != nil && bytes.Equal(key, after) {
+			key, _ = cursor.Next()
+		}
+	} else {
+		seek := prefixEnd(keyRange.prefix)
+		if keyRange.end != nil {
+			if rangeEnd := prefixEnd(concatBytes(keyRange.field, keyRange.end)); bytes.Compare(rangeEnd, seek) < 0 {
+				seek = rangeEnd
+			}
+		}
+		if after != nil && bytes.Compare(after, seek) < 0 {
+			seek = after
+		}
+		if key, _ = cursor.Seek(seek); key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+	}
+	for key != nil && bytes.HasPrefix(key, keyRange.prefix) {
+		encoded, id, ok := parseLogIndexKey(key, len(keyRange.field))
+		if ok {
+			if !descending && keyRange.end != nil && bytes.Compare(encoded, keyRange.end) > 0 ||
+				descending && keyRange.start != nil && bytes.Compare(encoded, keyRange.start) < 0 {
+				break
+			}
+			if (keyRange.start == nil || bytes.Compare(encoded, keyRange.start) >= 0) &&
+				(keyRange.end == nil || bytes.Compare(encoded, keyRange.end) <= 0) {
+				next, err := handler(key, encoded, id)
+				if err != nil || !next {
+					return err
+				}
+			}
+		}
+		if descending {
+			key, _ = cursor.Prev()
+		} else {
+			key, _ = cursor.Next()
+		}
+	}
+	return nil
+}
+
+// countKeys counts the keys of the plan, the counting stops when the count exceeds the limit
+func (plan *logPlan) countKeys(keys *bolt.Bucket, limit int) int {
+	if plan.ids != nil {
+		return len(plan.ids)
+	}
+	count := 0
+	for _, keyRange := range plan.ranges {
+		keyRange.forEachKey(keys, false, nil, func(key []byte, encoded []byte, id []byte) (bool, error) {
+			count++
+			return count <= limit, nil
+		})
+		if count > limit {
+			break
+		}
+	}
+	return count
+}
+
+// forEachCandidate calls the handler with the id and source of each candidate
+func (plan *logPlan) forEachCandidate(buckets *logIndexBuckets, handler func(id []byte, raw []byte) error) error {
+	if plan.ids != nil {
+		for _, id := range plan.ids {
+			if raw := buckets.docs.Get([]byte(id)); raw != nil {
+				if err := handler([]byte(id), raw); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	var seen map[string]bool
+	if !plan.unique {
+		seen = make(map[string]bool)
+	}
+	for _, keyRange := range plan.ranges {
+		err := keyRange.forEachKey(buckets.keys, false, nil, func(key []byte, encoded []byte, id []byte) (bool, error) {
+			if seen != nil {
+				if seen[string(id)] {
+					return true, nil
+				}
+				seen[string(id)] = true
+			}
+			if raw := buckets.docs.Get(id); raw != nil {
+				return true, handler(id, raw)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planQuery returns the plan of the query which has the least candidates, nil means that all documents
+// must be scanned, the estimate counts the candidates of a plan up to the limit
+func planQuery(query map[string]interface{}, meta *logIndexMeta,
+	estimate func(plan *logPlan, limit int) int) *logPlan {
+	for kind, value := range query {
+		body, _ := value.(map[string]interface{})
+		switch kind {
+		case "match_none":
+			return &logPlan{ids: []string{}, unique: true}
+		case "term", "terms", "prefix", "range":
+			return planFieldQuery(kind, body, meta)
+		case "ids":
+			values, _ := body["values"].([]interface{})
+			ids := make([]string, 0, len(values))
+			seen := make(map[string]bool)
+			for _, id := range values {
+				if !seen[fmt.Sprint(id)] {
+					seen[fmt.Sprint(id)] = true
+					ids = append(ids, fmt.Sprint(id))
+				}
+			}
+			return &logPlan{ids: ids, unique: true}
+		case "constant_score":
+			filter, _ := body["filter"].(map[string]interface{})
+			return planQuery(filter, meta, estimate)
+		case "nested":
+			// the values of nested objects are indexed with the full path of field
+			nestedQuery, _ := body["query"].(map[string]interface{})
+			return planQuery(nestedQuery, meta, estimate)
+		case "bool":
+			return planBoolQuery(body, meta, estimate)
+		}
+	}
+	return nil
+}
+
+func planBoolQuery(body map[string]interface{}, meta *logIndexMeta,
+	estimate func(plan *logPlan, limit int) int) *logPlan {
+	// the required clause which has the least candidates is used, each candidate is verified by the other clauses
+	var best *logPlan
+	bestCount := math.MaxInt32
+	for _, query := range boolClauses(body, "must", "filter") {
+		plan := planQuery(query, meta, estimate)
+		if plan == nil {
+			continue
+		}
+		if count := estimate(plan, bestCount); count < bestCount || best == nil {
+			best, bestCount = plan, count
+		}
+	}
+	if best != nil {
+		return best
+	}
+	shouldClauses := boolClauses(body, "should")
+	minimumShould := 0
+	if len(shouldClauses) > 0 {
+		minimumShould = 1
+		if value, ok := body["minimum_should_match"]; ok {
+			minimumShould = parseMinimumShouldMatch(value, len(shouldClauses))
+		}
+	}
+	if minimumShould <= 0 {
+		return nil
+	}
+	// a matched document matches at least one of the should clauses
+	union := &logPlan{}
+	for _, query := range shouldClauses {
+		plan := planQuery(query, meta, estimate)
+		if plan == nil || plan.ids != nil {
+			return nil
+		}
+		union.ranges = append(union.ranges, plan.ranges...)
+	}
+	return union
+}
+
+// boolClauses returns the clauses of the occurs of bool query, each occur is a query or a list of queries
+func boolClauses(body map[string]interface{}, occurs ...string) []map[string]interface{} {
+	clauses := make([]map[string]interface{}, 0)
+	for _, occur := range occurs {
+		switch value := body[occur].(type) {
+		case map[string]interface{}:
+			clauses = append(clauses, value)
+		case []interface{}:
+			for _, item := range value {
+				if query, ok := item.(map[string]interface{}); ok {
+					clauses = append(clauses, query)
+				}
+			}
+		}
+	}
+	return clauses
+}
+
+func planFieldQuery(kind string, body map[string]interface{}, meta *logIndexMeta) *logPlan {
+	var fieldName string
+	var param interface{}
+	for key, value := range body {
+		if key == "boost" || key == "_name" {
+			continue
+		}
+		fieldName, param = key, value
+	}
+	field := meta.field(fieldName)
+	if fieldName == "" || !field.isIndexed() {
+		return nil
+	}
+	prefix := logFieldPrefix(fieldName)
+	paramMap, _ := param.(map[string]interface{})
+	switch kind {
+	case "term", "terms":
+		items := []interface{}{param}
+		if kind == "terms" {
+			items, _ = param.([]interface{})
+		} else if paramMap != nil {
+			items = []interface{}{paramMap["value"]}
+		}
+		plan := &logPlan{unique: len(items) <= 1}
+		for _, item := range items {
+			encoded, ok := encodeLogValue(normalizeValue(field, item))
+			if !ok {
+				return nil
+			}
+			plan.ranges = append(plan.ranges, &logKeyRange{field: prefix, prefix: concatBytes(prefix, encoded)})
+		}
+		return plan
+	case "prefix":
+		if field.Type != "keyword" {
+			return nil
+		}
+		value := param
+		if paramMap != nil {
+			value = paramMap["value"]
+		}
+		str, ok := normalizeValue(field, value).(string)
+		if !ok {
+			return nil
+		}
+		return &logPlan{ranges: []*logKeyRange{{field: prefix,
+			prefix: concatBytes(prefix, encodeLogString(str, false))}}}
+	}
+	if paramMap == nil {
+		return nil
+	}
+	lower, upper, ok := parseRangeBounds(field, paramMap)
+	if !ok {
+		return nil
+	}
+	keyRange := &logKeyRange{field: prefix, prefix: prefix}
+	// the bounds are inclusive here, the exclusive bounds are checked by the matcher
+	for _, bound := range []struct {
+		value  interface{}
+		target *[]byte
+	}{{lower, &keyRange.start}, {upper, &keyRange.end}} {
+		if bound.value == nil {
+			continue
+		}
+		encoded, ok := encodeLogValue(bound.value)
+		if !ok {
+			return nil
+		}
+		*bound.target = encoded
+	}
+	// the numbers and strings are not compared with each other
+	switch {
+	case keyRange.start != nil:
+		keyRange.prefix = concatBytes(prefix, keyRange.start[:1])
+	case keyRange.end != nil:
+		keyRange.prefix = concatBytes(prefix, keyRange.end[:1])
+	}
+	return &logPlan{ranges: []*logKeyRange{keyRange}}
+}
+
+// parseRangeBounds returns the normalized lower and upper bounds of the range query, nil means unbounded
+func parseRangeBounds(field *logFieldMeta, param map[string]interface{}) (lower interface{}, upper interface{},
+	ok bool) {
+	for key, value := range param {
+		// the other keys like include_lower, format and time_zone are not bounds
+		if value == nil || (key != "from" && key != "to" && key != "gt" && key != "gte" && key != "lt" &&
+			key != "lte") {
+			continue
+		}
+		normalized := normalizeValue(field, value)
+		if field.isDate() {
+			millis, ok := parseDateMillis(value)
+			if !ok {
+				return nil, nil, false
+			}
+			normalized = millis
+		}
+		if strings.HasPrefix(key, "g") || key == "from" {
+			lower = normalized
+		} else {
+			upper = normalized
+		}
+	}
+	return lower, upper, true
+}
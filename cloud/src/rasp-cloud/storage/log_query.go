@@ -0,0 +1,887 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"container/heap"
+)
+
+// the subset of ElasticSearch query DSL which is used by the es queries of models,
+// the field values are normalized by the mappings of index template like ElasticSearch
+
+// logDoc is a document of the embedded log store
+type logDoc struct {
+	Index  string
+	Id     string
+	Type   string
+	Raw    []byte
+	Source map[string]interface{}
+	meta   *logIndexMeta
+}
+
+type logMatcher func(doc *logDoc) bool
+
+var (
+	dateLayouts = []string{
+		"2006-01-02T15:04:05.000Z07:00", time.RFC3339Nano, "2006-01-02T15:04:05-0700",
+		"2006-01-02T15:04:05.000-0700", "2006-01-02T15:04:05", "2006-01-02 15:04:05",
+		"2006-01-02T15:04", "2006-01-02", "2006-01", "2006",
+	}
+	dateMathRegex = regexp.MustCompile(`^now((?:[+-]\d+[yMwdhHms])*)(?:/([yMwdhHms]))?$`)
+	dateMathItem  = regexp.MustCompile(`([+-])(\d+)([yMwdhHms])`)
+)
+
+func compileQuery(query map[string]interface{}, meta *logIndexMeta) (logMatcher, error) {
+	if len(query) == 0 {
+		return func(doc *logDoc) bool { return true }, nil
+	}
+	if len(query) != 1 {
+		return nil, errors.New("the query must have exactly one key")
+	}
+	for kind, value := range query {
+		body, _ := value.(map[string]interface{})
+		if body == nil && kind != "match_all" {
+			return nil, errors.New("the body of " + kind + " query must be an object")
+		}
+		switch kind {
+		case "match_all":
+			return func(doc *logDoc) bool { return true }, nil
+		case "match_none":
+			return func(doc *logDoc) bool { return false }, nil
+		case "bool":
+			return compileBoolQuery(body, meta)
+		case "term", "terms", "prefix", "wildcard", "range":
+			return compileFieldQuery(kind, body, meta)
+		case "exists":
+			field := fmt.Sprint(body["field"])
+			return func(doc *logDoc) bool {
+				return len(docValues(doc, field)) > 0
+			}, nil
+		case "ids":
+			ids := make(map[string]bool)
+			values, _ := body["values"].([]interface{})
+			for _, id := range values {
+				ids[fmt.Sprint(id)] = true
+			}
+			return func(doc *logDoc) bool {
+				return ids[doc.Id]
+			}, nil
+		case "nested":
+			return compileNestedQuery(body, meta)
+		case "constant_score":
+			filter, _ := body["filter"].(map[string]interface{})
+			return compileQuery(filter, meta)
+		case "query_string":
+			return compileQueryString(fmt.Sprint(body["query"]), meta)
+		}
+		return nil, errors.New("unsupported query of the embedded log store: " + kind)
+	}
+	return nil, nil
+}
+
+func compileBoolQuery(body map[string]interface{}, meta *logIndexMeta) (logMatcher, error) {
+	clauses := make(map[string][]logMatcher)
+	for _, occur := range []string{"must", "filter", "should", "must_not"} {
+		var items []interface{}
+		switch value := body[occur].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			items = value
+		default:
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			query, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("the " + occur + " clause of bool query must be an object")
+			}
+			matcher, err := compileQuery(query, meta)
+			if err != nil {
+				return nil, err
+			}
+			clauses[occur] = append(clauses[occur], matcher)
+		}
+	}
+	required := append(clauses["must"], clauses["filter"]...)
+	minimumShould := 0
+	if len(clauses["should"]) > 0 {
+		if len(required) == 0 {
+			minimumShould = 1
+		}
+		if value, ok := body["minimum_should_match"]; ok {
+			minimumShould = parseMinimumShouldMatch(value, len(clauses["should"]))
+		}
+	}
+	return func(doc *logDoc) bool {
+		for _, matcher := range required {
+			if !matcher(doc) {
+				return false
+			}
+		}
+		for _, matcher := range clauses["must_not"] {
+			if matcher(doc) {
+				return false
+			}
+		}
+		if minimumShould > 0 {
+			matched := 0
+			for _, matcher := range clauses["should"] {
+				if matcher(doc) {
+					matched++
+					if matched >= minimumShould {
+						break
+					}
+				}
+			}
+			return matched >= minimumShould
+		}
+		return true
+	}, nil
+}
+
+func parseMinimumShouldMatch(value interface{}, count int) int {
+	str := strings.TrimSpace(fmt.Sprint(value))
+	if strings.HasSuffix(str, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+		if err != nil {
+			return 1
+		}
+		if percent < 0 {
+			return count + int(float64(count)*percent/100)
+		}
+		return int(float64(count) * percent / 100)
+	}
+	number, err := strconv.Atoi(str)
+	if err != nil {
+		return 1
+	}
+	if number < 0 {
+		return count + number
+	}
+	return number
+}
+
+func compileFieldQuery(kind string, body map[string]interface{}, meta *logIndexMeta) (logMatcher, error) {
+	var fieldName string
+	var param interface{}
+	for key, value := range body {
+		if key == "boost" || key == "_name" {
+			continue
+		}
+		fieldName, param = key, value
+	}
+	if fieldName == "" {
+		return nil, errors.New("the field of " + kind + " query can not be empty")
+	}
+	field := meta.field(fieldName)
+	paramMap, _ := param.(map[string]interface{})
+	switch kind {
+	case "term":
+		value := param
+		if paramMap != nil {
+			value = paramMap["value"]
+		}
+		value = normalizeValue(field, value)
+		return func(doc *logDoc) bool {
+			return containsLogValue(docValues(doc, fieldName), value)
+		}, nil
+	case "terms":
+		items, ok := param.([]interface{})
+		if !ok {
+			return nil, errors.New("the values of terms query must be an array")
+		}
+		values := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			values = append(values, normalizeValue(field, item))
+		}
+		return func(doc *logDoc) bool {
+			docValues := docValues(doc, fieldName)
+			for _, value := range values {
+				if containsLogValue(docValues, value) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "prefix", "wildcard":
+		pattern := param
+		if paramMap != nil {
+			pattern = paramMap["value"]
+			if kind == "wildcard" && pattern == nil {
+				pattern = paramMap["wildcard"]
+			}
+		}
+		patternStr := fmt.Sprint(normalizeValue(field, pattern))
+		if kind == "prefix" {
+			return func(doc *logDoc) bool {
+				for _, value := range docValues(doc, fieldName) {
+					if str, ok := value.(string); ok && strings.HasPrefix(str, patternStr) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		regex, err := compileWildcard(patternStr)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc *logDoc) bool {
+			for _, value := range docValues(doc, fieldName) {
+				if str, ok := value.(string); ok && regex.MatchString(str) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		if paramMap == nil {
+			return nil, errors.New("the param of range query must be an object")
+		}
+		return compileRangeQuery(fieldName, field, paramMap)
+	}
+}
+
+func compileRangeQuery(fieldName string, field *logFieldMeta, param map[string]interface{}) (logMatcher, error) {
+	type bound struct {
+		value     interface{}
+		inclusive bool
+	}
+	var lower, upper *bound
+	includeLower, includeUpper := true, true
+	if value, ok := param["include_lower"].(bool); ok {
+		includeLower = value
+	}
+	if value, ok := param["include_upper"].(bool); ok {
+		includeUpper = value
+	}
+	for key, value := range param {
+		// the other keys like include_lower, format and time_zone are not bounds
+		if value == nil || (key != "from" && key != "to" && key != "gt" && key != "gte" && key != "lt" &&
+			key != "lte") {
+			continue
+		}
+		normalized := normalizeValue(field, value)
+		if field.isDate() {
+			millis, ok := parseDateMillis(value)
+			if !ok {
+				return nil, errors.New("failed to parse the date of range query: " + fmt.Sprint(value))
+			}
+			normalized = millis
+		}
+		switch key {
+		case "from":
+			lower = &bound{normalized, includeLower}
+		case "gt", "gte":
+			lower = &bound{normalized, key == "gte"}
+		case "to":
+			upper = &bound{normalized, includeUpper}
+		case "lt", "lte":
+			upper = &bound{normalized, key == "lte"}
+		}
+	}
+	return func(doc *logDoc) bool {
+		for _, value := range docValues(doc, fieldName) {
+			if lower != nil {
+				result, ok := compareLogValues(value, lower.value)
+				if !ok || result < 0 || result == 0 && !lower.inclusive {
+					continue
+				}
+			}
+			if upper != nil {
+				result, ok := compareLogValues(value, upper.value)
+				if !ok || result > 0 || result == 0 && !upper.inclusive {
+					continue
+				}
+			}
+			return true
+		}
+		return false
+	}, nil
+}
+
+// compileNestedQuery matches the documents which have an object of the nested path matching the query
+func compileNestedQuery(body map[string]interface{}, meta *logIndexMeta) (logMatcher, error) {
+	path := fmt.Sprint(body["path"])
+	query, _ := body["query"].(map[string]interface{})
+	matcher, err := compileQuery(query, meta)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc *logDoc) bool {
+		for _, value := range rawValues(doc.Source, path) {
+			element, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			nestedSource := map[string]interface{}{}
+			current := nestedSource
+			parts := strings.Split(path, ".")
+			for _, part := range parts[:len(parts)-1] {
+				child := map[string]interface{}{}
+				current[part] = child
+				current = child
+			}
+			current[parts[len(parts)-1]] = element
+			if matcher(&logDoc{Index: doc.Index, Id: doc.Id, Type: doc.Type, Source: nestedSource, meta: doc.meta}) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileQueryString compiles the simple query string like "@timestamp:<1546272000000",
+// the terms are combined with AND
+func compileQueryString(queryString string, meta *logIndexMeta) (logMatcher, error) {
+	queryString = strings.TrimSpace(queryString)
+	if queryString == "" || queryString == "*" || queryString == "*:*" {
+		return func(doc *logDoc) bool { return true }, nil
+	}
+	matchers := make([]logMatcher, 0)
+	for _, term := range strings.Split(queryString, " AND ") {
+		index := strings.Index(term, ":")
+		if index <= 0 {
+			return nil, errors.New("unsupported query string of the embedded log store: " + queryString)
+		}
+		fieldName := strings.TrimSpace(term[:index])
+		value := strings.TrimSpace(term[index+1:])
+		var query map[string]interface{}
+		switch {
+		case strings.HasPrefix(value, ">="):
+			query = map[string]interface{}{"gte": value[2:]}
+		case strings.HasPrefix(value, "<="):
+			query = map[string]interface{}{"lte": value[2:]}
+		case strings.HasPrefix(value, ">"):
+			query = map[string]interface{}{"gt": value[1:]}
+		case strings.HasPrefix(value, "<"):
+			query = map[string]interface{}{"lt": value[1:]}
+		}
+		var matcher logMatcher
+		var err error
+		if query != nil {
+			matcher, err = compileRangeQuery(fieldName, meta.field(fieldName), query)
+		} else if strings.ContainsAny(value, "*?") {
+			matcher, err = compileFieldQuery("wildcard", map[string]interface{}{fieldName: value}, meta)
+		} else {
+			matcher, err = compileFieldQuery("term", map[string]interface{}{fieldName: strings.Trim(value, `"`)}, meta)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return func(doc *logDoc) bool {
+		for _, matcher := range matchers {
+			if !matcher(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileWildcard(pattern string) (*regexp.Regexp, error) {
+	var builder strings.Builder
+	builder.WriteString("^")
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			builder.WriteString("(?s:.*)")
+		case '?':
+			builder.WriteString("(?s:.)")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	builder.WriteString("$")
+	return regexp.Compile(builder.String())
+}
+
+func matchWildcard(pattern string, value string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return pattern == value
+	}
+	regex, err := compileWildcard(pattern)
+	return err == nil && regex.MatchString(value)
+}
+
+// docValues returns the normalized values of the field, the arrays are expanded
+func docValues(doc *logDoc, fieldName string) []interface{} {
+	switch fieldName {
+	case "_id":
+		return []interface{}{doc.Id}
+	case "_index":
+		return []interface{}{doc.Index}
+	case "_type":
+		return []interface{}{doc.Type}
+	}
+	field := doc.meta.field(fieldName)
+	values := rawValues(doc.Source, fieldName)
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		if str, ok := value.(string); ok && field.IgnoreAbove > 0 && len([]rune(str)) > field.IgnoreAbove {
+			continue
+		}
+		if field.isDate() {
+			if millis, ok := parseDateMillis(value); ok {
+				result = append(result, millis)
+			}
+			continue
+		}
+		result = append(result, normalizeValue(field, value))
+	}
+	return result
+}
+
+// rawValues returns the values of the dotted path, the arrays are expanded
+func rawValues(source map[string]interface{}, path string) []interface{} {
+	if value, ok := source[path]; ok {
+		return expandArray(value)
+	}
+	index := strings.Index(path, ".")
+	for index > 0 {
+		if child, ok := source[path[:index]]; ok {
+			result := make([]interface{}, 0)
+			for _, item := range expandArray(child) {
+				if childMap, ok := item.(map[string]interface{}); ok {
+					result = append(result, rawValues(childMap, path[index+1:])...)
+				}
+			}
+			return result
+		}
+		next := strings.Index(path[index+1:], ".")
+		if next < 0 {
+			break
+		}
+		index += next + 1
+	}
+	return nil
+}
+
+func expandArray(value interface{}) []interface{} {
+	if array, ok := value.([]interface{}); ok {
+		result := make([]interface{}, 0, len(array))
+		for _, item := range array {
+			result = append(result, expandArray(item)...)
+		}
+		return result
+	}
+	return []interface{}{value}
+}
+
+// normalizeValue converts the value to float64 for numeric fields, to string for keyword fields,
+// the keyword is lowercased if the field has the lowercase normalizer
+func normalizeValue(field *logFieldMeta, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if field.isDate() {
+		if millis, ok := parseDateMillis(value); ok {
+			return millis
+		}
+		return value
+	}
+	if field.isNumeric() {
+		if number, ok := logFloat(value); ok {
+			return number
+		}
+		return value
+	}
+	if field.Type == "" {
+		// the unmapped field keeps the type of json
+		if number, ok := value.(json.Number); ok {
+			if float, err := number.Float64(); err == nil {
+				return float
+			}
+		}
+		return value
+	}
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case json.Number:
+		str = v.String()
+	case float64:
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		str = fmt.Sprint(v)
+	}
+	if field.Lowercase {
+		str = strings.ToLower(str)
+	}
+	return str
+}
+
+func containsLogValue(values []interface{}, target interface{}) bool {
+	for _, value := range values {
+		if result, ok := compareLogValues(value, target); ok && result == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compareLogValues compares the numbers or strings, ok is false if they can not be compared
+func compareLogValues(a interface{}, b interface{}) (int, bool) {
+	if aNumber, ok := logFloat(a); ok {
+		if bNumber, ok := logFloat(b); ok {
+			return compareFloat(aNumber, bNumber), true
+		}
+	}
+	aStr, aOk := a.(string)
+	bStr, bOk := b.(string)
+	if aOk && bOk {
+		return strings.Compare(aStr, bStr), true
+	}
+	if aBool, ok := a.(bool); ok {
+		return strings.Compare(strconv.FormatBool(aBool), fmt.Sprint(b)), true
+	}
+	return 0, false
+}
+
+func logFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return toFloat(value)
+}
+
+// parseDateMillis parses the epoch milliseconds, the date string and the date math like now-1d/d
+func parseDateMillis(value interface{}) (float64, bool) {
+	if _, isString := value.(string); !isString {
+		return logFloat(value)
+	}
+	str := strings.TrimSpace(value.(string))
+	if number, err := strconv.ParseFloat(str, 64); err == nil {
+		return number, true
+	}
+	if strings.HasPrefix(str, "now") {
+		return parseDateMath(str)
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return float64(t.UnixNano() / int64(time.Millisecond)), true
+		}
+	}
+	return 0, false
+}
+
+func parseDateMath(expression string) (float64, bool) {
+	groups := dateMathRegex.FindStringSubmatch(expression)
+	if groups == nil {
+		return 0, false
+	}
+	t := time.Now().UTC()
+	for _, item := range dateMathItem.FindAllStringSubmatch(groups[1], -1) {
+		amount, _ := strconv.Atoi(item[2])
+		if item[1] == "-" {
+			amount = -amount
+		}
+		switch item[3] {
+		case "y":
+			t = t.AddDate(amount, 0, 0)
+		case "M":
+			t = t.AddDate(0, amount, 0)
+		case "w":
+			t = t.AddDate(0, 0, 7*amount)
+		case "d":
+			t = t.AddDate(0, 0, amount)
+		case "h", "H":
+			t = t.Add(time.Duration(amount) * time.Hour)
+		case "m":
+			t = t.Add(time.Duration(amount) * time.Minute)
+		case "s":
+			t = t.Add(time.Duration(amount) * time.Second)
+		}
+	}
+	if groups[2] != "" {
+		unit := map[string]string{"y": "year", "M": "month", "w": "week", "d": "day", "h": "hour",
+			"H": "hour", "m": "minute", "s": "second"}[groups[2]]
+		t = roundCalendar(t, unit)
+	}
+	return float64(t.UnixNano() / int64(time.Millisecond)), true
+}
+
+// logSortField is a field of the sort param of search, the missing values are always sorted at last
+type logSortField struct {
+	name       string
+	descending bool
+}
+
+type logTopDoc struct {
+	doc  *logDoc
+	keys []interface{}
+	seq  int
+}
+
+// logTopDocs keeps the first documents in the sort order with a heap whose root is the last one,
+// the documents with the same sort keys are kept in the order they are added
+type logTopDocs struct {
+	limit  int
+	fields []logSortField
+	items  []*logTopDoc
+	seq    int
+}
+
+// parseSortFields parses the sort param of search, like [{"event_time": {"order": "desc"}}]
+func parseSortFields(sortParam interface{}) ([]logSortField, error) {
+	var items []interface{}
+	switch value := sortParam.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = value
+	default:
+		items = []interface{}{value}
+	}
+	fields := make([]logSortField, 0, len(items))
+	for _, item := range items {
+		switch value := item.(type) {
+		case string:
+			if value != "_score" && value != "_doc" {
+				fields = append(fields, logSortField{name: value})
+			}
+		case map[string]interface{}:
+			for name, option := range value {
+				if name == "_score" || name == "_doc" {
+					continue
+				}
+				order := fmt.Sprint(option)
+				if optionMap, ok := option.(map[string]interface{}); ok {
+					order = fmt.Sprint(optionMap["order"])
+				}
+				fields = append(fields, logSortField{name: name, descending: order == "desc"})
+			}
+		default:
+			return nil, errors.New("invalid sort param")
+		}
+	}
+	return fields, nil
+}
+
+// sortKeys returns the sort values of the document, the min value is used for ascending sort
+// and the max value for descending sort like ElasticSearch
+func sortKeys(doc *logDoc, fields []logSortField) []interface{} {
+	keys := make([]interface{}, len(fields))
+	for i, field := range fields {
+		for _, value := range docValues(doc, field.name) {
+			if result, ok := compareLogValues(value, keys[i]); keys[i] == nil ||
+				ok && (field.descending && result > 0 || !field.descending && result < 0) {
+				keys[i] = value
+			}
+		}
+	}
+	return keys
+}
+
+// compareSortKeys returns a negative number if the keys a are sorted before the keys b
+func compareSortKeys(a []interface{}, b []interface{}, fields []logSortField) int {
+	for i, field := range fields {
+		if a[i] == nil || b[i] == nil {
+			if a[i] == nil && b[i] == nil {
+				continue
+			} else if a[i] == nil {
+				return 1
+			}
+			return -1
+		}
+		result, ok := compareLogValues(a[i], b[i])
+		if !ok || result == 0 {
+			continue
+		}
+		if field.descending {
+			return -result
+		}
+		return result
+	}
+	return 0
+}
+
+func newLogTopDocs(limit int, fields []logSortField) *logTopDocs {
+	return &logTopDocs{limit: limit, fields: fields}
+}
+
+func (top *logTopDocs) Len() int {
+	return len(top.items)
+}
+
+func (top *logTopDocs) Less(i, j int) bool {
+	return top.compare(top.items[i], top.items[j]) > 0
+}
+
+func (top *logTopDocs) Swap(i, j int) {
+	top.items[i], top.items[j] = top.items[j], top.items[i]
+}
+
+func (top *logTopDocs) Push(item interface{}) {
+	top.items = append(top.items, item.(*logTopDoc))
+}
+
+func (top *logTopDocs) Pop() interface{} {
+	item := top.items[len(top.items)-1]
+	top.items = top.items[:len(top.items)-1]
+	return item
+}
+
+func (top *logTopDocs) compare(a *logTopDoc, b *logTopDoc) int {
+	if result := compareSortKeys(a.keys, b.keys, top.fields); result != 0 {
+		return result
+	}
+	return a.seq - b.seq
+}
+
+// add adds the document if it is one of the first documents, the raw source is copied
+// because it is only valid in the transaction
+func (top *logTopDocs) add(doc *logDoc) {
+	top.seq++
+	if top.limit <= 0 {
+		return
+	}
+	item := &logTopDoc{keys: sortKeys(doc, top.fields), seq: top.seq}
+	full := len(top.items) >= top.limit
+	if full && top.compare(item, top.items[0]) >= 0 {
+		return
+	}
+	copied := *doc
+	copied.Raw = append([]byte(nil), doc.Raw...)
+	item.doc = &copied
+	if full {
+		top.items[0] = item
+		heap.Fix(top, 0)
+	} else {
+		heap.Push(top, item)
+	}
+}
+
+// sorted returns the kept documents in the sort order
+func (top *logTopDocs) sorted() []*logDoc {
+	items := append([]*logTopDoc(nil), top.items...)
+	sort.Slice(items, func(i, j int) bool {
+		return top.compare(items[i], items[j]) < 0
+	})
+	docs := make([]*logDoc, 0, len(items))
+	for _, item := range items {
+		docs = append(docs, item.doc)
+	}
+	return docs
+}
+
+// filterSource filters the source by the _source param of search, the param is a bool,
+// a pattern, a list of patterns or an object with includes and excludes
+func filterSource(doc *logDoc, sourceParam interface{}) (interface{}, bool) {
+	var includes, excludes []string
+	switch value := sourceParam.(type) {
+	case nil:
+		return json.RawMessage(doc.Raw), true
+	case bool:
+		if !value {
+			return nil, false
+		}
+		return json.RawMessage(doc.Raw), true
+	case string:
+		includes = []string{value}
+	case []interface{}:
+		includes = toStrings(value)
+	case map[string]interface{}:
+		includes = toStrings(value["includes"])
+		if includes == nil {
+			includes = toStrings(value["include"])
+		}
+		excludes = toStrings(value["excludes"])
+		if excludes == nil {
+			excludes = toStrings(value["exclude"])
+		}
+	}
+	if len(includes) == 0 && len(excludes) == 0 {
+		return json.RawMessage(doc.Raw), true
+	}
+	return filterSourceMap(doc.Source, "", includes, excludes), true
+}
+
+func filterSourceMap(source map[string]interface{}, prefix string, includes []string,
+	excludes []string) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range source {
+		path := prefix + key
+		excluded := false
+		for _, pattern := range excludes {
+			if matchWildcard(pattern, path) {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			continue
+		}
+		included := len(includes) == 0
+		isParent := false
+		for _, pattern := range includes {
+			if matchWildcard(pattern, path) {
+				included = true
+				break
+			}
+			if strings.HasPrefix(pattern, path+".") || strings.HasPrefix(pattern, "*") {
+				isParent = true
+			}
+		}
+		if included {
+			result[key] = value
+		} else if child, ok := value.(map[string]interface{}); ok && isParent {
+			if filtered := filterSourceMap(child, path+".", includes, excludes); len(filtered) > 0 {
+				result[key] = filtered
+			}
+		}
+	}
+	return result
+}
+
+func toStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	}
+	return nil
+}
+
+func isInteger(value float64) bool {
+	return value == math.Trunc(value) && math.Abs(value) < 1<<53
+}
@@ -0,0 +1,391 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/coreos/bbolt"
+	"github.com/olivere/elastic"
+	"sort"
+)
+
+// the scan of the embedded log store, the logs sorted by an indexed field are streamed by the keys of the field,
+// each batch is read in a short transaction and the handler is called out of it, so that the writes of logs
+// are not blocked by a slow handler
+
+const defaultScanSize = 1000
+
+// logScanStream is the keys of the sort field in an index, the matched documents are buffered in order
+type logScanStream struct {
+	index    string
+	meta     *logIndexMeta
+	keyRange *logKeyRange
+	// last is the last visited key, the next batch starts after it
+	last    []byte
+	done    bool
+	pending []*logScanItem
+	// seen is the handled documents which have multiple keys of the sort field
+	seen map[string]bool
+}
+
+type logScanItem struct {
+	stream  *logScanStream
+	encoded []byte
+	doc     *logDoc
+}
+
+// Scan calls the handler with the matched logs in the sort order, the logs are streamed by the keys
+// if they are sorted by a single indexed field, otherwise the ids and sort keys of matched logs are sorted first
+func (store *boltLogStore) Scan(ctx context.Context, search *LogSearch,
+	handler func(hit *elastic.SearchHit) error) error {
+	request, err := store.parseLogSearch(search)
+	if err != nil {
+		return err
+	}
+	size := search.Size
+	if size <= 0 {
+		size = defaultScanSize
+	}
+	metas := store.getIndexMetas(request.indices)
+	if len(request.sortFields) == 1 {
+		indexed := true
+		for _, meta := range metas {
+			if !meta.field(request.sortFields[0].name).isIndexed() {
+				indexed = false
+			}
+		}
+		if indexed {
+			return store.scanSorted(ctx, request, metas, size, handler)
+		}
+	}
+	return store.scanCollected(ctx, request, metas, size, handler)
+}
+
+func (store *boltLogStore) scanSorted(ctx context.Context, request *logSearchRequest, metas map[string]*logIndexMeta,
+	size int, handler func(hit *elastic.SearchHit) error) error {
+	field := request.sortFields[0]
+	streams := make([]*logScanStream, 0, len(metas))
+	for _, index := range request.indices {
+		meta := metas[index]
+		if meta == nil {
+			continue
+		}
+		// the keys out of the range of the sort field are skipped
+		keyRange := planSortRange(request.query, meta, field.name)
+		if keyRange == nil {
+			prefix := logFieldPrefix(field.name)
+			keyRange = &logKeyRange{field: prefix, prefix: prefix}
+		}
+		streams = append(streams, &logScanStream{index: index, meta: meta, keyRange: keyRange})
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		items, err := store.readScanBatch(request, streams, field.descending, size)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			break
+		}
+		for _, item := range items {
+			if err := handleScanDoc(item.doc, request.source, handler); err != nil {
+				return err
+			}
+		}
+	}
+	// the logs without the sort field are sorted at last like ElasticSearch
+	for _, stream := range streams {
+		if err := store.scanMissing(ctx, request, stream, size, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readScanBatch fills the buffers of streams and returns the first items of them in the sort order
+func (store *boltLogStore) readScanBatch(request *logSearchRequest, streams []*logScanStream, descending bool,
+	size int) ([]*logScanItem, error) {
+	err := store.db.View(func(tx *bolt.Tx) error {
+		for _, stream := range streams {
+			if stream.done || len(stream.pending) >= size {
+				continue
+			}
+			buckets := getIndexBuckets(tx, stream.index)
+			if buckets == nil {
+				stream.done = true
+				continue
+			}
+			if err := stream.fill(request.query, buckets, descending, size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*logScanItem, 0, size)
+	for len(items) < size {
+		var next *logScanStream
+		for _, stream := range streams {
+			if len(stream.pending) == 0 {
+				continue
+			}
+			if next == nil {
+				next = stream
+				continue
+			}
+			result := bytes.Compare(stream.pending[0].encoded, next.pending[0].encoded)
+			if descending && result > 0 || !descending && result < 0 {
+				next = stream
+			}
+		}
+		if next == nil {
+			break
+		}
+		items = append(items, next.pending[0])
+		next.pending = next.pending[1:]
+	}
+	return items, nil
+}
+
+// fill reads the keys after the last visited one until the buffer is full or the keys are exhausted
+func (stream *logScanStream) fill(query map[string]interface{}, buckets *logIndexBuckets, descending bool,
+	size int) error {
+	matcher, err := compileQuery(query, stream.meta)
+	if err != nil {
+		return err
+	}
+	exhausted := true
+	err = stream.keyRange.forEachKey(buckets.keys, descending, stream.last,
+		func(key []byte, encoded []byte, id []byte) (bool, error) {
+			if len(stream.pending) >= size {
+				exhausted = false
+				return false, nil
+			}
+			stream.last = append([]byte(nil), key...)
+			if stream.seen[string(id)] {
+				return true, nil
+			}
+			raw := buckets.docs.Get(id)
+			if raw == nil {
+				return true, nil
+			}
+			source, err := decodeSource(raw)
+			if err != nil {
+				return false, err
+			}
+			doc := &logDoc{Index: stream.index, Id: string(id), Type: stream.meta.Type, Source: source,
+				meta: stream.meta}
+			if !matcher(doc) {
+				return true, nil
+			}
+			// the document with multiple values is handled at the first one, which is the min value
+			// for ascending sort and the max value for descending sort
+			if len(docValues(doc, stream.keyRange.fieldName())) > 1 {
+				if stream.seen == nil {
+					stream.seen = make(map[string]bool)
+				}
+				stream.seen[string(id)] = true
+			}
+			doc.Raw = append([]byte(nil), raw...)
+			stream.pending = append(stream.pending,
+				&logScanItem{stream: stream, encoded: append([]byte(nil), encoded...), doc: doc})
+			return true, nil
+		})
+	if err != nil {
+		return err
+	}
+	stream.done = exhausted
+	return nil
+}
+
+// scanMissing scans the documents of the index which have no key of the sort field, the scan is skipped
+// if all documents of the index have the field
+func (store *boltLogStore) scanMissing(ctx context.Context, request *logSearchRequest, stream *logScanStream,
+	size int, handler func(hit *elastic.SearchHit) error) error {
+	// the documents without the field do not match the range of it
+	if stream.keyRange.start != nil || stream.keyRange.end != nil {
+		return nil
+	}
+	fieldName := stream.keyRange.fieldName()
+	var after []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		docs := make([]*logDoc, 0, size)
+		exhausted := true
+		err := store.db.View(func(tx *bolt.Tx) error {
+			buckets := getIndexBuckets(tx, stream.index)
+			if buckets == nil || buckets.count(logStatsDocsKey) <= buckets.count(logStatsFieldKey+fieldName) {
+				return nil
+			}
+			matcher, err := compileQuery(request.query, stream.meta)
+			if err != nil {
+				return err
+			}
+			cursor := buckets.docs.Cursor()
+			id, raw := cursor.First()
+			if after != nil {
+				if id, raw = cursor.Seek(after); bytes.Equal(id, after) {
+					id, raw = cursor.Next()
+				}
+			}
+			for ; id != nil; id, raw = cursor.Next() {
+				if len(docs) >= size {
+					exhausted = false
+					break
+				}
+				after = append([]byte(nil), id...)
+				source, err := decodeSource(raw)
+				if err != nil {
+					return err
+				}
+				doc := &logDoc{Index: stream.index, Id: string(id), Type: stream.meta.Type, Source: source,
+					meta: stream.meta}
+				if hasLogKey(doc, fieldName) || !matcher(doc) {
+					continue
+				}
+				doc.Raw = append([]byte(nil), raw...)
+				docs = append(docs, doc)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := handleScanDoc(doc, request.source, handler); err != nil {
+				return err
+			}
+		}
+		if exhausted {
+			return nil
+		}
+	}
+}
+
+// scanCollected sorts the ids and sort keys of the matched documents, then reads the documents in batches
+func (store *boltLogStore) scanCollected(ctx context.Context, request *logSearchRequest,
+	metas map[string]*logIndexMeta, size int, handler func(hit *elastic.SearchHit) error) error {
+	type scanEntry struct {
+		key  logDocKey
+		keys []interface{}
+	}
+	entries := make([]scanEntry, 0)
+	err := store.forEachMatch(ctx, request.indices, request.query, func(doc *logDoc) error {
+		entries = append(entries, scanEntry{key: logDocKey{index: doc.Index, id: doc.Id},
+			keys: sortKeys(doc, request.sortFields)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(request.sortFields) > 0 {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return compareSortKeys(entries[i].keys, entries[j].keys, request.sortFields) < 0
+		})
+	}
+	for start := 0; start < len(entries); start += size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		docs := make([]*logDoc, 0, end-start)
+		err := store.db.View(func(tx *bolt.Tx) error {
+			for _, entry := range entries[start:end] {
+				buckets := getIndexBuckets(tx, entry.key.index)
+				if buckets == nil {
+					continue
+				}
+				raw := buckets.docs.Get([]byte(entry.key.id))
+				if raw == nil {
+					continue
+				}
+				source, err := decodeSource(raw)
+				if err != nil {
+					return err
+				}
+				meta := metas[entry.key.index]
+				docs = append(docs, &logDoc{Index: entry.key.index, Id: entry.key.id, Type: meta.Type,
+					Raw: append([]byte(nil), raw...), Source: source, meta: meta})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := handleScanDoc(doc, request.source, handler); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// planSortRange returns the range of the sort field in the required clauses of the query
+func planSortRange(query map[string]interface{}, meta *logIndexMeta, fieldName string) *logKeyRange {
+	clauses := []map[string]interface{}{query}
+	if body, ok := query["bool"].(map[string]interface{}); ok {
+		clauses = boolClauses(body, "must", "filter")
+	}
+	for _, clause := range clauses {
+		body, ok := clause["range"].(map[string]interface{})
+		if !ok || body[fieldName] == nil {
+			continue
+		}
+		if plan := planFieldQuery("range", body, meta); plan != nil && len(plan.ranges) == 1 {
+			return plan.ranges[0]
+		}
+	}
+	return nil
+}
+
+func (keyRange *logKeyRange) fieldName() string {
+	return string(keyRange.field[:len(keyRange.field)-1])
+}
+
+// hasLogKey returns true if any value of the field is a key of the index
+func hasLogKey(doc *logDoc, fieldName string) bool {
+	for _, value := range docValues(doc, fieldName) {
+		if _, ok := encodeLogValue(value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleScanDoc converts the document to the hit of elastic client and calls the handler
+func handleScanDoc(doc *logDoc, sourceParam interface{}, handler func(hit *elastic.SearchHit) error) error {
+	content, err := json.Marshal(buildHit(doc, sourceParam))
+	if err != nil {
+		return err
+	}
+	hit := new(elastic.SearchHit)
+	if err = json.Unmarshal(content, hit); err != nil {
+		return err
+	}
+	return handler(hit)
+}
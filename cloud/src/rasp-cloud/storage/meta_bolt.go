@@ -0,0 +1,473 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"github.com/coreos/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// boltMetaStore keeps each collection in a bucket of bbolt, the key is the bson encoded _id
+// and the value is the bson encoded document, the queries scan the whole collection
+
+const metaTtlCheckInterval = time.Minute
+
+type boltMetaStore struct {
+	db       *bolt.DB
+	indexes  map[string][]*mgo.Index
+	lock     sync.RWMutex
+	stopChan chan struct{}
+}
+
+func openBoltMetaStore(path string) (*boltMetaStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltMetaStore{
+		db:       db,
+		indexes:  make(map[string][]*mgo.Index),
+		stopChan: make(chan struct{}),
+	}
+	go store.startTtlSweeper()
+	return store, nil
+}
+
+func (store *boltMetaStore) Close() {
+	close(store.stopChan)
+	store.db.Close()
+}
+
+// CreateIndex only records the unique and ttl indexes, the other indexes are useless for the scan
+func (store *boltMetaStore) CreateIndex(collection string, index *mgo.Index) error {
+	if len(index.Key) == 0 {
+		return errors.New("the key of index can not be empty")
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, existed := range store.indexes[collection] {
+		if reflect.DeepEqual(existed.Key, index.Key) {
+			*existed = *index
+			return nil
+		}
+	}
+	indexCopy := *index
+	store.indexes[collection] = append(store.indexes[collection], &indexCopy)
+	return nil
+}
+
+func (store *boltMetaStore) Count(collection string, selector interface{}) (int, error) {
+	count := 0
+	err := store.view(collection, selector, func(key []byte, doc bson.M) (bool, error) {
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+func (store *boltMetaStore) Insert(collection string, docs ...interface{}) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		for _, item := range docs {
+			doc, err := toBsonM(item)
+			if err != nil {
+				return err
+			}
+			if _, ok := doc["_id"]; !ok {
+				doc["_id"] = bson.NewObjectId()
+			}
+			key, err := encodeId(doc["_id"])
+			if err != nil {
+				return err
+			}
+			if bucket.Get(key) != nil {
+				return newDupError(collection, "_id")
+			}
+			if err = store.put(collection, bucket, key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *boltMetaStore) Find(collection string, query *Query, result interface{}) error {
+	docs, err := store.find(collection, query)
+	if err != nil {
+		return err
+	}
+	return decodeDocs(docs, result)
+}
+
+func (store *boltMetaStore) FindOne(collection string, query *Query, result interface{}) error {
+	one := *query
+	one.Limit = 1
+	docs, err := store.find(collection, &one)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return decodeDoc(docs[0], result)
+}
+
+func (store *boltMetaStore) find(collection string, query *Query) ([]bson.M, error) {
+	docs := make([]bson.M, 0)
+	// the limit can only be applied during the scan without sort
+	scanLimit := 0
+	if len(query.Sort) == 0 && query.Limit > 0 {
+		scanLimit = query.Skip + query.Limit
+	}
+	err := store.view(collection, query.Selector, func(key []byte, doc bson.M) (bool, error) {
+		docs = append(docs, doc)
+		return scanLimit == 0 || len(docs) < scanLimit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortDocs(docs, query.Sort)
+	if query.Skip > 0 {
+		if query.Skip >= len(docs) {
+			docs = docs[:0]
+		} else {
+			docs = docs[query.Skip:]
+		}
+	}
+	if query.Limit > 0 && query.Limit < len(docs) {
+		docs = docs[:query.Limit]
+	}
+	if query.Projection != nil {
+		projection, err := toBsonM(query.Projection)
+		if err != nil {
+			return nil, err
+		}
+		for i := range docs {
+			docs[i] = projectDoc(docs[i], projection)
+		}
+	}
+	return docs, nil
+}
+
+func (store *boltMetaStore) Update(collection string, selector interface{}, update interface{}) error {
+	info, err := store.update(collection, selector, update, false, false)
+	if err == nil && info.Matched == 0 {
+		return mgo.ErrNotFound
+	}
+	return err
+}
+
+func (store *boltMetaStore) UpdateAll(collection string, selector interface{},
+	update interface{}) (*mgo.ChangeInfo, error) {
+	return store.update(collection, selector, update, true, false)
+}
+
+func (store *boltMetaStore) Upsert(collection string, selector interface{},
+	update interface{}) (*mgo.ChangeInfo, error) {
+	return store.update(collection, selector, update, false, true)
+}
+
+func (store *boltMetaStore) update(collection string, selector interface{}, update interface{},
+	multi bool, upsert bool) (*mgo.ChangeInfo, error) {
+	selectorDoc, err := toBsonM(selector)
+	if err != nil {
+		return nil, err
+	}
+	updateDoc, err := toBsonM(update)
+	if err != nil {
+		return nil, err
+	}
+	info := &mgo.ChangeInfo{}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		matchedKeys := make([][]byte, 0)
+		matchedDocs := make([]bson.M, 0)
+		err = scanBucket(bucket, selectorDoc, func(key []byte, doc bson.M) (bool, error) {
+			matchedKeys = append(matchedKeys, append([]byte(nil), key...))
+			matchedDocs = append(matchedDocs, doc)
+			return multi, nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, doc := range matchedDocs {
+			id := doc["_id"]
+			doc, err = applyUpdate(doc, updateDoc, false)
+			if err != nil {
+				return err
+			}
+			doc["_id"] = id
+			if err = store.put(collection, bucket, matchedKeys[i], doc); err != nil {
+				return err
+			}
+			info.Matched++
+			info.Updated++
+		}
+		if len(matchedDocs) > 0 || !upsert {
+			return nil
+		}
+		doc, err := applyUpdate(newUpsertDoc(selectorDoc), updateDoc, true)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		info.UpsertedId = doc["_id"]
+		key, err := encodeId(doc["_id"])
+		if err != nil {
+			return err
+		}
+		return store.put(collection, bucket, key, doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (store *boltMetaStore) Remove(collection string, selector interface{}) error {
+	info, err := store.remove(collection, selector, false)
+	if err == nil && info.Removed == 0 {
+		return mgo.ErrNotFound
+	}
+	return err
+}
+
+func (store *boltMetaStore) RemoveAll(collection string, selector interface{}) (*mgo.ChangeInfo, error) {
+	return store.remove(collection, selector, true)
+}
+
+func (store *boltMetaStore) remove(collection string, selector interface{}, multi bool) (*mgo.ChangeInfo, error) {
+	selectorDoc, err := toBsonM(selector)
+	if err != nil {
+		return nil, err
+	}
+	info := &mgo.ChangeInfo{}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		keys := make([][]byte, 0)
+		err := scanBucket(bucket, selectorDoc, func(key []byte, doc bson.M) (bool, error) {
+			keys = append(keys, append([]byte(nil), key...))
+			return multi, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			info.Removed++
+			info.Matched++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// put checks the unique indexes and saves the document
+func (store *boltMetaStore) put(collection string, bucket *bolt.Bucket, key []byte, doc bson.M) error {
+	store.lock.RLock()
+	indexes := store.indexes[collection]
+	store.lock.RUnlock()
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+		fields := indexFields(index)
+		values := make([]interface{}, len(fields))
+		isNull := true
+		for i, field := range fields {
+			values[i] = firstValue(doc, field)
+			isNull = isNull && values[i] == nil
+		}
+		if isNull && index.Sparse {
+			continue
+		}
+		err := scanBucket(bucket, bson.M{}, func(otherKey []byte, other bson.M) (bool, error) {
+			if string(otherKey) == string(key) {
+				return true, nil
+			}
+			for i, field := range fields {
+				if !equalValues(firstValue(other, field), values[i]) {
+					return true, nil
+				}
+			}
+			return false, newDupError(collection, strings.Join(fields, "_"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	content, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, content)
+}
+
+func (store *boltMetaStore) view(collection string, selector interface{},
+	handle func(key []byte, doc bson.M) (bool, error)) error {
+	selectorDoc, err := toBsonM(selector)
+	if err != nil {
+		return err
+	}
+	return store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return scanBucket(bucket, selectorDoc, handle)
+	})
+}
+
+// startTtlSweeper removes the expired documents of the indexes with ExpireAfter like MongoDB
+func (store *boltMetaStore) startTtlSweeper() {
+	ticker := time.NewTicker(metaTtlCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stopChan:
+			return
+		case <-ticker.C:
+			store.removeExpiredDocs()
+		}
+	}
+}
+
+func (store *boltMetaStore) removeExpiredDocs() {
+	store.lock.RLock()
+	ttlIndexes := make(map[string]*mgo.Index)
+	for collection, indexes := range store.indexes {
+		for _, index := range indexes {
+			if index.ExpireAfter > 0 {
+				ttlIndexes[collection] = index
+			}
+		}
+	}
+	store.lock.RUnlock()
+	for collection, index := range ttlIndexes {
+		expiredTime := time.Now().Add(-index.ExpireAfter)
+		_, err := store.RemoveAll(collection, bson.M{indexFields(index)[0]: bson.M{"$lt": expiredTime}})
+		if err != nil {
+			beego.Error("failed to remove the expired documents of " + collection + ": " + err.Error())
+		}
+	}
+}
+
+// scanBucket calls the handle with the matched documents until it returns false
+func scanBucket(bucket *bolt.Bucket, selector bson.M, handle func(key []byte, doc bson.M) (bool, error)) error {
+	cursor := bucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		doc := bson.M{}
+		if err := bson.Unmarshal(value, &doc); err != nil {
+			return err
+		}
+		matched, err := matchDoc(doc, selector)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+		next, err := handle(key, doc)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexFields(index *mgo.Index) []string {
+	fields := make([]string, len(index.Key))
+	for i, key := range index.Key {
+		fields[i] = strings.TrimLeft(key, "+-")
+	}
+	return fields
+}
+
+func encodeId(id interface{}) ([]byte, error) {
+	return bson.Marshal(bson.D{{Name: "_id", Value: id}})
+}
+
+// newDupError returns the same error as MongoDB, so that mgo.IsDup works with it
+func newDupError(collection string, index string) error {
+	return &mgo.LastError{
+		Code: 11000,
+		Err:  fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", collection, index),
+	}
+}
+
+// decodeDocs decodes the documents into the result which is a pointer to slice like mgo
+func decodeDocs(docs []bson.M, result interface{}) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return errors.New("the result argument must be a slice address")
+	}
+	sliceValue := resultValue.Elem()
+	sliceValue = sliceValue.Slice(0, 0)
+	elemType := sliceValue.Type().Elem()
+	for _, doc := range docs {
+		var elem reflect.Value
+		switch elemType.Kind() {
+		case reflect.Interface:
+			elem = reflect.ValueOf(doc)
+		case reflect.Ptr:
+			elem = reflect.New(elemType.Elem())
+			if err := decodeDoc(doc, elem.Interface()); err != nil {
+				return err
+			}
+		default:
+			elem = reflect.New(elemType)
+			if err := decodeDoc(doc, elem.Interface()); err != nil {
+				return err
+			}
+			elem = elem.Elem()
+		}
+		sliceValue = reflect.Append(sliceValue, elem)
+	}
+	resultValue.Elem().Set(sliceValue)
+	return nil
+}
+
+func decodeDoc(doc bson.M, result interface{}) error {
+	content, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(content, result)
+}
@@ -0,0 +1,795 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the subset of MongoDB query language which is used by the models,
+// the documents are compared in the form of bson.M after bson encoding
+
+// toBsonM converts the selector or document to bson.M with the bson encoding of mgo
+func toBsonM(value interface{}) (bson.M, error) {
+	if value == nil {
+		return bson.M{}, nil
+	}
+	if m, ok := value.(bson.M); ok {
+		// the values of bson.M still need to be normalized, like []string and struct
+		value = map[string]interface{}(m)
+	}
+	content, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	result := bson.M{}
+	err = bson.Unmarshal(content, &result)
+	return result, err
+}
+
+// matchDoc returns whether the document matches the selector
+func matchDoc(doc bson.M, selector bson.M) (bool, error) {
+	for key, condition := range selector {
+		var matched bool
+		var err error
+		switch key {
+		case "$or", "$and", "$nor":
+			matched, err = matchLogical(doc, key, condition)
+		case "$where":
+			matched, err = matchWhere(doc, condition)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errors.New("unsupported query operator: " + key)
+			}
+			matched, err = matchField(lookupValues(doc, key), condition)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, operator string, condition interface{}) (bool, error) {
+	conditions, ok := condition.([]interface{})
+	if !ok {
+		return false, errors.New(operator + " must be an array")
+	}
+	for _, item := range conditions {
+		subSelector, ok := toDoc(item)
+		if !ok {
+			return false, errors.New(operator + " must be an array of documents")
+		}
+		matched, err := matchDoc(doc, subSelector)
+		if err != nil {
+			return false, err
+		}
+		if operator == "$or" && matched {
+			return true, nil
+		}
+		if operator == "$and" && !matched {
+			return false, nil
+		}
+		if operator == "$nor" && matched {
+			return false, nil
+		}
+	}
+	return operator != "$or", nil
+}
+
+// matchField returns whether the values of field match the condition,
+// the condition is a document of operators or a value to be equal
+func matchField(values []interface{}, condition interface{}) (bool, error) {
+	if regex, ok := condition.(bson.RegEx); ok {
+		return matchRegex(values, regex.Pattern, regex.Options)
+	}
+	conditionDoc, ok := toDoc(condition)
+	if !ok || !isOperatorDoc(conditionDoc) {
+		return containsValue(values, condition), nil
+	}
+	for operator, operand := range conditionDoc {
+		var matched bool
+		var err error
+		switch operator {
+		case "$eq":
+			matched = containsValue(values, operand)
+		case "$ne":
+			matched = !containsValue(values, operand)
+		case "$in", "$nin":
+			operands, ok := operand.([]interface{})
+			if !ok {
+				return false, errors.New(operator + " needs an array")
+			}
+			for _, item := range operands {
+				if containsValue(values, item) {
+					matched = true
+					break
+				}
+			}
+			if operator == "$nin" {
+				matched = !matched
+			}
+		case "$all":
+			operands, ok := operand.([]interface{})
+			if !ok {
+				return false, errors.New("$all needs an array")
+			}
+			matched = true
+			for _, item := range operands {
+				if !containsValue(values, item) {
+					matched = false
+					break
+				}
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			for _, value := range values {
+				if result, ok := compareValues(value, operand); ok &&
+					(operator == "$gt" && result > 0 || operator == "$gte" && result >= 0 ||
+						operator == "$lt" && result < 0 || operator == "$lte" && result <= 0) {
+					matched = true
+					break
+				}
+			}
+		case "$exists":
+			exists := len(values) > 0
+			matched = exists == isTrue(operand)
+		case "$regex":
+			options, _ := conditionDoc["$options"].(string)
+			pattern := fmt.Sprint(operand)
+			if regex, ok := operand.(bson.RegEx); ok {
+				pattern, options = regex.Pattern, regex.Options+options
+			}
+			matched, err = matchRegex(values, pattern, options)
+		case "$options":
+			matched = true
+		case "$elemMatch":
+			subSelector, ok := toDoc(operand)
+			if !ok {
+				return false, errors.New("$elemMatch needs a document")
+			}
+			for _, value := range values {
+				if element, ok := toDoc(value); ok {
+					if matched, err = matchDoc(element, subSelector); err != nil || matched {
+						break
+					}
+				}
+			}
+		case "$size":
+			for _, value := range values {
+				if array, ok := value.([]interface{}); ok && containsValue([]interface{}{len(array)}, operand) {
+					matched = true
+					break
+				}
+			}
+		default:
+			return false, errors.New("unsupported query operator: " + operator)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchRegex(values []interface{}, pattern string, options string) (bool, error) {
+	if strings.Contains(options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, value := range values {
+		if str, ok := value.(string); ok && regex.MatchString(str) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var whereTermRegex = regexp.MustCompile(`^\s*(this\.[\w.]+|-?\d+(\.\d+)?)\s*$`)
+
+// matchWhere evaluates the javascript expression of $where, only the comparison of the sums of
+// fields and numbers is supported, like "this.last_heartbeat_time+this.heartbeat_interval+180 < 1546272000"
+func matchWhere(doc bson.M, condition interface{}) (bool, error) {
+	expression, ok := condition.(string)
+	if !ok {
+		return false, errors.New("$where must be a string")
+	}
+	for _, operator := range []string{"===", "!==", "==", "!=", ">=", "<=", ">", "<"} {
+		index := strings.Index(expression, operator)
+		if index < 0 {
+			continue
+		}
+		left, err := evalWhereSum(doc, expression[:index])
+		if err != nil {
+			return false, err
+		}
+		right, err := evalWhereSum(doc, expression[index+len(operator):])
+		if err != nil {
+			return false, err
+		}
+		switch operator {
+		case "===", "==":
+			return left == right, nil
+		case "!==", "!=":
+			return left != right, nil
+		case ">=":
+			return left >= right, nil
+		case "<=":
+			return left <= right, nil
+		case ">":
+			return left > right, nil
+		default:
+			return left < right, nil
+		}
+	}
+	return false, errors.New("unsupported $where expression: " + expression)
+}
+
+func evalWhereSum(doc bson.M, expression string) (float64, error) {
+	var sum float64
+	for _, term := range strings.Split(expression, "+") {
+		if !whereTermRegex.MatchString(term) {
+			return 0, errors.New("unsupported $where expression: " + expression)
+		}
+		term = strings.TrimSpace(term)
+		if strings.HasPrefix(term, "this.") {
+			values := lookupValues(doc, strings.TrimPrefix(term, "this."))
+			if len(values) == 0 {
+				return 0, nil
+			}
+			number, ok := toFloat(values[0])
+			if !ok {
+				return 0, nil
+			}
+			sum += number
+		} else {
+			number, _ := strconv.ParseFloat(term, 64)
+			sum += number
+		}
+	}
+	return sum, nil
+}
+
+// lookupValues returns the values of the dotted path, the elements of arrays are expanded
+func lookupValues(doc bson.M, path string) []interface{} {
+	values := []interface{}{doc}
+	for _, part := range strings.Split(path, ".") {
+		next := make([]interface{}, 0)
+		for _, value := range values {
+			next = append(next, lookupChild(value, part)...)
+		}
+		values = next
+	}
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		result = append(result, value)
+		if array, ok := value.([]interface{}); ok {
+			result = append(result, array...)
+		}
+	}
+	return result
+}
+
+func lookupChild(value interface{}, name string) []interface{} {
+	if doc, ok := toDoc(value); ok {
+		if child, ok := doc[name]; ok {
+			return []interface{}{child}
+		}
+		return nil
+	}
+	if array, ok := value.([]interface{}); ok {
+		if index, err := strconv.Atoi(name); err == nil {
+			if index >= 0 && index < len(array) {
+				return []interface{}{array[index]}
+			}
+			return nil
+		}
+		result := make([]interface{}, 0)
+		for _, item := range array {
+			if doc, ok := toDoc(item); ok {
+				if child, ok := doc[name]; ok {
+					result = append(result, child)
+				}
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, target interface{}) bool {
+	if target == nil && len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if equalValues(value, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+	if result, ok := compareValues(a, b); ok {
+		return result == 0
+	}
+	aDoc, aOk := toDoc(a)
+	bDoc, bOk := toDoc(b)
+	if aOk && bOk {
+		if len(aDoc) != len(bDoc) {
+			return false
+		}
+		for key, value := range aDoc {
+			if !equalValues(value, bDoc[key]) {
+				return false
+			}
+		}
+		return true
+	}
+	aArray, aOk := a.([]interface{})
+	bArray, bOk := b.([]interface{})
+	if aOk && bOk {
+		if len(aArray) != len(bArray) {
+			return false
+		}
+		for i := range aArray {
+			if !equalValues(aArray[i], bArray[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues compares the values of the same kind, ok is false if they can not be compared
+func compareValues(a interface{}, b interface{}) (result int, ok bool) {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+	if aNumber, ok := toFloat(a); ok {
+		if bNumber, ok := toFloat(b); ok {
+			return compareFloat(aNumber, bNumber), true
+		}
+		return 0, false
+	}
+	switch aValue := a.(type) {
+	case string:
+		if bValue, ok := b.(string); ok {
+			return strings.Compare(aValue, bValue), true
+		}
+	case bson.ObjectId:
+		if bValue, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(aValue), string(bValue)), true
+		}
+	case bool:
+		if bValue, ok := b.(bool); ok {
+			if aValue == bValue {
+				return 0, true
+			} else if !aValue {
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if bValue, ok := b.(time.Time); ok {
+			if aValue.Equal(bValue) {
+				return 0, true
+			} else if aValue.Before(bValue) {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func compareFloat(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func toDoc(value interface{}) (bson.M, bool) {
+	switch v := value.(type) {
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return bson.M(v), true
+	}
+	return nil, false
+}
+
+func isOperatorDoc(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func isTrue(value interface{}) bool {
+	if b, ok := value.(bool); ok {
+		return b
+	}
+	if number, ok := toFloat(value); ok {
+		return number != 0
+	}
+	return value != nil
+}
+
+// applyUpdate applies the update document to the document, the update is a replacement if it has no operator,
+// isInsert is true if the document is inserted by upsert
+func applyUpdate(doc bson.M, update bson.M, isInsert bool) (bson.M, error) {
+	if !hasUpdateOperator(update) {
+		replacement := bson.M{}
+		for key, value := range update {
+			replacement[key] = value
+		}
+		if id, ok := doc["_id"]; ok {
+			replacement["_id"] = id
+		}
+		return replacement, nil
+	}
+	for operator, fields := range update {
+		fieldsDoc, ok := toDoc(fields)
+		if !ok {
+			return nil, errors.New("the value of " + operator + " must be a document")
+		}
+		for path, value := range fieldsDoc {
+			var err error
+			switch operator {
+			case "$set":
+				err = setPath(doc, path, value)
+			case "$setOnInsert":
+				if isInsert {
+					err = setPath(doc, path, value)
+				}
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc":
+				err = incPath(doc, path, value)
+			case "$push", "$addToSet":
+				err = pushPath(doc, path, value, operator == "$addToSet")
+			case "$pull":
+				err = pullPath(doc, path, value)
+			default:
+				err = errors.New("unsupported update operator: " + operator)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+func hasUpdateOperator(update bson.M) bool {
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// getParent returns the parent document of the dotted path, the missing documents are created
+func getParent(doc bson.M, path string, create bool) (bson.M, string, error) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := current[part]
+		if !ok || child == nil {
+			if !create {
+				return nil, "", nil
+			}
+			childDoc := bson.M{}
+			current[part] = childDoc
+			current = childDoc
+			continue
+		}
+		childDoc, ok := toDoc(child)
+		if !ok {
+			return nil, "", errors.New("can not set the field " + path + " in a non-document value")
+		}
+		current = childDoc
+	}
+	return current, parts[len(parts)-1], nil
+}
+
+func setPath(doc bson.M, path string, value interface{}) error {
+	parent, name, err := getParent(doc, path, true)
+	if err != nil {
+		return err
+	}
+	parent[name] = value
+	return nil
+}
+
+func unsetPath(doc bson.M, path string) {
+	parent, name, _ := getParent(doc, path, false)
+	if parent != nil {
+		delete(parent, name)
+	}
+}
+
+func incPath(doc bson.M, path string, value interface{}) error {
+	parent, name, err := getParent(doc, path, true)
+	if err != nil {
+		return err
+	}
+	increment, ok := toFloat(value)
+	if !ok {
+		return errors.New("$inc needs a number")
+	}
+	current, _ := toFloat(parent[name])
+	sum := current + increment
+	if _, isFloat := value.(float64); isFloat {
+		parent[name] = sum
+	} else {
+		parent[name] = int64(sum)
+	}
+	return nil
+}
+
+func pushPath(doc bson.M, path string, value interface{}, unique bool) error {
+	parent, name, err := getParent(doc, path, true)
+	if err != nil {
+		return err
+	}
+	array, _ := parent[name].([]interface{})
+	if parent[name] != nil && array == nil {
+		return errors.New("can not push to the non-array field " + path)
+	}
+	items := []interface{}{value}
+	var slice interface{}
+	if modifier, ok := toDoc(value); ok && isOperatorDoc(modifier) {
+		if each, ok := modifier["$each"].([]interface{}); ok {
+			items = each
+		}
+		slice = modifier["$slice"]
+	}
+	for _, item := range items {
+		if unique && containsValue(array, item) {
+			continue
+		}
+		array = append(array, item)
+	}
+	if slice != nil {
+		if size, ok := toFloat(slice); ok {
+			limit := int(size)
+			if limit < 0 && -limit < len(array) {
+				array = array[len(array)+limit:]
+			} else if limit >= 0 && limit < len(array) {
+				array = array[:limit]
+			}
+		}
+	}
+	parent[name] = array
+	return nil
+}
+
+func pullPath(doc bson.M, path string, condition interface{}) error {
+	parent, name, err := getParent(doc, path, false)
+	if err != nil || parent == nil {
+		return err
+	}
+	array, ok := parent[name].([]interface{})
+	if !ok {
+		return nil
+	}
+	result := make([]interface{}, 0, len(array))
+	for _, item := range array {
+		var matched bool
+		if conditionDoc, ok := toDoc(condition); ok {
+			if itemDoc, ok := toDoc(item); ok && !isOperatorDoc(conditionDoc) {
+				matched, err = matchDoc(itemDoc, conditionDoc)
+			} else {
+				matched, err = matchField([]interface{}{item}, conditionDoc)
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			matched = equalValues(item, condition)
+		}
+		if !matched {
+			result = append(result, item)
+		}
+	}
+	parent[name] = result
+	return nil
+}
+
+// newUpsertDoc returns the document inserted by upsert, the equality fields of selector are kept
+func newUpsertDoc(selector bson.M) bson.M {
+	doc := bson.M{}
+	for key, value := range selector {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if valueDoc, ok := toDoc(value); ok && isOperatorDoc(valueDoc) {
+			if eq, ok := valueDoc["$eq"]; ok {
+				setPath(doc, key, eq)
+			}
+			continue
+		}
+		setPath(doc, key, value)
+	}
+	return doc
+}
+
+// sortDocs sorts the documents by the fields of mgo, like "-time"
+func sortDocs(docs []bson.M, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+	less := func(a bson.M, b bson.M) bool {
+		for _, field := range fields {
+			descending := strings.HasPrefix(field, "-")
+			field = strings.TrimLeft(field, "+-")
+			result := compareSortValues(firstValue(a, field), firstValue(b, field))
+			if result != 0 {
+				return descending && result > 0 || !descending && result < 0
+			}
+		}
+		return false
+	}
+	stableSort(docs, less)
+}
+
+func firstValue(doc bson.M, path string) interface{} {
+	values := lookupValues(doc, path)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// compareSortValues compares the values of any kind, the order of kinds is null < number < string < others
+func compareSortValues(a interface{}, b interface{}) int {
+	if result, ok := compareValues(a, b); ok {
+		return result
+	}
+	return sortKind(a) - sortKind(b)
+}
+
+func sortKind(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+	if _, ok := toFloat(value); ok {
+		return 1
+	}
+	switch value.(type) {
+	case string:
+		return 2
+	case bson.M, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.ObjectId:
+		return 5
+	case bool:
+		return 6
+	case time.Time:
+		return 7
+	}
+	return 8
+}
+
+func stableSort(docs []bson.M, less func(a bson.M, b bson.M) bool) {
+	// insertion sort on small slices, merge sort on the others
+	if len(docs) < 12 {
+		for i := 1; i < len(docs); i++ {
+			for j := i; j > 0 && less(docs[j], docs[j-1]); j-- {
+				docs[j], docs[j-1] = docs[j-1], docs[j]
+			}
+		}
+		return
+	}
+	middle := len(docs) / 2
+	left := append([]bson.M(nil), docs[:middle]...)
+	right := append([]bson.M(nil), docs[middle:]...)
+	stableSort(left, less)
+	stableSort(right, less)
+	i, j := 0, 0
+	for k := range docs {
+		if j >= len(right) || i < len(left) && !less(right[j], left[i]) {
+			docs[k] = left[i]
+			i++
+		} else {
+			docs[k] = right[j]
+			j++
+		}
+	}
+}
+
+// projectDoc keeps or removes the top level fields of the document by the projection of mgo
+func projectDoc(doc bson.M, projection bson.M) bson.M {
+	if len(projection) == 0 {
+		return doc
+	}
+	include := false
+	for key, value := range projection {
+		if key != "_id" && isTrue(value) {
+			include = true
+			break
+		}
+	}
+	result := bson.M{}
+	if include {
+		for key, value := range projection {
+			if isTrue(value) {
+				if fieldValue, ok := doc[key]; ok {
+					result[key] = fieldValue
+				}
+			}
+		}
+		if value, ok := projection["_id"]; !ok || isTrue(value) {
+			if id, ok := doc["_id"]; ok {
+				result["_id"] = id
+			}
+		}
+		return result
+	}
+	for key, value := range doc {
+		if excluded, ok := projection[key]; ok && !isTrue(excluded) {
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
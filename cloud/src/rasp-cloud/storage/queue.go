@@ -0,0 +1,209 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"encoding/binary"
+	"github.com/coreos/bbolt"
+	"sync"
+	"time"
+)
+
+// DiskQueue is a durable FIFO queue in a local file, each item is kept until it is removed after handling,
+// so that the items survive the failure of the consumer and the restart of rasp-cloud
+
+const diskQueueBucketName = "queue"
+
+type DiskQueue struct {
+	db      *bolt.DB
+	maxSize int
+	size    int
+	lock    sync.Mutex
+}
+
+type QueueItem struct {
+	Key   uint64
+	Value []byte
+}
+
+// OpenDiskQueue opens the queue file, the relative path is based on the directory of rasp-cloud,
+// the queue holds at most maxSize items
+func OpenDiskQueue(path string, maxSize int) (*DiskQueue, error) {
+	db, err := bolt.Open(resolveDataPath(path), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	queue := &DiskQueue{db: db, maxSize: maxSize}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(diskQueueBucketName))
+		if err != nil {
+			return err
+		}
+		queue.size = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// Push appends the values to the tail of queue in a transaction, the count of appended values is returned,
+// the values beyond the max size of queue are not appended
+func (queue *DiskQueue) Push(values ...[]byte) (int, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	count := queue.maxSize - queue.size
+	if count > len(values) {
+		count = len(values)
+	}
+	if count <= 0 {
+		return 0, nil
+	}
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(diskQueueBucketName))
+		for _, value := range values[:count] {
+			sequence, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(encodeQueueKey(sequence), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	queue.size += count
+	return count, nil
+}
+
+// Peek returns at most count items from the head of queue without removing them
+func (queue *DiskQueue) Peek(count int) ([]*QueueItem, error) {
+	items := make([]*QueueItem, 0, count)
+	err := queue.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(diskQueueBucketName)).Cursor()
+		for key, value := cursor.First(); key != nil && len(items) < count; key, value = cursor.Next() {
+			items = append(items, &QueueItem{
+				Key:   binary.BigEndian.Uint64(key),
+				Value: append([]byte(nil), value...),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Remove removes the handled items with the keys
+func (queue *DiskQueue) Remove(keys ...uint64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	removed := 0
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(diskQueueBucketName))
+		for _, key := range keys {
+			encodedKey := encodeQueueKey(key)
+			if bucket.Get(encodedKey) == nil {
+				continue
+			}
+			if err := bucket.Delete(encodedKey); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	queue.size -= removed
+	return nil
+}
+
+// Requeue removes the handled items with the keys and appends the values to the tail of queue in a transaction,
+// the removed items are released before the values are appended, so the values within the released count are
+// always appended, the count of appended values is returned
+func (queue *DiskQueue) Requeue(keys []uint64, values ...[]byte) (int, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	removed := 0
+	count := 0
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(diskQueueBucketName))
+		for _, key := range keys {
+			encodedKey := encodeQueueKey(key)
+			if bucket.Get(encodedKey) == nil {
+				continue
+			}
+			if err := bucket.Delete(encodedKey); err != nil {
+				return err
+			}
+			removed++
+		}
+		count = queue.maxSize - queue.size + removed
+		if count > len(values) {
+			count = len(values)
+		} else if count < 0 {
+			count = 0
+		}
+		for _, value := range values[:count] {
+			sequence, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(encodeQueueKey(sequence), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	queue.size += count - removed
+	return count, nil
+}
+
+// Len returns the count of items in the queue
+func (queue *DiskQueue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.size
+}
+
+// MaxSize returns the max count of items in the queue
+func (queue *DiskQueue) MaxSize() int {
+	return queue.maxSize
+}
+
+func (queue *DiskQueue) Close() error {
+	return queue.db.Close()
+}
+
+func encodeQueueKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
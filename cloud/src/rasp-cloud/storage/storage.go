@@ -0,0 +1,141 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package storage
+
+import (
+	"gopkg.in/mgo.v2"
+	"os"
+	"path/filepath"
+	"rasp-cloud/conf"
+	"rasp-cloud/tools"
+	"context"
+	"github.com/olivere/elastic"
+)
+
+// the stores of rasp-cloud, the metadata is stored in MongoDB and the logs are stored in ElasticSearch by default,
+// the embedded stores keep both of them in local files for the evaluation and small sites
+
+const (
+	BackendExternal   = "external"
+	BackendEmbedded   = "embedded"
+	metaStoreFileName = "meta.db"
+	logStoreFileName  = "logs.db"
+)
+
+// MetaStore is the store of metadata with the query language of MongoDB,
+// the selector, query and update documents are the same as mgo
+type MetaStore interface {
+	Count(collection string, selector interface{}) (int, error)
+	CreateIndex(collection string, index *mgo.Index) error
+	Insert(collection string, docs ...interface{}) error
+	// Find returns all matched documents into the result which is a pointer to slice
+	Find(collection string, query *Query, result interface{}) error
+	// FindOne returns mgo.ErrNotFound if there is no matched document
+	FindOne(collection string, query *Query, result interface{}) error
+	// Update updates the first matched document, mgo.ErrNotFound is returned if there is no matched document
+	Update(collection string, selector interface{}, update interface{}) error
+	UpdateAll(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error)
+	Upsert(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error)
+	// Remove removes the first matched document, mgo.ErrNotFound is returned if there is no matched document
+	Remove(collection string, selector interface{}) error
+	RemoveAll(collection string, selector interface{}) (*mgo.ChangeInfo, error)
+	Close()
+}
+
+// Query is the find operation of MetaStore
+type Query struct {
+	Selector   interface{}
+	Projection interface{}
+	Sort       []string
+	Skip       int
+	Limit      int
+}
+
+// LogStore is the store of logs with the query DSL of ElasticSearch,
+// the queries, aggregations and results are the same as the elastic client
+type LogStore interface {
+	// PutTemplate puts the legacy index template, the mappings of the template are keyed by the es type
+	PutTemplate(name string, esType string, body string) error
+	// CreateIndex creates the index with the alias, the alias is added if the index exists
+	CreateIndex(name string, alias string) error
+	DeleteIndex(name string) error
+	// GetAliasIndices returns the indices of each alias which matches the pattern
+	GetAliasIndices(aliasPattern string) (map[string][]string, error)
+	IndexStats(indices ...string) (map[string]*elastic.IndexStats, error)
+	// Bulk executes the requests in order, the result of each request is in the items of the response
+	Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error)
+	Search(ctx context.Context, search *LogSearch) (*elastic.SearchResult, error)
+	Count(ctx context.Context, query elastic.Query, indices ...string) (int64, error)
+	// Scan calls the handler with all hits of the search in order, the size of search is the size of each batch,
+	// the scan stops with the error returned by the handler
+	Scan(ctx context.Context, search *LogSearch, handler func(hit *elastic.SearchHit) error) error
+	DeleteByQuery(ctx context.Context, query elastic.Query, indices ...string) (int64, error)
+	Close()
+}
+
+// LogSearch is the search operation of LogStore, the query is match_all if it is nil
+type LogSearch struct {
+	Indices      []string
+	Query        elastic.Query
+	Aggregations map[string]elastic.Aggregation
+	Sorters      []elastic.Sorter
+	Source       *elastic.FetchSourceContext
+	From         int
+	Size         int
+}
+
+// IsEmbedded returns whether the embedded stores are used instead of MongoDB and ElasticSearch
+func IsEmbedded() bool {
+	return conf.AppConfig.StorageBackend == BackendEmbedded
+}
+
+// OpenEmbeddedMetaStore opens the embedded metadata store in the data directory
+func OpenEmbeddedMetaStore() MetaStore {
+	store, err := openBoltMetaStore(getDataFilePath(metaStoreFileName))
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed, "failed to open the embedded metadata store", err)
+	}
+	return store
+}
+
+// OpenEmbeddedLogStore opens the embedded log store in the data directory
+func OpenEmbeddedLogStore() LogStore {
+	store, err := openBoltLogStore(getDataFilePath(logStoreFileName))
+	if err != nil {
+		tools.Panic(tools.ErrCodeESInitFailed, "failed to open the embedded log store", err)
+	}
+	return store
+}
+
+func getDataFilePath(name string) string {
+	return resolveDataPath(filepath.Join(conf.AppConfig.EmbeddedDataPath, name))
+}
+
+// resolveDataPath returns the absolute path of the data file, the relative path is based on the directory of
+// rasp-cloud, the parent directory is created if not exists
+func resolveDataPath(path string) string {
+	if !filepath.IsAbs(path) {
+		currentPath, err := tools.GetCurrentPath()
+		if err != nil {
+			tools.Panic(tools.ErrCodeConfigInitFailed, "failed to get current directory path", err)
+		}
+		path = filepath.Join(currentPath, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		tools.Panic(tools.ErrCodeConfigInitFailed, "failed to create the data directory "+filepath.Dir(path), err)
+	}
+	return path
+}
@@ -20,17 +20,19 @@ import (
 	"rasp-cloud/models/logs"
 	"errors"
 	"rasp-cloud/mongo"
+	"encoding/json"
 )
 
 type writerCloser struct {
+	closeErr error
 }
 
 func (*writerCloser) Write([]byte) (n int, err error) {
 	return 1, nil
 }
 
-func (*writerCloser) Close() error {
-	return nil
+func (w *writerCloser) Close() error {
+	return w.closeErr
 }
 
 func TestAttackAlarmPush(t *testing.T) {
@@ -132,10 +134,16 @@ func TestAttackAlarmPush(t *testing.T) {
 			},
 		)
 
-		monkey.Patch(smtp.SendMail, func(string, smtp.Auth, string, []string, []byte) error {
-			return nil
+		monkey.Patch(net.DialTimeout, func(string, string, time.Duration) (net.Conn, error) {
+			return &net.TCPConn{}, nil
 		})
 
+		monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "StartTLS",
+			func(*smtp.Client, *tls.Config) error {
+				return nil
+			},
+		)
+
 		Convey("when the alarm is for testing ", func() {
 			models.PushAttackAlarm(start.TestApp, 1, alarms, true)
 		})
@@ -212,10 +220,105 @@ func TestAttackAlarmPush(t *testing.T) {
 			So(err, ShouldNotEqual, nil)
 		})
 
+		Convey("when the data writer of tls client fails to close", func() {
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Data",
+				func(*smtp.Client) (io.WriteCloser, error) {
+					return &writerCloser{closeErr: errors.New("554 rejected")}, nil
+				},
+			)
+			start.TestApp.EmailAlarmConf.TlsEnable = true
+			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("when the plain email is upgraded with starttls of the tls config", func() {
+			var config *tls.Config
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "StartTLS",
+				func(_ *smtp.Client, tlsConfig *tls.Config) error {
+					config = tlsConfig
+					return nil
+				},
+			)
+			start.TestApp.EmailAlarmConf.TlsEnable = false
+			start.TestApp.EmailAlarmConf.TlsSkipVerify = true
+			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldEqual, nil)
+			So(config, ShouldNotEqual, nil)
+			So(config.InsecureSkipVerify, ShouldEqual, true)
+			start.TestApp.EmailAlarmConf.TlsSkipVerify = false
+		})
+
+		Convey("when the email start with starttls", func() {
+			monkey.Patch(net.DialTimeout, func(string, string, time.Duration) (net.Conn, error) {
+				return &net.TCPConn{}, nil
+			})
+			// the mocked client without connection is closed after the failed STARTTLS
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Close",
+				func(*smtp.Client) error {
+					return nil
+				},
+			)
+			defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Close")
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "StartTLS",
+				func(*smtp.Client, *tls.Config) error {
+					return nil
+				},
+			)
+			start.TestApp.EmailAlarmConf.StartTlsEnable = true
+			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldEqual, nil)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "StartTLS",
+				func(*smtp.Client, *tls.Config) error {
+					return errors.New("")
+				},
+			)
+			err = models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldNotEqual, nil)
+			start.TestApp.EmailAlarmConf.StartTlsEnable = false
+			monkey.Unpatch(net.DialTimeout)
+		})
+
+		Convey("when the email auth with xoauth2", func() {
+			start.TestApp.EmailAlarmConf.TlsEnable = true
+			start.TestApp.EmailAlarmConf.AuthType = models.EmailAuthTypeXOAuth2
+			start.TestApp.EmailAlarmConf.OAuthConf = models.EmailOAuthConf{
+				TokenUrl:     "https://oauth2.openrasp.com/token",
+				RefreshToken: "test",
+			}
+			monkey.PatchInstanceMethod(reflect.TypeOf(&httplib.BeegoHTTPRequest{}), "ToJSON",
+				func(_ *httplib.BeegoHTTPRequest, v interface{}) error {
+					return json.Unmarshal([]byte(`{"access_token":"test"}`), v)
+				},
+			)
+			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldEqual, nil)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&httplib.BeegoHTTPRequest{}), "ToJSON",
+				func(_ *httplib.BeegoHTTPRequest, v interface{}) error {
+					return json.Unmarshal([]byte(`{"error":"invalid_grant"}`), v)
+				},
+			)
+			err = models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldNotEqual, nil)
+			start.TestApp.EmailAlarmConf.AuthType = models.EmailAuthTypePlain
+			start.TestApp.EmailAlarmConf.TlsEnable = false
+		})
+
+		Convey("when the tls ca cert is invalid", func() {
+			start.TestApp.EmailAlarmConf.TlsEnable = true
+			start.TestApp.EmailAlarmConf.TlsCaCert = "invalid"
+			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
+			So(err, ShouldNotEqual, nil)
+			start.TestApp.EmailAlarmConf.TlsCaCert = ""
+			start.TestApp.EmailAlarmConf.TlsEnable = false
+		})
+
 		Convey("when normal smtp has error ", func() {
-			monkey.Patch(smtp.SendMail, func(string, smtp.Auth, string, []string, []byte) error {
-				return errors.New("")
+			monkey.Patch(net.DialTimeout, func(string, string, time.Duration) (net.Conn, error) {
+				return nil, errors.New("")
 			})
+			defer monkey.Unpatch(net.DialTimeout)
 			start.TestApp.EmailAlarmConf.TlsEnable = false
 			err := models.PushEmailAttackAlarm(start.TestApp, 1, alarms, false)
 			So(err, ShouldNotEqual, nil)
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+)
+
+func TestAlarmWhitelist(t *testing.T) {
+	Convey("Subject: Test Alarm Whitelist Api\n", t, func() {
+
+		Convey("when derive the whitelist url from the alarm url", func() {
+			whitelistUrl, err := models.GetAlarmWhitelistUrl(map[string]interface{}{
+				"url": "http://www.example.com:8080/article.php?id=1",
+			})
+			So(err, ShouldBeNil)
+			So(whitelistUrl, ShouldEqual, "www.example.com:8080/article.php")
+
+			_, err = models.GetAlarmWhitelistUrl(map[string]interface{}{"url": "/article.php"})
+			So(err, ShouldNotBeNil)
+
+			_, err = models.GetAlarmWhitelistUrl(map[string]interface{}{})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when the alarm_id is empty", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/whitelist/suggest", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the app does not exist", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/whitelist/apply", inits.GetJson(map[string]interface{}{
+				"app_id":   "not-exist-app",
+				"alarm_id": "AWmK7hT8fGf0xMH2Zgyt",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/es"
+	"github.com/olivere/elastic"
+)
+
+func TestEsCompat(t *testing.T) {
+	Convey("Subject: Test ES Compatibility\n", t, func() {
+		cluster := es.Cluster
+		defer func() {
+			es.Cluster = cluster
+		}()
+
+		Convey("when the cluster is ElasticSearch 6", func() {
+			es.Cluster = &es.ClusterInfo{Distribution: es.DistributionElasticSearch, Version: "6.8.0", Major: 6, Minor: 8}
+			So(es.Cluster.IsTypeless(), ShouldBeFalse)
+			So(es.DocType("attack-alarm"), ShouldEqual, "attack-alarm")
+			So(es.BulkDocType("attack-alarm"), ShouldEqual, "attack-alarm")
+			source, err := es.DateHistogram(elastic.NewDateHistogramAggregation().Field("event_time").
+				Interval("1d")).Source()
+			So(err, ShouldEqual, nil)
+			So(source.(map[string]interface{})["date_histogram"], ShouldContainKey, "interval")
+		})
+
+		Convey("when the cluster is ElasticSearch 8", func() {
+			es.Cluster = &es.ClusterInfo{Distribution: es.DistributionElasticSearch, Version: "8.11.0", Major: 8, Minor: 11}
+			So(es.Cluster.IsTypeless(), ShouldBeTrue)
+			So(es.Cluster.SupportComposableTemplate(), ShouldBeTrue)
+			So(es.DocType("attack-alarm"), ShouldEqual, "_doc")
+			So(es.BulkDocType("attack-alarm"), ShouldEqual, "")
+			source, err := es.DateHistogram(elastic.NewDateHistogramAggregation().Field("event_time").
+				Interval("1d")).Source()
+			So(err, ShouldEqual, nil)
+			opts := source.(map[string]interface{})["date_histogram"].(map[string]interface{})
+			So(opts, ShouldNotContainKey, "interval")
+			So(opts["calendar_interval"], ShouldEqual, "1d")
+			source, err = es.DateHistogram(elastic.NewDateHistogramAggregation().Field("event_time").
+				Interval("30m")).Source()
+			So(err, ShouldEqual, nil)
+			opts = source.(map[string]interface{})["date_histogram"].(map[string]interface{})
+			So(opts["fixed_interval"], ShouldEqual, "30m")
+		})
+
+		Convey("when the cluster is OpenSearch", func() {
+			es.Cluster = &es.ClusterInfo{Distribution: es.DistributionOpenSearch, Version: "2.11.0", Major: 2, Minor: 11}
+			So(es.Cluster.IsTypeless(), ShouldBeTrue)
+			So(es.Cluster.SupportComposableTemplate(), ShouldBeTrue)
+			So(es.Cluster.SupportCalendarInterval(), ShouldBeTrue)
+		})
+	})
+}
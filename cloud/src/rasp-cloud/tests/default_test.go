@@ -169,6 +169,61 @@ func TestAppConfigValidation(t *testing.T) {
 			conf.ValidRaspConf(&config)
 		})
 
+		Convey("when the alarm spill queue size is less than 0", func() {
+			config := *conf.AppConfig
+			config.AlarmSpillQueueSize = -1
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the alarm spill queue path is empty", func() {
+			config := *conf.AppConfig
+			config.AlarmSpillQueuePath = ""
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the alarm file compress is invalid", func() {
+			config := *conf.AppConfig
+			config.AlarmFileCompress = "zip"
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the alarm file max total size is less than 0", func() {
+			config := *conf.AppConfig
+			config.AlarmFileMaxTotalSize = -1
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the agent log max body size is 0", func() {
+			config := *conf.AppConfig
+			config.AgentLogMaxBodySize = 0
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the agent log max batch size is 0", func() {
+			config := *conf.AppConfig
+			config.AgentLogMaxBatchSize = 0
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the agent log max doc size is 0", func() {
+			config := *conf.AppConfig
+			config.AgentLogMaxDocSize = 0
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the alarm masking mode is invalid", func() {
+			config := *conf.AppConfig
+			config.AlarmMaskingMode = "remove"
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the alarm masking key is empty in the hash mode", func() {
+			config := *conf.AppConfig
+			config.AlarmMaskingMode = "hash"
+			config.AlarmMaskingKey = ""
+			conf.ValidRaspConf(&config)
+		})
+
 		Convey("when the alarm check interval is less than 10", func() {
 			config := *conf.AppConfig
 			config.AlarmCheckInterval = 9
@@ -186,6 +241,18 @@ func TestAppConfigValidation(t *testing.T) {
 			config.CookieLifeTime = 0
 			conf.ValidRaspConf(&config)
 		})
+
+		Convey("when the export max size is 0", func() {
+			config := *conf.AppConfig
+			config.ExportMaxSize = 0
+			conf.ValidRaspConf(&config)
+		})
+
+		Convey("when the export sync max size is greater than export max size", func() {
+			config := *conf.AppConfig
+			config.ExportSyncMaxSize = config.ExportMaxSize + 1
+			conf.ValidRaspConf(&config)
+		})
 	})
 }
 
@@ -0,0 +1,282 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"time"
+	"github.com/bouk/monkey"
+	"net"
+	"net/smtp"
+	"reflect"
+	"io"
+	"errors"
+	"rasp-cloud/mongo"
+	"gopkg.in/mgo.v2/bson"
+	"fmt"
+	"strings"
+	"rasp-cloud/es"
+	"rasp-cloud/models/logs"
+)
+
+func getValidDigest() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      "test digest",
+		"app_id":    start.TestApp.Id,
+		"enable":    true,
+		"period":    models.DigestPeriodDaily,
+		"hour":      8,
+		"time_zone": "Asia/Shanghai",
+		"email_conf": map[string]interface{}{
+			"server_addr": "smtp.test.com:25",
+			"recv_addr":   []string{"test@test.com"},
+			"password":    "123456",
+			"locale":      models.EmailLocaleEnUs,
+		},
+	}
+}
+
+func TestDigest(t *testing.T) {
+	Convey("Subject: Test Digest Api\n", t, func() {
+
+		Convey("when create, update and delete a digest", func() {
+			r := inits.GetResponse("POST", "/v1/api/digest", inits.GetJson(getValidDigest()))
+			So(r.Status, ShouldEqual, 0)
+			digest := r.Data.(map[string]interface{})
+			So(digest["email_conf"].(map[string]interface{})["password"], ShouldEqual, models.SecreteMask)
+
+			param := getValidDigest()
+			param["id"] = digest["id"]
+			param["period"] = models.DigestPeriodWeekly
+			param["email_conf"].(map[string]interface{})["password"] = models.SecreteMask
+			r = inits.GetResponse("POST", "/v1/api/digest/update", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["period"], ShouldEqual, models.DigestPeriodWeekly)
+
+			r = inits.GetResponse("POST", "/v1/api/digest/get", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/digest/delete", inits.GetJson(map[string]interface{}{
+				"id": digest["id"],
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the digest period is not supported", func() {
+			param := getValidDigest()
+			param["period"] = "monthly"
+			r := inits.GetResponse("POST", "/v1/api/digest", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the digest hour is out of range", func() {
+			param := getValidDigest()
+			param["hour"] = 24
+			r := inits.GetResponse("POST", "/v1/api/digest", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the digest time zone is invalid", func() {
+			param := getValidDigest()
+			param["time_zone"] = "Invalid/Zone"
+			r := inits.GetResponse("POST", "/v1/api/digest", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when get the period of a weekly digest", func() {
+			location, _ := time.LoadLocation("Asia/Shanghai")
+			now := time.Date(2019, 3, 6, 10, 0, 0, 0, location)
+			startTime, endTime, err := models.GetDigestPeriod(&models.Digest{
+				Period:   models.DigestPeriodWeekly,
+				Hour:     8,
+				Weekday:  int(time.Monday),
+				TimeZone: "Asia/Shanghai",
+			}, now)
+			So(err, ShouldBeNil)
+			So(endTime, ShouldEqual, time.Date(2019, 3, 4, 8, 0, 0, 0, location).UnixNano()/1000000)
+			So(endTime-startTime, ShouldEqual, 7*24*3600*1000)
+		})
+
+		Convey("when the period of a daily digest crosses the daylight saving time", func() {
+			location, _ := time.LoadLocation("America/New_York")
+			now := time.Date(2019, 3, 10, 10, 0, 0, 0, location)
+			startTime, endTime, err := models.GetDigestPeriod(&models.Digest{
+				Period:   models.DigestPeriodDaily,
+				Hour:     8,
+				TimeZone: "America/New_York",
+			}, now)
+			So(err, ShouldBeNil)
+			So(startTime, ShouldEqual, time.Date(2019, 3, 9, 8, 0, 0, 0, location).UnixNano()/1000000)
+			So(endTime, ShouldEqual, time.Date(2019, 3, 10, 8, 0, 0, 0, location).UnixNano()/1000000)
+			So(endTime-startTime, ShouldEqual, 23*3600*1000)
+		})
+
+		Convey("when render the csv of a digest report", func() {
+			report := &models.DigestReport{Apps: []*models.DigestAppReport{{
+				AppId:           "app",
+				AppName:         "name",
+				AttackTypes:     [][]interface{}{{"sql", int64(2)}},
+				InterceptStates: [][]interface{}{{"block", int64(2)}},
+				TopSources:      [][]interface{}{{"1.1.1.1", int64(2)}},
+				TopUrls:         [][]interface{}{{"http://a/", int64(2)}},
+				TopUserAgents:   [][]interface{}{{"curl", int64(2)}},
+			}}}
+			first, err := models.RenderDigestCsv(report)
+			So(err, ShouldBeNil)
+			// the order of rows is stable
+			for i := 0; i < 10; i++ {
+				content, err := models.RenderDigestCsv(report)
+				So(err, ShouldBeNil)
+				So(string(content), ShouldEqual, string(first))
+			}
+			So(string(first), ShouldContainSubstring, "app,name,attack_type,sql,2\napp,name,intercept_state,block,2\n"+
+				"app,name,attack_source,1.1.1.1,2\napp,name,url,http://a/,2\napp,name,user_agent,curl,2\n")
+		})
+
+		Convey("when the csv of a digest report has formula characters", func() {
+			report := &models.DigestReport{Apps: []*models.DigestAppReport{{
+				AppId:         "app",
+				AppName:       "name",
+				TopUserAgents: [][]interface{}{{"=cmd|' /C calc'!A0", int64(2)}},
+			}}}
+			content, err := models.RenderDigestCsv(report)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "app,name,user_agent,'=cmd|' /C calc'!A0,2\n")
+		})
+
+		Convey("when the vuln groups are more than a page", func() {
+			oldTime := time.Now().Add(-30*24*time.Hour).UnixNano() / 1000000
+			newTime := time.Now().UnixNano() / 1000000
+			alarms := make([]map[string]interface{}, 0, 1003)
+			for i := 0; i < 1001; i++ {
+				alarms = append(alarms, map[string]interface{}{
+					"app_id":      start.TestApp.Id,
+					"attack_type": "sql",
+					"stack_md5":   fmt.Sprintf("test-old-vuln-%04d", i),
+					"event_time":  oldTime,
+					"@timestamp":  oldTime,
+				})
+			}
+			alarms = append(alarms, map[string]interface{}{
+				"app_id":      start.TestApp.Id,
+				"attack_type": "sql",
+				"stack_md5":   "test-old-vuln-0000",
+				"event_time":  newTime,
+				"@timestamp":  newTime,
+			}, map[string]interface{}{
+				"app_id":      start.TestApp.Id,
+				"attack_type": "xxe",
+				"stack_md5":   "test-vuln-new",
+				"event_time":  newTime,
+				"@timestamp":  newTime,
+			})
+			err := es.BulkInsert("attack-alarm", alarms)
+			So(err, ShouldBeNil)
+			vulns, err := logs.GetNewVulns(newTime-3600*1000, newTime+1000, nil, start.TestApp.Id)
+			So(err, ShouldBeNil)
+			found := false
+			for _, vuln := range vulns {
+				So(strings.HasPrefix(fmt.Sprint(vuln["stack_md5"]), "test-old-vuln-"), ShouldBeFalse)
+				if vuln["stack_md5"] == "test-vuln-new" {
+					found = true
+					So(vuln["attack_type"], ShouldEqual, "xxe")
+					So(vuln["first_time"], ShouldEqual, newTime)
+					So(vuln["attack_count"], ShouldEqual, 1)
+				}
+			}
+			So(found, ShouldBeTrue)
+		})
+	})
+}
+
+func TestDigestRetry(t *testing.T) {
+	Convey("Subject: Test Digest Retry\n", t, func() {
+		param := getValidDigest()
+		param["email_conf"] = map[string]interface{}{
+			"server_addr": "smtp.test.com:25",
+			"recv_addr":   []string{"digest-en@test.com", "digest-zh@test.com"},
+			"recv_locale": []map[string]interface{}{{"addr": "digest-zh@test.com", "locale": models.EmailLocaleZhCn}},
+			"locale":      models.EmailLocaleEnUs,
+		}
+		r := inits.GetResponse("POST", "/v1/api/digest", inits.GetJson(param))
+		So(r.Status, ShouldEqual, 0)
+		digestId := r.Data.(map[string]interface{})["id"]
+		defer inits.GetResponse("POST", "/v1/api/digest/delete", inits.GetJson(map[string]interface{}{
+			"id": digestId,
+		}))
+		So(mongo.UpdateId("digest", digestId, bson.M{"last_send_time": 0}), ShouldBeNil)
+
+		monkey.Patch(net.DialTimeout, func(string, string, time.Duration) (net.Conn, error) {
+			return &net.TCPConn{}, nil
+		})
+		monkey.Patch(smtp.NewClient, func(conn net.Conn, host string) (*smtp.Client, error) {
+			return &smtp.Client{}, nil
+		})
+		monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Extension",
+			func(*smtp.Client, string) (bool, string) {
+				return false, ""
+			},
+		)
+		monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Mail",
+			func(*smtp.Client, string) error {
+				return nil
+			},
+		)
+		monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Data",
+			func(*smtp.Client) (io.WriteCloser, error) {
+				return &writerCloser{}, nil
+			},
+		)
+		defer monkey.Unpatch(net.DialTimeout)
+		defer monkey.Unpatch(smtp.NewClient)
+		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Extension")
+		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Mail")
+		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Data")
+		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Rcpt")
+		var rcpts []string
+		patchRcpt := func(failedAddr string) {
+			rcpts = make([]string, 0)
+			monkey.PatchInstanceMethod(reflect.TypeOf(&smtp.Client{}), "Rcpt",
+				func(_ *smtp.Client, addr string) error {
+					if addr == "digest-en@test.com" || addr == "digest-zh@test.com" {
+						rcpts = append(rcpts, addr)
+					}
+					if addr == failedAddr {
+						return errors.New("failed to send to " + addr)
+					}
+					return nil
+				},
+			)
+		}
+
+		patchRcpt("digest-zh@test.com")
+		models.HandleDigests()
+		So(rcpts, ShouldContain, "digest-en@test.com")
+		So(rcpts, ShouldContain, "digest-zh@test.com")
+		digest, err := models.GetDigestById(digestId.(string), false)
+		So(err, ShouldBeNil)
+		So(digest.LastError, ShouldNotEqual, "")
+
+		// only the failed locale is sent again after the lock expires
+		So(mongo.UpdateId("digest", digestId, bson.M{"lock_time": 0}), ShouldBeNil)
+		patchRcpt("")
+		models.HandleDigests()
+		So(rcpts, ShouldResemble, []string{"digest-zh@test.com"})
+		digest, err = models.GetDigestById(digestId.(string), false)
+		So(err, ShouldBeNil)
+		So(digest.LastError, ShouldEqual, "")
+		So(digest.LastSendTime, ShouldBeGreaterThan, 0)
+
+		patchRcpt("")
+		models.HandleDigests()
+		So(len(rcpts), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"github.com/bouk/monkey"
+	"gopkg.in/mgo.v2"
+)
+
+func TestEmailTemplate(t *testing.T) {
+	Convey("Subject: Test Email Template Api\n", t, func() {
+
+		Convey("when get the default template", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template/get", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["is_default"], ShouldEqual, true)
+		})
+
+		Convey("when the locale is not supported", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template/get", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": "fr-FR",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when update the template with valid content", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"locale":  models.EmailLocaleEnUs,
+				"subject": "[{{.AppName}}] alarm",
+				"content": "{{range .Alarms}}{{.attack_type}}{{end}}",
+			}))
+			So(r.Status, ShouldEqual, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/app/email/template/preview", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["content"], ShouldContainSubstring, "SQL Injection")
+			// the name of test app may be changed by the other tests
+			app, err := models.GetAppById(start.TestApp.Id)
+			So(err, ShouldBeNil)
+			So(r.Data.(map[string]interface{})["subject"], ShouldEqual, "[TEST] ["+app.Name+"] alarm")
+
+			r = inits.GetResponse("POST", "/v1/api/app/email/template/restore", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["is_default"], ShouldEqual, true)
+		})
+
+		Convey("when preview the detailed link without the panel url", func() {
+			monkey.Patch(models.GetServerUrl, func() (*models.ServerUrl, error) {
+				return nil, mgo.ErrNotFound
+			})
+			defer monkey.Unpatch(models.GetServerUrl)
+			r := inits.GetResponse("POST", "/v1/api/app/email/template", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"locale":  models.EmailLocaleEnUs,
+				"subject": "alarm",
+				"content": "[{{.DetailedLink}}]",
+			}))
+			So(r.Status, ShouldEqual, 0)
+			defer inits.GetResponse("POST", "/v1/api/app/email/template/restore", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+
+			r = inits.GetResponse("POST", "/v1/api/app/email/template/preview", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["content"], ShouldEqual, "[]")
+		})
+
+		Convey("when the rendered subject has line breaks", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"locale":  models.EmailLocaleEnUs,
+				"subject": "{{range .Alarms}}{{.attack_type}}\r\nBcc: test@openrasp.com\n{{end}}",
+				"content": "{{range .Alarms}}{{.attack_type}}{{end}}",
+			}))
+			So(r.Status, ShouldEqual, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/app/email/template/preview", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			subject := r.Data.(map[string]interface{})["subject"].(string)
+			So(subject, ShouldContainSubstring, "Bcc: test@openrasp.com")
+			So(subject, ShouldNotContainSubstring, "\r")
+			So(subject, ShouldNotContainSubstring, "\n")
+
+			inits.GetResponse("POST", "/v1/api/app/email/template/restore", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"locale": models.EmailLocaleEnUs,
+			}))
+		})
+
+		Convey("when the template content has syntax errors", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"locale":  models.EmailLocaleZhCn,
+				"content": "{{range .Alarms}}",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when get the template variables", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/email/template/variables", "")
+			So(r.Status, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models/logs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"net"
+	"github.com/bouk/monkey"
+)
+
+func TestAttackEnrich(t *testing.T) {
+	Convey("Subject: Test Attack Enrich\n", t, func() {
+
+		Convey("when lookup the network zones", func() {
+			zones, err := logs.ParseNetworkZones("10.0.0.0/8=office, 10.1.0.0/16=dmz,fd00::/8=ipv6")
+			So(err, ShouldBeNil)
+			So(zones.Lookup(net.ParseIP("10.1.2.3"), false), ShouldResemble, []string{"dmz"})
+			So(zones.Lookup(net.ParseIP("10.1.2.3"), true), ShouldResemble, []string{"dmz", "office"})
+			So(zones.Lookup(net.ParseIP("10.2.2.3"), false), ShouldResemble, []string{"office"})
+			So(zones.Lookup(net.ParseIP("fd00::1"), false), ShouldResemble, []string{"ipv6"})
+			So(len(zones.Lookup(net.ParseIP("8.8.8.8"), true)), ShouldEqual, 0)
+		})
+
+		Convey("when the network zone is invalid", func() {
+			_, err := logs.ParseNetworkZones("10.0.0.0/8")
+			So(err, ShouldNotBeNil)
+			_, err = logs.ParseNetworkZones("10.0.0.0/33=office")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when load the ip reputation feeds", func() {
+			dir, err := ioutil.TempDir("", "reputation")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			textFeed := filepath.Join(dir, "tor.txt")
+			So(ioutil.WriteFile(textFeed, []byte("# tor exit nodes\n1.2.3.4\n5.6.0.0/16 scanner\n"), 0644), ShouldBeNil)
+			csvFeed := filepath.Join(dir, "feed.csv")
+			So(ioutil.WriteFile(csvFeed, []byte("cidr,category\n1.2.3.0/24,botnet\n"), 0644), ShouldBeNil)
+
+			table := logs.NewCidrTable()
+			So(logs.LoadIpReputationFeed(table, textFeed), ShouldBeNil)
+			So(logs.LoadIpReputationFeed(table, csvFeed), ShouldBeNil)
+			So(table.Lookup(net.ParseIP("1.2.3.4"), true), ShouldResemble, []string{"tor", "botnet"})
+			So(table.Lookup(net.ParseIP("5.6.7.8"), true), ShouldResemble, []string{"scanner"})
+
+			So(ioutil.WriteFile(textFeed, []byte("1.2.3.4\nnot-an-ip\n"), 0644), ShouldBeNil)
+			So(logs.LoadIpReputationFeed(logs.NewCidrTable(), textFeed), ShouldNotBeNil)
+		})
+
+		Convey("when the geoip database fails to load", func() {
+			dbPath := logs.GetGeoIpDbStatus()[0].Path
+			So(os.MkdirAll(filepath.Dir(dbPath), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(dbPath, []byte("invalid geoip database"), 0644), ShouldBeNil)
+			defer os.Remove(dbPath)
+			reads := 0
+			monkey.Patch(ioutil.ReadFile, func(filename string) ([]byte, error) {
+				if filename == dbPath {
+					reads++
+				}
+				return []byte("invalid geoip database"), nil
+			})
+			defer monkey.Unpatch(ioutil.ReadFile)
+
+			status := logs.ReloadGeoIpDbs(false)
+			So(status[0].Loaded, ShouldBeFalse)
+			So(status[0].Error, ShouldNotEqual, "")
+			// the unchanged file is loaded again because the last load failed
+			logs.ReloadGeoIpDbs(false)
+			So(reads, ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	"time"
+	"strings"
+	"rasp-cloud/models/logs"
+	"github.com/bouk/monkey"
+	"errors"
+)
+
+func getExportData(param map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"app_id":     start.TestApp.Id,
+			"start_time": 1,
+			"end_time":   time.Now().Unix() * 1000,
+		},
+	}
+	for k, v := range param {
+		data[k] = v
+	}
+	return data
+}
+
+func TestLogExport(t *testing.T) {
+	Convey("Subject: Test Log Export Api\n", t, func() {
+
+		Convey("when export attack logs with csv", func() {
+			w := inits.GetResponseRecorder("POST", "/v1/api/log/attack/export", inits.GetJson(getExportData(
+				map[string]interface{}{
+					"format":  "csv",
+					"columns": []string{"event_time", "attack_type", "server_nic"},
+				})))
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldContainSubstring, "text/csv")
+			So(strings.Contains(w.Body.String(), "event_time,attack_type,server_nic"), ShouldBeTrue)
+		})
+
+		Convey("when export policy and error logs with ndjson", func() {
+			w := inits.GetResponseRecorder("POST", "/v1/api/log/policy/export", inits.GetJson(getExportData(
+				map[string]interface{}{"format": "ndjson"})))
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+
+			w = inits.GetResponseRecorder("POST", "/v1/api/log/error/export", inits.GetJson(getExportData(
+				map[string]interface{}{"format": "ndjson", "max_size": 1})))
+			So(w.Code, ShouldEqual, 200)
+			So(strings.Count(w.Body.String(), "\n"), ShouldBeLessThanOrEqualTo, 1)
+		})
+
+		Convey("when the export format is not supported", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(getExportData(
+				map[string]interface{}{"format": "xlsx"})))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the export column is unknown", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(getExportData(
+				map[string]interface{}{"columns": []string{"policy_id"}})))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the es has errors in log count", func() {
+			monkey.Patch(logs.CountLogs, func(int64, int64, map[string]interface{}, ...string) (int64, error) {
+				return 0, errors.New("")
+			})
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(getExportData(nil)))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			monkey.Unpatch(logs.CountLogs)
+		})
+
+		Convey("when export logs in background", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(getExportData(
+				map[string]interface{}{"async": true})))
+			So(r.Status, ShouldEqual, 0)
+			jobId := r.Data.(map[string]interface{})["id"]
+
+			var status interface{}
+			for i := 0; i < 50; i++ {
+				r = inits.GetResponse("POST", "/v1/api/export/get", inits.GetJson(map[string]interface{}{
+					"app_id":  start.TestApp.Id,
+					"page":    1,
+					"perpage": 1,
+				}))
+				So(r.Status, ShouldEqual, 0)
+				status = r.Data.(map[string]interface{})["data"].([]interface{})[0].(map[string]interface{})["status"]
+				if status != "running" {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			So(status, ShouldEqual, "success")
+
+			w := inits.GetResponseRecorder("GET", "/v1/api/export/download?id="+jobId.(string), "")
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Disposition"), ShouldContainSubstring, ".csv")
+
+			r = inits.GetResponse("POST", "/v1/api/export/delete", inits.GetJson(map[string]interface{}{
+				"id": jobId,
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the csv cell starts with a formula character", func() {
+			for _, cell := range []string{"=HYPERLINK(\"http://evil\")", "+1", "-1+1", "@SUM(A1)", "\tcmd", "\rcmd"} {
+				So(logs.EscapeCsvCell(cell), ShouldEqual, "'"+cell)
+			}
+			So(logs.EscapeCsvCell("/index.php?id=1"), ShouldEqual, "/index.php?id=1")
+			So(logs.EscapeCsvCell(""), ShouldEqual, "")
+		})
+
+		Convey("when download the export job that does not exist", func() {
+			r := inits.GetResponse("GET", "/v1/api/export/download?id=000000000000000000000000", "")
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
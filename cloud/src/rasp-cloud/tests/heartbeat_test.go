@@ -24,7 +24,10 @@ func TestHeartBeat(t *testing.T) {
 		}}
 		monkey.PatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header",
 			func(input *context.BeegoInput, key string) string {
-				return start.TestApp.Id
+				if key == "X-OpenRASP-AppID" {
+					return start.TestApp.Id
+				}
+				return input.Context.Request.Header.Get(key)
 			},
 		)
 		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header")
@@ -41,7 +44,10 @@ func TestHeartBeat(t *testing.T) {
 		Convey("when the app id doesn't exist", func() {
 			monkey.PatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header",
 				func(input *context.BeegoInput, key string) string {
-					return "00000000000000"
+					if key == "X-OpenRASP-AppID" {
+						return "00000000000000"
+					}
+					return input.Context.Request.Header.Get(key)
 				},
 			)
 			r := inits.GetResponse("POST", "/v1/agent/heartbeat", inits.GetJson(map[string]interface{}{
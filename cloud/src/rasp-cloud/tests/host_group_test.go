@@ -0,0 +1,211 @@
+package test
+
+import (
+	"testing"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"github.com/bouk/monkey"
+)
+
+const testGroupPluginContent = `const plugin_version = '2019-0225-1830'
+// BEGIN ALGORITHM CONFIG //
+
+var algorithmConfig = {"meta": {"all_log": true}, "sql_userinput": {"action": "block", "min_length": 10}}
+
+// END ALGORITHM CONFIG //
+`
+
+func getValidHostGroup(name string, priority int, env string) map[string]interface{} {
+	return map[string]interface{}{
+		"app_id":   start.TestApp.Id,
+		"name":     name,
+		"priority": priority,
+		"selector": []map[string]interface{}{
+			{"key": "env", "operator": models.LabelOperatorIn, "values": []string{env}},
+		},
+		"general_config": map[string]interface{}{
+			"plugin.timeout.millis": priority * 100,
+		},
+	}
+}
+
+func TestHostGroup(t *testing.T) {
+	Convey("Subject: Test Host Group Api\n", t, func() {
+		Convey("when create, update and delete host groups", func() {
+			r := inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(getValidHostGroup("group1", 1, "staging")))
+			So(r.Status, ShouldEqual, 0)
+			group1 := r.Data.(map[string]interface{})
+			r = inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(getValidHostGroup("group2", 2, "staging")))
+			So(r.Status, ShouldEqual, 0)
+			group2 := r.Data.(map[string]interface{})
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/labels", inits.GetJson(map[string]interface{}{
+				"id":     start.TestRasp.Id,
+				"labels": map[string]string{"env": "staging"},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["config_time"], ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/config", inits.GetJson(map[string]interface{}{
+				"id": start.TestRasp.Id,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			config := r.Data.(map[string]interface{})
+			So(len(config["host_groups"].([]interface{})), ShouldEqual, 2)
+			So(config["general_config"].(map[string]interface{})["plugin.timeout.millis"], ShouldEqual, 200)
+
+			param := getValidHostGroup("group2", 0, "staging")
+			param["id"] = group2["id"]
+			r = inits.GetResponse("POST", "/v1/api/host_group/update", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 0)
+			r = inits.GetResponse("POST", "/v1/api/rasp/config", inits.GetJson(map[string]interface{}{
+				"id": start.TestRasp.Id,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			config = r.Data.(map[string]interface{})
+			So(config["general_config"].(map[string]interface{})["plugin.timeout.millis"], ShouldEqual, 100)
+
+			r = inits.GetResponse("POST", "/v1/api/host_group/rasps", inits.GetJson(map[string]interface{}{
+				"id":      group1["id"],
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldEqual, 1)
+
+			r = inits.GetResponse("POST", "/v1/api/host_group/get", inits.GetJson(map[string]interface{}{
+				"app_id":  start.TestApp.Id,
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldEqual, 2)
+
+			for _, group := range []map[string]interface{}{group1, group2} {
+				r = inits.GetResponse("POST", "/v1/api/host_group/delete", inits.GetJson(map[string]interface{}{
+					"id": group["id"],
+				}))
+				So(r.Status, ShouldEqual, 0)
+			}
+			r = inits.GetResponse("POST", "/v1/api/rasp/labels", inits.GetJson(map[string]interface{}{
+				"id":     start.TestRasp.Id,
+				"labels": map[string]string{},
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the selector is invalid", func() {
+			param := getValidHostGroup("group", 1, "staging")
+			param["selector"] = []map[string]interface{}{}
+			r := inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 400)
+
+			param["selector"] = []map[string]interface{}{{"key": "env", "operator": "like"}}
+			r = inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 400)
+
+			param["selector"] = []map[string]interface{}{{"key": "env", "operator": models.LabelOperatorIn}}
+			r = inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 400)
+		})
+
+		Convey("when the whitelist is overridden by group", func() {
+			param := getValidHostGroup("group", 1, "staging")
+			param["general_config"] = map[string]interface{}{"hook.white": map[string]interface{}{}}
+			r := inits.GetResponse("POST", "/v1/api/host_group", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 400)
+		})
+
+		Convey("when the labels of rasp are invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/labels", inits.GetJson(map[string]interface{}{
+				"id":     start.TestRasp.Id,
+				"labels": map[string]string{"$env": "staging"},
+			}))
+			So(r.Status, ShouldEqual, 400)
+		})
+	})
+}
+
+func TestMatchHostGroup(t *testing.T) {
+	Convey("Subject: Test Host Group Selector\n", t, func() {
+		group := &models.HostGroup{Selector: []*models.LabelRequirement{
+			{Key: "env", Operator: models.LabelOperatorIn, Values: []string{"staging", "test"}},
+			{Key: "dc", Operator: models.LabelOperatorNotIn, Values: []string{"bj"}},
+			{Key: "canary", Operator: models.LabelOperatorNotExists},
+		}}
+		So(models.MatchHostGroup(group, map[string]string{"env": "test"}), ShouldEqual, true)
+		So(models.MatchHostGroup(group, map[string]string{"env": "test", "dc": "sh"}), ShouldEqual, true)
+		So(models.MatchHostGroup(group, map[string]string{"env": "test", "dc": "bj"}), ShouldEqual, false)
+		So(models.MatchHostGroup(group, map[string]string{"env": "prod"}), ShouldEqual, false)
+		So(models.MatchHostGroup(group, map[string]string{"env": "test", "canary": ""}), ShouldEqual, false)
+		So(models.MatchHostGroup(&models.HostGroup{}, map[string]string{"env": "test"}), ShouldEqual, false)
+
+		rasp := &models.Rasp{
+			Labels:       map[string]string{"env": "staging", "dc": "bj"},
+			CustomLabels: map[string]string{"env": "prod"},
+		}
+		So(models.GetRaspLabels(rasp), ShouldResemble, map[string]string{"env": "prod", "dc": "bj"})
+	})
+}
+
+func TestGetRaspConfig(t *testing.T) {
+	Convey("Subject: Test Rasp Config With Host Groups\n", t, func() {
+		plugin := &models.Plugin{
+			Id:              "test_plugin",
+			AppId:           start.TestApp.Id,
+			Md5:             "test_md5",
+			Content:         testGroupPluginContent,
+			AlgorithmConfig: map[string]interface{}{
+				"meta":          map[string]interface{}{"all_log": true},
+				"sql_userinput": map[string]interface{}{"action": "block", "min_length": 10},
+			},
+		}
+		monkey.Patch(models.GetSelectedPlugin, func(appId string, hasContent bool) (*models.Plugin, error) {
+			return plugin, nil
+		})
+		defer monkey.Unpatch(models.GetSelectedPlugin)
+		// the matched groups are in the order they are applied
+		groups := []*models.HostGroup{
+			{Id: "a", Priority: 1, AlgorithmConfig: map[string]interface{}{
+				"sql_userinput": map[string]interface{}{"action": "log"}}},
+			{Id: "b", Priority: 1, AlgorithmConfig: map[string]interface{}{
+				"sql_userinput": map[string]interface{}{"action": "ignore"}, "unknown": true}},
+		}
+		monkey.Patch(models.GetMatchedHostGroups, func(appId string, labels map[string]string) ([]*models.HostGroup, error) {
+			return groups, nil
+		})
+		defer monkey.Unpatch(models.GetMatchedHostGroups)
+
+		Convey("when the groups override the algorithm config", func() {
+			app := &models.App{Id: start.TestApp.Id, ConfigTime: 1, GeneralConfig: map[string]interface{}{}}
+			config, err := models.GetRaspConfig(app, &models.Rasp{ConfigTime: 2})
+			So(err, ShouldEqual, nil)
+			So(config.ConfigTime, ShouldEqual, 2)
+			So(config.Plugin.Md5, ShouldNotEqual, plugin.Md5)
+			algorithm := config.Plugin.AlgorithmConfig["sql_userinput"].(map[string]interface{})
+			So(algorithm["action"], ShouldEqual, "ignore")
+			So(algorithm["min_length"], ShouldEqual, 10)
+			So(config.Plugin.AlgorithmConfig["unknown"], ShouldEqual, nil)
+			So(plugin.AlgorithmConfig["sql_userinput"].(map[string]interface{})["action"], ShouldEqual, "block")
+			So(config.GeneralConfig["hook.white"], ShouldNotEqual, nil)
+		})
+
+		Convey("when the plugin content of the groups is cached", func() {
+			app := &models.App{Id: start.TestApp.Id, ConfigTime: 1, GeneralConfig: map[string]interface{}{}}
+			config, err := models.GetRaspConfig(app, &models.Rasp{})
+			So(err, ShouldEqual, nil)
+			cached, err := models.GetRaspConfig(app, &models.Rasp{})
+			So(err, ShouldEqual, nil)
+			So(cached.Plugin.Md5, ShouldEqual, config.Plugin.Md5)
+			So(cached.Plugin.Content, ShouldEqual, config.Plugin.Content)
+			// the content is rebuilt after the config of group is changed
+			groups[1].AlgorithmConfig["sql_userinput"] = map[string]interface{}{"action": "block"}
+			changed, err := models.GetRaspConfig(app, &models.Rasp{})
+			So(err, ShouldEqual, nil)
+			So(changed.Plugin.Md5, ShouldNotEqual, config.Plugin.Md5)
+			So(changed.Plugin.Content, ShouldContainSubstring, `"action": "block"`)
+		})
+	})
+}
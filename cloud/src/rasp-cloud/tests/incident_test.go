@@ -0,0 +1,115 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"rasp-cloud/mongo"
+	"time"
+	"rasp-cloud/es"
+	"rasp-cloud/models/logs"
+)
+
+func getIncidentEvent(id string, eventTime string, attackSource string, requestId string,
+	interceptState string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              id,
+		"app_id":          start.TestApp.Id,
+		"event_time":      eventTime,
+		"attack_type":     "sql",
+		"intercept_state": interceptState,
+		"url":             "http://www.example.com/" + id,
+		"attack_source":   attackSource,
+		"server_hostname": "host-" + id,
+		"request_id":      requestId,
+		"header":          map[string]interface{}{"cookie": "JSESSIONID=" + requestId},
+	}
+}
+
+func TestIncident(t *testing.T) {
+	Convey("Subject: Test Incident Api\n", t, func() {
+
+		Convey("when correlate the attack events", func() {
+			incidents := models.CorrelateIncidentEvents([]map[string]interface{}{
+				getIncidentEvent("1", "2019-03-06T10:00:00+0800", "1.1.1.1", "r1", "block"),
+				getIncidentEvent("2", "2019-03-06T10:10:00+0800", "1.1.1.1", "r2", "log"),
+				// shares the request_id with event 2 from another source
+				getIncidentEvent("3", "2019-03-06T10:11:00+0800", "2.2.2.2", "r2", "block"),
+				// out of the window of source 1.1.1.1
+				getIncidentEvent("4", "2019-03-06T12:00:00+0800", "1.1.1.1", "r4", "block"),
+			})
+			So(len(incidents), ShouldEqual, 2)
+			So(incidents[0].EventCount, ShouldEqual, 3)
+			So(incidents[0].Breached, ShouldBeTrue)
+			So(len(incidents[0].AttackSources), ShouldEqual, 2)
+			So(len(incidents[0].Timeline), ShouldEqual, 3)
+			So(incidents[0].LastSeen-incidents[0].FirstSeen, ShouldEqual, 11*60*1000)
+			So(incidents[1].EventCount, ShouldEqual, 1)
+			So(incidents[1].Breached, ShouldBeFalse)
+		})
+
+		Convey("when the attack is inserted late with an old timestamp", func() {
+			now := time.Now().UnixNano() / 1000000
+			err := es.BulkInsert("attack-alarm", []map[string]interface{}{{
+				"app_id":       start.TestApp.Id,
+				"attack_type":  "sql",
+				"@timestamp":   now - 2*3600*1000,
+				es.BulkIdField: "test-late-attack",
+			}})
+			So(err, ShouldBeNil)
+			events, err := logs.GetAttacksWithInsertTime(now-60*1000, now+60*1000, 10000, "attack_type")
+			So(err, ShouldBeNil)
+			found := false
+			for _, event := range events {
+				if event["id"] == "test-late-attack" {
+					found = true
+				}
+			}
+			So(found, ShouldBeTrue)
+		})
+
+		Convey("when search incidents", func() {
+			r := inits.GetResponse("POST", "/v1/api/incident/search", inits.GetJson(map[string]interface{}{
+				"data":    map[string]interface{}{"app_id": start.TestApp.Id},
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the incident does not exist", func() {
+			r := inits.GetResponse("POST", "/v1/api/incident/get", inits.GetJson(map[string]interface{}{
+				"id": "not-exist-incident",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when remove the app from the incidents", func() {
+			events := []map[string]interface{}{
+				getIncidentEvent("11", "2019-03-06T10:00:00+0800", "3.3.3.3", "r11", "log"),
+				getIncidentEvent("12", "2019-03-06T10:05:00+0800", "3.3.3.3", "r12", "block"),
+			}
+			events[0]["app_id"] = "removed-app"
+			incidents := models.CorrelateIncidentEvents(events)
+			So(len(incidents), ShouldEqual, 1)
+			incident := incidents[0]
+			incident.Id = "incident-of-removed-app"
+			So(mongo.UpsertId("incident", incident.Id, incident), ShouldEqual, nil)
+
+			So(models.RemoveIncidentByAppId("removed-app"), ShouldEqual, nil)
+			incident, err := models.GetIncidentById(incident.Id)
+			So(err, ShouldEqual, nil)
+			So(incident.AppIds, ShouldResemble, []string{start.TestApp.Id})
+			So(incident.EventCount, ShouldEqual, 1)
+			So(incident.BlockCount, ShouldEqual, 1)
+			So(incident.LogCount, ShouldEqual, 0)
+			So(incident.Breached, ShouldBeFalse)
+			So(len(incident.Timeline), ShouldEqual, 1)
+			So(incident.FirstSeen, ShouldEqual, incident.LastSeen)
+			So(mongo.RemoveId("incident", incident.Id), ShouldEqual, nil)
+		})
+	})
+}
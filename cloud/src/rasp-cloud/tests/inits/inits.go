@@ -47,6 +47,20 @@ func GetResponseRecorder(method string, path string, body string) (*httptest.Res
 	return w
 }
 
+func GetResponseWithHeader(method string, path string, body string, header map[string]string) (*Response) {
+	r, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+	response := &Response{}
+	So(w.Code, ShouldEqual, 200)
+	err := json.Unmarshal(w.Body.Bytes(), response)
+	So(err, ShouldEqual, nil)
+	return response
+}
+
 func GetJson(data interface{}) string {
 	jsonBytes, _ := json.Marshal(data)
 	return string(jsonBytes)
@@ -12,6 +12,16 @@ import (
 	"reflect"
 	"github.com/olivere/elastic"
 	"context"
+	"rasp-cloud/es"
+	"rasp-cloud/tools"
+	"io/ioutil"
+	"os"
+	"path"
+	"encoding/json"
+	"rasp-cloud/conf"
+	"strings"
+	"bytes"
+	"compress/gzip"
 )
 
 func TestPostLog(t *testing.T) {
@@ -139,9 +149,148 @@ func TestPostLog(t *testing.T) {
 			So(r.Status, ShouldEqual, 0)
 		})
 
+		Convey("when the alarm does not match the schema", func() {
+			r := inits.GetResponse("POST", "/v1/agent/log/attack", `[
+			{"rasp_id": "f5e618eaae43a3c5df13e649bb899e47", "event_time": "1551882976000"},
+			{"rasp_id": "f5e618eaae43a3c5df13e649bb899e47", "event_time": "1551882976000", "attack_type": "sql",
+			"plugin_confidence": "high"}, "invalid"]`)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 0)
+			items := data["items"].([]interface{})
+			So(len(items), ShouldEqual, 3)
+			for _, item := range items {
+				So(item.(map[string]interface{})["status"], ShouldEqual, "rejected")
+			}
+		})
+
+		Convey("when the keyword is longer than the es template", func() {
+			r := inits.GetResponse("POST", "/v1/agent/log/attack", `[
+			{"rasp_id": "f5e618eaae43a3c5df13e649bb899e47", "event_time": "1551882976000", "attack_type": "sql",
+			"url": "`+inits.GetLongString(300)+`"}]`)
+			So(r.Status, ShouldEqual, 0)
+			items := r.Data.(map[string]interface{})["items"].([]interface{})
+			So(items[0].(map[string]interface{})["truncated"], ShouldResemble, []interface{}{"url"})
+		})
+
+		Convey("when the count of alarms is greater than the max batch size", func() {
+			batchSize := conf.AppConfig.AgentLogMaxBatchSize
+			conf.AppConfig.AgentLogMaxBatchSize = 1
+			defer func() {
+				conf.AppConfig.AgentLogMaxBatchSize = batchSize
+			}()
+			r := inits.GetResponse("POST", "/v1/agent/log/error", `[{}, {}]`)
+			So(r.Status, ShouldEqual, 400)
+		})
+
+		Convey("when the request body is larger than the max body size", func() {
+			bodySize := conf.AppConfig.AgentLogMaxBodySize
+			conf.AppConfig.AgentLogMaxBodySize = 1
+			defer func() {
+				conf.AppConfig.AgentLogMaxBodySize = bodySize
+			}()
+			r := inits.GetResponse("POST", "/v1/agent/log/error", `["`+strings.Repeat("a", 1024*1024)+`"]`)
+			So(r.Status, ShouldEqual, 413)
+		})
+
+		Convey("when the alarms are uploaded as ndjson", func() {
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error",
+				ndjsonErrorAlarm+"\n\n"+ndjsonErrorAlarm+"\r\n{invalid\n"+ndjsonErrorAlarm, ndjsonHeader)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 3)
+			So(data["complete"], ShouldEqual, true)
+			items := data["items"].([]interface{})
+			So(len(items), ShouldEqual, 4)
+			So(items[2].(map[string]interface{})["status"], ShouldEqual, "rejected")
+		})
+
+		Convey("when the line of ndjson is larger than the max doc size", func() {
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error",
+				`{"message": "`+strings.Repeat("a", conf.AppConfig.AgentLogMaxDocSize*1024)+`"}`+"\n"+
+					ndjsonErrorAlarm, ndjsonHeader)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 1)
+			items := data["items"].([]interface{})
+			So(items[0].(map[string]interface{})["status"], ShouldEqual, "rejected")
+			So(items[1].(map[string]interface{})["status"], ShouldEqual, "accepted")
+		})
+
+		Convey("when the count of ndjson alarms is greater than the max batch size", func() {
+			batchSize := conf.AppConfig.AgentLogMaxBatchSize
+			conf.AppConfig.AgentLogMaxBatchSize = 1
+			defer func() {
+				conf.AppConfig.AgentLogMaxBatchSize = batchSize
+			}()
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error",
+				ndjsonErrorAlarm+"\n"+ndjsonErrorAlarm, ndjsonHeader)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 1)
+			So(data["complete"], ShouldEqual, false)
+		})
+
+		Convey("when the alarms are uploaded as gzip json", func() {
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error",
+				gzipString("["+ndjsonErrorAlarm+","+ndjsonErrorAlarm+"]"), gzipHeader)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 2)
+		})
+
+		Convey("when the alarms are uploaded as gzip ndjson", func() {
+			header := map[string]string{"Content-Encoding": "gzip", "Content-Type": "application/x-ndjson"}
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error",
+				gzipString(ndjsonErrorAlarm+"\n"+ndjsonErrorAlarm), header)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 2)
+			So(data["complete"], ShouldEqual, true)
+		})
+
+		Convey("when the decoded gzip ndjson is larger than the max body size", func() {
+			bodySize := conf.AppConfig.AgentLogMaxBodySize
+			conf.AppConfig.AgentLogMaxBodySize = 1
+			defer func() {
+				conf.AppConfig.AgentLogMaxBodySize = bodySize
+			}()
+			header := map[string]string{"Content-Encoding": "gzip", "Content-Type": "application/x-ndjson"}
+			body := ndjsonErrorAlarm + "\n" + strings.Repeat(" ", 1024*1024) + "\n" + ndjsonErrorAlarm
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error", gzipString(body), header)
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, 1)
+			So(data["complete"], ShouldEqual, false)
+		})
+
+		Convey("when the gzip body is invalid", func() {
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error", "["+ndjsonErrorAlarm+"]", gzipHeader)
+			So(r.Status, ShouldEqual, 400)
+		})
+
+		Convey("when the content encoding is not supported", func() {
+			r := inits.GetResponseWithHeader("POST", "/v1/agent/log/error", "["+ndjsonErrorAlarm+"]",
+				map[string]string{"Content-Encoding": "br"})
+			So(r.Status, ShouldEqual, 415)
+		})
 	})
 }
 
+var gzipHeader = map[string]string{"Content-Encoding": "gzip"}
+
+func gzipString(content string) string {
+	buffer := new(bytes.Buffer)
+	writer := gzip.NewWriter(buffer)
+	writer.Write([]byte(content))
+	writer.Close()
+	return buffer.String()
+}
+
+const ndjsonErrorAlarm = `{"rasp_id": "f5e618eaae43a3c5df13e649bb899e47", "message": "error", "event_time": "1551882976000"}`
+
+var ndjsonHeader = map[string]string{"Content-Type": "application/x-ndjson"}
+
 func getAttackLogSearchData() map[string]interface{} {
 	return map[string]interface{}{
 		"page":    1,
@@ -320,6 +469,64 @@ func TestAttackLogAggr(t *testing.T) {
 			So(r.Status, ShouldEqual, 0)
 		})
 
+		Convey("when aggr with field", func() {
+			data := getAggrParam()
+			for _, field := range []string{"attack_source", "url", "path", "server_hostname",
+				"rasp_id", "plugin_algorithm"} {
+				data["field"] = field
+				r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/field", inits.GetJson(data))
+				So(r.Status, ShouldEqual, 0)
+			}
+		})
+
+		Convey("when aggr with field by the block/log count and the top apps", func() {
+			data := getAggrParam()
+			data["field"] = "attack_source"
+			data["app_size"] = 5
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/field", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+			for _, item := range r.Data.([]interface{}) {
+				fieldItem := item.(map[string]interface{})
+				So(fieldItem, ShouldContainKey, "block")
+				So(fieldItem, ShouldContainKey, "log")
+				So(len(fieldItem["apps"].([]interface{})), ShouldBeLessThanOrEqualTo, 5)
+				So(fieldItem["block"].(float64)+fieldItem["log"].(float64), ShouldBeLessThanOrEqualTo,
+					fieldItem["count"].(float64))
+			}
+		})
+
+		Convey("when the app size of field aggr is out of range", func() {
+			data := getAggrParam()
+			data["field"] = "attack_source"
+			data["app_size"] = 101
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/field", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when aggr with unsupported field", func() {
+			data := getAggrParam()
+			data["field"] = "stack_trace"
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/field", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when aggr with geo", func() {
+			data := getAggrParam()
+			data["grid_size"] = 10
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/geo", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the grid size of geo aggr is out of range", func() {
+			data := getAggrParam()
+			data["grid_size"] = 0.1
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/geo", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			data["grid_size"] = 2.5
+			r = inits.GetResponse("POST", "/v1/api/log/attack/aggr/geo", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
 		Convey("when aggr app_id does not exist", func() {
 			data := getAggrParam()
 			data["app_id"] = "222222222222222222"
@@ -491,8 +698,8 @@ func TestAttackLogAggr(t *testing.T) {
 			So(r.Status, ShouldBeGreaterThan, 0)
 			monkey.Unpatch(logs.SearchLogs)
 
-			monkey.PatchInstanceMethod(reflect.TypeOf(&elastic.SearchService{}), "Do",
-				func(*elastic.SearchService, context.Context) (*elastic.SearchResult, error) {
+			monkey.PatchInstanceMethod(reflect.TypeOf(&es.SearchService{}), "Do",
+				func(*es.SearchService, context.Context) (*elastic.SearchResult, error) {
 					return &elastic.SearchResult{Error: &elastic.ErrorDetails{}}, errors.New("")
 				},
 			)
@@ -505,12 +712,64 @@ func TestAttackLogAggr(t *testing.T) {
 			So(r.Status, ShouldBeGreaterThan, 0)
 			r = inits.GetResponse("POST", "/v1/api/log/attack/aggr/time", inits.GetJson(data))
 			So(r.Status, ShouldBeGreaterThan, 0)
-			monkey.UnpatchInstanceMethod(reflect.TypeOf(&elastic.SearchService{}), "Do")
+			monkey.UnpatchInstanceMethod(reflect.TypeOf(&es.SearchService{}), "Do")
 		})
 
 	})
 }
 
+func TestPolicyAndErrorLogAggr(t *testing.T) {
+	Convey("Subject: Test Policy And Error Log Aggr Api\n", t, func() {
+
+		Convey("when aggr policy alarms with time", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/aggr/time", inits.GetJson(getAggrParam()))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when aggr policy alarms with field", func() {
+			data := getAggrParam()
+			for _, field := range []string{"policy_id", "server_hostname", "server_type"} {
+				data["field"] = field
+				r := inits.GetResponse("POST", "/v1/api/log/policy/aggr/field", inits.GetJson(data))
+				So(r.Status, ShouldEqual, 0)
+			}
+		})
+
+		Convey("when aggr error alarms with time", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/error/aggr/time", inits.GetJson(getAggrParam()))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when aggr error alarms with field", func() {
+			data := getAggrParam()
+			for _, field := range []string{"err_code", "level", "rasp_id"} {
+				data["field"] = field
+				r := inits.GetResponse("POST", "/v1/api/log/error/aggr/field", inits.GetJson(data))
+				So(r.Status, ShouldEqual, 0)
+			}
+		})
+
+		Convey("when aggr error alarms with agent version", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/error/aggr/version", inits.GetJson(getAggrParam()))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when aggr policy alarms with unsupported field", func() {
+			data := getAggrParam()
+			data["field"] = "err_code"
+			r := inits.GetResponse("POST", "/v1/api/log/policy/aggr/field", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when time zone of error aggr is empty", func() {
+			data := getAggrParam()
+			data["time_zone"] = ""
+			r := inits.GetResponse("POST", "/v1/api/log/error/aggr/time", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
 func TestAddLogWithFile(t *testing.T) {
 	Convey("Subject: Test Add Log With File\n", t, func() {
 		Convey("when es addr is empty", func() {
@@ -528,3 +787,141 @@ func TestAddLogWithFile(t *testing.T) {
 	})
 
 }
+
+func TestBackfill(t *testing.T) {
+	Convey("Subject: Test Backfill\n", t, func() {
+		alarm := map[string]interface{}{
+			"app_id":      start.TestApp.Id,
+			"attack_type": "sql",
+			"@timestamp":  time.Now().UnixNano() / 1000000,
+		}
+
+		Convey("when the alarm is written to both of file and es", func() {
+			err := logs.AddLogWithFileAndES("attack-alarm", alarm)
+			So(err, ShouldEqual, nil)
+			So(alarm, ShouldContainKey, es.BulkIdField)
+		})
+
+		Convey("when the alarm files are imported", func() {
+			So(logs.AddLogWithFile("attack-alarm", alarm), ShouldEqual, nil)
+			filter := &logs.BackfillFilter{AppId: start.TestApp.Id, StartTime: time.Now().Add(-time.Hour).UnixNano() / 1000000}
+			result, err := logs.Backfill(filter)
+			So(err, ShouldEqual, nil)
+			So(result.Imported, ShouldBeGreaterThan, 0)
+
+			// the import can run again without duplicated alarms
+			again, err := logs.Backfill(filter)
+			So(err, ShouldEqual, nil)
+			So(again.Imported, ShouldEqual, result.Imported)
+		})
+
+		Convey("when the app of filter does not match", func() {
+			result, err := logs.Backfill(&logs.BackfillFilter{AppId: "not-exist"})
+			So(err, ShouldEqual, nil)
+			So(result.Imported, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestAlarmFileArchive(t *testing.T) {
+	Convey("Subject: Test Alarm File Archive\n", t, func() {
+		dir, err := ioutil.TempDir("", "openrasp-alarm-file")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+		logPath := path.Join(dir, "attack.log")
+		writer := tools.NewFileWriter()
+		err = writer.Init(`{"filename":"` + logPath + `", "daily":true, "maxdays":10, "perm":"0777",
+			"compress":"gzip", "maxtotalsize":0}`)
+		So(err, ShouldEqual, nil)
+		defer writer.Destroy()
+
+		Convey("when the rotated file is compressed and listed in the manifest", func() {
+			So(writer.WriteMsg(time.Now(), `{"app_id":"app1"}`, 0), ShouldEqual, nil)
+			So(writer.(*tools.RaspFileLogWriter).DoRotate(time.Now()), ShouldEqual, nil)
+			var manifest tools.LogManifest
+			for i := 0; i < 50 && len(manifest.Files) == 0; i++ {
+				time.Sleep(100 * time.Millisecond)
+				if content, err := ioutil.ReadFile(path.Join(dir, "attack"+tools.ManifestSuffix)); err == nil {
+					json.Unmarshal(content, &manifest)
+				}
+			}
+			So(manifest.Current, ShouldEqual, "attack.log")
+			So(len(manifest.Files), ShouldEqual, 1)
+			So(manifest.Files[0].Compressed, ShouldBeTrue)
+			isExists, _ := tools.PathExists(path.Join(dir, manifest.Files[0].Name))
+			So(isExists, ShouldBeTrue)
+		})
+
+		Convey("when the compress is invalid", func() {
+			err := tools.NewFileWriter().Init(`{"filename":"` + logPath + `", "compress":"zip"}`)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("when the max total size is less than the max size of file", func() {
+			writer := tools.NewFileWriter().(*tools.RaspFileLogWriter)
+			err := writer.Init(`{"filename":"` + path.Join(dir, "size.log") + `", "maxsize":1048576,
+				"maxtotalsize":1000}`)
+			So(err, ShouldEqual, nil)
+			defer writer.Destroy()
+			So(writer.MaxSize, ShouldEqual, 100)
+		})
+
+		Convey("when the total size of files in the directories of apps is greater than the max", func() {
+			appDir := path.Join(dir, "app1")
+			So(os.MkdirAll(appDir, os.ModePerm), ShouldEqual, nil)
+			oldFile := path.Join(appDir, "attack.2019-01-01.001.log")
+			newFile := path.Join(dir, "attack.2019-01-02.001.log")
+			So(ioutil.WriteFile(oldFile, []byte(strings.Repeat("a", 100)), 0644), ShouldEqual, nil)
+			So(ioutil.WriteFile(newFile, []byte(strings.Repeat("b", 100)), 0644), ShouldEqual, nil)
+			So(os.Chtimes(oldFile, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)), ShouldEqual, nil)
+			So(os.Chtimes(newFile, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)), ShouldEqual, nil)
+
+			appWriter := tools.NewFileWriter()
+			err := appWriter.Init(`{"filename":"` + path.Join(appDir, "attack.log") + `", "daily":true,
+				"maxdays":10, "perm":"0777", "maxtotalsize":150, "totalsizedir":"` + dir + `"}`)
+			So(err, ShouldEqual, nil)
+			defer appWriter.Destroy()
+			removed := false
+			for i := 0; i < 50 && !removed; i++ {
+				time.Sleep(100 * time.Millisecond)
+				isExists, _ := tools.PathExists(oldFile)
+				removed = !isExists
+			}
+			So(removed, ShouldBeTrue)
+			// the new file may be compressed by the writer of the directory
+			isExists, _ := tools.PathExists(newFile)
+			isCompressed, _ := tools.PathExists(newFile + tools.GzipSuffix)
+			So(isExists || isCompressed, ShouldBeTrue)
+		})
+	})
+}
+
+func TestAlarmFilePerApp(t *testing.T) {
+	Convey("Subject: Test Alarm File Per App\n", t, func() {
+		perApp := conf.AppConfig.AlarmFilePerApp
+		conf.AppConfig.AlarmFilePerApp = true
+		defer func() {
+			conf.AppConfig.AlarmFilePerApp = perApp
+		}()
+		currentPath, err := tools.GetCurrentPath()
+		So(err, ShouldEqual, nil)
+
+		Convey("when the alarm is written to the directory of its app", func() {
+			alarm := map[string]interface{}{"app_id": start.TestApp.Id, "attack_type": "per_app_file"}
+			So(logs.AddLogWithFile("attack-alarm", alarm), ShouldEqual, nil)
+			content, err := ioutil.ReadFile(path.Join(currentPath+logs.AttackAlarmInfo.FileDir, start.TestApp.Id,
+				logs.AttackAlarmInfo.FileName))
+			So(err, ShouldEqual, nil)
+			So(string(content), ShouldContainSubstring, "per_app_file")
+		})
+
+		Convey("when the app id is invalid", func() {
+			alarm := map[string]interface{}{"app_id": "../invalid", "attack_type": "invalid_app_file"}
+			So(logs.AddLogWithFile("attack-alarm", alarm), ShouldEqual, nil)
+			content, err := ioutil.ReadFile(path.Join(currentPath+logs.AttackAlarmInfo.FileDir,
+				logs.AttackAlarmInfo.FileName))
+			So(err, ShouldEqual, nil)
+			So(string(content), ShouldContainSubstring, "invalid_app_file")
+		})
+	})
+}
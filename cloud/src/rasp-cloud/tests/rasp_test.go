@@ -16,7 +16,10 @@ func TestRaspRegister(t *testing.T) {
 	Convey("Subject: Test Rasp Register Api\n", t, func() {
 		monkey.PatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header",
 			func(input *context.BeegoInput, key string) string {
-				return start.TestApp.Id
+				if key == "X-OpenRASP-AppID" {
+					return start.TestApp.Id
+				}
+				return input.Context.Request.Header.Get(key)
 			},
 		)
 		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header")
@@ -37,6 +40,13 @@ func TestRaspRegister(t *testing.T) {
 			monkey.Unpatch(models.UpsertRaspById)
 		})
 
+		Convey("when the labels are invalid", func() {
+			rasp := *start.TestRasp
+			rasp.Labels = map[string]string{"env.name": "staging"}
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(rasp))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
 		Convey("when the rasp_id is empty", func() {
 			rasp := *start.TestRasp
 			rasp.Id = ""
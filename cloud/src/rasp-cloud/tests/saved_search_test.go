@@ -0,0 +1,139 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"github.com/bouk/monkey"
+	"time"
+	"crypto/sha1"
+	"fmt"
+)
+
+func getValidSavedSearch() map[string]interface{} {
+	return map[string]interface{}{
+		"name":       "test saved search",
+		"log_type":   models.SavedSearchLogTypeAttack,
+		"app_id":     start.TestApp.Id,
+		"time_range": "24h",
+		"data": map[string]interface{}{
+			"attack_type":     []string{"sql", "command"},
+			"intercept_state": []string{"block"},
+			"url":             "login",
+		},
+	}
+}
+
+func TestSavedSearch(t *testing.T) {
+	Convey("Subject: Test Saved Search Api\n", t, func() {
+		monkey.Patch(models.GetRequestUser, func(string, string) (string, error) {
+			return "openrasp", nil
+		})
+		defer monkey.Unpatch(models.GetRequestUser)
+
+		Convey("when create, update and delete a saved search", func() {
+			r := inits.GetResponse("POST", "/v1/api/search", inits.GetJson(getValidSavedSearch()))
+			So(r.Status, ShouldEqual, 0)
+			search := r.Data.(map[string]interface{})
+			So(search["owner"], ShouldEqual, "openrasp")
+
+			param := getValidSavedSearch()
+			param["id"] = search["id"]
+			param["shared"] = true
+			param["alarm"] = map[string]interface{}{"enable": true, "threshold": 10}
+			r = inits.GetResponse("POST", "/v1/api/search/update", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["shared"], ShouldEqual, true)
+
+			r = inits.GetResponse("POST", "/v1/api/search/detail", inits.GetJson(map[string]interface{}{
+				"id": search["id"],
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})["data"].(map[string]interface{})
+			So(data["end_time"].(float64)-data["start_time"].(float64), ShouldEqual, 24*3600*1000)
+
+			r = inits.GetResponse("POST", "/v1/api/search/get", inits.GetJson(map[string]interface{}{
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/search/delete", inits.GetJson(map[string]interface{}{
+				"id": search["id"],
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the saved search is modified by other user", func() {
+			r := inits.GetResponse("POST", "/v1/api/search", inits.GetJson(getValidSavedSearch()))
+			So(r.Status, ShouldEqual, 0)
+			search := r.Data.(map[string]interface{})
+
+			monkey.Patch(models.GetRequestUser, func(string, string) (string, error) {
+				return "token:12345678", nil
+			})
+			r = inits.GetResponse("POST", "/v1/api/search/delete", inits.GetJson(map[string]interface{}{
+				"id": search["id"],
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			monkey.Patch(models.GetRequestUser, func(string, string) (string, error) {
+				return "openrasp", nil
+			})
+
+			r = inits.GetResponse("POST", "/v1/api/search/delete", inits.GetJson(map[string]interface{}{
+				"id": search["id"],
+			}))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the time range is invalid", func() {
+			param := getValidSavedSearch()
+			param["time_range"] = "24y"
+			r := inits.GetResponse("POST", "/v1/api/search", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the log type is not supported", func() {
+			param := getValidSavedSearch()
+			param["log_type"] = "report"
+			r := inits.GetResponse("POST", "/v1/api/search", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the alarm is enabled for a policy search", func() {
+			param := getValidSavedSearch()
+			param["log_type"] = models.SavedSearchLogTypePolicy
+			param["alarm"] = map[string]interface{}{"enable": true}
+			r := inits.GetResponse("POST", "/v1/api/search", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when parse the relative time range", func() {
+			duration, err := models.ParseTimeRange("7d")
+			So(err, ShouldBeNil)
+			So(duration, ShouldEqual, 7*24*time.Hour)
+
+			_, err = models.ParseTimeRange("400d")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when the request is authenticated by a token", func() {
+			monkey.Unpatch(models.GetRequestUser)
+			monkey.Patch(models.HasCookie, func(string) (bool, error) {
+				return false, nil
+			})
+			monkey.Patch(models.HasToken, func(string) (bool, error) {
+				return true, nil
+			})
+			defer monkey.Unpatch(models.HasCookie)
+			defer monkey.Unpatch(models.HasToken)
+			owner, err := models.GetRequestUser("", "test-token")
+			So(err, ShouldBeNil)
+			So(owner, ShouldEqual, fmt.Sprintf("token:%x", sha1.Sum([]byte("test-token"))))
+		})
+	})
+}
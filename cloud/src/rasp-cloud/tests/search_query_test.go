@@ -0,0 +1,76 @@
+package test
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	"time"
+	"rasp-cloud/models/logs"
+)
+
+func getQuerySearchData(query string) map[string]interface{} {
+	return map[string]interface{}{
+		"page":    1,
+		"perpage": 1,
+		"data": map[string]interface{}{
+			"app_id":     start.TestApp.Id,
+			"start_time": 1,
+			"end_time":   time.Now().Unix() * 1000,
+			"query":      query,
+		},
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	Convey("Subject: Test Log Search Query\n", t, func() {
+
+		Convey("when the query is valid", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(getQuerySearchData(
+				`attack_type:(sql OR xxe) AND NOT intercept_state:log AND attack_source:127.0.0.0/8`)))
+			So(r.Status, ShouldEqual, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(getQuerySearchData(
+				`policy_id:[3000 TO 3010] OR server_hostname:ubuntu*`)))
+			So(r.Status, ShouldEqual, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/log/error/search", inits.GetJson(getQuerySearchData(
+				`level:warning AND -message:"connection refused"`)))
+			So(r.Status, ShouldEqual, 0)
+		})
+
+		Convey("when the query has syntax errors", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(getQuerySearchData(
+				`attack_type:sql AND (url:*login*`)))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			So(r.Desc, ShouldContainSubstring, "missing closing parenthesis")
+		})
+
+		Convey("when the query field is not defined in es template", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(getQuerySearchData(
+				`attack_type:sql`)))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			So(r.Desc, ShouldContainSubstring, "unknown field")
+		})
+
+		Convey("when the value does not match the field type", func() {
+			_, err := logs.ParseSearchQuery(logs.AttackAlarmInfo.EsType, `plugin_confidence:high`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when the CIDR is not on the octet boundary", func() {
+			query, err := logs.ParseSearchQuery(logs.AttackAlarmInfo.EsType, `attack_source:10.1.16.0/20`)
+			So(err, ShouldBeNil)
+			source, err := query.Source()
+			So(err, ShouldBeNil)
+			So(len(source.(map[string]interface{})["bool"].(map[string]interface{})["should"].([]interface{})),
+				ShouldEqual, 16)
+		})
+
+		Convey("when the query is empty", func() {
+			query, err := logs.ParseSearchQuery(logs.AttackAlarmInfo.EsType, "  ")
+			So(err, ShouldBeNil)
+			So(query, ShouldBeNil)
+		})
+	})
+}
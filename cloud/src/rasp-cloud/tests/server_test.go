@@ -8,6 +8,7 @@ import (
 	"github.com/bouk/monkey"
 	"errors"
 	"gopkg.in/mgo.v2"
+	"rasp-cloud/es"
 )
 
 func getValidServerUrl() *models.ServerUrl {
@@ -94,3 +95,54 @@ func TestGetServerUrl(t *testing.T) {
 		})
 	})
 }
+
+func TestGeoIp(t *testing.T) {
+	Convey("Subject: Test GeoIp Api\n", t, func() {
+		Convey("when get the status of geoip databases", func() {
+			r := inits.GetResponse("POST", "/v1/api/server/geoip/get", "{}")
+			So(r.Status, ShouldEqual, 0)
+			So(len(r.Data.([]interface{})), ShouldEqual, 2)
+		})
+
+		Convey("when reload the geoip databases", func() {
+			r := inits.GetResponse("POST", "/v1/api/server/geoip/reload", "{}")
+			So(r.Status, ShouldEqual, 0)
+			for _, item := range r.Data.([]interface{}) {
+				status := item.(map[string]interface{})
+				if status["name"] == "geo" {
+					So(status["loaded"], ShouldBeTrue)
+				}
+			}
+		})
+	})
+}
+
+func TestSpillQueue(t *testing.T) {
+	Convey("Subject: Test Spill Queue Api\n", t, func() {
+		Convey("when get the status of alarm spill queue", func() {
+			r := inits.GetResponse("POST", "/v1/api/server/queue/get", "{}")
+			So(r.Status, ShouldEqual, 0)
+			status := r.Data.(map[string]interface{})
+			So(status["enabled"], ShouldBeTrue)
+			So(status["depth"], ShouldBeGreaterThanOrEqualTo, 0)
+			So(status["max_size"], ShouldEqual, 1000000)
+		})
+	})
+}
+
+func TestDeadLetter(t *testing.T) {
+	Convey("Subject: Test Dead Letter Api\n", t, func() {
+		Convey("when the alarm without app_id is inserted", func() {
+			err := es.BulkInsert("attack-alarm", []map[string]interface{}{{"attack_type": "sql"}})
+			So(err, ShouldEqual, nil)
+			r := inits.GetResponse("POST", "/v1/api/server/deadletter/get", "{}")
+			So(r.Status, ShouldEqual, 0)
+			status := r.Data.(map[string]interface{})
+			So(status["total"], ShouldBeGreaterThan, 0)
+			counts := status["counts"].(map[string]interface{})["attack-alarm"].(map[string]interface{})
+			So(counts["invalid_app_id"], ShouldBeGreaterThan, 0)
+			recent := status["recent"].([]interface{})
+			So(recent[0].(map[string]interface{})["error_type"], ShouldEqual, "invalid_app_id")
+		})
+	})
+}
@@ -39,6 +39,8 @@ var TestRasp = &models.Rasp{
 func init() {
 	routers.InitRouter()
 	beego.ErrorController(&controllers.ErrorController{})
+	// the auth filters are not loaded in tests, the bodies of agents are decoded like the server
+	beego.InsertFilter("/v1/agent/*", beego.BeforeStatic, controllers.DecodeAgentBody)
 	beego.BConfig.RecoverFunc = func(*context.Context) {
 		if err := recover(); err != nil {
 		}
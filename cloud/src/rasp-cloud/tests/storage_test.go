@@ -0,0 +1,192 @@
+package test
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/storage"
+	"rasp-cloud/conf"
+	"github.com/olivere/elastic"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+func TestEmbeddedStorage(t *testing.T) {
+	Convey("Subject: Test Embedded Storage\n", t, func() {
+		dataPath := conf.AppConfig.EmbeddedDataPath
+		dir, err := ioutil.TempDir("", "openrasp-storage")
+		So(err, ShouldEqual, nil)
+		conf.AppConfig.EmbeddedDataPath = dir
+		defer func() {
+			conf.AppConfig.EmbeddedDataPath = dataPath
+			os.RemoveAll(dir)
+		}()
+
+		Convey("when the metadata is stored in the embedded store", func() {
+			store := storage.OpenEmbeddedMetaStore()
+			defer store.Close()
+			So(store.CreateIndex("app", &mgo.Index{Key: []string{"name"}, Unique: true}), ShouldEqual, nil)
+			So(store.Insert("app", bson.M{"_id": "app1", "name": "a", "count": 1},
+				bson.M{"_id": "app2", "name": "b", "count": 5}), ShouldEqual, nil)
+			So(mgo.IsDup(store.Insert("app", bson.M{"_id": "app3", "name": "a"})), ShouldBeTrue)
+
+			var apps []map[string]interface{}
+			err := store.Find("app", &storage.Query{Selector: bson.M{"count": bson.M{"$gte": 1}},
+				Sort: []string{"-count"}}, &apps)
+			So(err, ShouldEqual, nil)
+			So(len(apps), ShouldEqual, 2)
+			So(apps[0]["_id"], ShouldEqual, "app2")
+
+			info, err := store.Upsert("app", bson.M{"_id": "app3"},
+				bson.M{"$set": bson.M{"name": "c"}, "$inc": bson.M{"count": 2}})
+			So(err, ShouldEqual, nil)
+			So(info.UpsertedId, ShouldEqual, "app3")
+			var app struct {
+				Name  string `bson:"name"`
+				Count int    `bson:"count"`
+			}
+			So(store.FindOne("app", &storage.Query{Selector: bson.M{"_id": "app3"}}, &app), ShouldEqual, nil)
+			So(app.Name, ShouldEqual, "c")
+			So(app.Count, ShouldEqual, 2)
+			So(store.Update("app", bson.M{"_id": "app4"}, bson.M{"$set": bson.M{"count": 1}}),
+				ShouldEqual, mgo.ErrNotFound)
+		})
+
+		Convey("when the items are pushed to the disk queue", func() {
+			queue, err := storage.OpenDiskQueue(dir+"/queue.db", 3)
+			So(err, ShouldEqual, nil)
+			count, err := queue.Push([]byte("a"), []byte("b"))
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 2)
+			count, err = queue.Push([]byte("c"), []byte("d"))
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 1)
+			So(queue.Len(), ShouldEqual, 3)
+
+			items, err := queue.Peek(2)
+			So(err, ShouldEqual, nil)
+			So(len(items), ShouldEqual, 2)
+			So(string(items[0].Value), ShouldEqual, "a")
+			So(queue.Remove(items[0].Key, items[1].Key), ShouldEqual, nil)
+			So(queue.Len(), ShouldEqual, 1)
+			So(queue.Close(), ShouldEqual, nil)
+
+			queue, err = storage.OpenDiskQueue(dir+"/queue.db", 3)
+			So(err, ShouldEqual, nil)
+			defer queue.Close()
+			So(queue.Len(), ShouldEqual, 1)
+			items, err = queue.Peek(10)
+			So(err, ShouldEqual, nil)
+			So(string(items[0].Value), ShouldEqual, "c")
+
+			// the full queue releases the removed items before the failed ones are appended again
+			count, err = queue.Push([]byte("e"), []byte("f"))
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 2)
+			items, err = queue.Peek(3)
+			So(err, ShouldEqual, nil)
+			count, err = queue.Requeue([]uint64{items[0].Key, items[1].Key, items[2].Key}, []byte("c"), []byte("f"))
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 2)
+			So(queue.Len(), ShouldEqual, 2)
+			items, err = queue.Peek(10)
+			So(err, ShouldEqual, nil)
+			So(string(items[0].Value), ShouldEqual, "c")
+			So(string(items[1].Value), ShouldEqual, "f")
+		})
+
+		Convey("when the logs are stored in the embedded store", func() {
+			store := storage.OpenEmbeddedLogStore()
+			defer store.Close()
+			ctx := context.Background()
+			err := store.PutTemplate("openrasp-attack-alarm", "attack-alarm", `{
+				"template": "openrasp-attack-alarm-*",
+				"settings": {"analysis": {"normalizer": {"lowercase_normalizer": {"type": "custom", "filter": ["lowercase"]}}}},
+				"mappings": {"attack-alarm": {"properties": {
+					"@timestamp": {"type": "date"},
+					"attack_type": {"type": "keyword", "normalizer": "lowercase_normalizer"},
+					"level": {"type": "long"}}}}}`)
+			So(err, ShouldEqual, nil)
+			So(store.CreateIndex("openrasp-attack-alarm-app1-2019.01.01", "real-openrasp-attack-alarm-app1"),
+				ShouldEqual, nil)
+
+			requests := make([]elastic.BulkableRequest, 0, 10)
+			for i := 0; i < 10; i++ {
+				attackType := "SQL"
+				if i%2 == 0 {
+					attackType = "xss"
+				}
+				requests = append(requests, elastic.NewBulkIndexRequest().Index("real-openrasp-attack-alarm-app1").
+					Type("attack-alarm").Doc(map[string]interface{}{"attack_type": attackType, "level": i,
+					"@timestamp": 1546300800000 + int64(i)*1000}))
+			}
+			response, err := store.Bulk(ctx, requests...)
+			So(err, ShouldEqual, nil)
+			So(response.Errors, ShouldBeFalse)
+
+			result, err := store.Search(ctx, &storage.LogSearch{
+				Indices: []string{"real-openrasp-attack-alarm-*"},
+				Query: elastic.NewBoolQuery().Must(elastic.NewTermQuery("attack_type", "sql"),
+					elastic.NewRangeQuery("level").Gte(5)),
+				Aggregations: map[string]elastic.Aggregation{
+					"type": elastic.NewTermsAggregation().Field("attack_type"),
+				},
+				Sorters: []elastic.Sorter{elastic.SortInfo{Field: "level", Ascending: false}},
+				Size:    1,
+			})
+			So(err, ShouldEqual, nil)
+			So(result.Hits.TotalHits, ShouldEqual, 3)
+			So(result.Hits.Hits[0].Index, ShouldEqual, "openrasp-attack-alarm-app1-2019.01.01")
+			terms, ok := result.Aggregations.Terms("type")
+			So(ok, ShouldBeTrue)
+			So(terms.Buckets[0].Key, ShouldEqual, "sql")
+			So(terms.Buckets[0].DocCount, ShouldEqual, 3)
+
+			Convey("the range query with the format and include keys is matched by the bounds", func() {
+				query := elastic.NewRangeQuery("@timestamp").From(1546300802000).To(1546300805000).
+					IncludeLower(false).IncludeUpper(true).Format("epoch_millis")
+				count, err := store.Count(ctx, query, "real-openrasp-attack-alarm-app1")
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 3)
+
+				result, err := store.Search(ctx, &storage.LogSearch{
+					Indices: []string{"real-openrasp-attack-alarm-app1"},
+					Query: elastic.NewBoolQuery().Filter(query, elastic.NewTermQuery("attack_type", "SQL")),
+					Sorters: []elastic.Sorter{elastic.SortInfo{Field: "@timestamp", Ascending: true}},
+					Size:    10,
+				})
+				So(err, ShouldEqual, nil)
+				So(result.Hits.TotalHits, ShouldEqual, 2)
+
+				levels := make([]string, 0)
+				err = store.Scan(ctx, &storage.LogSearch{
+					Indices: []string{"real-openrasp-attack-alarm-app1"},
+					Query:   query,
+					Sorters: []elastic.Sorter{elastic.SortInfo{Field: "@timestamp", Ascending: false}},
+					Size:    2,
+				}, func(hit *elastic.SearchHit) error {
+					var source map[string]interface{}
+					if err := json.Unmarshal(*hit.Source, &source); err != nil {
+						return err
+					}
+					levels = append(levels, fmt.Sprint(source["level"]))
+					return nil
+				})
+				So(err, ShouldEqual, nil)
+				So(levels, ShouldResemble, []string{"5", "4", "3"})
+			})
+
+			deleted, err := store.DeleteByQuery(ctx, elastic.NewRangeQuery("level").Lt(3),
+				"real-openrasp-attack-alarm-app1")
+			So(err, ShouldEqual, nil)
+			So(deleted, ShouldEqual, 3)
+			count, err := store.Count(ctx, nil, "real-openrasp-attack-alarm-app1")
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 7)
+		})
+	})
+}
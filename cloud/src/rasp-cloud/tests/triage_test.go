@@ -0,0 +1,126 @@
+package test
+
+import (
+	"testing"
+	_ "rasp-cloud/tests/start"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/tests/start"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"github.com/bouk/monkey"
+	"strconv"
+	"time"
+	"context"
+	"rasp-cloud/es"
+	"github.com/olivere/elastic"
+)
+
+func getValidTriage() map[string]interface{} {
+	return map[string]interface{}{
+		"app_id":      start.TestApp.Id,
+		"target_type": models.TriageTargetVuln,
+		"target_id":   "8bfb3bd5c5e7a5c8a7bbba8d1d5c6b01",
+		"state":       models.TriageStateFalsePositive,
+		"assignee":    "alice",
+		"tags":        []string{"scanner", " "},
+	}
+}
+
+func TestTriage(t *testing.T) {
+	Convey("Subject: Test Triage Api\n", t, func() {
+		monkey.Patch(models.GetRequestUser, func(string, string) (string, error) {
+			return "openrasp", nil
+		})
+		defer monkey.Unpatch(models.GetRequestUser)
+
+		Convey("when update and comment a vulnerability", func() {
+			r := inits.GetResponse("POST", "/v1/api/triage/update", inits.GetJson(getValidTriage()))
+			So(r.Status, ShouldEqual, 0)
+			triage := r.Data.(map[string]interface{})
+			So(triage["state"], ShouldEqual, models.TriageStateFalsePositive)
+			So(len(triage["tags"].([]interface{})), ShouldEqual, 1)
+
+			param := getValidTriage()
+			param["content"] = "reported by the internal scanner"
+			r = inits.GetResponse("POST", "/v1/api/triage/comment", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 0)
+			comments := r.Data.(map[string]interface{})["comments"].([]interface{})
+			So(comments[len(comments)-1].(map[string]interface{})["user"], ShouldEqual, "openrasp")
+
+			r = inits.GetResponse("POST", "/v1/api/triage/search", inits.GetJson(map[string]interface{}{
+				"data": map[string]interface{}{
+					"app_id":   start.TestApp.Id,
+					"state":    models.TriageStateFalsePositive,
+					"assignee": "alice",
+				},
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when get the triage of a new event", func() {
+			r := inits.GetResponse("POST", "/v1/api/triage/get", inits.GetJson(map[string]interface{}{
+				"app_id":      start.TestApp.Id,
+				"target_type": models.TriageTargetEvent,
+				"target_id":   "not-triaged-event",
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["state"], ShouldEqual, models.TriageStateNew)
+		})
+
+		Convey("when the triage state is not supported", func() {
+			param := getValidTriage()
+			param["state"] = "closed"
+			r := inits.GetResponse("POST", "/v1/api/triage/update", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the target type is not supported", func() {
+			param := getValidTriage()
+			param["target_type"] = "host"
+			r := inits.GetResponse("POST", "/v1/api/triage/update", inits.GetJson(param))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the triaged vulnerability has the same stack in another app", func() {
+			stackMd5 := "test-triage-stack-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			now := time.Now().UnixNano() / 1000000
+			err := es.BulkInsert("attack-alarm", []map[string]interface{}{
+				{"app_id": start.TestApp.Id, "stack_md5": stackMd5, "event_time": now, "@timestamp": now},
+				{"app_id": "test-triage-other-app", "stack_md5": stackMd5, "event_time": now, "@timestamp": now},
+			})
+			So(err, ShouldBeNil)
+			param := getValidTriage()
+			param["target_id"] = stackMd5
+			r := inits.GetResponse("POST", "/v1/api/triage/update", inits.GetJson(param))
+			So(r.Status, ShouldEqual, 0)
+			countVulns := func(state string) int64 {
+				searchData := map[string]interface{}{"triage_state": []interface{}{state}}
+				So(models.HandleTriageSearchData("*", models.TriageTargetVuln, "stack_md5", searchData), ShouldBeNil)
+				count, err := es.Count("real-openrasp-attack-alarm-*").Query(elastic.NewBoolQuery().Filter(
+					elastic.NewTermQuery("stack_md5", stackMd5), searchData["triage"].(elastic.Query))).
+					Do(context.Background())
+				So(err, ShouldBeNil)
+				return count
+			}
+			So(countVulns(models.TriageStateNew), ShouldEqual, 1)
+			So(countVulns(models.TriageStateFalsePositive), ShouldEqual, 1)
+		})
+
+		Convey("when filter the attack search with an invalid triage state", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(map[string]interface{}{
+				"data": map[string]interface{}{
+					"start_time":   1,
+					"end_time":     1000,
+					"app_id":       start.TestApp.Id,
+					"triage_state": []string{"closed"},
+				},
+				"page":    1,
+				"perpage": 10,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
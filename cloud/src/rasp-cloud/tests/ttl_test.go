@@ -6,6 +6,11 @@ import (
 	"testing"
 	. "github.com/smartystreets/goconvey/convey"
 	"rasp-cloud/es"
+	"rasp-cloud/tests/start"
+	"rasp-cloud/conf"
+	"time"
+	"context"
+	"github.com/olivere/elastic"
 )
 
 func TestTTL(t *testing.T) {
@@ -17,3 +22,63 @@ func TestTTL(t *testing.T) {
 		es.DeleteExpiredData()
 	})
 }
+
+func TestRollingIndex(t *testing.T) {
+	Convey("Subject: Test ES Rolling Index\n", t, func() {
+		indexTime := time.Date(2019, 1, 2, 23, 59, 59, 0, time.UTC)
+
+		Convey("when the rollover period is day", func() {
+			period := conf.AppConfig.EsIndexRolloverPeriod
+			defer func() {
+				conf.AppConfig.EsIndexRolloverPeriod = period
+			}()
+			conf.AppConfig.EsIndexRolloverPeriod = es.RolloverPeriodDay
+			So(es.GetRollingIndexName("openrasp-attack-alarm", "app", indexTime),
+				ShouldEqual, "openrasp-attack-alarm-app-2019.01.02")
+		})
+
+		Convey("when the rollover period is month", func() {
+			period := conf.AppConfig.EsIndexRolloverPeriod
+			defer func() {
+				conf.AppConfig.EsIndexRolloverPeriod = period
+			}()
+			conf.AppConfig.EsIndexRolloverPeriod = es.RolloverPeriodMonth
+			So(es.GetRollingIndexName("openrasp-attack-alarm", "app", indexTime),
+				ShouldEqual, "openrasp-attack-alarm-app-2019.01")
+		})
+
+		Convey("when get the write index of app", func() {
+			index, err := es.GetWriteIndex("openrasp-report-data", start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, es.GetRollingIndexName("openrasp-report-data", start.TestApp.Id, time.Now()))
+			aliasIndices, err := es.GetAliasIndices(es.GetAliasName("openrasp-report-data", start.TestApp.Id))
+			So(err, ShouldEqual, nil)
+			So(aliasIndices[es.GetAliasName("openrasp-report-data", start.TestApp.Id)], ShouldContain, index)
+		})
+
+		Convey("when get the rolling index of the past time", func() {
+			index, err := es.GetRollingIndex("openrasp-report-data", start.TestApp.Id, indexTime)
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, es.GetRollingIndexName("openrasp-report-data", start.TestApp.Id, indexTime))
+			aliasIndices, err := es.GetAliasIndices(es.GetAliasName("openrasp-report-data", start.TestApp.Id))
+			So(err, ShouldEqual, nil)
+			So(aliasIndices[es.GetAliasName("openrasp-report-data", start.TestApp.Id)], ShouldContain, index)
+		})
+
+		Convey("when the policy alarm is upserted in two periods", func() {
+			for _, alarmTime := range []time.Time{indexTime, time.Now()} {
+				err := es.BulkInsert("policy-alarm", []map[string]interface{}{{
+					"app_id":     start.TestApp.Id,
+					"upsert_id":  "test-upsert-id",
+					"@timestamp": alarmTime.UnixNano() / 1000000,
+				}})
+				So(err, ShouldEqual, nil)
+			}
+			count, err := es.Count(es.GetAliasName("openrasp-policy-alarm", start.TestApp.Id)).
+				Query(elastic.NewIdsQuery().Ids("test-upsert-id")).
+				Do(context.Background())
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,52 @@
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>{{.Labels.title}}</title>
+    <style>
+        body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #333; }
+        h2 { border-bottom: 1px solid #ddd; padding-bottom: 6px; }
+        table { border-collapse: collapse; margin-bottom: 16px; }
+        th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; word-break: break-all; }
+        th { background: #f5f5f5; }
+    </style>
+</head>
+<body>
+<h1>{{.Labels.title}} - {{.Name}} ({{.Period}})</h1>
+<p>{{.Labels.period}}: {{.StartTime}} ~ {{.EndTime}}</p>
+{{$labels := .Labels}}
+{{range .Apps}}
+<h2>{{$labels.app}}: {{.AppName}}</h2>
+<table>
+    <tr><th>{{$labels.attack_total}}</th><td>{{.AttackTotal}}</td></tr>
+    <tr><th>{{$labels.request_sum}}</th><td>{{.RequestSum}}</td></tr>
+    <tr><th>{{$labels.rasp_online}}</th><td>{{.OnlineRatio}} ({{.RaspOnline}}/{{.RaspTotal}})</td></tr>
+</table>
+<table>
+    <tr><th>{{$labels.attack_type}}</th><th>{{$labels.count}}</th></tr>
+    {{range .AttackTypes}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{else}}<tr><td colspan="2">{{$labels.none}}</td></tr>{{end}}
+</table>
+<table>
+    <tr><th>{{$labels.intercept}}</th><th>{{$labels.count}}</th></tr>
+    {{range .InterceptStates}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{else}}<tr><td colspan="2">{{$labels.none}}</td></tr>{{end}}
+</table>
+<table>
+    <tr><th>{{$labels.source}}</th><th>{{$labels.count}}</th></tr>
+    {{range .TopSources}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{else}}<tr><td colspan="2">{{$labels.none}}</td></tr>{{end}}
+</table>
+<table>
+    <tr><th>{{$labels.url}}</th><th>{{$labels.count}}</th></tr>
+    {{range .TopUrls}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{else}}<tr><td colspan="2">{{$labels.none}}</td></tr>{{end}}
+</table>
+<table>
+    <tr><th>{{$labels.user_agent}}</th><th>{{$labels.count}}</th></tr>
+    {{range .TopUserAgents}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{else}}<tr><td colspan="2">{{$labels.none}}</td></tr>{{end}}
+</table>
+<table>
+    <tr><th colspan="4">{{$labels.new_vuln}}</th></tr>
+    <tr><th>{{$labels.attack_type}}</th><th>{{$labels.url}}</th><th>{{$labels.first_time}}</th><th>{{$labels.count}}</th></tr>
+    {{range .NewVulns}}<tr><td>{{.attack_type}}</td><td>{{.url}}</td><td>{{.first_time}}</td><td>{{.attack_count}}</td></tr>{{else}}<tr><td colspan="4">{{$labels.none}}</td></tr>{{end}}
+</table>
+{{end}}
+</body>
+</html>
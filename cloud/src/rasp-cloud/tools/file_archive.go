@@ -0,0 +1,308 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+
+package tools
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"sync"
+)
+
+// the rotated files of RaspFileLogWriter are archived after the rotation, they are compressed,
+// the oldest ones beyond the max total size are removed, and the complete files are listed in the manifest,
+// so that the downstream shippers can track them
+
+const (
+	CompressNone        = "none"
+	CompressGzip        = "gzip"
+	GzipSuffix          = ".gz"
+	ManifestSuffix      = ".manifest.json"
+	archiveTempSuffix   = ".tmp"
+	archiveManifestPerm = 0644
+	// the current file is rotated at a part of the max total size, since the total size is only checked
+	// when the files are rotated
+	totalSizeRotateParts = 10
+)
+
+// logArchiveFile is a file counted by the max total size
+type logArchiveFile struct {
+	dir  string
+	info os.FileInfo
+}
+
+var (
+	// the writers sharing a total size directory delete the files and write the manifests in turn
+	totalSizeDirLocks     = make(map[string]*sync.Mutex)
+	totalSizeDirLocksLock sync.Mutex
+)
+
+// LogManifest lists the rotated files which are complete, the current file is still being written
+type LogManifest struct {
+	Current    string             `json:"current"`
+	UpdateTime int64              `json:"update_time"`
+	Files      []*LogManifestFile `json:"files"`
+}
+
+type LogManifestFile struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ModifyTime int64  `json:"modify_time"`
+	Compressed bool   `json:"compressed"`
+}
+
+// archive compresses the rotated files, removes the expired files and the oldest ones beyond the max total size,
+// then writes the manifest, the leftover files of the last run are also handled when the logger starts
+func (w *RaspFileLogWriter) archive() {
+	w.archiveLock.Lock()
+	defer w.archiveLock.Unlock()
+	if w.Compress == CompressGzip {
+		for _, file := range w.rotatedFiles() {
+			if strings.HasSuffix(file.Name(), GzipSuffix) {
+				continue
+			}
+			if err := w.compressFile(filepath.Join(filepath.Dir(w.Filename), file.Name())); err != nil {
+				fmt.Fprintf(os.Stderr, "FileLogWriter(%q): failed to compress %s: %s\n", w.Filename, file.Name(), err)
+			}
+		}
+	}
+	w.deleteOldLog()
+	if w.TotalSizeDir != "" {
+		lock := getTotalSizeDirLock(w.TotalSizeDir)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	w.deleteOverflowLog()
+	if err := w.writeManifest(filepath.Dir(w.Filename)); err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): failed to write manifest: %s\n", w.Filename, err)
+	}
+}
+
+func getTotalSizeDirLock(dir string) *sync.Mutex {
+	totalSizeDirLocksLock.Lock()
+	defer totalSizeDirLocksLock.Unlock()
+	dir = filepath.Clean(dir)
+	lock, ok := totalSizeDirLocks[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		totalSizeDirLocks[dir] = lock
+	}
+	return lock
+}
+
+// rotatedFiles returns the rotated files in the order of rotation, like attack.2019-01-01.001.log.gz
+func (w *RaspFileLogWriter) rotatedFiles() []os.FileInfo {
+	return w.rotatedFilesIn(filepath.Dir(w.Filename))
+}
+
+// rotatedFilesIn returns the rotated files of the same name as the writer in the directory
+func (w *RaspFileLogWriter) rotatedFilesIn(dir string) []os.FileInfo {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	prefix := filepath.Base(w.fileNameOnly) + "."
+	files := make([]os.FileInfo, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || name == filepath.Base(w.Filename) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasSuffix(name, w.suffix) || strings.HasSuffix(name, w.suffix+GzipSuffix) {
+			files = append(files, fileInfo)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files
+}
+
+// lstatRotatedFile returns nil if the rotated file exists, no matter whether it has been compressed
+func lstatRotatedFile(fileName string) error {
+	_, err := os.Lstat(fileName)
+	if err != nil {
+		_, err = os.Lstat(fileName + GzipSuffix)
+	}
+	return err
+}
+
+// nextRotatedNum returns the number after the last rotated file of the date, so that the number of the file
+// removed by the max total size is not reused, and the order of names is still the order of rotation
+func (w *RaspFileLogWriter) nextRotatedNum(date time.Time, num int) int {
+	prefix := filepath.Base(w.fileNameOnly) + "." + date.Format("2006-01-02") + "."
+	for _, file := range w.rotatedFiles() {
+		if !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(file.Name(), prefix), ".", 2)
+		if last, err := strconv.Atoi(fields[0]); err == nil && last >= num {
+			num = last + 1
+		}
+	}
+	return num
+}
+
+// compressFile compresses the file to a temp file at first, it is renamed after the compression,
+// so that the incomplete compressed file is never seen by the shippers
+func (w *RaspFileLogWriter) compressFile(fileName string) error {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tempName := fileName + GzipSuffix + archiveTempSuffix
+	dst, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if rotatePerm, err := strconv.ParseInt(w.RotatePerm, 8, 64); err == nil {
+		os.Chmod(tempName, os.FileMode(rotatePerm))
+	}
+	// the modify time is kept for the expiration of maxdays
+	if fileInfo, err := src.Stat(); err == nil {
+		os.Chtimes(tempName, fileInfo.ModTime(), fileInfo.ModTime())
+	}
+	if err := os.Rename(tempName, fileName+GzipSuffix); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return os.Remove(fileName)
+}
+
+// deleteOverflowLog removes the oldest rotated files until the total size of files is not greater than MaxTotalSize,
+// the files of the same name in the sub directories of TotalSizeDir are counted together, and the manifests
+// of the other directories are written again after their files are removed
+func (w *RaspFileLogWriter) deleteOverflowLog() {
+	if w.MaxTotalSize <= 0 {
+		return
+	}
+	dirs := []string{filepath.Dir(w.Filename)}
+	if w.TotalSizeDir != "" {
+		dirs = w.totalSizeDirs()
+	}
+	var totalSize int64
+	files := make([]*logArchiveFile, 0)
+	currentName := filepath.Base(w.Filename)
+	for _, dir := range dirs {
+		if fileInfo, err := os.Stat(filepath.Join(dir, currentName)); err == nil {
+			totalSize += fileInfo.Size()
+		}
+		for _, file := range w.rotatedFilesIn(dir) {
+			totalSize += file.Size()
+			files = append(files, &logArchiveFile{dir: dir, info: file})
+		}
+	}
+	// the files of different directories are removed in the order of modify time, which is kept by the compression
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].info.ModTime().Equal(files[j].info.ModTime()) {
+			return files[i].info.ModTime().Before(files[j].info.ModTime())
+		}
+		return files[i].info.Name() < files[j].info.Name()
+	})
+	changedDirs := make(map[string]bool)
+	for _, file := range files {
+		if totalSize <= w.MaxTotalSize {
+			break
+		}
+		fileName := filepath.Join(file.dir, file.info.Name())
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "FileLogWriter(%q): failed to remove %s: %s\n", w.Filename, fileName, err)
+			continue
+		}
+		totalSize -= file.info.Size()
+		changedDirs[file.dir] = true
+	}
+	for dir := range changedDirs {
+		if dir == filepath.Dir(w.Filename) {
+			continue
+		}
+		if err := w.writeManifest(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "FileLogWriter(%q): failed to write manifest of %s: %s\n", w.Filename, dir, err)
+		}
+	}
+}
+
+// totalSizeDirs returns TotalSizeDir and its sub directories which have the files of the writer
+func (w *RaspFileLogWriter) totalSizeDirs() []string {
+	dirs := make([]string, 0)
+	currentName := filepath.Base(w.Filename)
+	filepath.Walk(w.TotalSizeDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || !info.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, currentName)); err == nil || len(w.rotatedFilesIn(path)) > 0 {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs
+}
+
+// writeManifest writes the manifest like attack.manifest.json beside the current file in the directory,
+// the files waiting for compression are not complete
+func (w *RaspFileLogWriter) writeManifest(dir string) error {
+	manifest := &LogManifest{
+		Current:    filepath.Base(w.Filename),
+		UpdateTime: time.Now().UnixNano() / 1000000,
+		Files:      make([]*LogManifestFile, 0),
+	}
+	for _, file := range w.rotatedFilesIn(dir) {
+		compressed := strings.HasSuffix(file.Name(), GzipSuffix)
+		if w.Compress == CompressGzip && !compressed {
+			continue
+		}
+		manifest.Files = append(manifest.Files, &LogManifestFile{
+			Name:       file.Name(),
+			Size:       file.Size(),
+			ModifyTime: file.ModTime().UnixNano() / 1000000,
+			Compressed: compressed,
+		})
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestName := filepath.Join(dir, filepath.Base(w.fileNameOnly)+ManifestSuffix)
+	tempName := manifestName + archiveTempSuffix
+	if err := ioutil.WriteFile(tempName, content, archiveManifestPerm); err != nil {
+		return err
+	}
+	return os.Rename(tempName, manifestName)
+}
@@ -67,6 +67,17 @@ type RaspFileLogWriter struct {
 
 	RotatePerm string `json:"rotateperm"`
 
+	// Compress the rotated files, none or gzip
+	Compress string `json:"compress"`
+
+	// Remove the oldest rotated files if the total size of files is greater than it, 0 means no limit,
+	// the MaxSize is not greater than a tenth of it so that the current file is rotated before it grows too large
+	MaxTotalSize int64 `json:"maxtotalsize"`
+	// The directory where the max total size is counted, including the files of the same name in its
+	// sub directories, only the directory of the file is counted if it is empty
+	TotalSizeDir string `json:"totalsizedir"`
+	archiveLock  sync.Mutex
+
 	fileNameOnly, suffix string // like "project.log", project is fileNameOnly and .log is suffix
 }
 
@@ -95,7 +106,10 @@ func NewFileWriter() logs.Logger {
 //	"daily":true,
 //	"maxDays":15,
 //	"rotate":true,
-//  	"perm":"0600"
+//  	"perm":"0600",
+//	"compress":"gzip",
+//	"maxtotalsize":1073741824,
+//	"totalsizedir":"logs"
 //	}
 func (w *RaspFileLogWriter) Init(jsonConfig string) error {
 	err := json.Unmarshal([]byte(jsonConfig), w)
@@ -110,7 +124,22 @@ func (w *RaspFileLogWriter) Init(jsonConfig string) error {
 	if w.suffix == "" {
 		w.suffix = ".log"
 	}
+	if w.Compress != "" && w.Compress != CompressNone && w.Compress != CompressGzip {
+		return errors.New("the compress of file logger must be none or gzip")
+	}
+	if w.MaxTotalSize > 0 {
+		maxSize := w.MaxTotalSize / totalSizeRotateParts
+		if maxSize < 1 {
+			maxSize = 1
+		}
+		if w.MaxSize <= 0 || int64(w.MaxSize) > maxSize {
+			w.MaxSize = int(maxSize)
+		}
+	}
 	err = w.startLogger()
+	if err == nil {
+		go w.archive()
+	}
 	return err
 }
 
@@ -269,13 +298,15 @@ func (w *RaspFileLogWriter) DoRotate(logTime time.Time) error {
 
 	// only when one of them be setted, then the file would be splited
 	if w.MaxLines > 0 || w.MaxSize > 0 {
+		num = w.nextRotatedNum(logTime, num)
 		for ; err == nil && num <= w.MaxFiles; num++ {
 			fName = w.fileNameOnly + fmt.Sprintf(".%s.%03d%s", logTime.Format("2006-01-02"), num, w.suffix)
-			_, err = os.Lstat(fName)
+			err = lstatRotatedFile(fName)
 		}
 	} else {
+		num = w.nextRotatedNum(w.dailyOpenTime, num)
 		fName = w.fileNameOnly + fmt.Sprintf(".%s.%03d%s", w.dailyOpenTime.Format("2006-01-02"), num, w.suffix)
-		_, err = os.Lstat(fName)
+		err = lstatRotatedFile(fName)
 		w.MaxFilesCurFiles = num
 	}
 	// return error if the last file checked still existed
@@ -298,7 +329,7 @@ func (w *RaspFileLogWriter) DoRotate(logTime time.Time) error {
 RESTART_LOGGER:
 
 	startLoggerErr := w.startLogger()
-	go w.deleteOldLog()
+	go w.archive()
 
 	if startLoggerErr != nil {
 		return fmt.Errorf("Rotate StartLogger: %s", startLoggerErr)
@@ -324,7 +355,8 @@ func (w *RaspFileLogWriter) deleteOldLog() {
 
 		if !info.IsDir() && info.ModTime().Add(24 * time.Hour * time.Duration(w.MaxDays)).Before(time.Now()) {
 			if strings.HasPrefix(filepath.Base(path), filepath.Base(w.fileNameOnly)) &&
-				strings.HasSuffix(filepath.Base(path), w.suffix) {
+				(strings.HasSuffix(filepath.Base(path), w.suffix) ||
+					strings.HasSuffix(filepath.Base(path), w.suffix+GzipSuffix)) {
 				os.Remove(path)
 			}
 		}